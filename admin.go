@@ -0,0 +1,595 @@
+package shortly
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+const (
+	adminActionDisableURL  = "disable_url"
+	adminActionEnableURL   = "enable_url"
+	adminActionDeleteURL   = "delete_url"
+	adminActionBanUser     = "ban_user"
+	adminActionUnbanUser   = "unban_user"
+	adminActionGrantAdmin  = "grant_admin"
+	adminActionRevokeAdmin = "revoke_admin"
+)
+
+// ErrBanned is returned when a banned user tries to authenticate
+type ErrBanned struct {
+	db.ErrBase
+}
+
+func NewErrBanned(message string) *ErrBanned {
+	return &ErrBanned{
+		ErrBase: db.ErrBase{Message: message},
+	}
+}
+
+// ErrNotAllowed is returned for moderation requests that make no sense, such as admins banning
+// themselves
+type ErrNotAllowed struct {
+	db.ErrBase
+}
+
+func NewErrNotAllowed(message string) *ErrNotAllowed {
+	return &ErrNotAllowed{
+		ErrBase: db.ErrBase{Message: message},
+	}
+}
+
+// adminStatus maps the errors of moderation actions onto http status codes
+func adminStatus(err error) int {
+	if _, ok := err.(*ErrNotAllowed); ok {
+		return http.StatusBadRequest
+	}
+	return statusForErr(err)
+}
+
+// ValidDisabledStatus reports whether status may be served in place of a disabled link's redirect
+func ValidDisabledStatus(status int) bool {
+	return status == http.StatusUnavailableForLegalReasons || status == http.StatusGone
+}
+
+// disabledMessage tells visitors why a link no longer redirects
+func disabledMessage(storedURL *db.StoredURL) string {
+	if storedURL.DisabledReason == "" {
+		return "this link has been disabled"
+	}
+	return "this link has been disabled: " + storedURL.DisabledReason
+}
+
+// isAdmin reports whether the request is from an admin. Api keys never carry admin rights, so a
+// leaked key can't be used to moderate.
+func isAdmin(r *http.Request) bool {
+	u := UserFromContext(r.Context())
+	return u != nil && u.IsAdmin && !usingAPIKey(r.Context())
+}
+
+// RequireAdmin rejects json api requests that aren't from an admin
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			writeJSON(w, http.StatusForbidden, &URLResponse{Err: "admin access required"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireAdminPage rejects page requests that aren't from an admin, it expects to be wrapped in
+// RequireLogin
+func RequireAdminPage(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// moderator returns the store as a db.Moderator, writing a 501 if the backend does not support it
+func (a *App) moderator(w http.ResponseWriter) (db.Moderator, bool) {
+	m, ok := a.store.(db.Moderator)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &URLResponse{Err: "store does not support moderation"})
+	}
+	return m, ok
+}
+
+// recordAdminAction adds to the admin log, the action has already happened so failures are only logged
+func (a *App) recordAdminAction(m db.Moderator, r *http.Request, action string, target string, detail string) {
+	admin := UserFromContext(r.Context())
+	slog.InfoContext(r.Context(), "admin action", "admin_id", admin.ID, "action", action, "target", target,
+		"detail", detail)
+	err := m.RecordAdminAction(&db.AdminAction{AdminID: admin.ID, Action: action, Target: target, Detail: detail})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to record admin action", "action", action, "target", target,
+			"error", err)
+	}
+}
+
+// disableURL stops key redirecting, visitors get status and reason instead
+func (a *App) disableURL(m db.Moderator, r *http.Request, key string, status int, reason string) error {
+	if !ValidDisabledStatus(status) {
+		return NewErrNotAllowed(fmt.Sprintf("status must be %d or %d", http.StatusUnavailableForLegalReasons,
+			http.StatusGone))
+	}
+	storedURL, err := a.urls(r.Context()).Get(key)
+	if err != nil {
+		return err
+	}
+	before := urlSnapshot(storedURL)
+	if err := m.SetDisabled(key, status, reason); err != nil {
+		return err
+	}
+	a.recordAdminAction(m, r, adminActionDisableURL, key, fmt.Sprintf("%d %s", status, reason))
+	a.auditURLChange(r, AuditURLDisable, key, before)
+	return nil
+}
+
+func (a *App) enableURL(m db.Moderator, r *http.Request, key string) error {
+	storedURL, err := a.urls(r.Context()).Get(key)
+	if err != nil {
+		return err
+	}
+	before := urlSnapshot(storedURL)
+	if err := m.SetDisabled(key, 0, ""); err != nil {
+		return err
+	}
+	a.recordAdminAction(m, r, adminActionEnableURL, key, "")
+	a.auditURLChange(r, AuditURLEnable, key, before)
+	return nil
+}
+
+func (a *App) adminDeleteURL(m db.Moderator, r *http.Request, key string) error {
+	o, ok := a.store.(db.Owner)
+	if !ok {
+		return db.NewErrDB("store does not support deleting urls")
+	}
+	storedURL, err := a.urls(r.Context()).Get(key)
+	if err != nil {
+		return err
+	}
+	if err := o.Delete(key); err != nil {
+		return err
+	}
+	a.recordAdminAction(m, r, adminActionDeleteURL, key, storedURL.OriginalURL)
+	a.audit(r, AuditURLDelete, key, urlSnapshot(storedURL), nil)
+	a.emitURLEvent(r.Context(), db.EventURLDeleted, key, storedURL)
+	return nil
+}
+
+// userBan is the audited state of a user's ban
+type userBan struct {
+	Banned    bool   `json:"banned"`
+	BanReason string `json:"ban_reason,omitempty"`
+	// DisabledURLs is how many of the user's links were disabled along with the ban
+	DisabledURLs int `json:"disabled_urls,omitempty"`
+}
+
+// banUser stops userID logging in and ends their sessions, optionally disabling all their links
+func (a *App) banUser(m db.Moderator, r *http.Request, userID string, reason string, disableURLs bool) error {
+	if userID == UserFromContext(r.Context()).ID {
+		return NewErrNotAllowed("you can't ban yourself")
+	}
+	before, err := a.userByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := m.SetBanned(userID, true, reason); err != nil {
+		return err
+	}
+	if rec, ok := a.recovery(); ok {
+		if err := rec.DeleteUserSessions(userID); err != nil {
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+		}
+	}
+	after := &userBan{Banned: true, BanReason: reason}
+	detail := reason
+	if disableURLs {
+		n, err := m.DisableUserURLs(userID, http.StatusGone, reason)
+		if err != nil {
+			return err
+		}
+		after.DisabledURLs = n
+		detail = strings.TrimSpace(fmt.Sprintf("%s (disabled %d urls)", reason, n))
+	}
+	a.recordAdminAction(m, r, adminActionBanUser, userID, detail)
+	a.audit(r, AuditUserBan, userID, &userBan{Banned: before.Banned, BanReason: before.BanReason}, after)
+	return nil
+}
+
+// unbanUser lets userID log in again, links disabled by the ban stay disabled
+func (a *App) unbanUser(m db.Moderator, r *http.Request, userID string) error {
+	before, err := a.userByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := m.SetBanned(userID, false, ""); err != nil {
+		return err
+	}
+	a.recordAdminAction(m, r, adminActionUnbanUser, userID, "")
+	a.audit(r, AuditUserUnban, userID, &userBan{Banned: before.Banned, BanReason: before.BanReason},
+		&userBan{})
+	return nil
+}
+
+func (a *App) setAdmin(m db.Moderator, r *http.Request, userID string, grant bool) error {
+	if userID == UserFromContext(r.Context()).ID && !grant {
+		return NewErrNotAllowed("you can't revoke your own admin access")
+	}
+	before, err := a.userByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := m.SetAdmin(userID, grant); err != nil {
+		return err
+	}
+	action := adminActionRevokeAdmin
+	if grant {
+		action = adminActionGrantAdmin
+	}
+	a.recordAdminAction(m, r, action, userID, "")
+	a.audit(r, AuditUserSetAdmin, userID, &SetAdminRequest{Admin: before.IsAdmin}, &SetAdminRequest{Admin: grant})
+	return nil
+}
+
+// userByID looks up a user, for stores that support accounts
+func (a *App) userByID(userID string) (*db.User, error) {
+	s, ok := a.store.(db.UserStore)
+	if !ok {
+		return nil, db.NewErrDB("store does not support user accounts")
+	}
+	return s.UserByID(userID)
+}
+
+type DisableURLRequest struct {
+	// Status is served instead of the redirect, 451 or 410
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type BanUserRequest struct {
+	Reason string `json:"reason"`
+	// DisableURLs also disables every link the user created with 410 Gone
+	DisableURLs bool `json:"disable_urls,omitempty"`
+}
+
+type SetAdminRequest struct {
+	Admin bool `json:"admin"`
+}
+
+type UsersResponse struct {
+	Users      []*db.User `json:"users"`
+	Total      int        `json:"total"`
+	NextOffset int        `json:"next_offset,omitempty"`
+	Err        string     `json:"error"`
+}
+
+type AdminActionsResponse struct {
+	Actions    []*db.AdminAction `json:"actions"`
+	Total      int               `json:"total"`
+	NextOffset int               `json:"next_offset,omitempty"`
+	Err        string            `json:"error"`
+}
+
+// AdminSearchURLsHandler lists every url, taking the same query parameters as ListURLsHandler
+// curl -H "Authorization: Bearer $TOKEN" "localhost:8080/api/v1/admin/urls?q=casino"
+func (a *App) AdminSearchURLsHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	q, msg := parseListQuery(r)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &ListURLsResponse{Err: msg})
+		return
+	}
+	urls, total, err := m.SearchURLs(q)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &ListURLsResponse{Err: err.Error()})
+		return
+	}
+	resp := &ListURLsResponse{URLs: urls, Total: total}
+	if q.Offset+len(urls) < total {
+		resp.NextOffset = q.Offset + len(urls)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminDisableURLHandler takes a link down
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/admin/urls/7RxfRd/disable -d '{"status": 451, "reason": "court order"}'
+func (a *App) AdminDisableURLHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	req := &DisableURLRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &URLResponse{Err: err.Error()})
+		return
+	}
+	err := a.disableURL(m, r, mux.Vars(r)["url"], req.Status, strings.TrimSpace(req.Reason))
+	if err != nil {
+		writeJSON(w, adminStatus(err), &URLResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &URLResponse{})
+}
+
+// AdminEnableURLHandler restores a disabled link
+func (a *App) AdminEnableURLHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	if err := a.enableURL(m, r, mux.Vars(r)["url"]); err != nil {
+		writeJSON(w, adminStatus(err), &URLResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &URLResponse{})
+}
+
+// AdminDeleteURLHandler deletes any link
+func (a *App) AdminDeleteURLHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	if err := a.adminDeleteURL(m, r, mux.Vars(r)["url"]); err != nil {
+		writeJSON(w, adminStatus(err), &URLResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &URLResponse{})
+}
+
+// AdminSearchUsersHandler lists users whose email contains ?q=, newest first
+func (a *App) AdminSearchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	q, msg := parseListQuery(r)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &UsersResponse{Err: msg})
+		return
+	}
+	users, total, err := m.SearchUsers(q)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &UsersResponse{Err: err.Error()})
+		return
+	}
+	resp := &UsersResponse{Users: users, Total: total}
+	if q.Offset+len(users) < total {
+		resp.NextOffset = q.Offset + len(users)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminBanUserHandler bans a user
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/admin/users/$ID/ban -d '{"reason": "spam", "disable_urls": true}'
+func (a *App) AdminBanUserHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	req := &BanUserRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &MeResponse{Err: err.Error()})
+		return
+	}
+	err := a.banUser(m, r, mux.Vars(r)["id"], strings.TrimSpace(req.Reason), req.DisableURLs)
+	if err != nil {
+		writeJSON(w, adminStatus(err), &MeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &MeResponse{})
+}
+
+// AdminUnbanUserHandler lifts a ban
+func (a *App) AdminUnbanUserHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	if err := a.unbanUser(m, r, mux.Vars(r)["id"]); err != nil {
+		writeJSON(w, adminStatus(err), &MeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &MeResponse{})
+}
+
+// AdminSetAdminHandler grants or revokes admin access
+// curl -X PUT -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/admin/users/$ID/admin -d '{"admin": true}'
+func (a *App) AdminSetAdminHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	req := &SetAdminRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &MeResponse{Err: err.Error()})
+		return
+	}
+	if err := a.setAdmin(m, r, mux.Vars(r)["id"], req.Admin); err != nil {
+		writeJSON(w, adminStatus(err), &MeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &MeResponse{})
+}
+
+// AdminActionsHandler returns the admin log, newest first
+func (a *App) AdminActionsHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.moderator(w)
+	if !ok {
+		return
+	}
+	q, msg := parseListQuery(r)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &AdminActionsResponse{Err: msg})
+		return
+	}
+	acts, total, err := m.AdminActions(q.Offset, q.Limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &AdminActionsResponse{Err: err.Error()})
+		return
+	}
+	resp := &AdminActionsResponse{Actions: acts, Total: total}
+	if q.Offset+len(acts) < total {
+		resp.NextOffset = q.Offset + len(acts)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type AdminTemplateData struct {
+	PageTitle string
+	User      *db.User
+	Query     string
+	UserQuery string
+	// Search is the query string of the current search, appended to form actions to keep it
+	Search    string
+	URLs      []*db.ListedURL
+	URLTotal  int
+	Users     []*db.User
+	Actions   []*db.AdminAction
+	CSRFToken string
+	Msg       string
+	Err       string
+}
+
+// renderAdmin searches urls and users according to ?q= and ?users= and renders the console with
+// the latest admin actions
+func (a *App) renderAdmin(w http.ResponseWriter, r *http.Request, status int, data *AdminTemplateData) {
+	data.PageTitle = "Admin"
+	data.User = UserFromContext(r.Context())
+	data.CSRFToken = csrfToken(w, r)
+	params := r.URL.Query()
+	data.Query = params.Get("q")
+	data.UserQuery = params.Get("users")
+	data.Search = adminSearch(data.Query, data.UserQuery)
+
+	m, ok := a.store.(db.Moderator)
+	if !ok {
+		data.Err = "moderation is not supported"
+		status = http.StatusNotImplemented
+	} else {
+		var err error
+		q := defaultListQuery()
+		q.Filter = data.Query
+		if data.URLs, data.URLTotal, err = m.SearchURLs(q); err != nil {
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+		}
+		if data.UserQuery != "" {
+			if data.Users, _, err = m.SearchUsers(&db.ListQuery{Filter: data.UserQuery, Limit: defaultPageSize}); err != nil {
+				slog.ErrorContext(r.Context(), "request error", "error", err)
+			}
+		}
+		if data.Actions, _, err = m.AdminActions(0, defaultPageSize); err != nil {
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+		}
+	}
+
+	w.Header().Set(ContentType, "text/html")
+	t, err := template.New("admin.html").ParseFiles("templates/admin.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	if err := t.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+	}
+}
+
+// AdminPageHandler is the moderation console
+func (a *App) AdminPageHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderAdmin(w, r, http.StatusOK, &AdminTemplateData{})
+}
+
+// adminForm runs a moderation action from a console form and renders the result
+func (a *App) adminForm(w http.ResponseWriter, r *http.Request, done string,
+	act func(m db.Moderator) error) {
+	m, ok := a.store.(db.Moderator)
+	if !ok {
+		a.renderAdmin(w, r, http.StatusNotImplemented, &AdminTemplateData{})
+		return
+	}
+	if err := act(m); err != nil {
+		a.renderAdmin(w, r, adminStatus(err), &AdminTemplateData{Err: err.Error()})
+		return
+	}
+	a.renderAdmin(w, r, http.StatusOK, &AdminTemplateData{Msg: done})
+}
+
+// AdminDisableURLFormHandler takes a link down from the console
+func (a *App) AdminDisableURLFormHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["url"]
+	status, _ := strconv.Atoi(r.PostFormValue("status"))
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	a.adminForm(w, r, "Disabled "+key, func(m db.Moderator) error {
+		return a.disableURL(m, r, key, status, reason)
+	})
+}
+
+// AdminEnableURLFormHandler restores a link from the console
+func (a *App) AdminEnableURLFormHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["url"]
+	a.adminForm(w, r, "Enabled "+key, func(m db.Moderator) error {
+		return a.enableURL(m, r, key)
+	})
+}
+
+// AdminDeleteURLFormHandler deletes a link from the console
+func (a *App) AdminDeleteURLFormHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["url"]
+	a.adminForm(w, r, "Deleted "+key, func(m db.Moderator) error {
+		return a.adminDeleteURL(m, r, key)
+	})
+}
+
+// AdminBanUserFormHandler bans a user from the console
+func (a *App) AdminBanUserFormHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	disableURLs := r.PostFormValue("disable_urls") != ""
+	a.adminForm(w, r, "Banned user "+id, func(m db.Moderator) error {
+		return a.banUser(m, r, id, reason, disableURLs)
+	})
+}
+
+// AdminUnbanUserFormHandler lifts a ban from the console
+func (a *App) AdminUnbanUserFormHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	a.adminForm(w, r, "Unbanned user "+id, func(m db.Moderator) error {
+		return a.unbanUser(m, r, id)
+	})
+}
+
+// adminSearch keeps the console's search in the action urls of its forms
+func adminSearch(query string, userQuery string) string {
+	v := url.Values{}
+	if query != "" {
+		v.Set("q", query)
+	}
+	if userQuery != "" {
+		v.Set("users", userQuery)
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
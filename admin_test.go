@@ -0,0 +1,146 @@
+package shortly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminModeration(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	dog := apiLogin(t, app, "dog@foobarcat.com")
+	catUser, _ := store.UserByEmail("cat@foobarcat.com")
+	dogUser, _ := store.UserByEmail("dog@foobarcat.com")
+
+	rr := apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://casino.example.com"}`, dog)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	key := resp.ShortenedURL
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://dog.com"}`, dog)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	other := resp.ShortenedURL
+
+	// only admins, and only with access tokens
+	rr = apiRequest(app, "GET", "/api/v1/admin/urls", "", cat)
+	a.Equal(http.StatusForbidden, rr.Code)
+	a.NoError(store.SetAdmin(catUser.ID, true))
+	rr = apiRequest(app, "POST", "/api/v1/keys", `{"name": "ci", "scopes": ["read"]}`, cat)
+	keyResp := &APIKeyResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), keyResp))
+	rr = apiRequest(app, "GET", "/api/v1/admin/urls", "", keyResp.Key)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/urls?q=casino", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), key)
+	a.Contains(rr.Body.String(), `"total":1`)
+
+	// disabled links stop redirecting until they are enabled again
+	rr = apiRequest(app, "POST", "/api/v1/admin/urls/"+key+"/disable", `{"status": 404}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/admin/urls/"+key+"/disable", `{"status": 451, "reason": "court order"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = getPage(app, "/"+key)
+	a.Equal(http.StatusUnavailableForLegalReasons, rr.Code)
+	a.Contains(rr.Body.String(), "court order")
+	a.Empty(rr.Header().Get("Location"))
+	rr = apiRequest(app, "GET", "/v1/redirect/"+key, "", "")
+	a.Equal(http.StatusUnavailableForLegalReasons, rr.Code)
+	a.NotContains(rr.Body.String(), "casino")
+	rr = getPage(app, "/"+key+"+")
+	a.Equal(http.StatusUnavailableForLegalReasons, rr.Code)
+	a.NotContains(rr.Body.String(), "casino")
+	rr = apiRequest(app, "POST", "/api/v1/admin/urls/"+key+"/enable", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = getPage(app, "/"+key)
+	a.Equal(http.StatusFound, rr.Code)
+
+	rr = apiRequest(app, "DELETE", "/api/v1/admin/urls/"+key, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	_, err := store.Get(key)
+	a.IsType(&db.ErrNotFound{}, err)
+
+	// banned users are logged out everywhere and can't log back in
+	rr = apiRequest(app, "GET", "/api/v1/admin/users?q=dog", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), dogUser.ID)
+	rr = apiRequest(app, "POST", "/api/v1/admin/users/"+catUser.ID+"/ban", `{"reason": "oops"}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/admin/users/"+dogUser.ID+"/ban", `{"reason": "spam", "disable_urls": true}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/me", "", dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/login", `{"email": "dog@foobarcat.com", "password": "hunter22"}`, "")
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = postForm(app, "/login", url.Values{"email": {"dog@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = getPage(app, "/"+other)
+	a.Equal(http.StatusGone, rr.Code)
+
+	rr = apiRequest(app, "POST", "/api/v1/admin/users/"+dogUser.ID+"/unban", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/login", `{"email": "dog@foobarcat.com", "password": "hunter22"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+
+	rr = apiRequest(app, "PUT", "/api/v1/admin/users/"+catUser.ID+"/admin", `{"admin": false}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "PUT", "/api/v1/admin/users/"+dogUser.ID+"/admin", `{"admin": true}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/actions", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	acts := &AdminActionsResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), acts))
+	a.Equal(6, acts.Total)
+	a.Equal(adminActionGrantAdmin, acts.Actions[0].Action)
+	a.Equal(adminActionDisableURL, acts.Actions[5].Action)
+	a.Equal(catUser.ID, acts.Actions[5].AdminID)
+	a.Equal("451 court order", acts.Actions[5].Detail)
+}
+
+func TestAdminConsole(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	rr := postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	c := sessionCookie(rr)
+	rr = postForm(app, "/signup", url.Values{"email": {"dog@foobarcat.com"}, "password": {"hunter22"}})
+	dog := sessionCookie(rr)
+	rr = postForm(app, "/dashboard/urls", url.Values{"url": {"http://casino.example.com"}}, dog)
+	a.Equal(http.StatusOK, rr.Code)
+	catUser, _ := store.UserByEmail("cat@foobarcat.com")
+	dogUser, _ := store.UserByEmail("dog@foobarcat.com")
+	urls, _, _ := store.ListByUser(dogUser.ID, defaultListQuery())
+	key := urls[0].ID
+
+	rr = getPage(app, "/admin", c)
+	a.Equal(http.StatusForbidden, rr.Code)
+	a.NoError(store.SetAdmin(catUser.ID, true))
+	rr = getPage(app, "/admin?q=casino&users=dog", c)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), "http://casino.example.com")
+	a.Contains(rr.Body.String(), "dog@foobarcat.com")
+
+	rr = postForm(app, "/admin/urls/"+key+"/disable", url.Values{"status": {"410"}, "reason": {"spam"}}, c)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), "Disabled "+key)
+	rr = getPage(app, "/"+key)
+	a.Equal(http.StatusGone, rr.Code)
+
+	rr = postForm(app, "/admin/users/"+dogUser.ID+"/ban", url.Values{"reason": {"spam"}}, c)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), adminActionBanUser)
+	rr = getPage(app, "/dashboard", dog)
+	a.Equal(http.StatusSeeOther, rr.Code)
+}
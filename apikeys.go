@@ -0,0 +1,237 @@
+package shortly
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// ScopeCreate allows creating and editing urls
+	ScopeCreate = "create"
+	// ScopeRead allows viewing urls and the user's profile
+	ScopeRead = "read"
+	// ScopeDelete allows deleting urls
+	ScopeDelete = "delete"
+	// ScopeAnalytics allows viewing click statistics
+	ScopeAnalytics = "analytics"
+
+	apiKeyPrefix    = "shk_"
+	apiKeyShownLen  = len(apiKeyPrefix) + 8
+	maxAPIKeyName   = 100
+	touchAPIKeyFreq = time.Minute
+)
+
+var allScopes = []string{ScopeCreate, ScopeRead, ScopeDelete, ScopeAnalytics}
+
+// withScopes limits what the request may do, requests without scopes are unrestricted
+func withScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesContextKey, scopes)
+}
+
+// HasScope reports whether the request's credentials allow scope. Sessions and access tokens allow
+// everything, api keys only what they were created with.
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, restricted := ctx.Value(scopesContextKey).([]string)
+	if !restricted {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func usingAPIKey(ctx context.Context) bool {
+	_, restricted := ctx.Value(scopesContextKey).([]string)
+	return restricted
+}
+
+// RequireScope rejects requests whose credentials don't allow scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r.Context(), scope) {
+			writeJSON(w, http.StatusForbidden, &URLResponse{Err: "api key lacks the " + scope + " scope"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authenticateAPIKey returns the user and scopes of an api key, recording that it was used
+func (a *App) authenticateAPIKey(ctx context.Context, key string) (*db.User, []string, error) {
+	s, ok := a.store.(db.APIKeyStore)
+	if !ok {
+		return nil, nil, db.NewErrNotFound("store does not support api keys")
+	}
+	k, err := s.APIKeyByHash(hashToken(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	users, ok := a.store.(db.UserStore)
+	if !ok {
+		return nil, nil, db.NewErrNotFound("store does not support user accounts")
+	}
+	u, err := users.UserByID(k.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// only write last used occasionally so busy keys don't cost a write per request
+	now := time.Now().UTC()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > touchAPIKeyFreq {
+		if err := s.TouchAPIKey(k.ID, now); err != nil {
+			slog.ErrorContext(ctx, "failed to record api key use", "api_key_id", k.ID, "error", err)
+		}
+	}
+	return u, k.Scopes, nil
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is an optional lifetime in seconds
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+type APIKeyResponse struct {
+	APIKey *db.APIKey `json:"api_key,omitempty"`
+	// Key is only ever returned when the key is created
+	Key string `json:"key,omitempty"`
+	Err string `json:"error"`
+}
+
+type APIKeysResponse struct {
+	APIKeys []*db.APIKey `json:"api_keys"`
+	Err     string       `json:"error"`
+}
+
+// validateAPIKeyRequest returns a message describing what is wrong with req, if anything
+func validateAPIKeyRequest(req *CreateAPIKeyRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPIKeyName {
+		return "name must be between 1 and 100 characters"
+	}
+	if len(req.Scopes) == 0 {
+		return "at least one scope is required"
+	}
+	for _, scope := range req.Scopes {
+		known := false
+		for _, s := range allScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return "unknown scope " + scope
+		}
+	}
+	if req.ExpiresIn < 0 {
+		return "expires_in must be positive"
+	}
+	return ""
+}
+
+// newAPIKey stores a new key for the user making r, returning it and the plaintext key
+func (a *App) newAPIKey(r *http.Request, req *CreateAPIKeyRequest) (*db.APIKey, string, error) {
+	u := UserFromContext(r.Context())
+	s, ok := a.store.(db.APIKeyStore)
+	if !ok {
+		return nil, "", db.NewErrDB("store does not support api keys")
+	}
+	key := apiKeyPrefix + newToken()
+	k := &db.APIKey{
+		UserID:    u.ID,
+		Name:      req.Name,
+		Prefix:    key[:apiKeyShownLen],
+		Hash:      hashToken(key),
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.ExpiresIn > 0 {
+		expires := k.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		k.ExpiresAt = &expires
+	}
+	if err := s.CreateAPIKey(k); err != nil {
+		return nil, "", err
+	}
+	slog.InfoContext(r.Context(), "created api key", "user_id", u.ID, "api_key_id", k.ID)
+	a.audit(r, AuditAPIKeyCreate, k.ID, nil, k)
+	return k, key, nil
+}
+
+// apiKeyStore returns the store as a db.APIKeyStore, writing an error if the backend doesn't
+// support api keys or the request was itself made with an api key
+func (a *App) apiKeyStore(w http.ResponseWriter, r *http.Request) (db.APIKeyStore, bool) {
+	if usingAPIKey(r.Context()) {
+		writeJSON(w, http.StatusForbidden, &APIKeyResponse{Err: "api keys can't manage api keys"})
+		return nil, false
+	}
+	s, ok := a.store.(db.APIKeyStore)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &APIKeyResponse{Err: "store does not support api keys"})
+	}
+	return s, ok
+}
+
+// CreateAPIKeyHandler creates a named api key with the given scopes. The key is only shown once.
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/keys -d '{"name": "ci", "scopes": ["create"], "expires_in": 86400}'
+func (a *App) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.apiKeyStore(w, r); !ok {
+		return
+	}
+	req := &CreateAPIKeyRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &APIKeyResponse{Err: err.Error()})
+		return
+	}
+	if msg := validateAPIKeyRequest(req); msg != "" {
+		writeJSON(w, http.StatusBadRequest, &APIKeyResponse{Err: msg})
+		return
+	}
+	k, key, err := a.newAPIKey(r, req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &APIKeyResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &APIKeyResponse{APIKey: k, Key: key})
+}
+
+// ListAPIKeysHandler lists the authenticated user's api keys
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/keys
+func (a *App) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.apiKeyStore(w, r)
+	if !ok {
+		return
+	}
+	keys, err := s.APIKeysByUser(UserFromContext(r.Context()).ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &APIKeysResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &APIKeysResponse{APIKeys: keys})
+}
+
+// RevokeAPIKeyHandler deletes one of the authenticated user's api keys
+// curl -X DELETE -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/keys/$ID
+func (a *App) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.apiKeyStore(w, r)
+	if !ok {
+		return
+	}
+	u := UserFromContext(r.Context())
+	id := mux.Vars(r)["id"]
+	if err := s.RevokeAPIKey(u.ID, id); err != nil {
+		writeJSON(w, statusForErr(err), &APIKeyResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "revoked api key", "user_id", u.ID, "api_key_id", id)
+	a.audit(r, AuditAPIKeyRevoke, id, nil, nil)
+	writeJSON(w, http.StatusOK, &APIKeyResponse{})
+}
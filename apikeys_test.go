@@ -0,0 +1,96 @@
+package shortly
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	token := apiLogin(t, app, "cat@foobarcat.com")
+
+	rr := apiRequest(app, "POST", "/api/v1/keys", `{"name": "ci", "scopes": ["create", "fly"]}`, token)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/keys", `{"name": "", "scopes": ["create"]}`, token)
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	rr = apiRequest(app, "POST", "/api/v1/keys", `{"name": "ci", "scopes": ["create", "read"]}`, token)
+	a.Equal(http.StatusOK, rr.Code)
+	created := &APIKeyResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), created))
+	key := created.Key
+	a.Contains(key, apiKeyPrefix)
+	a.Equal(key[:apiKeyShownLen], created.APIKey.Prefix)
+	a.Nil(created.APIKey.ExpiresAt)
+
+	stored := store.APIKeys[created.APIKey.ID]
+	a.NotContains(rr.Body.String(), stored.UserID)
+	a.NotEqual(key, stored.Hash, "keys are stored hashed")
+	a.Nil(stored.LastUsedAt)
+
+	// the key can create and read but not delete
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, key)
+	a.Equal(http.StatusOK, rr.Code)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	a.NotNil(stored.LastUsedAt)
+
+	rr = apiRequest(app, "GET", "/api/v1/urls", "", key)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "DELETE", "/api/v1/urls/"+resp.ShortenedURL, "", key)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	// keys can't be used to manage keys
+	rr = apiRequest(app, "GET", "/api/v1/keys", "", key)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	rr = apiRequest(app, "GET", "/api/v1/keys", "", token)
+	a.Equal(http.StatusOK, rr.Code)
+	list := &APIKeysResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), list))
+	a.Len(list.APIKeys, 1)
+	a.Equal("ci", list.APIKeys[0].Name)
+
+	// another user can't revoke it
+	other := apiLogin(t, app, "dog@foobarcat.com")
+	rr = apiRequest(app, "DELETE", "/api/v1/keys/"+created.APIKey.ID, "", other)
+	a.Equal(http.StatusNotFound, rr.Code)
+
+	rr = apiRequest(app, "DELETE", "/api/v1/keys/"+created.APIKey.ID, "", token)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls", "", key)
+	a.Equal(http.StatusUnauthorized, rr.Code)
+}
+
+func TestExpiredAPIKey(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	token := apiLogin(t, app, "cat@foobarcat.com")
+
+	rr := apiRequest(app, "POST", "/api/v1/keys", `{"name": "ci", "scopes": ["read"], "expires_in": 60}`, token)
+	a.Equal(http.StatusOK, rr.Code)
+	created := &APIKeyResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), created))
+	a.NotNil(created.APIKey.ExpiresAt)
+
+	rr = apiRequest(app, "GET", "/api/v1/me", "", created.Key)
+	a.Equal(http.StatusOK, rr.Code)
+
+	expired := time.Now().Add(-time.Second)
+	store.APIKeys[created.APIKey.ID].ExpiresAt = &expired
+	rr = apiRequest(app, "GET", "/api/v1/me", "", created.Key)
+	a.Equal(http.StatusUnauthorized, rr.Code)
+}
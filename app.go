@@ -1,20 +1,24 @@
 package shortly
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/aultimus/shortly/db"
-	"github.com/cocoonlife/timber"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -28,60 +32,235 @@ const (
 type App struct {
 	server *http.Server
 	store  db.DBer
+
+	// Safety checks destinations shown on preview pages, defaults to HeuristicSafety
+	Safety SafetyChecker
+	// SessionTTL is how long a login lasts
+	SessionTTL time.Duration
+	// Tokens issues and verifies the access tokens of the json api
+	Tokens *TokenIssuer
+	// RedirectStatus is the status used for links that don't set their own, 0 picks one
+	// automatically, see defaultRedirectStatus
+	RedirectStatus int
+	// Campaigns are the named templates available to create requests
+	Campaigns CampaignTemplates
+	// Mailer sends verification and password reset emails, defaults to logging them
+	Mailer Mailer
+	// BaseURL prefixes links in emails
+	BaseURL string
+	// OIDC enables single sign-on with an OpenID Connect provider when set
+	OIDC *OIDCProvider
+	// ClickConfig sizes the click pipeline started by Init when the store records clicks
+	ClickConfig ClickTrackerConfig
+	// Clicks records redirects, nil when the store doesn't record clicks
+	Clicks *ClickTracker
+	// RollupInterval is how often clicks are rolled up for stats, defaults to a minute
+	RollupInterval time.Duration
+	// Rollups keeps stats up to date, nil when the store doesn't support stats
+	Rollups *RollupJob
+	// Metrics are served on the debug listener, see Metrics.Handler
+	Metrics *Metrics
+	// Tracing provides the spans of requests and store calls, defaults to recording none, see
+	// NewTracerProvider
+	Tracing trace.TracerProvider
+	// WebhookConfig tunes the webhook deliveries started by Init when the store supports webhooks
+	WebhookConfig WebhookConfig
+	// Webhooks sends webhook deliveries, nil when the store doesn't support webhooks
+	Webhooks *WebhookDispatcher
+	// TrustedProxies may set X-Forwarded-For, e.g. our load balancers
+	TrustedProxies []*net.IPNet
+	// DropIPs keeps client ips out of the database entirely, audit events record none and clicks
+	// are geolocated without keeping an ip hash, at the cost of unique visitor counts
+	DropIPs bool
 }
 
 func NewApp() *App {
-	return &App{}
+	return &App{
+		SessionTTL: defaultSessionTTL,
+		Tokens:     NewEphemeralTokenIssuer(),
+		Mailer:     &LogMailer{},
+		BaseURL:    "https://" + domainName,
+		Metrics:    NewMetrics(),
+		Tracing:    trace.NewNoopTracerProvider(),
+	}
 }
 
 // TODO Routes to add:
 // HTML Routes:
-// GET /login
-// GET /signup
-// GET /dashboard	User’s main UI
 // GET /settings	Optional account settings
 
-// For auth we could either use sessions or JWTs. Sessions is likely easier
-// as it is browser-native. However, we will have to store session data in db.
-// We can just set header: Set-Cookie: session_id=abc123; HttpOnly; Secure; SameSite=Strict
-// This is how login works on 99% of websites.
-// Register	User submits email/password → server hashes and stores credentials
-// Login	User submits credentials → server verifies → issues session/JWT
-// Request URLs	Frontend sends request with session or JWT → server identifies user and returns their URLs
-
-// API Routes (if we wanted to expose a json api):
-// POST	/api/v1/signup	Create user	Optional if self-service
-// POST	/api/v1/login	Authenticate user	Returns JWT
-// Require JWT:
-// GET	/api/v1/me	Get current user profile	JWT required
-// POST	/api/v1/urls	Create new short URL (body has original)
-// GET	/api/v1/urls	List user’s URLs
-// GET	/api/v1/urls/{id}	Get one URL by ID (user's own)
-// DELETE	/api/v1/urls/{id}	Delete one URL (user's own)
-
-
 func (a *App) Init(store db.DBer, portNum string) error {
 	router := mux.NewRouter()
+	router.Use(a.Metrics.Middleware)
+	router.Use(RequestIDMiddleware)
+	router.Use(a.TracingMiddleware)
+	router.Use(LoggingMiddleware)
+	router.Use(a.ClientIPMiddleware)
+	router.Use(a.SessionMiddleware)
+
+	// every shortened url is previewed rather than followed on the preview subdomain
+	// e.g. preview.sh.foobarcat.com/7RxfRd
+	preview := router.Host("preview.{domain:.+}").Subrouter()
+	preview.HandleFunc("/{url}", a.PreviewHandler).Methods(http.MethodGet)
 
 	router.HandleFunc("/", a.RootHandler).Methods(http.MethodGet)
 
 	router.HandleFunc("/health",
 		a.HealthHandler).Methods(http.MethodGet)
 
+	// Users register with an email and password, logging in issues a session cookie
+	router.HandleFunc("/signup", a.SignupPageHandler).Methods(http.MethodGet)
+	router.HandleFunc("/signup", RequireCSRF(a.SignupHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/login", a.LoginPageHandler).Methods(http.MethodGet)
+	router.HandleFunc("/login", RequireCSRF(a.LoginHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/logout", RequireCSRF(a.LogoutHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/login/oidc", a.OIDCLoginHandler).Methods(http.MethodGet)
+	router.HandleFunc("/login/oidc/callback", a.OIDCCallbackHandler).Methods(http.MethodGet)
+
+	// Emailed single use links verify addresses and reset forgotten passwords
+	router.HandleFunc("/verify", a.VerifyEmailHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reset", a.ForgotPasswordPageHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reset", RequireCSRF(a.ForgotPasswordHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/reset/confirm", a.ResetPasswordPageHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reset/confirm", RequireCSRF(a.ResetPasswordHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/invitations/accept", RequireLogin(a.AcceptInvitationPageHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/invitations/accept",
+		RequireLogin(RequireCSRF(a.AcceptInvitationFormHandler))).Methods(http.MethodPost)
+
+	// The dashboard is the logged in user's html ui, all its forms post with a csrf token
+	router.HandleFunc("/dashboard", RequireLogin(a.DashboardHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/dashboard/urls",
+		RequireLogin(RequireCSRF(a.DashboardCreateHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/dashboard/urls/{url}/edit",
+		RequireLogin(RequireCSRF(a.DashboardEditHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/dashboard/urls/{url}/delete",
+		RequireLogin(RequireCSRF(a.DashboardDeleteHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/dashboard/keys",
+		RequireLogin(RequireCSRF(a.DashboardCreateKeyHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/dashboard/keys/{id}/revoke",
+		RequireLogin(RequireCSRF(a.DashboardRevokeKeyHandler))).Methods(http.MethodPost)
+
+	// The admin console moderates every user's links
+	router.HandleFunc("/admin", RequireLogin(RequireAdminPage(a.AdminPageHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/admin/urls/{url}/disable",
+		RequireLogin(RequireAdminPage(RequireCSRF(a.AdminDisableURLFormHandler)))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/urls/{url}/enable",
+		RequireLogin(RequireAdminPage(RequireCSRF(a.AdminEnableURLFormHandler)))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/urls/{url}/delete",
+		RequireLogin(RequireAdminPage(RequireCSRF(a.AdminDeleteURLFormHandler)))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{id}/ban",
+		RequireLogin(RequireAdminPage(RequireCSRF(a.AdminBanUserFormHandler)))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{id}/unban",
+		RequireLogin(RequireAdminPage(RequireCSRF(a.AdminUnbanUserFormHandler)))).Methods(http.MethodPost)
+
+	// The json api authenticates with bearer tokens rather than cookies
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/signup", a.APISignupHandler).Methods(http.MethodPost)
+	api.HandleFunc("/login", a.APILoginHandler).Methods(http.MethodPost)
+	api.HandleFunc("/refresh", a.APIRefreshHandler).Methods(http.MethodPost)
+	api.HandleFunc("/verify", a.APIVerifyEmailHandler).Methods(http.MethodPost)
+	api.HandleFunc("/password/forgot", a.APIForgotPasswordHandler).Methods(http.MethodPost)
+	api.HandleFunc("/password/reset", a.APIResetPasswordHandler).Methods(http.MethodPost)
+
+	authed := api.NewRoute().Subrouter()
+	authed.Use(a.TokenMiddleware)
+	// api keys are limited to their scopes, access tokens may do anything
+	authed.HandleFunc("/me", RequireScope(ScopeRead, a.MeHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/verify/resend", a.ResendVerificationHandler).Methods(http.MethodPost)
+	authed.HandleFunc("/urls", RequireScope(ScopeCreate, a.CreateJSONHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/urls", RequireScope(ScopeRead, a.ListURLsHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/urls/{url}", RequireScope(ScopeRead, a.GetURLHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/urls/{url}", RequireScope(ScopeCreate, a.UpdateJSONHandler)).Methods(http.MethodPut)
+	authed.HandleFunc("/urls/{url}", RequireScope(ScopeDelete, a.DeleteURLHandler)).Methods(http.MethodDelete)
+	authed.HandleFunc("/urls/{url}/revisions",
+		RequireScope(ScopeRead, a.RevisionsJSONHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/urls/{url}/rollback",
+		RequireScope(ScopeCreate, a.RollbackJSONHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/urls/{url}/transfer",
+		RequireScope(ScopeCreate, a.TransferURLHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/urls/{url}/stats", RequireScope(ScopeAnalytics, a.URLStatsHandler)).Methods(http.MethodGet)
+
+	// Workspaces share urls between their members, whose role decides what they may do
+	authed.HandleFunc("/workspaces", RequireScope(ScopeCreate, a.CreateWorkspaceHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/workspaces", RequireScope(ScopeRead, a.ListWorkspacesHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/workspaces/{id}", RequireScope(ScopeRead, a.GetWorkspaceHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/workspaces/{id}/urls",
+		RequireScope(ScopeRead, a.ListWorkspaceURLsHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/workspaces/{id}/invitations",
+		RequireScope(ScopeCreate, a.InviteHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/workspaces/{id}/members/{user_id}",
+		RequireScope(ScopeCreate, a.SetMemberRoleHandler)).Methods(http.MethodPut)
+	authed.HandleFunc("/workspaces/{id}/members/{user_id}",
+		RequireScope(ScopeCreate, a.RemoveMemberHandler)).Methods(http.MethodDelete)
+	authed.HandleFunc("/workspaces/{id}/transfer",
+		RequireScope(ScopeCreate, a.TransferWorkspaceHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/invitations/accept",
+		RequireScope(ScopeCreate, a.AcceptInvitationHandler)).Methods(http.MethodPost)
+
+	// admin endpoints need an access token, api keys are refused
+	authed.HandleFunc("/admin/urls", RequireAdmin(a.AdminSearchURLsHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/admin/urls/{url}", RequireAdmin(a.AdminDeleteURLHandler)).Methods(http.MethodDelete)
+	authed.HandleFunc("/admin/urls/{url}/disable", RequireAdmin(a.AdminDisableURLHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/admin/urls/{url}/enable", RequireAdmin(a.AdminEnableURLHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/admin/users", RequireAdmin(a.AdminSearchUsersHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/admin/users/{id}/ban", RequireAdmin(a.AdminBanUserHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/admin/users/{id}/unban", RequireAdmin(a.AdminUnbanUserHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/admin/users/{id}/admin", RequireAdmin(a.AdminSetAdminHandler)).Methods(http.MethodPut)
+	authed.HandleFunc("/admin/actions", RequireAdmin(a.AdminActionsHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/admin/audit", RequireAdmin(a.AuditEventsHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/admin/clicks", RequireAdmin(a.ClickStatsHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/admin/export/{what}", RequireAdmin(a.ExportHandler)).Methods(http.MethodGet)
+
+	authed.HandleFunc("/webhooks", RequireScope(ScopeCreate, a.CreateWebhookHandler)).Methods(http.MethodPost)
+	authed.HandleFunc("/webhooks", RequireScope(ScopeRead, a.ListWebhooksHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/webhooks/{id}", RequireScope(ScopeCreate, a.DeleteWebhookHandler)).Methods(http.MethodDelete)
+	authed.HandleFunc("/webhooks/{id}/deliveries",
+		RequireScope(ScopeRead, a.WebhookDeliveriesHandler)).Methods(http.MethodGet)
+	authed.HandleFunc("/webhooks/{id}/deliveries/{delivery}/retry",
+		RequireScope(ScopeCreate, a.RetryWebhookDeliveryHandler)).Methods(http.MethodPost)
+
+	authed.HandleFunc("/keys", a.CreateAPIKeyHandler).Methods(http.MethodPost)
+	authed.HandleFunc("/keys", a.ListAPIKeysHandler).Methods(http.MethodGet)
+	authed.HandleFunc("/keys/{id}", a.RevokeAPIKeyHandler).Methods(http.MethodDelete)
+
 	router.HandleFunc("/create",
 		a.CreateHandler).Methods(http.MethodGet)
 
 	router.HandleFunc("/v1/create",
 		a.CreateJSONHandler).Methods(http.MethodPost)
 
+	// managing urls requires a logged in session and so a csrf token, see also the /api/v1
+	// equivalents
+	router.HandleFunc("/v1/urls/{url}",
+		RequireCSRF(a.UpdateJSONHandler)).Methods(http.MethodPut)
+
+	router.HandleFunc("/v1/urls/{url}",
+		RequireCSRF(a.DeleteURLHandler)).Methods(http.MethodDelete)
+
+	router.HandleFunc("/v1/urls/{url}/revisions",
+		a.RevisionsJSONHandler).Methods(http.MethodGet)
+
+	router.HandleFunc("/v1/urls/{url}/rollback",
+		RequireCSRF(a.RollbackJSONHandler)).Methods(http.MethodPost)
+
+	router.HandleFunc("/v1/preview/{url}",
+		a.PreviewJSONHandler).Methods(http.MethodGet)
+
 	// The restful way to do it would be to GET /url/id but that is a bit of a longer string,
 	// we could redirect to that url?
 	router.HandleFunc("/v1/redirect/{url}",
 		a.RedirectJSONHandler).Methods(http.MethodGet)
 
+	router.HandleFunc("/{url}+",
+		a.PreviewHandler).Methods(http.MethodGet)
+
 	router.HandleFunc("/{url}",
 		a.RedirectHandler).Methods(http.MethodGet)
 
+	// extra path segments are only honoured by passthrough links
+	router.HandleFunc("/{url}/{rest:.*}",
+		a.RedirectHandler).Methods(http.MethodGet)
+
 	server := &http.Server{
 		Addr:           ":" + portNum,
 		Handler:        router,
@@ -91,7 +270,21 @@ func (a *App) Init(store db.DBer, portNum string) error {
 		MaxHeaderBytes: 1 << 20,
 	}
 	a.server = server
-	a.store = store
+	a.store = a.observeBackend(store)
+	if s, ok := a.store.(db.Webhooker); ok && a.Webhooks == nil {
+		a.Webhooks = NewWebhookDispatcher(s, a.WebhookConfig)
+	}
+	if rec, ok := a.store.(db.ClickRecorder); ok && a.Clicks == nil {
+		a.ClickConfig.DropIPs = a.ClickConfig.DropIPs || a.DropIPs
+		if a.Webhooks != nil && a.ClickConfig.OnWrite == nil {
+			a.ClickConfig.OnWrite = a.clickThresholds
+		}
+		a.Clicks = NewClickTracker(rec, a.ClickConfig)
+		a.Metrics.watchClicks(a.Clicks)
+	}
+	if s, ok := a.store.(db.ClickStatter); ok && a.Rollups == nil {
+		a.Rollups = NewRollupJob(s, a.RollupInterval)
+	}
 
 	return nil
 }
@@ -100,18 +293,35 @@ func (a *App) Run() error {
 	return a.server.ListenAndServe()
 }
 
+// Shutdown stops the server once in flight requests are done, then writes and rolls up the clicks
+// still queued and stops sending webhooks
+func (a *App) Shutdown(ctx context.Context) error {
+	err := a.server.Shutdown(ctx)
+	if a.Clicks != nil {
+		a.Clicks.Close()
+	}
+	if a.Rollups != nil {
+		a.Rollups.Close()
+	}
+	// after the clicks, whose last batches may reach click thresholds
+	if a.Webhooks != nil {
+		a.Webhooks.Close()
+	}
+	return err
+}
+
 func (a *App) RootHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(ContentType, "text/html")
 	// TODO: don't do everytime
 	b, err := ioutil.ReadFile("static/index.html")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		timber.Errorf(err.Error())
+		slog.ErrorContext(r.Context(), "request error", "error", err)
 		return
 	}
 	_, err = w.Write(b)
 	if err != nil {
-		timber.Errorf(err.Error())
+		slog.ErrorContext(r.Context(), "request error", "error", err)
 	}
 }
 
@@ -120,8 +330,52 @@ func (a *App) HealthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type RedirectResponse struct {
-	OriginalURL string `json:"original_url"`
-	Err         string `json:"error"`
+	OriginalURL    string `json:"original_url"`
+	RedirectStatus int    `json:"redirect_status,omitempty"`
+	Passthrough    bool   `json:"passthrough,omitempty"`
+	Campaign       string `json:"campaign,omitempty"`
+	Err            string `json:"error"`
+}
+
+// ValidRedirectStatus reports whether status may be used to redirect a shortened url
+func ValidRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// defaultRedirectStatus is used for links that don't specify a status. Permanent redirects are
+// cached indefinitely by browsers, so if links can be edited we default to 302
+func (a *App) defaultRedirectStatus() int {
+	if a.RedirectStatus != 0 {
+		return a.RedirectStatus
+	}
+	if _, ok := a.store.(db.Reviser); ok {
+		return http.StatusFound
+	}
+	return http.StatusMovedPermanently
+}
+
+// redirectStatus returns the status to redirect storedURL with
+func (a *App) redirectStatus(storedURL *db.StoredURL) int {
+	if storedURL.RedirectStatus != 0 {
+		return storedURL.RedirectStatus
+	}
+	return a.defaultRedirectStatus()
+}
+
+// setCacheControl sets caching headers matching the redirect status. Permanent redirects may be
+// cached by anyone for a long time, temporary ones must come back to us every time
+func setCacheControl(w http.ResponseWriter, status int) {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	default:
+		w.Header().Set("Cache-Control", "private, no-cache, no-store, must-revalidate")
+	}
 }
 
 // TODO: refactor out common code amongst Redirect* handlers
@@ -134,9 +388,9 @@ func (a *App) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 	if shortenedURL == "" {
 		w.WriteHeader(http.StatusBadRequest)
 	}
-	timber.Infof("Handling request for shortened url %s", shortenedURL)
+	slog.DebugContext(r.Context(), "handling redirect", "key", shortenedURL)
 
-	storedURL, err := a.store.Get(shortenedURL)
+	storedURL, err := a.urls(r.Context()).Get(shortenedURL)
 	if err != nil {
 		switch err.(type) {
 		case *db.ErrDB:
@@ -145,9 +399,29 @@ func (a *App) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		// else assume a Not found error (could declare this error type and switch on it)
 		w.WriteHeader(http.StatusNotFound)
-		timber.Errorf(err.Error())
+		slog.ErrorContext(r.Context(), "request error", "error", err)
 	} else {
-		http.Redirect(w, r, storedURL.OriginalURL, http.StatusMovedPermanently)
+		if storedURL.DisabledStatus != 0 {
+			w.WriteHeader(storedURL.DisabledStatus)
+			w.Write([]byte(template.HTMLEscapeString(disabledMessage(storedURL))))
+			return
+		}
+		if !storedURL.Passthrough && vars["rest"] != "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		target, err := destination(storedURL, vars["rest"], r.URL.Query())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		status := a.redirectStatus(storedURL)
+		setCacheControl(w, status)
+		http.Redirect(w, r, target, status)
+		if a.Clicks != nil {
+			a.Clicks.Track(r, shortenedURL)
+		}
 	}
 }
 
@@ -157,37 +431,37 @@ func (a *App) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) RedirectJSONHandler(w http.ResponseWriter, r *http.Request) {
 	resp := &RedirectResponse{}
 	vars := mux.Vars(r)
-	w.Header().Set(ContentType, JSONMimeType)
 
 	shortenedURL := vars["url"]
 	if shortenedURL == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		b, _ := json.Marshal(resp)
-		w.Write(b)
+		writeJSON(w, http.StatusBadRequest, resp)
+		return
 	}
-	timber.Infof("Handling JSON request for shortened url %s", shortenedURL)
+	slog.DebugContext(r.Context(), "handling json redirect", "key", shortenedURL)
 
-	storedURL, err := a.store.Get(shortenedURL)
+	storedURL, err := a.urls(r.Context()).Get(shortenedURL)
+	status := http.StatusOK
 	if err != nil {
 		switch err.(type) {
 		case *db.ErrDB:
-			w.WriteHeader(http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			resp.Err = err.Error()
+			writeJSON(w, http.StatusInternalServerError, resp)
 			return
 		}
 		// else assume a Not found error (could declare this error type and switch on it)
-		w.WriteHeader(http.StatusNotFound)
+		status = http.StatusNotFound
 		resp.Err = err.Error()
+	} else if storedURL.DisabledStatus != 0 {
+		status = storedURL.DisabledStatus
+		resp.Err = disabledMessage(storedURL)
 	} else {
 		resp.OriginalURL = storedURL.OriginalURL
+		resp.RedirectStatus = a.redirectStatus(storedURL)
+		resp.Passthrough = storedURL.Passthrough
+		resp.Campaign = storedURL.Campaign
 	}
-
-	b, err := json.Marshal(resp)
-	if err != nil {
-		timber.Errorf("failed to marshal response")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.Write(b)
+	writeJSON(w, status, resp)
 }
 
 // TODO: maybe we should pass around a net.url.URL object rather than a string
@@ -214,29 +488,37 @@ func (a *App) CreateHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(ContentType, "text/html")
 	err := r.ParseForm()
 	if err != nil {
-		timber.Errorf(err.Error())
+		slog.ErrorContext(r.Context(), "request error", "error", err)
 		return
 	}
 	originalURL := r.Form.Get("url")
 	originalURL, err = EnsurePrefix(originalURL)
 	if err != nil {
-		timber.Errorf(err.Error())
+		slog.ErrorContext(r.Context(), "request error", "error", err)
 		return
 	}
 
-	shortenedURL, err := a.Create(&CreateRequest{originalURL}, &MD5Hash{})
+	req := &CreateRequest{OriginalURL: originalURL}
+	if u := UserFromContext(r.Context()); u != nil {
+		req.UserID = u.ID
+	}
+	shortenedURL, created, err := a.Create(r.Context(), req, &MD5Hash{})
 	if err != nil {
 		switch err.(type) {
 		case *db.ErrCollision:
-			timber.Errorf(err.Error())
+			slog.ErrorContext(r.Context(), "request error", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		default:
-			timber.Errorf(err.Error())
+			slog.ErrorContext(r.Context(), "request error", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 	}
+	if created {
+		a.auditURLChange(r, AuditURLCreate, shortenedURL, nil)
+		a.emitURLEvent(r.Context(), db.EventURLCreated, shortenedURL, nil)
+	}
 	// TODO: handle error case with html? - currently we just 500
 	templateData := ResultTemplateData{
 		PageTitle:   "Success!",
@@ -247,19 +529,31 @@ func (a *App) CreateHandler(w http.ResponseWriter, r *http.Request) {
 
 	t, err := template.New("result.html").ParseFiles("templates/result.html")
 	if err != nil {
-		timber.Errorf(err.Error())
+		slog.ErrorContext(r.Context(), "request error", "error", err)
 		return
 	}
 
 	err = t.Execute(w, templateData)
 	if err != nil {
-		timber.Errorf(err.Error())
+		slog.ErrorContext(r.Context(), "request error", "error", err)
 		return
 	}
 }
 
 type CreateRequest struct {
 	OriginalURL string `json:"original_url"`
+	// RedirectStatus optionally overrides the app's redirect status for this link
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Passthrough appends the extra path and query of a redirect request to OriginalURL
+	Passthrough bool `json:"passthrough,omitempty"`
+	// Campaign parameters, e.g. utm_source, are merged into the destination at redirect time.
+	// They override those of CampaignTemplate when both are given.
+	Campaign         map[string]string `json:"campaign,omitempty"`
+	CampaignTemplate string            `json:"campaign_template,omitempty"`
+	// WorkspaceID optionally creates the link in a workspace the user is an editor of
+	WorkspaceID string `json:"workspace_id,omitempty"`
+	// UserID is set from the authenticated user, anonymous links have none
+	UserID string `json:"-"`
 }
 
 type CreateResponse struct {
@@ -272,127 +566,176 @@ type CreateResponse struct {
 // TODO: Add test case where mandatory field original_url is missing
 func (a *App) CreateJSONHandler(w http.ResponseWriter, r *http.Request) {
 	resp := &CreateResponse{}
-	w.Header().Set(ContentType, JSONMimeType)
 
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		timber.Errorf("create handler failed to read bytes: %s", err.Error())
+		slog.ErrorContext(r.Context(), "failed to read create request", "error", err)
 		resp.Err = err.Error()
-		b, _ = json.Marshal(resp)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(b)
+		writeJSON(w, http.StatusBadRequest, resp)
 		return
 	}
 
 	req := &CreateRequest{}
 	err = json.Unmarshal(b, req)
 	if err != nil {
-		timber.Errorf("create handler failed to unmarshal bytes: %s", string(b))
+		slog.ErrorContext(r.Context(), "failed to unmarshal create request", "body", string(b), "error", err)
 		resp.Err = err.Error()
-		b, _ = json.Marshal(resp)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(b)
+		writeJSON(w, http.StatusBadRequest, resp)
 		return
 	}
 
+	if u := UserFromContext(r.Context()); u != nil {
+		req.UserID = u.ID
+	}
+
+	if req.RedirectStatus != 0 && !ValidRedirectStatus(req.RedirectStatus) {
+		resp.Err = fmt.Sprintf("unsupported redirect_status %d", req.RedirectStatus)
+		writeJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+
+	if req.WorkspaceID != "" {
+		if status, msg := a.canCreateIn(r.Context(), UserFromContext(r.Context()), req.WorkspaceID); status != http.StatusOK {
+			resp.Err = msg
+			writeJSON(w, status, resp)
+			return
+		}
+	}
+
 	// should we return this potentially updated OriginalURL, then we could test the correction at
 	// the handler level
 	req.OriginalURL, err = EnsurePrefix(req.OriginalURL)
 	if err != nil {
-		timber.Errorf(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		resp.Err = err.Error()
+		writeJSON(w, http.StatusInternalServerError, resp)
 		return
 	}
 
-	shortenedURL, err := a.Create(req, &MD5Hash{})
+	shortenedURL, created, err := a.Create(r.Context(), req, &MD5Hash{})
 	if err != nil {
+		resp.Err = err.Error()
 		switch err.(type) {
-		case *db.ErrCollision:
-			timber.Errorf(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		case *ErrUnknownCampaign:
+			writeJSON(w, http.StatusBadRequest, resp)
 		default:
-			timber.Errorf(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			writeJSON(w, http.StatusInternalServerError, resp)
 		}
+		return
 	}
 
-	resp = &CreateResponse{ShortenedURL: shortenedURL}
-	if err != nil {
-		resp.Err = err.Error()
-	}
-	b, err = json.Marshal(resp)
-	if err != nil {
-		timber.Errorf("failed to marshal response")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if created {
+		a.auditURLChange(r, AuditURLCreate, shortenedURL, nil)
+		a.emitURLEvent(r.Context(), db.EventURLCreated, shortenedURL, nil)
 	}
-	w.Write(b)
+	writeJSON(w, http.StatusOK, &CreateResponse{ShortenedURL: shortenedURL})
 }
 
-func (a *App) doCreate(originalURL string, permutedValue string, hasher Hasher) (string, error) {
-	shortenedURL := hasher.Hash(permutedValue)
-	timber.Infof("Create request for [%s], hashes to [%s]", permutedValue, shortenedURL)
+// doCreate is one attempt at storing candidate, traced with the attempt number, 0 being the
+// unpermuted value. created is false when the same link already had the key.
+func (a *App) doCreate(ctx context.Context, attempt int, candidate *db.StoredURL, permutedValue string,
+	hasher Hasher) (shortenedURL string, created bool, err error) {
+	shortenedURL = hasher.Hash(permutedValue)
+	slog.DebugContext(ctx, "create attempt", "value", permutedValue, "key", shortenedURL)
+	ctx, span := a.tracer().Start(ctx, "create.attempt", trace.WithAttributes(
+		attribute.Int("shortly.attempt", attempt), attribute.String("shortly.key", shortenedURL)))
+	defer func() {
+		_, collision := err.(*db.ErrCollision)
+		span.SetAttributes(attribute.Bool("shortly.collision", collision))
+		if collision {
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
 	// lets try and store it
 
-	storedURL, err := a.store.Get(shortenedURL)
+	storedURL, err := a.urls(ctx).Get(shortenedURL)
 	if err == nil {
-		// check if data is equal
-		if storedURL.OriginalURL == originalURL {
-			return shortenedURL, nil
+		// check if data is equal, links to the same url with different options get their own key
+		if storedURL.SameLink(candidate) {
+			return shortenedURL, false, nil
 		}
 
 		// collision
-		return "", db.NewErrCollision(fmt.Sprintf("key [%s] already exists", shortenedURL))
+		return "", false, db.NewErrCollision(fmt.Sprintf("key [%s] already exists", shortenedURL))
 	}
 	switch err.(type) {
 	case *db.ErrNotFound:
 		// pass
 	default:
-		return "", err
+		return "", false, err
 	}
 
-	storedURL = &db.StoredURL{permutedValue}
-	err = a.store.Create(shortenedURL, storedURL)
-	return shortenedURL, err
+	err = a.urls(ctx).Create(shortenedURL, candidate)
+	return shortenedURL, err == nil, err
 }
 
-func (a *App) Create(req *CreateRequest, hasher Hasher) (string, error) {
+// Create returns the key of a link for req, storing it unless the same link already exists.
+// created reports whether it was stored, so that only new links are audited and announced.
+func (a *App) Create(ctx context.Context, req *CreateRequest, hasher Hasher) (shortenedURL string, created bool,
+	err error) {
+	campaign, err := a.resolveCampaign(req)
+	if err != nil {
+		return "", false, err
+	}
+	candidate := &db.StoredURL{
+		OriginalURL:    req.OriginalURL,
+		RedirectStatus: req.RedirectStatus,
+		Passthrough:    req.Passthrough,
+		Campaign:       campaign,
+		UserID:         req.UserID,
+		WorkspaceID:    req.WorkspaceID,
+	}
+	// tagged and owned links hash their campaign and owner too so that many variants of one url
+	// don't all have to permute past the anonymous untagged link's key
+	hashValue := req.OriginalURL
+	if campaign != "" {
+		hashValue += "?" + campaign
+	}
+	if req.UserID != "" {
+		hashValue += "#" + req.UserID
+	}
+	if req.WorkspaceID != "" {
+		hashValue += "@" + req.WorkspaceID
+	}
+
 	// attempt to generate hash and store without permutation
-	shortenedURL, err := a.doCreate(req.OriginalURL, req.OriginalURL, hasher)
+	shortenedURL, created, err = a.doCreate(ctx, 0, candidate, hashValue, hasher)
 	if err == nil {
 		// success
-		return shortenedURL, err
+		return shortenedURL, created, err
 	}
 
 	switch err.(type) {
 	case *db.ErrCollision:
 		// probably a collision - todo refine this assumption
-		// pass
+		a.Metrics.collisions.Inc()
 	default:
-		return shortenedURL, err
+		return shortenedURL, false, err
 	}
 
 	// permute in case of collision
 	for i := 0; i < maxCollisions; i++ {
 		suffix := strconv.Itoa(i)
-		newValue := req.OriginalURL + suffix
-		shortenedURL, err := a.doCreate(req.OriginalURL, newValue, hasher)
+		newValue := hashValue + suffix
+		shortenedURL, created, err := a.doCreate(ctx, i+1, candidate, newValue, hasher)
 		if err == nil {
 			// success
-			return shortenedURL, err
+			return shortenedURL, created, err
 		}
 
 		switch err.(type) {
 		case *db.ErrCollision:
 			// probably a collision - todo refine this assumption
+			a.Metrics.collisions.Inc()
 			continue
 		default:
-			return shortenedURL, err
+			return shortenedURL, false, err
 		}
 	}
-	return "", db.NewErrCollision(fmt.Sprintf("failed to store %s, too many collisions", req.OriginalURL))
+	return "", false, db.NewErrCollision(fmt.Sprintf("failed to store %s, too many collisions", req.OriginalURL))
 }
 
 type Hasher interface {
@@ -1,9 +1,11 @@
 package shortly
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -27,7 +29,7 @@ func TestRedirectJSONHandler(t *testing.T) {
 	a := assert.New(t)
 
 	app := NewApp()
-	app.Init(db.NewMapDB())
+	app.Init(db.NewMapDB(), "8080")
 	req, err := http.NewRequest("GET", "/v1/redirect/foo", nil)
 	a.NoError(err)
 
@@ -76,7 +78,7 @@ func TestCreateJSONHandler(t *testing.T) {
 	a := assert.New(t)
 
 	app := NewApp()
-	app.Init(db.NewMapDB())
+	app.Init(db.NewMapDB(), "8080")
 	body := strings.NewReader(`{"original_url": "http://foobarcat.blogspot.com"}`)
 	req, err := http.NewRequest("POST", "/v1/create", body)
 	a.NoError(err)
@@ -188,10 +190,10 @@ func TestCollision(t *testing.T) {
 
 	app := NewApp()
 	dbMap := db.NewMapDB()
-	dbMap.M["foo"] = &db.StoredURL{"bar"}
-	app.Init(dbMap)
+	dbMap.M["foo"] = &db.StoredURL{OriginalURL: "bar"}
+	app.Init(dbMap, "8080")
 
-	_, err := app.Create(&CreateRequest{OriginalURL: "http://www.google.com"}, &Collision{maxCollisions: 64})
+	_, _, err := app.Create(context.Background(), &CreateRequest{OriginalURL: "http://www.google.com"}, &Collision{maxCollisions: 64})
 	a.Error(err)
 
 	_, ok := err.(*db.ErrCollision)
@@ -203,10 +205,10 @@ func TestSomeCollision(t *testing.T) {
 
 	app := NewApp()
 	dbMap := db.NewMapDB()
-	dbMap.M["foo"] = &db.StoredURL{"bar"}
-	app.Init(dbMap)
+	dbMap.M["foo"] = &db.StoredURL{OriginalURL: "bar"}
+	app.Init(dbMap, "8080")
 
-	_, err := app.Create(&CreateRequest{OriginalURL: "http://www.google.com"}, &Collision{maxCollisions: 63})
+	_, _, err := app.Create(context.Background(), &CreateRequest{OriginalURL: "http://www.google.com"}, &Collision{maxCollisions: 63})
 	a.NoError(err)
 }
 
@@ -215,10 +217,10 @@ func TestCreateSameData(t *testing.T) {
 
 	app := NewApp()
 	dbMap := db.NewMapDB()
-	dbMap.M["foo"] = &db.StoredURL{"bar"}
-	app.Init(dbMap)
+	dbMap.M["foo"] = &db.StoredURL{OriginalURL: "bar"}
+	app.Init(dbMap, "8080")
 
-	_, err := app.Create(&CreateRequest{OriginalURL: "bar"}, &MD5Hash{})
+	_, _, err := app.Create(context.Background(), &CreateRequest{OriginalURL: "bar"}, &MD5Hash{})
 	a.NoError(err)
 }
 
@@ -251,7 +253,7 @@ func TestRedirectHandler(t *testing.T) {
 	a := assert.New(t)
 
 	app := NewApp()
-	app.Init(db.NewMapDB())
+	app.Init(db.NewMapDB(), "8080")
 	req, err := http.NewRequest("GET", "/foo", nil)
 	a.NoError(err)
 
@@ -271,8 +273,26 @@ func TestRedirectHandler(t *testing.T) {
 	rr = httptest.NewRecorder()
 	app.server.Handler.ServeHTTP(rr, req) // kind of hacky
 
+	// links are editable in the map store so we default to a temporary redirect
+	a.Equal(http.StatusFound, rr.Code)
+	a.Equal("http://bar", rr.Header().Get("Location"))
+	a.Contains(rr.Header().Get("Cache-Control"), "no-store")
+
+	// a global default applies to links without their own status
+	app.RedirectStatus = http.StatusMovedPermanently
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req) // kind of hacky
 	a.Equal(http.StatusMovedPermanently, rr.Code)
-	// Check results
+	a.Equal("public, max-age=31536000", rr.Header().Get("Cache-Control"))
+
+	// per link status overrides the global default
+	err = app.store.Create("baz", &db.StoredURL{OriginalURL: "http://bar", RedirectStatus: http.StatusTemporaryRedirect})
+	a.NoError(err)
+	req, err = http.NewRequest("GET", "/baz", nil)
+	a.NoError(err)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req) // kind of hacky
+	a.Equal(http.StatusTemporaryRedirect, rr.Code)
 
 	// force DBError and check we return internal server error
 	app.store = &DBErrStore{}
@@ -289,7 +309,7 @@ func TestCreateHandler(t *testing.T) {
 	a := assert.New(t)
 
 	app := NewApp()
-	app.Init(db.NewMapDB())
+	app.Init(db.NewMapDB(), "8080")
 	req, err := http.NewRequest("GET", "/create?url=http://foobarcat.blogspot.com", nil)
 
 	a.NoError(err)
@@ -332,3 +352,341 @@ func TestCreateHandler(t *testing.T) {
 	// TODO: create collision - check that we got different URL back, easily done when we enable
 	// the custom_alias feature
 }
+
+func TestUpdateAndRollback(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	rr := postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	c := sessionCookie(rr)
+	owner, err := store.UserByEmail("cat@foobarcat.com")
+	a.NoError(err)
+
+	// updating a missing url is a 404
+	req, err := http.NewRequest("PUT", "/v1/urls/foo", strings.NewReader(`{"original_url": "http://bar"}`))
+	a.NoError(err)
+	addCSRF(req)
+	rr = httptest.NewRecorder()
+	req.AddCookie(c)
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusNotFound, rr.Code)
+
+	err = app.store.Create("foo", &db.StoredURL{OriginalURL: "http://first", UserID: owner.ID})
+	a.NoError(err)
+
+	// changes made with a session need a csrf token
+	req, err = http.NewRequest("PUT", "/v1/urls/foo", strings.NewReader(`{"original_url": "http://bar"}`))
+	a.NoError(err)
+	req.AddCookie(c)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusForbidden, rr.Code)
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeader, "forged")
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusForbidden, rr.Code)
+	req, err = http.NewRequest("DELETE", "/v1/urls/foo", nil)
+	a.NoError(err)
+	req.AddCookie(c)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusForbidden, rr.Code)
+	stored, err := app.store.Get("foo")
+	a.NoError(err)
+	a.Equal("http://first", stored.OriginalURL)
+
+	// only the owner may edit a url
+	req, err = http.NewRequest("PUT", "/v1/urls/foo", strings.NewReader(`{"original_url": "http://bar"}`))
+	a.NoError(err)
+	addCSRF(req)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusUnauthorized, rr.Code)
+
+	rr = postForm(app, "/signup", url.Values{"email": {"dog@foobarcat.com"}, "password": {"hunter22"}})
+	req, err = http.NewRequest("PUT", "/v1/urls/foo", strings.NewReader(`{"original_url": "http://bar"}`))
+	a.NoError(err)
+	addCSRF(req)
+	req.AddCookie(sessionCookie(rr))
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	for _, u := range []string{"second", "http://third"} {
+		req, err = http.NewRequest("PUT", "/v1/urls/foo", strings.NewReader(`{"original_url": "`+u+`"}`))
+		a.NoError(err)
+		addCSRF(req)
+		rr = httptest.NewRecorder()
+		req.AddCookie(c)
+		app.server.Handler.ServeHTTP(rr, req)
+		a.Equal(http.StatusOK, rr.Code)
+	}
+	stored, err = app.store.Get("foo")
+	a.NoError(err)
+	a.Equal("http://third", stored.OriginalURL)
+
+	// check history
+	req, err = http.NewRequest("GET", "/v1/urls/foo/revisions", nil)
+	a.NoError(err)
+	rr = httptest.NewRecorder()
+	req.AddCookie(c)
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+	revs := &RevisionsResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), revs))
+	a.Len(revs.Revisions, 2)
+	a.Equal("http://first", revs.Revisions[0].OldURL)
+	a.Equal("http://second", revs.Revisions[0].NewURL)
+	a.Equal(2, revs.Revisions[1].Number)
+
+	// roll back to revision 1
+	req, err = http.NewRequest("POST", "/v1/urls/foo/rollback", strings.NewReader(`{"revision": 1}`))
+	a.NoError(err)
+	addCSRF(req)
+	rr = httptest.NewRecorder()
+	req.AddCookie(c)
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+	stored, err = app.store.Get("foo")
+	a.NoError(err)
+	a.Equal("http://second", stored.OriginalURL)
+
+	// roll back to the original
+	req, err = http.NewRequest("POST", "/v1/urls/foo/rollback", strings.NewReader(`{"revision": 0}`))
+	a.NoError(err)
+	addCSRF(req)
+	rr = httptest.NewRecorder()
+	req.AddCookie(c)
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+	stored, err = app.store.Get("foo")
+	a.NoError(err)
+	a.Equal("http://first", stored.OriginalURL)
+
+	// unknown revision
+	req, err = http.NewRequest("POST", "/v1/urls/foo/rollback", strings.NewReader(`{"revision": 9}`))
+	a.NoError(err)
+	addCSRF(req)
+	rr = httptest.NewRecorder()
+	req.AddCookie(c)
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	// stores that can't edit urls
+	app.store = &DBErrStore{}
+	req, err = http.NewRequest("GET", "/v1/urls/foo/revisions", nil)
+	a.NoError(err)
+	rr = httptest.NewRecorder()
+	req.AddCookie(c)
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusNotImplemented, rr.Code)
+}
+
+func TestCreateRedirectStatus(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+
+	create := func(body string) (int, *CreateResponse) {
+		req, err := http.NewRequest("POST", "/v1/create", strings.NewReader(body))
+		a.NoError(err)
+		rr := httptest.NewRecorder()
+		app.server.Handler.ServeHTTP(rr, req)
+		resp := &CreateResponse{}
+		a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+		return rr.Code, resp
+	}
+
+	code, plain := create(`{"original_url": "http://foobarcat.blogspot.com"}`)
+	a.Equal(http.StatusOK, code)
+	code, permanent := create(`{"original_url": "http://foobarcat.blogspot.com", "redirect_status": 308}`)
+	a.Equal(http.StatusOK, code)
+	a.NotEqual(plain.ShortenedURL, permanent.ShortenedURL, "different options get a different key")
+
+	stored, err := app.store.Get(permanent.ShortenedURL)
+	a.NoError(err)
+	a.Equal(http.StatusPermanentRedirect, stored.RedirectStatus)
+	a.Equal("http://foobarcat.blogspot.com", stored.OriginalURL, "permuted keys store the original url")
+
+	code, again := create(`{"original_url": "http://foobarcat.blogspot.com", "redirect_status": 308}`)
+	a.Equal(http.StatusOK, code)
+	a.Equal(permanent.ShortenedURL, again.ShortenedURL)
+
+	code, _ = create(`{"original_url": "http://foobarcat.blogspot.com", "redirect_status": 200}`)
+	a.Equal(http.StatusBadRequest, code)
+}
+
+func TestPassthroughURL(t *testing.T) {
+	a := assert.New(t)
+
+	var testData = []struct {
+		original string
+		path     string
+		query    string
+		out      string
+	}{
+		{"http://docs.com", "", "", "http://docs.com"},
+		{"http://docs.com", "a/b", "", "http://docs.com/a/b"},
+		{"http://docs.com/v2/", "a/b", "", "http://docs.com/v2/a/b"},
+		{"http://docs.com/v2", "a", "ref=x", "http://docs.com/v2/a?ref=x"},
+		{"http://docs.com/v2?lang=en", "", "ref=x&lang=fr", "http://docs.com/v2?lang=en&ref=x"},
+		{"http://docs.com/v2#top", "a b", "", "http://docs.com/v2/a%20b#top"},
+	}
+
+	for _, td := range testData {
+		q, err := url.ParseQuery(td.query)
+		a.NoError(err)
+		r, err := PassthroughURL(td.original, td.path, q)
+		a.NoError(err)
+		a.Equal(td.out, r)
+	}
+}
+
+func TestRedirectHandlerPassthrough(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+	err := app.store.Create("foo", &db.StoredURL{OriginalURL: "http://docs.com/v2", Passthrough: true})
+	a.NoError(err)
+	err = app.store.Create("bar", &db.StoredURL{OriginalURL: "http://docs.com/v2"})
+	a.NoError(err)
+
+	req, err := http.NewRequest("GET", "/foo/extra/path?ref=x", nil)
+	a.NoError(err)
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusFound, rr.Code)
+	a.Equal("http://docs.com/v2/extra/path?ref=x", rr.Header().Get("Location"))
+
+	// links without passthrough ignore the query and don't match longer paths
+	req, err = http.NewRequest("GET", "/bar?ref=x", nil)
+	a.NoError(err)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusFound, rr.Code)
+	a.Equal("http://docs.com/v2", rr.Header().Get("Location"))
+
+	req, err = http.NewRequest("GET", "/bar/extra/path", nil)
+	a.NoError(err)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusNotFound, rr.Code)
+}
+
+func TestCreateCampaign(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+	app.Campaigns = CampaignTemplates{
+		"newsletter": {"utm_source": "newsletter", "utm_medium": "email"},
+	}
+
+	create := func(body string) (int, *CreateResponse) {
+		req, err := http.NewRequest("POST", "/v1/create", strings.NewReader(body))
+		a.NoError(err)
+		rr := httptest.NewRecorder()
+		app.server.Handler.ServeHTTP(rr, req)
+		resp := &CreateResponse{}
+		a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+		return rr.Code, resp
+	}
+
+	_, plain := create(`{"original_url": "http://shop.com/sale?id=1"}`)
+	_, plain1 := create(`{"original_url": "http://shop.com/sale?id=1"}`)
+	a.Equal(plain.ShortenedURL, plain1.ShortenedURL, "untagged links still dedupe")
+
+	_, tagged := create(`{"original_url": "http://shop.com/sale?id=1", "campaign_template": "newsletter",
+		"campaign": {"utm_campaign": "spring"}}`)
+	_, tagged1 := create(`{"original_url": "http://shop.com/sale?id=1", "campaign_template": "newsletter",
+		"campaign": {"utm_campaign": "spring"}}`)
+	_, other := create(`{"original_url": "http://shop.com/sale?id=1", "campaign": {"utm_source": "twitter"}}`)
+	a.NotEqual(plain.ShortenedURL, tagged.ShortenedURL)
+	a.NotEqual(tagged.ShortenedURL, other.ShortenedURL)
+	a.Equal(tagged.ShortenedURL, tagged1.ShortenedURL, "equal campaigns dedupe")
+
+	code, _ := create(`{"original_url": "http://shop.com", "campaign_template": "missing"}`)
+	a.Equal(http.StatusBadRequest, code)
+
+	req, err := http.NewRequest("GET", "/"+tagged.ShortenedURL, nil)
+	a.NoError(err)
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusFound, rr.Code)
+	a.Equal("http://shop.com/sale?id=1&utm_campaign=spring&utm_medium=email&utm_source=newsletter",
+		rr.Header().Get("Location"))
+}
+
+func TestApplyCampaign(t *testing.T) {
+	a := assert.New(t)
+
+	r, err := ApplyCampaign("http://shop.com", "")
+	a.NoError(err)
+	a.Equal("http://shop.com", r)
+
+	r, err = ApplyCampaign("http://shop.com/?utm_source=old&id=2#top", "utm_source=new")
+	a.NoError(err)
+	a.Equal("http://shop.com/?id=2&utm_source=new#top", r)
+}
+
+func TestPreviewHandler(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+	err := app.store.Create("foo", &db.StoredURL{OriginalURL: "http://user@1.2.3.4/login", Campaign: "utm_source=x"})
+	a.NoError(err)
+
+	// + suffix renders html without redirecting
+	req, err := http.NewRequest("GET", "/foo+", nil)
+	a.NoError(err)
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Equal("text/html", rr.Header().Get(ContentType))
+	a.Contains(rr.Body.String(), "http://user@1.2.3.4/login?utm_source=x")
+
+	// preview host serves json to clients that ask for it
+	req, err = http.NewRequest("GET", "http://preview.sh.foobarcat.com/foo", nil)
+	a.NoError(err)
+	req.Header.Set("Accept", JSONMimeType)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+	resp := &PreviewResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	a.Equal("http://user@1.2.3.4/login?utm_source=x", resp.Destination)
+	a.False(resp.CreatedAt.IsZero())
+	a.False(resp.Safety.Safe)
+	a.Len(resp.Safety.Warnings, 2)
+
+	// json endpoint
+	req, err = http.NewRequest("GET", "/v1/preview/missing", nil)
+	a.NoError(err)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusNotFound, rr.Code)
+
+	req, err = http.NewRequest("GET", "http://preview.localhost:8080/missing", nil)
+	a.NoError(err)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusNotFound, rr.Code)
+	a.Equal("text/html", rr.Header().Get(ContentType))
+}
+
+func TestHeuristicSafety(t *testing.T) {
+	a := assert.New(t)
+	h := &HeuristicSafety{}
+
+	a.True(h.Check("https://www.google.com/search?q=x").Safe)
+	a.True(h.Check("http://foobarcat.blogspot.com").Safe)
+	a.False(h.Check("javascript:alert(1)").Safe)
+	a.False(h.Check("http://www.xn--ggle-0nda.com").Safe)
+	a.False(h.Check("http://127.0.0.1:8080").Safe)
+}
@@ -0,0 +1,212 @@
+package shortly
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// audit actions, the prefix names what the target is
+const (
+	AuditURLCreate         = "url.create"
+	AuditURLUpdate         = "url.update"
+	AuditURLRollback       = "url.rollback"
+	AuditURLDelete         = "url.delete"
+	AuditURLTransfer       = "url.transfer"
+	AuditURLDisable        = "url.disable"
+	AuditURLEnable         = "url.enable"
+	AuditUserCreate        = "user.create"
+	AuditUserVerifyEmail   = "user.verify_email"
+	AuditUserResetPassword = "user.reset_password"
+	AuditUserBan           = "user.ban"
+	AuditUserUnban         = "user.unban"
+	AuditUserSetAdmin      = "user.set_admin"
+	AuditAPIKeyCreate      = "api_key.create"
+	AuditAPIKeyRevoke      = "api_key.revoke"
+	AuditWorkspaceCreate   = "workspace.create"
+	AuditWorkspaceInvite   = "workspace.invite"
+	AuditWorkspaceJoin     = "workspace.join"
+	AuditWorkspaceSetRole  = "workspace.set_role"
+	AuditWorkspaceRemove   = "workspace.remove_member"
+	AuditWorkspaceTransfer = "workspace.transfer"
+	AuditWebhookCreate     = "webhook.create"
+	AuditWebhookDelete     = "webhook.delete"
+	AuditWebhookRetry      = "webhook.retry_delivery"
+)
+
+// validRequestID limits the ids accepted from clients so they can't inject into logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware gives every request an id, echoed in the X-Request-ID response header. An id
+// set by the client or a proxy in front of us is kept so that requests can be followed across both.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = db.NewID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+// RequestIDFromContext returns the id given to the request by RequestIDMiddleware
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// snapshot is a json value for an audit event, nil values are left out
+func snapshot(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("failed to marshal audit snapshot", "error", err)
+		return nil
+	}
+	return b
+}
+
+// audit records a change made by r. before and after are what changed, either may be nil. The
+// change has already been made by the time it is audited so failures are only logged.
+func (a *App) audit(r *http.Request, action string, target string, before interface{}, after interface{}) {
+	s, ok := a.store.(db.Auditor)
+	if !ok {
+		return
+	}
+	e := &db.AuditEvent{
+		Action:    action,
+		Target:    target,
+		Before:    snapshot(before),
+		After:     snapshot(after),
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+	if !a.DropIPs {
+		e.IP = clientIP(r)
+	}
+	if u := UserFromContext(r.Context()); u != nil {
+		e.ActorID = u.ID
+	}
+	if err := s.RecordAuditEvent(e); err != nil {
+		slog.ErrorContext(r.Context(), "failed to audit", "action", action, "target", target, "error", err)
+	}
+}
+
+// auditURL snapshots the parts of a url that can change
+type auditURL struct {
+	OriginalURL    string `json:"original_url"`
+	RedirectStatus int    `json:"redirect_status,omitempty"`
+	Passthrough    bool   `json:"passthrough,omitempty"`
+	Campaign       string `json:"campaign,omitempty"`
+	UserID         string `json:"user_id,omitempty"`
+	WorkspaceID    string `json:"workspace_id,omitempty"`
+	DisabledStatus int    `json:"disabled_status,omitempty"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+}
+
+func urlSnapshot(s *db.StoredURL) *auditURL {
+	return &auditURL{
+		OriginalURL:    s.OriginalURL,
+		RedirectStatus: s.RedirectStatus,
+		Passthrough:    s.Passthrough,
+		Campaign:       s.Campaign,
+		UserID:         s.UserID,
+		WorkspaceID:    s.WorkspaceID,
+		DisabledStatus: s.DisabledStatus,
+		DisabledReason: s.DisabledReason,
+	}
+}
+
+// auditURLChange records a change to the url key, fetching its new state to compare with before,
+// which is nil for new urls. Stores may hand out the url they go on to change so before must be
+// snapshotted ahead of the change.
+func (a *App) auditURLChange(r *http.Request, action string, key string, before *auditURL) {
+	var b, after interface{}
+	if before != nil {
+		b = before
+	}
+	stored, err := a.urls(r.Context()).Get(key)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look up audited url", "key", key, "error", err)
+	} else {
+		after = urlSnapshot(stored)
+	}
+	a.audit(r, action, key, b, after)
+}
+
+type AuditEventsResponse struct {
+	Events     []*db.AuditEvent `json:"events"`
+	Total      int              `json:"total"`
+	NextOffset int              `json:"next_offset,omitempty"`
+	Err        string           `json:"error"`
+}
+
+// parseAuditFilter reads ?actor=&action=&target=&since=&until=&offset=&limit= where since and until
+// are RFC 3339 times
+func parseAuditFilter(r *http.Request) (*db.AuditFilter, string) {
+	params := r.URL.Query()
+	f := &db.AuditFilter{
+		ActorID: params.Get("actor"),
+		Action:  params.Get("action"),
+		Target:  params.Get("target"),
+		Limit:   defaultPageSize,
+	}
+	var err error
+	if s := params.Get("since"); s != "" {
+		if f.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, "since must be an RFC 3339 time"
+		}
+	}
+	if s := params.Get("until"); s != "" {
+		if f.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, "until must be an RFC 3339 time"
+		}
+	}
+	if s := params.Get("offset"); s != "" {
+		if f.Offset, err = strconv.Atoi(s); err != nil || f.Offset < 0 {
+			return nil, "offset must be a non negative integer"
+		}
+	}
+	if s := params.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 || f.Limit > maxPageSize {
+			return nil, "limit must be between 1 and " + strconv.Itoa(maxPageSize)
+		}
+	}
+	return f, ""
+}
+
+// AuditEventsHandler searches the audit trail, newest first
+// curl -H "Authorization: Bearer $TOKEN" "localhost:8080/api/v1/admin/audit?target=7RxfRd&since=2024-06-01T00:00:00Z"
+func (a *App) AuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.store.(db.Auditor)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &AuditEventsResponse{Err: "store does not support auditing"})
+		return
+	}
+	f, msg := parseAuditFilter(r)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &AuditEventsResponse{Err: msg})
+		return
+	}
+	events, total, err := s.AuditEvents(f)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &AuditEventsResponse{Err: err.Error()})
+		return
+	}
+	resp := &AuditEventsResponse{Events: events, Total: total}
+	if f.Offset+len(events) < total {
+		resp.NextOffset = f.Offset + len(events)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,86 @@
+package shortly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditTrail(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	dog := apiLogin(t, app, "dog@foobarcat.com")
+	catUser, _ := store.UserByEmail("cat@foobarcat.com")
+	dogUser, _ := store.UserByEmail("dog@foobarcat.com")
+
+	rr := apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://dog.com"}`, dog)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	key := resp.ShortenedURL
+	a.NotEmpty(rr.Header().Get(requestIDHeader))
+	// shortening the same url again gives the same link, which wasn't created again
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://dog.com"}`, dog)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	a.Equal(key, resp.ShortenedURL)
+
+	// a request id from the client is kept
+	req, _ := http.NewRequest("PUT", "/api/v1/urls/"+key, strings.NewReader(`{"original_url": "http://dog.org"}`))
+	req.Header.Set("Authorization", "Bearer "+dog)
+	req.Header.Set(requestIDHeader, "lb-1234")
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Equal("lb-1234", rr.Header().Get(requestIDHeader))
+
+	a.NoError(store.SetAdmin(catUser.ID, true))
+	rr = apiRequest(app, "POST", "/api/v1/admin/urls/"+key+"/disable", `{"status": 410, "reason": "spam"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "DELETE", "/api/v1/admin/urls/"+key, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/audit", "", dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/admin/audit?since=yesterday", "", cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/audit?target="+key, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	events := &AuditEventsResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), events))
+	a.Equal(4, events.Total)
+	a.Equal(AuditURLDelete, events.Events[0].Action)
+	a.Equal(catUser.ID, events.Events[0].ActorID)
+	a.Empty(events.Events[0].After)
+	a.Equal(AuditURLDisable, events.Events[1].Action)
+	a.Contains(string(events.Events[1].After), `"disabled_status":410`)
+	a.NotContains(string(events.Events[1].Before), "disabled_status")
+	update := events.Events[2]
+	a.Equal(AuditURLUpdate, update.Action)
+	a.Equal(dogUser.ID, update.ActorID)
+	a.Equal("lb-1234", update.RequestID)
+	a.Contains(string(update.Before), "http://dog.com")
+	a.Contains(string(update.After), "http://dog.org")
+	a.Equal(AuditURLCreate, events.Events[3].Action)
+	a.Empty(events.Events[3].Before)
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/audit?actor="+dogUser.ID+"&action="+AuditUserCreate, "", cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), events))
+	a.Equal(0, events.Total)
+	rr = apiRequest(app, "GET", "/api/v1/admin/audit?target="+dogUser.ID+"&action="+AuditUserCreate, "", cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), events))
+	a.Equal(1, events.Total)
+	a.NotContains(string(events.Events[0].After), "password")
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/audit?until=2000-01-01T00:00:00Z", "", cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), events))
+	a.Equal(0, events.Total)
+}
@@ -0,0 +1,330 @@
+package shortly
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = "session_id"
+	minPasswordLength = 8
+	defaultSessionTTL = 7 * 24 * time.Hour
+)
+
+// bcryptCost is a variable so that tests can hash quickly
+var bcryptCost = bcrypt.DefaultCost
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	scopesContextKey
+	requestIDContextKey
+	clientIPContextKey
+)
+
+// UserFromContext returns the authenticated user attached to ctx by the auth middleware, or nil
+func UserFromContext(ctx context.Context) *db.User {
+	u, _ := ctx.Value(userContextKey).(*db.User)
+	return u
+}
+
+func withUser(ctx context.Context, u *db.User) context.Context {
+	return context.WithValue(ctx, userContextKey, u)
+}
+
+// newToken returns a random url safe token
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken is how tokens handed to clients are stored, a leaked table can't be used to log in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	return string(b), err
+}
+
+// validateCredentials checks a signup request, returning a message suitable for the user
+func validateCredentials(email string, password string) string {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "please enter a valid email address"
+	}
+	if len(password) < minPasswordLength {
+		return "passwords must be at least 8 characters"
+	}
+	return ""
+}
+
+type sessionStorer interface {
+	db.UserStore
+	db.SessionStore
+}
+
+// sessions returns the store as a sessionStorer if the backend supports user accounts
+func (a *App) sessions() (sessionStorer, bool) {
+	s, ok := a.store.(sessionStorer)
+	return s, ok
+}
+
+// authenticate returns the user with the given email and password
+func (a *App) authenticate(email string, password string) (*db.User, error) {
+	s, ok := a.sessions()
+	if !ok {
+		return nil, db.NewErrDB("store does not support user accounts")
+	}
+	u, err := s.UserByEmail(strings.TrimSpace(email))
+	if err != nil {
+		return nil, err
+	}
+	if u.PasswordHash == "" {
+		return nil, db.NewErrNotFound("user has no password set")
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
+	if err != nil {
+		return nil, db.NewErrNotFound("incorrect password")
+	}
+	if u.Banned {
+		return nil, NewErrBanned("your account has been suspended")
+	}
+	return u, nil
+}
+
+// startSession stores a new session for u and sets the session cookie
+func (a *App) startSession(w http.ResponseWriter, u *db.User) error {
+	s, ok := a.sessions()
+	if !ok {
+		return db.NewErrDB("store does not support user accounts")
+	}
+	token := newToken()
+	now := time.Now().UTC()
+	session := &db.Session{
+		ID:        hashToken(token),
+		UserID:    u.ID,
+		Kind:      db.SessionBrowser,
+		CreatedAt: now,
+		ExpiresAt: now.Add(a.SessionTTL),
+	}
+	if err := s.CreateSession(session); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// SessionMiddleware attaches the user of a valid session cookie to the request context
+func (a *App) SessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(sessionCookieName)
+		s, ok := a.sessions()
+		if err != nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session, err := s.Session(hashToken(c.Value))
+		if err != nil || session.Kind != db.SessionBrowser {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, err := s.UserByID(session.UserID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to load session user", "user_id", session.UserID, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u.Banned {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withUser(r.Context(), u)))
+	})
+}
+
+// RequireLogin redirects to the login page unless the request has an authenticated user
+func RequireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if UserFromContext(r.Context()) == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type AuthTemplateData struct {
+	PageTitle string
+	Action    string
+	Email     string
+	CSRFToken string
+	// SSO offers logging in with the identity provider
+	SSO bool
+	Err string
+}
+
+func renderAuthPage(w http.ResponseWriter, r *http.Request, status int, data *AuthTemplateData) {
+	data.CSRFToken = csrfToken(w, r)
+	w.Header().Set(ContentType, "text/html")
+	t, err := template.New("auth.html").ParseFiles("templates/auth.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	if err := t.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+	}
+}
+
+// LoginPageHandler serves the login form
+func (a *App) LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderAuthPage(w, r, http.StatusOK, &AuthTemplateData{PageTitle: "Log in", Action: "/login", SSO: a.OIDC != nil})
+}
+
+// SignupPageHandler serves the registration form
+func (a *App) SignupPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderAuthPage(w, r, http.StatusOK, &AuthTemplateData{PageTitle: "Sign up", Action: "/signup", SSO: a.OIDC != nil})
+}
+
+// SignupHandler registers a new user from the signup form and logs them in
+func (a *App) SignupHandler(w http.ResponseWriter, r *http.Request) {
+	data := &AuthTemplateData{PageTitle: "Sign up", Action: "/signup", SSO: a.OIDC != nil}
+	s, ok := a.sessions()
+	if !ok {
+		data.Err = "sign up is not available"
+		renderAuthPage(w, r, http.StatusNotImplemented, data)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		data.Err = err.Error()
+		renderAuthPage(w, r, http.StatusBadRequest, data)
+		return
+	}
+	data.Email = strings.TrimSpace(r.PostForm.Get("email"))
+	password := r.PostForm.Get("password")
+	if msg := validateCredentials(data.Email, password); msg != "" {
+		data.Err = msg
+		renderAuthPage(w, r, http.StatusBadRequest, data)
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		data.Err = "something went wrong"
+		renderAuthPage(w, r, http.StatusInternalServerError, data)
+		return
+	}
+	u, err := s.CreateUser(data.Email, hash)
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrExists:
+			data.Err = "an account with that email already exists"
+			renderAuthPage(w, r, http.StatusConflict, data)
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			data.Err = "something went wrong"
+			renderAuthPage(w, r, http.StatusInternalServerError, data)
+		}
+		return
+	}
+	slog.InfoContext(r.Context(), "registered user", "user_id", u.ID)
+	a.audit(r, AuditUserCreate, u.ID, nil, u)
+	a.sendVerification(r.Context(), u)
+
+	if err := a.startSession(w, u); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		data.Err = "something went wrong"
+		renderAuthPage(w, r, http.StatusInternalServerError, data)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// LoginHandler checks the credentials from the login form and starts a session
+func (a *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	data := &AuthTemplateData{PageTitle: "Log in", Action: "/login", SSO: a.OIDC != nil}
+	if err := r.ParseForm(); err != nil {
+		data.Err = err.Error()
+		renderAuthPage(w, r, http.StatusBadRequest, data)
+		return
+	}
+	data.Email = strings.TrimSpace(r.PostForm.Get("email"))
+
+	u, err := a.authenticate(data.Email, r.PostForm.Get("password"))
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrNotFound:
+			// don't reveal whether it was the email or password that was wrong
+			data.Err = "incorrect email or password"
+			renderAuthPage(w, r, http.StatusUnauthorized, data)
+		case *ErrBanned:
+			data.Err = err.Error()
+			renderAuthPage(w, r, http.StatusForbidden, data)
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			data.Err = "something went wrong"
+			renderAuthPage(w, r, http.StatusInternalServerError, data)
+		}
+		return
+	}
+
+	if err := a.startSession(w, u); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		data.Err = "something went wrong"
+		renderAuthPage(w, r, http.StatusInternalServerError, data)
+		return
+	}
+	slog.InfoContext(r.Context(), "user logged in", "user_id", u.ID)
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// LogoutHandler ends the current session and clears the cookie
+func (a *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if s, ok := a.sessions(); ok {
+			if err := s.DeleteSession(hashToken(c.Value)); err != nil {
+				slog.ErrorContext(r.Context(), "request error", "error", err)
+			}
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
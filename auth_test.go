@@ -0,0 +1,134 @@
+package shortly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	bcryptCost = bcrypt.MinCost
+}
+
+const testCSRFToken = "csrf-test-token"
+
+// postForm submits form with a valid csrf token
+func postForm(app *App, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set(csrfFieldName, testCSRFToken)
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set(ContentType, "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// addCSRF gives a json request a valid csrf token
+func addCSRF(req *http.Request) {
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeader, testCSRFToken)
+}
+
+func sessionCookie(rr *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSignupLoginLogout(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+
+	creds := url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}}
+
+	rr := postForm(app, "/signup", url.Values{"email": {"not an email"}, "password": {"hunter22"}})
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"short"}})
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	// signup logs the user in
+	rr = postForm(app, "/signup", creds)
+	a.Equal(http.StatusSeeOther, rr.Code)
+	c := sessionCookie(rr)
+	a.NotNil(c)
+	a.True(c.HttpOnly)
+	a.True(c.Secure)
+	a.Equal(http.SameSiteStrictMode, c.SameSite)
+
+	u, err := store.UserByEmail("cat@foobarcat.com")
+	a.NoError(err)
+	a.NotEqual("hunter22", u.PasswordHash)
+	_, exists := store.Sessions[c.Value]
+	a.False(exists, "sessions are stored hashed")
+
+	rr = postForm(app, "/signup", creds)
+	a.Equal(http.StatusConflict, rr.Code)
+
+	rr = postForm(app, "/login", url.Values{"email": {"cat@foobarcat.com"}, "password": {"wrong"}})
+	a.Equal(http.StatusUnauthorized, rr.Code)
+	a.Nil(sessionCookie(rr))
+
+	rr = postForm(app, "/login", url.Values{"email": {"CAT@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusSeeOther, rr.Code)
+	c = sessionCookie(rr)
+	a.NotNil(c)
+
+	// the middleware attaches the user to the request
+	var seen *db.User
+	handler := app.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = UserFromContext(r.Context())
+	}))
+	req, err := http.NewRequest("GET", "/", nil)
+	a.NoError(err)
+	req.AddCookie(c)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	a.NotNil(seen)
+	a.Equal(u.ID, seen.ID)
+
+	rr = postForm(app, "/logout", nil, c)
+	a.Equal(http.StatusSeeOther, rr.Code)
+	a.Equal("", sessionCookie(rr).Value)
+	seen = nil
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	a.Nil(seen)
+}
+
+func TestExpiredSession(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.SessionTTL = -1
+	app.Init(db.NewMapDB(), "8080")
+
+	rr := postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusSeeOther, rr.Code)
+
+	var seen *db.User
+	handler := app.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = UserFromContext(r.Context())
+	}))
+	req, err := http.NewRequest("GET", "/", nil)
+	a.NoError(err)
+	req.AddCookie(sessionCookie(rr))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	a.Nil(seen)
+}
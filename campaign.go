@@ -0,0 +1,78 @@
+package shortly
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/aultimus/shortly/db"
+)
+
+// CampaignTemplates maps a template name to the parameters it tags links with e.g.
+// {"newsletter": {"utm_source": "newsletter", "utm_medium": "email"}}
+type CampaignTemplates map[string]map[string]string
+
+// LoadCampaignTemplates reads CampaignTemplates from a json file
+func LoadCampaignTemplates(path string) (CampaignTemplates, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	templates := CampaignTemplates{}
+	if err := json.Unmarshal(b, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse campaign templates %s: %w", path, err)
+	}
+	return templates, nil
+}
+
+type ErrUnknownCampaign struct {
+	db.ErrBase
+}
+
+func NewErrUnknownCampaign(message string) *ErrUnknownCampaign {
+	return &ErrUnknownCampaign{
+		ErrBase: db.ErrBase{Message: message},
+	}
+}
+
+// resolveCampaign returns the url encoded campaign parameters for req. Parameters given explicitly
+// override those of the named template. Encoding sorts by key so equal campaigns encode identically.
+func (a *App) resolveCampaign(req *CreateRequest) (string, error) {
+	params := url.Values{}
+	if req.CampaignTemplate != "" {
+		template, exists := a.Campaigns[req.CampaignTemplate]
+		if !exists {
+			return "", NewErrUnknownCampaign(fmt.Sprintf("unknown campaign template %s", req.CampaignTemplate))
+		}
+		for k, v := range template {
+			params.Set(k, v)
+		}
+	}
+	for k, v := range req.Campaign {
+		params.Set(k, v)
+	}
+	return params.Encode(), nil
+}
+
+// ApplyCampaign merges the url encoded campaign parameters into the query of originalURL, campaign
+// values replacing any of the same name already present
+func ApplyCampaign(originalURL string, campaign string) (string, error) {
+	if campaign == "" {
+		return originalURL, nil
+	}
+	params, err := url.ParseQuery(campaign)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(originalURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,248 @@
+package shortly
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+)
+
+const (
+	defaultClickQueueSize     = 10000
+	defaultClickWorkers       = 2
+	defaultClickBatchSize     = 500
+	defaultClickFlushInterval = time.Second
+	// maxClickHeaderLen truncates referrers and user agents, which clients can make arbitrarily long
+	maxClickHeaderLen = 512
+)
+
+// ClickTrackerConfig sizes the click pipeline, zero fields take the defaults
+type ClickTrackerConfig struct {
+	// QueueSize is how many clicks may wait to be written, clicks beyond it are dropped
+	QueueSize int
+	Workers   int
+	// BatchSize is the most clicks written at once, smaller batches are written every FlushInterval
+	BatchSize     int
+	FlushInterval time.Duration
+	// Salt is mixed into client ips before hashing, a random salt is used when empty
+	Salt []byte
+	// UserAgents classifies the user agents of clicks, defaults to DefaultUARules
+	UserAgents *UAClassifier
+	// GeoIP locates clicks when set
+	GeoIP *GeoIP
+	// DropIPs stops clicks keeping even a hash of the client's ip
+	DropIPs bool
+	// OnWrite is called by workers with each batch they write, which is reused once it returns
+	OnWrite func(clicks []*db.Click)
+}
+
+// ClickStats are the counters of a ClickTracker
+type ClickStats struct {
+	// Queued is how many clicks are waiting to be written
+	Queued int `json:"queued"`
+	// Overflowed counts clicks dropped because the queue was full
+	Overflowed uint64 `json:"overflowed"`
+	// Dropped counts clicks lost because the store failed to write their batch
+	Dropped uint64 `json:"dropped"`
+	Written uint64 `json:"written"`
+}
+
+// ClickTracker records clicks in the background. Redirects only ever add to a bounded queue, which
+// workers drain in batches, so a slow or failing store costs clicks rather than slowing redirects.
+type ClickTracker struct {
+	store    db.ClickRecorder
+	queue    chan *db.Click
+	batch    int
+	interval time.Duration
+	salt     []byte
+	agents   *UAClassifier
+	geo      *GeoIP
+	dropIPs  bool
+	onWrite  func(clicks []*db.Click)
+	wg       sync.WaitGroup
+
+	// mu guards closed so that Track never sends on the closed queue
+	mu     sync.RWMutex
+	closed bool
+
+	overflowed uint64
+	dropped    uint64
+	written    uint64
+}
+
+// NewClickTracker starts the workers of a tracker writing to store, Close stops them
+func NewClickTracker(store db.ClickRecorder, conf ClickTrackerConfig) *ClickTracker {
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = defaultClickQueueSize
+	}
+	if conf.Workers <= 0 {
+		conf.Workers = defaultClickWorkers
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultClickBatchSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = defaultClickFlushInterval
+	}
+	if conf.UserAgents == nil {
+		conf.UserAgents = NewUAClassifier(nil)
+	}
+	if len(conf.Salt) == 0 {
+		conf.Salt = make([]byte, 32)
+		if _, err := rand.Read(conf.Salt); err != nil {
+			panic(err)
+		}
+	}
+	t := &ClickTracker{
+		store:    store,
+		queue:    make(chan *db.Click, conf.QueueSize),
+		batch:    conf.BatchSize,
+		interval: conf.FlushInterval,
+		salt:     conf.Salt,
+		agents:   conf.UserAgents,
+		geo:      conf.GeoIP,
+		dropIPs:  conf.DropIPs,
+		onWrite:  conf.OnWrite,
+	}
+	t.wg.Add(conf.Workers)
+	for i := 0; i < conf.Workers; i++ {
+		go t.work()
+	}
+	return t
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// HashIP hashes ip with the tracker's salt so that clicks from the same client can be told apart
+// without keeping their address
+func (t *ClickTracker) HashIP(ip string) string {
+	h := sha256.New()
+	h.Write(t.salt)
+	h.Write([]byte(ip))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Track queues a click on key made by r, it never blocks. Clicks are enriched by the workers.
+func (t *ClickTracker) Track(r *http.Request, key string) {
+	c := &db.Click{
+		Key:       key,
+		ClickedAt: time.Now().UTC(),
+		Referrer:  truncate(r.Referer(), maxClickHeaderLen),
+		UserAgent: truncate(r.UserAgent(), maxClickHeaderLen),
+		IP:        clientIP(r),
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- c:
+	default:
+		atomic.AddUint64(&t.overflowed, 1)
+	}
+}
+
+func (t *ClickTracker) work() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	batch := make([]*db.Click, 0, t.batch)
+	for {
+		select {
+		case c, ok := <-t.queue:
+			if !ok {
+				t.flush(batch)
+				return
+			}
+			t.enrich(c)
+			batch = append(batch, c)
+			if len(batch) >= t.batch {
+				batch = t.flush(batch)
+			}
+		case <-ticker.C:
+			batch = t.flush(batch)
+		}
+	}
+}
+
+// enrich classifies c's user agent and locates and hashes its ip, which is then forgotten
+func (t *ClickTracker) enrich(c *db.Click) {
+	ua := t.agents.Classify(c.UserAgent)
+	c.Browser, c.OS, c.Device, c.Bot = ua.Browser, ua.OS, ua.Device, ua.Bot
+	if t.geo != nil {
+		loc := t.geo.Lookup(c.IP)
+		c.Country, c.City = loc.Country, loc.City
+	}
+	if !t.dropIPs {
+		c.IPHash = t.HashIP(c.IP)
+	}
+	c.IP = ""
+}
+
+// flush writes batch, returning it emptied for reuse
+func (t *ClickTracker) flush(batch []*db.Click) []*db.Click {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := t.store.RecordClicks(batch); err != nil {
+		slog.Error("dropped clicks", "clicks", len(batch), "error", err)
+		atomic.AddUint64(&t.dropped, uint64(len(batch)))
+	} else {
+		atomic.AddUint64(&t.written, uint64(len(batch)))
+		if t.onWrite != nil {
+			t.onWrite(batch)
+		}
+	}
+	return batch[:0]
+}
+
+// Stats returns the tracker's counters
+func (t *ClickTracker) Stats() *ClickStats {
+	return &ClickStats{
+		Queued:     len(t.queue),
+		Overflowed: atomic.LoadUint64(&t.overflowed),
+		Dropped:    atomic.LoadUint64(&t.dropped),
+		Written:    atomic.LoadUint64(&t.written),
+	}
+}
+
+// Close stops accepting clicks and waits for the queued ones to be written
+func (t *ClickTracker) Close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+type ClickStatsResponse struct {
+	Stats *ClickStats `json:"stats,omitempty"`
+	Err   string      `json:"error"`
+}
+
+// ClickStatsHandler reports the health of the click pipeline
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/admin/clicks
+func (a *App) ClickStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Clicks == nil {
+		writeJSON(w, http.StatusNotImplemented, &ClickStatsResponse{Err: "store does not record clicks"})
+		return
+	}
+	writeJSON(w, http.StatusOK, &ClickStatsResponse{Stats: a.Clicks.Stats()})
+}
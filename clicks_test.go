@@ -0,0 +1,107 @@
+package shortly
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClickTracking(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	catUser, _ := store.UserByEmail("cat@foobarcat.com")
+	a.NoError(store.SetAdmin(catUser.ID, true))
+	a.NoError(store.Create("7RxfRd", &db.StoredURL{OriginalURL: "http://foobarcat.blogspot.com"}))
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/7RxfRd", nil)
+		req.Header.Set("Referer", "http://news.example.com")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:126.0) Gecko/20100101 Firefox/126.0")
+		req.RemoteAddr = "203.0.113.7:5555"
+		app.server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// unknown links aren't clicks, bots are but aren't counted
+	getPage(app, "/nothere")
+	req, _ := http.NewRequest("GET", "/7RxfRd", nil)
+	req.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+	app.server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := apiRequest(app, "GET", "/api/v1/admin/clicks", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	app.Clicks.Close()
+
+	a.Len(store.Clicks, 4)
+	// workers write in no particular order
+	var people []*db.Click
+	for _, c := range store.Clicks {
+		if c.Bot {
+			a.Equal("Slack", c.Browser)
+		} else {
+			people = append(people, c)
+		}
+	}
+	a.Len(people, 3)
+	c := people[0]
+	a.Equal("7RxfRd", c.Key)
+	a.Equal("http://news.example.com", c.Referrer)
+	a.Equal("Firefox", c.Browser)
+	a.Equal("Linux", c.OS)
+	a.Equal(DeviceDesktop, c.Device)
+	a.NotContains(c.IPHash, "203.0.113.7")
+	a.Equal(c.IPHash, people[1].IPHash)
+	a.Equal(uint64(4), app.Clicks.Stats().Written)
+
+	counts, err := store.ClickCounts([]string{"7RxfRd"})
+	a.NoError(err)
+	a.Equal(int64(3), counts["7RxfRd"])
+
+	// closed trackers ignore clicks
+	getPage(app, "/7RxfRd")
+	a.Len(store.Clicks, 4)
+}
+
+// blockingRecorder holds up the workers until release is closed, then fails every batch
+type blockingRecorder struct {
+	release chan struct{}
+}
+
+func (b *blockingRecorder) RecordClicks(clicks []*db.Click) error {
+	<-b.release
+	return errors.New("database is down")
+}
+
+func TestClickOverflow(t *testing.T) {
+	a := assert.New(t)
+
+	rec := &blockingRecorder{release: make(chan struct{})}
+	tracker := NewClickTracker(rec, ClickTrackerConfig{QueueSize: 2, Workers: 1, BatchSize: 1})
+	req, _ := http.NewRequest("GET", "/7RxfRd", nil)
+	// the worker takes one click and blocks writing it, two more fill the queue
+	tracker.Track(req, "7RxfRd")
+	a.Eventually(func() bool { return tracker.Stats().Queued == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 4; i++ {
+		tracker.Track(req, "7RxfRd")
+	}
+	stats := tracker.Stats()
+	a.Equal(2, stats.Queued)
+	a.Equal(uint64(2), stats.Overflowed)
+
+	close(rec.release)
+	tracker.Close()
+	stats = tracker.Stats()
+	a.Equal(uint64(3), stats.Dropped)
+	a.Equal(uint64(0), stats.Written)
+
+	b, _ := json.Marshal(stats)
+	a.Contains(string(b), `"overflowed":2`)
+}
@@ -0,0 +1,101 @@
+package shortly
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+// ParseTrustedProxies parses a comma separated list of ips and cidr ranges
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy %s", p)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %s: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trusted(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveClientIP returns the address of the client behind any trusted proxies. X-Forwarded-For is
+// read from the right, each trusted proxy having appended the address it received the request from,
+// and the first address not trusted is the client. Anything further left could have been made up by
+// the client.
+func resolveClientIP(r *http.Request, proxies []*net.IPNet) string {
+	addr := remoteHost(r)
+	if !trusted(proxies, addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values(forwardedForHeader), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+		if !trusted(proxies, hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// ClientIPMiddleware works out the address of the client, trusting X-Forwarded-For only when it was
+// set by one of a.TrustedProxies
+func (a *App) ClientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, a.TrustedProxies)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPContextKey, ip)))
+	})
+}
+
+// clientIP returns the address the request came from
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
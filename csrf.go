@@ -0,0 +1,57 @@
+package shortly
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfFieldName  = "csrf_token"
+	// csrfHeader carries the token for json requests, which have no form to put it in
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the token html forms must submit, setting the csrf cookie if the client doesn't
+// have one yet. This is the double submit pattern: a cross site form can't read our cookie so it
+// can't submit a matching field.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token := newToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// validCSRF reports whether the form submitted with r, or its X-CSRF-Token header, carries the
+// token from the csrf cookie
+func validCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	field := r.PostFormValue(csrfFieldName)
+	if field == "" {
+		field = r.Header.Get(csrfHeader)
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(field)) == 1
+}
+
+// RequireCSRF rejects form posts and json requests without a valid csrf token
+func RequireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validCSRF(r) {
+			http.Error(w, "invalid csrf token, please reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
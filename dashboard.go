@@ -0,0 +1,275 @@
+package shortly
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+type DashboardURL struct {
+	ID          string
+	ShortURL    string
+	OriginalURL string
+	CreatedAt   time.Time
+	// Clicks is -1 when the store doesn't count clicks
+	Clicks int64
+}
+
+type DashboardTemplateData struct {
+	PageTitle string
+	User      *db.User
+	URLs      []*DashboardURL
+	Total     int
+	Query     string
+	Sort      string
+	// PrevPage and NextPage are query strings for the neighbouring pages, empty if there is none
+	PrevPage  string
+	NextPage  string
+	APIKeys   []*db.APIKey
+	Scopes    []string
+	NewKey    string
+	CSRFToken string
+	Msg       string
+	Err       string
+}
+
+// renderDashboard lists the user's urls according to the query string of r and renders the
+// dashboard, with data's message, error or new key filled in by the caller
+func (a *App) renderDashboard(w http.ResponseWriter, r *http.Request, status int, data *DashboardTemplateData) {
+	u := UserFromContext(r.Context())
+	data.PageTitle = "Dashboard"
+	data.User = u
+	data.Scopes = allScopes
+	data.CSRFToken = csrfToken(w, r)
+
+	q, msg := parseListQuery(r)
+	if msg != "" {
+		q = defaultListQuery()
+		data.Err = msg
+		status = http.StatusBadRequest
+	}
+	data.Query = q.Filter
+	data.Sort = r.URL.Query().Get("sort")
+
+	if o, ok := a.store.(db.Owner); ok {
+		urls, total, err := o.ListByUser(u.ID, q)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			data.Err = "failed to load your urls"
+			status = http.StatusInternalServerError
+		}
+		data.Total = total
+		data.URLs = a.dashboardURLs(r.Context(), urls)
+		page := func(offset int) string {
+			v := url.Values{"offset": {strconv.Itoa(offset)}, "q": {q.Filter}, "sort": {data.Sort}}
+			return v.Encode()
+		}
+		if q.Offset > 0 {
+			prev := q.Offset - q.Limit
+			if prev < 0 {
+				prev = 0
+			}
+			data.PrevPage = page(prev)
+		}
+		if q.Offset+len(urls) < total {
+			data.NextPage = page(q.Offset + len(urls))
+		}
+	}
+
+	if s, ok := a.store.(db.APIKeyStore); ok {
+		keys, err := s.APIKeysByUser(u.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+		}
+		data.APIKeys = keys
+	}
+
+	w.Header().Set(ContentType, "text/html")
+	t, err := template.New("dashboard.html").ParseFiles("templates/dashboard.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	if err := t.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+	}
+}
+
+// dashboardURLs adds short urls and click counts to urls
+func (a *App) dashboardURLs(ctx context.Context, urls []*db.ListedURL) []*DashboardURL {
+	var counts map[string]int64
+	if c, ok := a.store.(db.ClickCounter); ok {
+		keys := make([]string, len(urls))
+		for i, u := range urls {
+			keys[i] = u.ID
+		}
+		var err error
+		if counts, err = c.ClickCounts(keys); err != nil {
+			slog.ErrorContext(ctx, "failed to count clicks", "error", err)
+		}
+	}
+
+	out := make([]*DashboardURL, len(urls))
+	for i, u := range urls {
+		out[i] = &DashboardURL{
+			ID:          u.ID,
+			ShortURL:    domainName + "/" + u.ID,
+			OriginalURL: u.OriginalURL,
+			CreatedAt:   u.CreatedAt,
+			Clicks:      -1,
+		}
+		if counts != nil {
+			out[i].Clicks = counts[u.ID]
+		}
+	}
+	return out
+}
+
+// DashboardHandler is the logged in user's main page
+func (a *App) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderDashboard(w, r, http.StatusOK, &DashboardTemplateData{})
+}
+
+// DashboardCreateHandler creates a url owned by the user from the dashboard form
+func (a *App) DashboardCreateHandler(w http.ResponseWriter, r *http.Request) {
+	originalURL := strings.TrimSpace(r.PostFormValue("url"))
+	if originalURL == "" {
+		a.renderDashboard(w, r, http.StatusBadRequest, &DashboardTemplateData{Err: "enter a url to shorten"})
+		return
+	}
+	originalURL, err := EnsurePrefix(originalURL)
+	if err != nil {
+		a.renderDashboard(w, r, http.StatusBadRequest, &DashboardTemplateData{Err: err.Error()})
+		return
+	}
+	req := &CreateRequest{OriginalURL: originalURL, UserID: UserFromContext(r.Context()).ID}
+	shortenedURL, created, err := a.Create(r.Context(), req, &MD5Hash{})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		a.renderDashboard(w, r, http.StatusInternalServerError, &DashboardTemplateData{Err: "failed to shorten url"})
+		return
+	}
+	if created {
+		a.auditURLChange(r, AuditURLCreate, shortenedURL, nil)
+		a.emitURLEvent(r.Context(), db.EventURLCreated, shortenedURL, nil)
+	}
+	a.renderDashboard(w, r, http.StatusOK, &DashboardTemplateData{
+		Msg: "Shortened " + originalURL + " to " + domainName + "/" + shortenedURL})
+}
+
+// dashboardManagedURL checks the user may manage the url named in the path, rendering an error if not
+func (a *App) dashboardManagedURL(w http.ResponseWriter, r *http.Request) (string, *db.StoredURL, bool) {
+	key := mux.Vars(r)["url"]
+	storedURL, err := a.urls(r.Context()).Get(key)
+	if err != nil {
+		a.renderDashboard(w, r, statusForErr(err), &DashboardTemplateData{Err: err.Error()})
+		return "", nil, false
+	}
+	if !a.canAccess(r.Context(), UserFromContext(r.Context()), storedURL, db.RoleEditor) {
+		a.renderDashboard(w, r, http.StatusForbidden, &DashboardTemplateData{Err: "you can't manage " + key})
+		return "", nil, false
+	}
+	return key, storedURL, true
+}
+
+// DashboardEditHandler changes the destination of one of the user's urls
+func (a *App) DashboardEditHandler(w http.ResponseWriter, r *http.Request) {
+	key, storedURL, ok := a.dashboardManagedURL(w, r)
+	if !ok {
+		return
+	}
+	before := urlSnapshot(storedURL)
+	rv, ok := a.store.(db.Reviser)
+	if !ok {
+		a.renderDashboard(w, r, http.StatusNotImplemented, &DashboardTemplateData{Err: "urls can't be edited"})
+		return
+	}
+	originalURL := strings.TrimSpace(r.PostFormValue("url"))
+	if originalURL == "" {
+		a.renderDashboard(w, r, http.StatusBadRequest, &DashboardTemplateData{Err: "enter a url"})
+		return
+	}
+	originalURL, err := EnsurePrefix(originalURL)
+	if err != nil {
+		a.renderDashboard(w, r, http.StatusBadRequest, &DashboardTemplateData{Err: err.Error()})
+		return
+	}
+	if _, err := rv.Update(key, originalURL, requestActor(r)); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		a.renderDashboard(w, r, statusForErr(err), &DashboardTemplateData{Err: "failed to update " + key})
+		return
+	}
+	a.auditURLChange(r, AuditURLUpdate, key, before)
+	a.renderDashboard(w, r, http.StatusOK, &DashboardTemplateData{Msg: "Updated " + key})
+}
+
+// DashboardDeleteHandler deletes one of the user's urls
+func (a *App) DashboardDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, storedURL, ok := a.dashboardManagedURL(w, r)
+	if !ok {
+		return
+	}
+	o, ok := a.store.(db.Owner)
+	if !ok {
+		a.renderDashboard(w, r, http.StatusNotImplemented, &DashboardTemplateData{Err: "urls can't be deleted"})
+		return
+	}
+	if err := o.Delete(key); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		a.renderDashboard(w, r, statusForErr(err), &DashboardTemplateData{Err: "failed to delete " + key})
+		return
+	}
+	a.audit(r, AuditURLDelete, key, urlSnapshot(storedURL), nil)
+	a.emitURLEvent(r.Context(), db.EventURLDeleted, key, storedURL)
+	a.renderDashboard(w, r, http.StatusOK, &DashboardTemplateData{Msg: "Deleted " + key})
+}
+
+// DashboardCreateKeyHandler creates an api key, showing it to the user this one time only
+func (a *App) DashboardCreateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	req := &CreateAPIKeyRequest{Name: r.PostFormValue("name"), Scopes: r.PostForm["scopes"]}
+	if days := r.PostFormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			a.renderDashboard(w, r, http.StatusBadRequest, &DashboardTemplateData{Err: "expiry must be a number of days"})
+			return
+		}
+		req.ExpiresIn = n * 24 * 60 * 60
+	}
+	if msg := validateAPIKeyRequest(req); msg != "" {
+		a.renderDashboard(w, r, http.StatusBadRequest, &DashboardTemplateData{Err: msg})
+		return
+	}
+	_, key, err := a.newAPIKey(r, req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		a.renderDashboard(w, r, statusForErr(err), &DashboardTemplateData{Err: "failed to create api key"})
+		return
+	}
+	a.renderDashboard(w, r, http.StatusOK, &DashboardTemplateData{NewKey: key})
+}
+
+// DashboardRevokeKeyHandler revokes one of the user's api keys
+func (a *App) DashboardRevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.store.(db.APIKeyStore)
+	if !ok {
+		a.renderDashboard(w, r, http.StatusNotImplemented, &DashboardTemplateData{Err: "api keys are not supported"})
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := s.RevokeAPIKey(UserFromContext(r.Context()).ID, id); err != nil {
+		a.renderDashboard(w, r, statusForErr(err), &DashboardTemplateData{Err: err.Error()})
+		return
+	}
+	a.audit(r, AuditAPIKeyRevoke, id, nil, nil)
+	a.renderDashboard(w, r, http.StatusOK, &DashboardTemplateData{Msg: "Revoked api key"})
+}
@@ -0,0 +1,130 @@
+package shortly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getPage(app *App, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestDashboard(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+
+	rr := getPage(app, "/dashboard")
+	a.Equal(http.StatusSeeOther, rr.Code)
+	a.Equal("/login", rr.Header().Get("Location"))
+
+	rr = postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal("/dashboard", rr.Header().Get("Location"))
+	c := sessionCookie(rr)
+
+	rr = getPage(app, "/dashboard", c)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), "cat@foobarcat.com")
+	a.Contains(rr.Body.String(), "No urls yet")
+
+	rr = postForm(app, "/dashboard/urls", url.Values{"url": {"foobarcat.blogspot.com"}}, c)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), "http://foobarcat.blogspot.com")
+
+	owner, err := store.UserByEmail("cat@foobarcat.com")
+	a.NoError(err)
+	urls, total, err := store.ListByUser(owner.ID, defaultListQuery())
+	a.NoError(err)
+	a.Equal(1, total)
+	key := urls[0].ID
+
+	rr = postForm(app, "/dashboard/urls/"+key+"/edit", url.Values{"url": {"http://www.google.com"}}, c)
+	a.Equal(http.StatusOK, rr.Code)
+	stored, err := store.Get(key)
+	a.NoError(err)
+	a.Equal("http://www.google.com", stored.OriginalURL)
+	revs, err := store.Revisions(key)
+	a.NoError(err)
+	a.Equal(owner.ID, revs[0].ChangedBy)
+
+	// other users can't edit or delete it
+	rr = postForm(app, "/signup", url.Values{"email": {"dog@foobarcat.com"}, "password": {"hunter22"}})
+	other := sessionCookie(rr)
+	rr = postForm(app, "/dashboard/urls/"+key+"/delete", nil, other)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	rr = postForm(app, "/dashboard/keys", url.Values{"name": {"ci"}, "scopes": {"read", "create"}}, c)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), apiKeyPrefix)
+	keys, err := store.APIKeysByUser(owner.ID)
+	a.NoError(err)
+	a.Len(keys, 1)
+	rr = postForm(app, "/dashboard/keys/"+keys[0].ID+"/revoke", nil, c)
+	a.Equal(http.StatusOK, rr.Code)
+	keys, err = store.APIKeysByUser(owner.ID)
+	a.NoError(err)
+	a.Len(keys, 0)
+
+	rr = postForm(app, "/dashboard/urls/"+key+"/delete", nil, c)
+	a.Equal(http.StatusOK, rr.Code)
+	_, err = store.Get(key)
+	a.Error(err)
+}
+
+func TestCSRF(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+
+	rr := postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	c := sessionCookie(rr)
+
+	// forms render the token from the csrf cookie, setting one if needed
+	rr = getPage(app, "/login")
+	a.Equal(http.StatusOK, rr.Code)
+	var csrf *http.Cookie
+	for _, rc := range rr.Result().Cookies() {
+		if rc.Name == csrfCookieName {
+			csrf = rc
+		}
+	}
+	a.NotNil(csrf)
+	a.Contains(rr.Body.String(), `value="`+csrf.Value+`"`)
+
+	// posts without a matching token are rejected
+	form := url.Values{"url": {"http://www.google.com"}, csrfFieldName: {"forged"}}
+	req, err := http.NewRequest("POST", "/dashboard/urls", strings.NewReader(form.Encode()))
+	a.NoError(err)
+	req.Header.Set(ContentType, "application/x-www-form-urlencoded")
+	req.AddCookie(c)
+	req.AddCookie(csrf)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	form.Set(csrfFieldName, csrf.Value)
+	req, err = http.NewRequest("POST", "/dashboard/urls", strings.NewReader(form.Encode()))
+	a.NoError(err)
+	req.Header.Set(ContentType, "application/x-www-form-urlencoded")
+	req.AddCookie(c)
+	req.AddCookie(csrf)
+	rr = httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// APIKey lets scripts act as a user with a limited set of scopes. Only a hash of the key is
+// stored, Prefix is kept so users can tell their keys apart.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// APIKeyStore is implemented by stores that hold api keys
+type APIKeyStore interface {
+	CreateAPIKey(k *APIKey) error
+	APIKeysByUser(userID string) ([]*APIKey, error)
+	// APIKeyByHash returns ErrNotFound for unknown and expired keys
+	APIKeyByHash(hash string) (*APIKey, error)
+	// RevokeAPIKey deletes the key with the given id if it belongs to userID
+	RevokeAPIKey(userID string, id string) error
+	TouchAPIKey(id string, usedAt time.Time) error
+}
+
+func (m *MapDB) CreateAPIKey(k *APIKey) error {
+	if k.ID == "" {
+		k.ID = NewID()
+	}
+	m.APIKeys[k.ID] = k
+	return nil
+}
+
+func (m *MapDB) APIKeysByUser(userID string) ([]*APIKey, error) {
+	keys := []*APIKey{}
+	for _, k := range m.APIKeys {
+		if k.UserID == userID {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (m *MapDB) APIKeyByHash(hash string) (*APIKey, error) {
+	for _, k := range m.APIKeys {
+		if k.Hash == hash && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now())) {
+			return k, nil
+		}
+	}
+	return nil, NewErrNotFound("api key does not exist in db")
+}
+
+func (m *MapDB) RevokeAPIKey(userID string, id string) error {
+	k, exists := m.APIKeys[id]
+	if !exists || k.UserID != userID {
+		return NewErrNotFound(fmt.Sprintf("api key %s does not exist in db", id))
+	}
+	delete(m.APIKeys, id)
+	return nil
+}
+
+func (m *MapDB) TouchAPIKey(id string, usedAt time.Time) error {
+	if k, exists := m.APIKeys[id]; exists {
+		k.LastUsedAt = &usedAt
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditEvent records a single change made through the app. Events are append only, stores offer no
+// way to change or remove them.
+type AuditEvent struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// ActorID is the user who made the change, empty for anonymous requests
+	ActorID string `json:"actor_id,omitempty"`
+	// Action is e.g. url.create or workspace.set_role
+	Action string `json:"action"`
+	// Target is the short code of the url, or the id of the user, workspace or key, acted on
+	Target string `json:"target"`
+	// Before and After are json snapshots of what changed, absent for creations and deletions
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+}
+
+// AuditFilter selects audit events, zero fields match everything
+type AuditFilter struct {
+	ActorID string
+	Action  string
+	Target  string
+	// Since is inclusive and Until exclusive
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+func (f *AuditFilter) match(e *AuditEvent) bool {
+	return (f.ActorID == "" || e.ActorID == f.ActorID) && (f.Action == "" || e.Action == f.Action) &&
+		(f.Target == "" || e.Target == f.Target) && (f.Since.IsZero() || !e.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || e.CreatedAt.Before(f.Until))
+}
+
+// Auditor is implemented by stores that keep an audit trail
+type Auditor interface {
+	RecordAuditEvent(e *AuditEvent) error
+	// AuditEvents returns a page of the events matching f, newest first, and how many match in total
+	AuditEvents(f *AuditFilter) ([]*AuditEvent, int, error)
+}
+
+func (m *MapDB) RecordAuditEvent(e *AuditEvent) error {
+	e.ID = NewID()
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	m.Audit = append(m.Audit, e)
+	return nil
+}
+
+func (m *MapDB) AuditEvents(f *AuditFilter) ([]*AuditEvent, int, error) {
+	events := []*AuditEvent{}
+	for i := len(m.Audit) - 1; i >= 0; i-- {
+		if f.match(m.Audit[i]) {
+			events = append(events, m.Audit[i])
+		}
+	}
+	return page(events, f.Offset, f.Limit), len(events), nil
+}
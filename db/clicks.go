@@ -0,0 +1,61 @@
+package db
+
+import (
+	"time"
+)
+
+// Click is a single redirect of a shortened url
+type Click struct {
+	// ID is given by the store, in the order clicks are recorded
+	ID        int64     `json:"id"`
+	Key       string    `json:"key"`
+	ClickedAt time.Time `json:"clicked_at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// IP is the client's ip, which is only held in memory until the click has been enriched
+	IP string `json:"-"`
+	// IPHash is a salted hash of the client's ip, raw ips are never stored
+	IPHash string `json:"ip_hash,omitempty"`
+	// Browser is the name of the bot for bots
+	Browser string `json:"browser,omitempty"`
+	OS      string `json:"os,omitempty"`
+	// Device is desktop, mobile, tablet or bot
+	Device string `json:"device,omitempty"`
+	// Bot clicks are kept but left out of counts unless asked for
+	Bot bool `json:"bot,omitempty"`
+	// Country is the ISO 3166 code of the client's country, when known
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+}
+
+// ClickRecorder is implemented by stores that record clicks on urls
+type ClickRecorder interface {
+	// RecordClicks stores a batch of clicks, either all of them or none
+	RecordClicks(clicks []*Click) error
+}
+
+func (m *MapDB) RecordClicks(clicks []*Click) error {
+	m.clicksMu.Lock()
+	defer m.clicksMu.Unlock()
+	for _, c := range clicks {
+		c.ID = int64(len(m.Clicks) + 1)
+		m.Clicks = append(m.Clicks, c)
+	}
+	return nil
+}
+
+// ClickCounts leaves out bots
+func (m *MapDB) ClickCounts(keys []string) (map[string]int64, error) {
+	m.clicksMu.Lock()
+	defer m.clicksMu.Unlock()
+	counts := make(map[string]int64, len(keys))
+	for _, k := range keys {
+		counts[k] = 0
+	}
+	for _, c := range m.Clicks {
+		if _, ok := counts[c.Key]; ok && !c.Bot {
+			counts[c.Key]++
+		}
+	}
+	return counts, nil
+}
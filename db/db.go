@@ -2,6 +2,10 @@ package db
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aultimus/shortly/hll"
 )
 
 type DBer interface {
@@ -11,6 +15,45 @@ type DBer interface {
 
 type StoredURL struct {
 	OriginalURL string `json:"original_string"`
+	// RedirectStatus is the http status used when redirecting, 0 means use the app default
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Passthrough links append any extra path and query of the request to OriginalURL
+	Passthrough bool `json:"passthrough,omitempty"`
+	// Campaign holds url encoded parameters merged into OriginalURL's query at redirect time
+	Campaign  string    `json:"campaign,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// UserID is the user that created the url, empty for anonymous links
+	UserID string `json:"user_id,omitempty"`
+	// WorkspaceID is the workspace that owns the url, if any. Workspace urls are managed by the
+	// workspace's members according to their role rather than by their creator.
+	WorkspaceID string `json:"workspace_id,omitempty"`
+	// DisabledStatus is set by a moderator to 451 or 410 to stop the url redirecting
+	DisabledStatus int    `json:"disabled_status,omitempty"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+}
+
+// SameLink reports whether s and o redirect to the same place in the same way, such that a create
+// request for o can be satisfied by the existing s
+func (s *StoredURL) SameLink(o *StoredURL) bool {
+	return s.OriginalURL == o.OriginalURL && s.RedirectStatus == o.RedirectStatus &&
+		s.Passthrough == o.Passthrough && s.Campaign == o.Campaign && s.UserID == o.UserID &&
+		s.WorkspaceID == o.WorkspaceID && s.DisabledStatus == o.DisabledStatus
+}
+
+// Revision records a single change of a shortened url's destination
+type Revision struct {
+	Number    int       `json:"revision"`
+	OldURL    string    `json:"old_url"`
+	NewURL    string    `json:"new_url"`
+	ChangedBy string    `json:"changed_by"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Reviser is implemented by stores that support editing the destination of an existing
+// shortened url. Every edit is recorded as a Revision, numbered from 1 per key.
+type Reviser interface {
+	Update(key string, newURL string, changedBy string) (*Revision, error)
+	Revisions(key string) ([]*Revision, error)
 }
 
 type ErrBase struct {
@@ -52,16 +95,48 @@ func NewErrNotFound(message string) error {
 }
 
 type MapDB struct {
-	M map[string]*StoredURL
+	M        map[string]*StoredURL
+	R        map[string][]*Revision
+	Users    map[string]*User
+	Sessions map[string]*Session
+	APIKeys  map[string]*APIKey
+	Tokens   map[string]*UserToken
+	// Identities maps an issuer and subject to a user id
+	Identities  map[string]string
+	Workspaces  map[string]*Workspace
+	Memberships map[string][]*Member
+	Invitations map[string]*Invitation
+	// AdminLog and Audit are oldest first
+	AdminLog []*AdminAction
+	Audit    []*AuditEvent
+	// Clicks are written by background workers and so, unlike the rest of MapDB, are guarded by
+	// clicksMu along with their rollups. Clicks before rolledUp have been rolled up.
+	Clicks   []*Click
+	clicksMu sync.Mutex
+	rolledUp int
+	hourly   map[rollupKey]int64
+	sketches map[sketchKey]*hll.Sketch
+	daily    map[dimKey]int64
+	// webhooks and their deliveries are also used by background workers, guarded by webhooksMu
+	webhooks   map[string]*Webhook
+	deliveries []*WebhookDelivery
+	webhooksMu sync.Mutex
+	// updated is when urls last changed, if since they were created, and deletions are tombstones
+	// of deleted urls, both for exports
+	updated   map[string]time.Time
+	deletions []*ExportedURL
 }
 
 func (m *MapDB) Create(key string, value *StoredURL) error {
 	stored, exists := m.M[key]
 	if exists {
-		if *stored == *value {
+		if stored.SameLink(value) {
 			return nil
 		}
 	}
+	if value.CreatedAt.IsZero() {
+		value.CreatedAt = time.Now().UTC()
+	}
 	m.M[key] = value
 	return nil
 }
@@ -75,8 +150,48 @@ func (m *MapDB) Get(key string) (*StoredURL, error) {
 	return value, err
 }
 
+func (m *MapDB) Update(key string, newURL string, changedBy string) (*Revision, error) {
+	stored, exists := m.M[key]
+	if !exists {
+		return nil, NewErrNotFound(fmt.Sprintf("key %s does not exist in db", key))
+	}
+	rev := &Revision{
+		Number:    len(m.R[key]) + 1,
+		OldURL:    stored.OriginalURL,
+		NewURL:    newURL,
+		ChangedBy: changedBy,
+		ChangedAt: time.Now().UTC(),
+	}
+	updated := *stored
+	updated.OriginalURL = newURL
+	m.M[key] = &updated
+	m.R[key] = append(m.R[key], rev)
+	m.touch(key)
+	return rev, nil
+}
+
+func (m *MapDB) Revisions(key string) ([]*Revision, error) {
+	if _, exists := m.M[key]; !exists {
+		return nil, NewErrNotFound(fmt.Sprintf("key %s does not exist in db", key))
+	}
+	return m.R[key], nil
+}
+
 func NewMapDB() *MapDB {
 	return &MapDB{
-		M: make(map[string]*StoredURL),
+		M:           make(map[string]*StoredURL),
+		R:           make(map[string][]*Revision),
+		Users:       make(map[string]*User),
+		Sessions:    make(map[string]*Session),
+		APIKeys:     make(map[string]*APIKey),
+		Tokens:      make(map[string]*UserToken),
+		Identities:  make(map[string]string),
+		Workspaces:  make(map[string]*Workspace),
+		Memberships: make(map[string][]*Member),
+		Invitations: make(map[string]*Invitation),
+		hourly:      make(map[rollupKey]int64),
+		sketches:    make(map[sketchKey]*hll.Sketch),
+		daily:       make(map[dimKey]int64),
+		webhooks:    make(map[string]*Webhook),
 	}
 }
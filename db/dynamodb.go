@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -31,12 +32,30 @@ func NewDynamoService() *DynamoService {
 
 type Item struct {
 	// slightly annoying that capitalisation is inconsistent amongst keys but no biggy!
-	Hash        string `json:"Hash"`
-	OriginalURL string `json:"original_url"`
+	Hash           string    `json:"Hash"`
+	OriginalURL    string    `json:"original_url"`
+	RedirectStatus int       `json:"redirect_status,omitempty"`
+	Passthrough    bool      `json:"passthrough,omitempty"`
+	Campaign       string    `json:"campaign,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UserID         string    `json:"user_id,omitempty"`
+	WorkspaceID    string    `json:"workspace_id,omitempty"`
 }
 
 func (d *DynamoService) Create(key string, data *StoredURL) error {
-	item := Item{key, data.OriginalURL}
+	item := Item{
+		Hash:           key,
+		OriginalURL:    data.OriginalURL,
+		RedirectStatus: data.RedirectStatus,
+		Passthrough:    data.Passthrough,
+		Campaign:       data.Campaign,
+		CreatedAt:      data.CreatedAt,
+		UserID:         data.UserID,
+		WorkspaceID:    data.WorkspaceID,
+	}
+	if item.CreatedAt.IsZero() {
+		item.CreatedAt = time.Now().UTC()
+	}
 
 	av, err := dynamodbattribute.MarshalMap(item)
 	if err != nil {
@@ -78,5 +97,13 @@ func (d *DynamoService) Get(key string) (*StoredURL, error) {
 		return nil, NewErrNotFound(fmt.Sprintf("could not find key %s", key))
 	}
 
-	return &StoredURL{item.OriginalURL}, nil
+	return &StoredURL{
+		OriginalURL:    item.OriginalURL,
+		RedirectStatus: item.RedirectStatus,
+		Passthrough:    item.Passthrough,
+		Campaign:       item.Campaign,
+		CreatedAt:      item.CreatedAt,
+		UserID:         item.UserID,
+		WorkspaceID:    item.WorkspaceID,
+	}, nil
 }
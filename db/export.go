@@ -0,0 +1,106 @@
+package db
+
+import (
+	"sort"
+	"time"
+)
+
+// ExportQuery selects the clicks or urls to export. Clicks are selected by id, after AfterID up to
+// and including UpToID, and by when they happened, urls by when they last changed. From is
+// inclusive and To exclusive, a zero To has no end.
+type ExportQuery struct {
+	From    time.Time
+	To      time.Time
+	AfterID int64
+	UpToID  int64
+}
+
+// ExportedURL is a url as it was when it last changed or, if Deleted, a tombstone holding only the
+// id and creation time of a url that has been deleted
+type ExportedURL struct {
+	ListedURL
+	// UpdatedAt is when the url was created, last changed or deleted
+	UpdatedAt time.Time `json:"updated_at"`
+	Deleted   bool      `json:"deleted"`
+}
+
+// Exporter is implemented by stores that can stream clicks and urls for export, clicks in order of
+// id and urls in order of when they last changed and then id. Rows are passed to fn one at a time
+// as they are read, so exports take constant memory however many rows there are. An error from fn
+// stops the export and is returned.
+type Exporter interface {
+	// LastClickID returns the id of the newest click. Clicks are given increasing ids as they are
+	// written, so no click written later has a lower id.
+	LastClickID() (int64, error)
+	ExportClicks(q *ExportQuery, fn func(*Click) error) error
+	ExportURLs(q *ExportQuery, fn func(*ExportedURL) error) error
+}
+
+func (q *ExportQuery) inRange(t time.Time) bool {
+	return !t.Before(q.From) && (q.To.IsZero() || t.Before(q.To))
+}
+
+func (m *MapDB) LastClickID() (int64, error) {
+	m.clicksMu.Lock()
+	defer m.clicksMu.Unlock()
+	if len(m.Clicks) == 0 {
+		return 0, nil
+	}
+	return m.Clicks[len(m.Clicks)-1].ID, nil
+}
+
+func (m *MapDB) ExportClicks(q *ExportQuery, fn func(*Click) error) error {
+	// copied so that clicks can be recorded while the export is written, they are recorded in id order
+	m.clicksMu.Lock()
+	clicks := []*Click{}
+	for _, c := range m.Clicks {
+		if c.ID > q.AfterID && c.ID <= q.UpToID && q.inRange(c.ClickedAt) {
+			clicks = append(clicks, c)
+		}
+	}
+	m.clicksMu.Unlock()
+	for _, c := range clicks {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touch records that the url key has changed, so that it is exported again
+func (m *MapDB) touch(key string) {
+	if m.updated == nil {
+		m.updated = make(map[string]time.Time)
+	}
+	m.updated[key] = time.Now().UTC()
+}
+
+func (m *MapDB) ExportURLs(q *ExportQuery, fn func(*ExportedURL) error) error {
+	urls := []*ExportedURL{}
+	for k, v := range m.M {
+		u := &ExportedURL{ListedURL: ListedURL{ID: k, StoredURL: *v}, UpdatedAt: v.CreatedAt}
+		if t, ok := m.updated[k]; ok {
+			u.UpdatedAt = t
+		}
+		if q.inRange(u.UpdatedAt) {
+			urls = append(urls, u)
+		}
+	}
+	for _, u := range m.deletions {
+		if q.inRange(u.UpdatedAt) {
+			urls = append(urls, u)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if !urls[i].UpdatedAt.Equal(urls[j].UpdatedAt) {
+			return urls[i].UpdatedAt.Before(urls[j].UpdatedAt)
+		}
+		return urls[i].ID < urls[j].ID
+	})
+	for _, u := range urls {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package db
+
+// IdentityStore is implemented by stores that link users to accounts at external identity providers
+type IdentityStore interface {
+	// UserByIdentity returns the user linked to the subject at issuer
+	UserByIdentity(issuer string, subject string) (*User, error)
+	LinkIdentity(userID string, issuer string, subject string) error
+}
+
+func identityKey(issuer string, subject string) string {
+	return issuer + "\x00" + subject
+}
+
+func (m *MapDB) UserByIdentity(issuer string, subject string) (*User, error) {
+	userID, exists := m.Identities[identityKey(issuer, subject)]
+	if !exists {
+		return nil, NewErrNotFound("identity does not exist in db")
+	}
+	return m.UserByID(userID)
+}
+
+func (m *MapDB) LinkIdentity(userID string, issuer string, subject string) error {
+	key := identityKey(issuer, subject)
+	if _, exists := m.Identities[key]; exists {
+		return NewErrExists("identity is already linked")
+	}
+	m.Identities[key] = userID
+	return nil
+}
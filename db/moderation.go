@@ -0,0 +1,133 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminAction records something an admin did from the moderation console
+type AdminAction struct {
+	ID      string `json:"id"`
+	AdminID string `json:"admin_id"`
+	// Action is e.g. disable_url or ban_user
+	Action string `json:"action"`
+	// Target is the url key or user id acted on
+	Target    string    `json:"target"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Moderator is implemented by stores that support the admin moderation console
+type Moderator interface {
+	// SearchURLs returns a page of all urls matching q
+	SearchURLs(q *ListQuery) ([]*ListedURL, int, error)
+	// SetDisabled stops a url redirecting, responding with status instead, 0 re-enables it
+	SetDisabled(key string, status int, reason string) error
+	// DisableUserURLs disables every url created by the user, returning how many there were
+	DisableUserURLs(userID string, status int, reason string) (int, error)
+	// SearchUsers returns a page of users whose email contains q.Filter, newest first
+	SearchUsers(q *ListQuery) ([]*User, int, error)
+	SetAdmin(userID string, admin bool) error
+	SetBanned(userID string, banned bool, reason string) error
+	RecordAdminAction(act *AdminAction) error
+	// AdminActions returns a page of the admin log, newest first
+	AdminActions(offset int, limit int) ([]*AdminAction, int, error)
+}
+
+func (m *MapDB) SearchURLs(q *ListQuery) ([]*ListedURL, int, error) {
+	return m.list(func(*StoredURL) bool { return true }, q)
+}
+
+func (m *MapDB) SetDisabled(key string, status int, reason string) error {
+	stored, exists := m.M[key]
+	if !exists {
+		return NewErrNotFound(fmt.Sprintf("key %s does not exist in db", key))
+	}
+	stored.DisabledStatus = status
+	stored.DisabledReason = reason
+	m.touch(key)
+	return nil
+}
+
+func (m *MapDB) DisableUserURLs(userID string, status int, reason string) (int, error) {
+	n := 0
+	for key, stored := range m.M {
+		if stored.UserID == userID && stored.DisabledStatus == 0 {
+			stored.DisabledStatus = status
+			stored.DisabledReason = reason
+			m.touch(key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MapDB) SearchUsers(q *ListQuery) ([]*User, int, error) {
+	filter := strings.ToLower(q.Filter)
+	users := []*User{}
+	for _, u := range m.Users {
+		if strings.Contains(strings.ToLower(u.Email), filter) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].CreatedAt.After(users[j].CreatedAt)
+		}
+		return users[i].ID < users[j].ID
+	})
+	return page(users, q.Offset, q.Limit), len(users), nil
+}
+
+func (m *MapDB) SetAdmin(userID string, admin bool) error {
+	u, err := m.UserByID(userID)
+	if err != nil {
+		return err
+	}
+	u.IsAdmin = admin
+	return nil
+}
+
+func (m *MapDB) SetBanned(userID string, banned bool, reason string) error {
+	u, err := m.UserByID(userID)
+	if err != nil {
+		return err
+	}
+	u.Banned = banned
+	u.BanReason = ""
+	if banned {
+		u.BanReason = reason
+	}
+	return nil
+}
+
+func (m *MapDB) RecordAdminAction(act *AdminAction) error {
+	act.ID = NewID()
+	if act.CreatedAt.IsZero() {
+		act.CreatedAt = time.Now().UTC()
+	}
+	m.AdminLog = append(m.AdminLog, act)
+	return nil
+}
+
+func (m *MapDB) AdminActions(offset int, limit int) ([]*AdminAction, int, error) {
+	acts := make([]*AdminAction, len(m.AdminLog))
+	for i, act := range m.AdminLog {
+		acts[len(acts)-1-i] = act
+	}
+	return page(acts, offset, limit), len(acts), nil
+}
+
+// page returns the items of s from offset, at most limit of them
+func page[T any](s []T, offset int, limit int) []T {
+	if offset >= len(s) {
+		return []T{}
+	}
+	end := offset + limit
+	if end > len(s) {
+		end = len(s)
+	}
+	return s[offset:end]
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SortCreatedAt   = "created_at"
+	SortOriginalURL = "original_url"
+	SortID          = "id"
+)
+
+// ListQuery selects a page of a user's urls. Filter matches a case insensitive substring of the
+// key or original url.
+type ListQuery struct {
+	Offset int
+	Limit  int
+	Sort   string
+	Desc   bool
+	Filter string
+}
+
+// ListedURL is a StoredURL along with its key
+type ListedURL struct {
+	ID string `json:"id"`
+	StoredURL
+}
+
+// Owner is implemented by stores that can list the urls created by a user and delete urls
+type Owner interface {
+	// ListByUser returns a page of the user's personal urls, those not in a workspace, and the
+	// total number matching the filter
+	ListByUser(userID string, q *ListQuery) ([]*ListedURL, int, error)
+	Delete(key string) error
+}
+
+func (m *MapDB) Delete(key string) error {
+	stored, exists := m.M[key]
+	if !exists {
+		return NewErrNotFound(fmt.Sprintf("key %s does not exist in db", key))
+	}
+	m.deletions = append(m.deletions, &ExportedURL{
+		ListedURL: ListedURL{ID: key, StoredURL: StoredURL{CreatedAt: stored.CreatedAt}},
+		UpdatedAt: time.Now().UTC(), Deleted: true})
+	delete(m.M, key)
+	delete(m.R, key)
+	delete(m.updated, key)
+	return nil
+}
+
+func (m *MapDB) ListByUser(userID string, q *ListQuery) ([]*ListedURL, int, error) {
+	return m.list(func(s *StoredURL) bool { return s.UserID == userID && s.WorkspaceID == "" }, q)
+}
+
+// list returns a page of the urls matching both include and q
+func (m *MapDB) list(include func(*StoredURL) bool, q *ListQuery) ([]*ListedURL, int, error) {
+	filter := strings.ToLower(q.Filter)
+	urls := []*ListedURL{}
+	for key, stored := range m.M {
+		if !include(stored) {
+			continue
+		}
+		if filter != "" && !strings.Contains(strings.ToLower(key), filter) &&
+			!strings.Contains(strings.ToLower(stored.OriginalURL), filter) {
+			continue
+		}
+		urls = append(urls, &ListedURL{ID: key, StoredURL: *stored})
+	}
+
+	less := func(i, j int) bool {
+		a, b := urls[i], urls[j]
+		switch q.Sort {
+		case SortOriginalURL:
+			if a.OriginalURL != b.OriginalURL {
+				return a.OriginalURL < b.OriginalURL
+			}
+		case SortID:
+		default:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+		}
+		return a.ID < b.ID
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if q.Desc {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+
+	return page(urls, q.Offset, q.Limit), len(urls), nil
+}
+
+// ClickCounter is implemented by stores that record clicks on urls
+type ClickCounter interface {
+	// ClickCounts returns the total clicks of each of the given keys, keys without clicks may be absent
+	ClickCounts(keys []string) (map[string]int64, error)
+}
@@ -10,6 +10,15 @@ type PostgresDB struct {
 	db *sql.DB
 }
 
+// urlColumns are selected to scan a StoredURL, see scanDest
+const urlColumns = `original_url, redirect_status, passthrough, campaign, created_at, COALESCE(user_id::text, ''),
+	COALESCE(workspace_id::text, ''), disabled_status, disabled_reason`
+
+func (s *StoredURL) scanDest() []interface{} {
+	return []interface{}{&s.OriginalURL, &s.RedirectStatus, &s.Passthrough, &s.Campaign, &s.CreatedAt, &s.UserID,
+		&s.WorkspaceID, &s.DisabledStatus, &s.DisabledReason}
+}
+
 func NewPostgresDB(connStr string) (*PostgresDB, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -22,7 +31,11 @@ func NewPostgresDB(connStr string) (*PostgresDB, error) {
 }
 
 func (p *PostgresDB) Create(key string, value *StoredURL) error {
-	_, err := p.db.Exec(`INSERT INTO urls (id, original_url, created_at) VALUES ($1, $2, now()) ON CONFLICT (id) DO NOTHING`, key, value.OriginalURL)
+	_, err := p.db.Exec(`INSERT INTO urls (id, original_url, redirect_status, passthrough, campaign, user_id,
+		workspace_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::uuid, NULLIF($7, '')::uuid, now()) ON CONFLICT (id) DO NOTHING`,
+		key, value.OriginalURL, value.RedirectStatus, value.Passthrough, value.Campaign, value.UserID,
+		value.WorkspaceID)
 	if err != nil {
 		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
 	}
@@ -30,15 +43,133 @@ func (p *PostgresDB) Create(key string, value *StoredURL) error {
 }
 
 func (p *PostgresDB) Get(key string) (*StoredURL, error) {
-	var originalURL string
-	err := p.db.QueryRow(`SELECT original_url FROM urls WHERE id = $1`, key).Scan(&originalURL)
+	stored := &StoredURL{}
+	err := p.db.QueryRow(`SELECT `+urlColumns+` FROM urls WHERE id = $1`, key).Scan(stored.scanDest()...)
 	if err == sql.ErrNoRows {
 		return nil, NewErrNotFound(fmt.Sprintf("could not find key %s", key))
 	}
 	if err != nil {
 		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
 	}
-	return &StoredURL{OriginalURL: originalURL}, nil
+	return stored, nil
+}
+
+func (p *PostgresDB) Update(key string, newURL string, changedBy string) (*Revision, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+
+	var oldURL string
+	err = tx.QueryRow(`SELECT original_url FROM urls WHERE id = $1 FOR UPDATE`, key).Scan(&oldURL)
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound(fmt.Sprintf("could not find key %s", key))
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+
+	rev := &Revision{OldURL: oldURL, NewURL: newURL, ChangedBy: changedBy}
+	err = tx.QueryRow(`INSERT INTO url_revisions (url_id, revision, old_url, new_url, changed_by, changed_at)
+		SELECT $1, COALESCE(MAX(revision), 0) + 1, $2, $3, $4, now() FROM url_revisions WHERE url_id = $1
+		RETURNING revision, changed_at`, key, oldURL, newURL, changedBy).Scan(&rev.Number, &rev.ChangedAt)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	_, err = tx.Exec(`UPDATE urls SET original_url = $2, updated_at = now() WHERE id = $1`, key, newURL)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return rev, nil
+}
+
+func (p *PostgresDB) Revisions(key string) ([]*Revision, error) {
+	if _, err := p.Get(key); err != nil {
+		return nil, err
+	}
+	rows, err := p.db.Query(`SELECT revision, old_url, new_url, COALESCE(changed_by, ''), changed_at
+		FROM url_revisions WHERE url_id = $1 ORDER BY revision`, key)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	revs := []*Revision{}
+	for rows.Next() {
+		rev := &Revision{}
+		err := rows.Scan(&rev.Number, &rev.OldURL, &rev.NewURL, &rev.ChangedBy, &rev.ChangedAt)
+		if err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		revs = append(revs, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return revs, nil
+}
+
+func (p *PostgresDB) Delete(key string) error {
+	// the deleted url leaves a tombstone for exports
+	res, err := p.db.Exec(`WITH deleted AS (DELETE FROM urls WHERE id = $1 RETURNING id, created_at)
+		INSERT INTO url_deletions (url_id, created_at, deleted_at) SELECT id, created_at, now() FROM deleted`, key)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres delete error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("could not find key %s", key))
+	}
+	return nil
+}
+
+// listOrder maps ListQuery sort fields onto columns
+var listOrder = map[string]string{
+	SortCreatedAt:   "created_at",
+	SortOriginalURL: "original_url",
+	SortID:          "id",
+}
+
+func (p *PostgresDB) ListByUser(userID string, q *ListQuery) ([]*ListedURL, int, error) {
+	return p.listURLs(`user_id = $4 AND workspace_id IS NULL`, q, userID)
+}
+
+// listURLs returns a page of the urls matching where, which refers to args from $4
+func (p *PostgresDB) listURLs(where string, q *ListQuery, args ...interface{}) ([]*ListedURL, int, error) {
+	order, ok := listOrder[q.Sort]
+	if !ok {
+		order = listOrder[SortCreatedAt]
+	}
+	if q.Desc {
+		order += " DESC"
+	}
+	// id breaks ties so that pages are stable
+	rows, err := p.db.Query(`SELECT id, `+urlColumns+`, count(*) OVER()
+		FROM urls WHERE `+where+`
+		AND ($1 = '' OR strpos(lower(id), lower($1)) > 0 OR strpos(lower(original_url), lower($1)) > 0)
+		ORDER BY `+order+`, id LIMIT $2 OFFSET $3`, append([]interface{}{q.Filter, q.Limit, q.Offset}, args...)...)
+	if err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	urls := []*ListedURL{}
+	total := 0
+	for rows.Next() {
+		u := &ListedURL{}
+		dest := append([]interface{}{&u.ID}, u.scanDest()...)
+		if err := rows.Scan(append(dest, &total)...); err != nil {
+			return nil, 0, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		urls = append(urls, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return urls, total, nil
 }
 
 func (p *PostgresDB) Close() error {
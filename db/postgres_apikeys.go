@@ -0,0 +1,90 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, created_at, expires_at, last_used_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	k := &APIKey{}
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Hash, pq.Array(&k.Scopes),
+		&k.CreatedAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	return k, nil
+}
+
+func (p *PostgresDB) CreateAPIKey(k *APIKey) error {
+	err := p.db.QueryRow(`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		k.UserID, k.Name, k.Prefix, k.Hash, pq.Array(k.Scopes), k.CreatedAt, k.ExpiresAt).Scan(&k.ID)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) APIKeysByUser(userID string) ([]*APIKey, error) {
+	rows, err := p.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return keys, nil
+}
+
+func (p *PostgresDB) APIKeyByHash(hash string) (*APIKey, error) {
+	k, err := scanAPIKey(p.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE key_hash = $1 AND (expires_at IS NULL OR expires_at > now())`, hash))
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound("could not find api key")
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return k, nil
+}
+
+func (p *PostgresDB) RevokeAPIKey(userID string, id string) error {
+	res, err := p.db.Exec(`DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres delete error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("could not find api key %s", id))
+	}
+	return nil
+}
+
+func (p *PostgresDB) TouchAPIKey(id string, usedAt time.Time) error {
+	_, err := p.db.Exec(`UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, usedAt)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nullJSON stores empty snapshots as NULL rather than invalid jsonb
+func nullJSON(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
+
+func (p *PostgresDB) RecordAuditEvent(e *AuditEvent) error {
+	err := p.db.QueryRow(`INSERT INTO audit_events (actor_id, action, target, before, after, ip, request_id)
+		VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		e.ActorID, e.Action, e.Target, nullJSON(e.Before), nullJSON(e.After), e.IP, e.RequestID).Scan(
+		&e.ID, &e.CreatedAt)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) AuditEvents(f *AuditFilter) ([]*AuditEvent, int, error) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+	if f.ActorID != "" {
+		add("actor_id = ?", f.ActorID)
+	}
+	if f.Action != "" {
+		add("action = ?", f.Action)
+	}
+	if f.Target != "" {
+		add("target = ?", f.Target)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < ?", f.Until)
+	}
+	args = append(args, f.Limit, f.Offset)
+	rows, err := p.db.Query(`SELECT id, created_at, COALESCE(actor_id, ''), action, target,
+		before::text, after::text, ip, request_id, count(*) OVER()
+		FROM audit_events WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY created_at DESC, id LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)),
+		args...)
+	if err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	total := 0
+	for rows.Next() {
+		e := &AuditEvent{}
+		var before, after sql.NullString
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.Action, &e.Target, &before, &after, &e.IP,
+			&e.RequestID, &total)
+		if err != nil {
+			return nil, 0, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		if before.Valid {
+			e.Before = []byte(before.String)
+		}
+		if after.Valid {
+			e.After = []byte(after.String)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return events, total, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// RecordClicks copies the batch into the clicks table in a single transaction
+func (p *PostgresDB) RecordClicks(clicks []*Click) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("clicks", "url_id", "clicked_at", "referrer", "referrer_host",
+		"user_agent", "ip_hash", "browser", "os", "device", "bot", "country", "city"))
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres copy error: %v", err))
+	}
+	for _, c := range clicks {
+		if _, err := stmt.Exec(c.Key, c.ClickedAt, c.Referrer, ReferrerHost(c.Referrer), c.UserAgent, c.IPHash,
+			c.Browser, c.OS, c.Device, c.Bot, c.Country, c.City); err != nil {
+			stmt.Close()
+			return NewErrDB(fmt.Sprintf("postgres copy error: %v", err))
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return NewErrDB(fmt.Sprintf("postgres copy error: %v", err))
+	}
+	if err := stmt.Close(); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres copy error: %v", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return nil
+}
+
+// ClickCounts leaves out bots
+func (p *PostgresDB) ClickCounts(keys []string) (map[string]int64, error) {
+	rows, err := p.db.Query(`SELECT url_id, count(*) FROM clicks WHERE url_id = ANY($1) AND NOT bot
+		GROUP BY url_id`,
+		pq.Array(keys))
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64, len(keys))
+	for rows.Next() {
+		var key string
+		var n int64
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		counts[key] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return counts, nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"fmt"
+)
+
+// LastClickID locks clicks against writes for a moment, so that clicks still being written have
+// committed, or rolled back, before the newest id is read. Ids are taken from a sequence as clicks
+// are inserted and a click could otherwise commit after a click with a higher id was read.
+func (p *PostgresDB) LastClickID() (int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`LOCK TABLE clicks IN SHARE MODE`); err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres lock error: %v", err))
+	}
+	var id int64
+	if err := tx.QueryRow(`SELECT COALESCE(max(id), 0) FROM clicks`).Scan(&id); err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return id, nil
+}
+
+// exportTo is the end of q, or NULL for none
+func exportTo(q *ExportQuery) interface{} {
+	if q.To.IsZero() {
+		return nil
+	}
+	return q.To
+}
+
+// ExportClicks streams rows as lib/pq reads them off the connection, which is held until the
+// export has been written
+func (p *PostgresDB) ExportClicks(q *ExportQuery, fn func(*Click) error) error {
+	rows, err := p.db.Query(`SELECT id, url_id, clicked_at, referrer, user_agent, ip_hash, browser, os, device, bot,
+		country, city FROM clicks WHERE id > $1 AND id <= $2 AND clicked_at >= $3
+		AND ($4::timestamptz IS NULL OR clicked_at < $4) ORDER BY id`, q.AfterID, q.UpToID, q.From, exportTo(q))
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &Click{}
+		if err := rows.Scan(&c.ID, &c.Key, &c.ClickedAt, &c.Referrer, &c.UserAgent, &c.IPHash, &c.Browser, &c.OS,
+			&c.Device, &c.Bot, &c.Country, &c.City); err != nil {
+			return NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		c.ClickedAt = c.ClickedAt.UTC()
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return nil
+}
+
+// ExportURLs exports urls that have changed along with the tombstones of urls that were deleted
+func (p *PostgresDB) ExportURLs(q *ExportQuery, fn func(*ExportedURL) error) error {
+	rows, err := p.db.Query(`SELECT id, `+urlColumns+`, COALESCE(updated_at, created_at), FALSE FROM urls
+			WHERE COALESCE(updated_at, created_at) >= $1
+			AND ($2::timestamptz IS NULL OR COALESCE(updated_at, created_at) < $2)
+		UNION ALL
+		SELECT url_id, '', 0, FALSE, '', created_at, '', '', 0, '', deleted_at, TRUE FROM url_deletions
+			WHERE deleted_at >= $1 AND ($2::timestamptz IS NULL OR deleted_at < $2)
+		ORDER BY 11, 1`, q.From, exportTo(q))
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u := &ExportedURL{}
+		dest := append([]interface{}{&u.ID}, u.scanDest()...)
+		if err := rows.Scan(append(dest, &u.UpdatedAt, &u.Deleted)...); err != nil {
+			return NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+func (p *PostgresDB) UserByIdentity(issuer string, subject string) (*User, error) {
+	return p.queryUser(`SELECT `+userColumns+` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2)`, issuer, subject)
+}
+
+func (p *PostgresDB) LinkIdentity(userID string, issuer string, subject string) error {
+	_, err := p.db.Exec(`INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3)`,
+		issuer, subject, userID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+			return NewErrExists("identity is already linked")
+		}
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func (p *PostgresDB) SearchURLs(q *ListQuery) ([]*ListedURL, int, error) {
+	return p.listURLs(`TRUE`, q)
+}
+
+func (p *PostgresDB) SetDisabled(key string, status int, reason string) error {
+	res, err := p.db.Exec(`UPDATE urls SET disabled_status = $2, disabled_reason = $3, updated_at = now()
+		WHERE id = $1`, key, status, reason)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("could not find key %s", key))
+	}
+	return nil
+}
+
+func (p *PostgresDB) DisableUserURLs(userID string, status int, reason string) (int, error) {
+	res, err := p.db.Exec(`UPDATE urls SET disabled_status = $2, disabled_reason = $3, updated_at = now()
+		WHERE user_id = $1 AND disabled_status = 0`, userID, status, reason)
+	if err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (p *PostgresDB) SearchUsers(q *ListQuery) ([]*User, int, error) {
+	rows, err := p.db.Query(`SELECT `+userColumns+`, count(*) OVER() FROM users
+		WHERE strpos(lower(email), lower($1)) > 0
+		ORDER BY created_at DESC, id LIMIT $2 OFFSET $3`, q.Filter, q.Limit, q.Offset)
+	if err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	total := 0
+	for rows.Next() {
+		u := &User{}
+		var passwordHash sql.NullString
+		if err := rows.Scan(append(u.scanDest(&passwordHash), &total)...); err != nil {
+			return nil, 0, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		u.PasswordHash = passwordHash.String
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return users, total, nil
+}
+
+// execUser runs a statement on a single user, returning ErrNotFound if there is none
+func (p *PostgresDB) execUser(query string, userID string, args ...interface{}) error {
+	res, err := p.db.Exec(query, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("could not find user %s", userID))
+	}
+	return nil
+}
+
+func (p *PostgresDB) SetAdmin(userID string, admin bool) error {
+	return p.execUser(`UPDATE users SET is_admin = $2 WHERE id = $1`, userID, admin)
+}
+
+func (p *PostgresDB) SetBanned(userID string, banned bool, reason string) error {
+	if !banned {
+		return p.execUser(`UPDATE users SET banned_at = NULL, ban_reason = NULL WHERE id = $1`, userID)
+	}
+	return p.execUser(`UPDATE users SET banned_at = COALESCE(banned_at, now()), ban_reason = $2 WHERE id = $1`,
+		userID, reason)
+}
+
+func (p *PostgresDB) RecordAdminAction(act *AdminAction) error {
+	err := p.db.QueryRow(`INSERT INTO admin_actions (admin_id, action, target, detail)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_at`, act.AdminID, act.Action, act.Target, act.Detail).Scan(
+		&act.ID, &act.CreatedAt)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) AdminActions(offset int, limit int) ([]*AdminAction, int, error) {
+	rows, err := p.db.Query(`SELECT id, COALESCE(admin_id::text, ''), action, target, detail, created_at,
+		count(*) OVER() FROM admin_actions ORDER BY created_at DESC, id LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	acts := []*AdminAction{}
+	total := 0
+	for rows.Next() {
+		act := &AdminAction{}
+		err := rows.Scan(&act.ID, &act.AdminID, &act.Action, &act.Target, &act.Detail, &act.CreatedAt, &total)
+		if err != nil {
+			return nil, 0, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		acts = append(acts, act)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return acts, total, nil
+}
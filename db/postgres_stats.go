@@ -0,0 +1,272 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aultimus/shortly/hll"
+)
+
+// RollupClicks claims a batch of clicks and adds them to every rollup in one transaction, so a
+// batch is either rolled up completely or not at all. SKIP LOCKED lets several instances roll up at
+// once. Counts are added up by one statement, which returns the batch's visitors to be sketched.
+func (p *PostgresDB) RollupClicks(limit int) (int, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`WITH batch AS (
+			UPDATE clicks SET rolled_up = TRUE WHERE id IN (
+				SELECT id FROM clicks WHERE NOT rolled_up ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+			RETURNING url_id, clicked_at, date_trunc('hour', clicked_at, 'UTC') AS hour,
+				date_trunc('day', clicked_at, 'UTC') AS day, bot, ip_hash, referrer_host, country, city, browser,
+				os, device
+		), hourly AS (
+			INSERT INTO click_rollups (url_id, hour, bot, clicks)
+			SELECT url_id, hour, bot, count(*) FROM batch GROUP BY url_id, hour, bot
+			ON CONFLICT (url_id, hour, bot) DO UPDATE SET clicks = click_rollups.clicks + EXCLUDED.clicks
+		), daily AS (
+			INSERT INTO click_dimension_rollups (url_id, day, bot, dimension, value, clicks)
+			SELECT url_id, day, bot, d.dimension, d.value, count(*) FROM batch CROSS JOIN LATERAL (VALUES
+				($2, COALESCE(NULLIF(referrer_host, ''), $7)), ($3, COALESCE(NULLIF(country, ''), $8)),
+				($4, COALESCE(NULLIF(browser, ''), $8)), ($5, COALESCE(NULLIF(os, ''), $8)),
+				($6, COALESCE(NULLIF(device, ''), $8)),
+				($9, COALESCE(NULLIF(city, '') || COALESCE(', ' || NULLIF(country, ''), ''), $8))
+			) AS d(dimension, value)
+			GROUP BY url_id, day, bot, d.dimension, d.value
+			ON CONFLICT (url_id, day, bot, dimension, value)
+				DO UPDATE SET clicks = click_dimension_rollups.clicks + EXCLUDED.clicks
+		)
+		SELECT url_id, clicked_at, bot, ip_hash FROM batch`,
+		limit, DimReferrer, DimCountry, DimBrowser, DimOS, DimDevice, directReferrer, unknownValue,
+		DimCity)
+	if err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres rollup error: %v", err))
+	}
+	defer rows.Close()
+	n := 0
+	sketches := visitorSketches{}
+	for rows.Next() {
+		var key, ipHash string
+		var clickedAt time.Time
+		var bot bool
+		if err := rows.Scan(&key, &clickedAt, &bot, &ipHash); err != nil {
+			return 0, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		sketches.add(key, clickedAt, bot, ipHash)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres rollup error: %v", err))
+	}
+	if err := mergeSketches(tx, sketches); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return n, nil
+}
+
+// mergeSketches adds sketches to the stored sketches. They are locked in the same order by every
+// instance so that they can't deadlock.
+func mergeSketches(tx *sql.Tx, sketches visitorSketches) error {
+	keys := make([]sketchKey, 0, len(sketches))
+	for k := range sketches {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		if a.bucket != b.bucket {
+			return a.bucket < b.bucket
+		}
+		if !a.start.Equal(b.start) {
+			return a.start.Before(b.start)
+		}
+		return !a.bot && b.bot
+	})
+	for _, k := range keys {
+		if err := mergeSketch(tx, k, sketches[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillSketches sketches a batch of the exact visitors kept from before clicks were sketched,
+// deleting them in the same transaction, so that the uniques of clicks rolled up back then are
+// counted without rolling their clicks up again. The table is left empty once all are sketched.
+func (p *PostgresDB) BackfillSketches(limit int) (int, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM click_visitors WHERE (url_id, hour, bot, ip_hash) IN (
+			SELECT url_id, hour, bot, ip_hash FROM click_visitors LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING url_id, hour, bot, ip_hash`, limit)
+	if err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres backfill error: %v", err))
+	}
+	defer rows.Close()
+	n := 0
+	sketches := visitorSketches{}
+	for rows.Next() {
+		var key, ipHash string
+		var hour time.Time
+		var bot bool
+		if err := rows.Scan(&key, &hour, &bot, &ipHash); err != nil {
+			return 0, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		sketches.add(key, hour, bot, ipHash)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres backfill error: %v", err))
+	}
+	if err := mergeSketches(tx, sketches); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return n, nil
+}
+
+// mergeSketch adds sketch to the stored sketch of k. Sketches are merged by the app so a stored
+// sketch is inserted if there is none or else locked, merged and written back.
+func mergeSketch(tx *sql.Tx, k sketchKey, sketch *hll.Sketch) error {
+	b, err := sketch.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`INSERT INTO click_sketches (url_id, bucket, start, bot, sketch) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING`, k.key, k.bucket, k.start, k.bot, b)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	if inserted == 1 {
+		return nil
+	}
+	if err := tx.QueryRow(`SELECT sketch FROM click_sketches WHERE url_id = $1 AND bucket = $2 AND start = $3
+		AND bot = $4 FOR UPDATE`, k.key, k.bucket, k.start, k.bot).Scan(&b); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	stored, err := hll.Unmarshal(b)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres sketch error: %v", err))
+	}
+	stored.Merge(sketch)
+	if b, err = stored.MarshalBinary(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE click_sketches SET sketch = $5 WHERE url_id = $1 AND bucket = $2 AND start = $3
+		AND bot = $4`, k.key, k.bucket, k.start, k.bot, b); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) ClickStats(q *StatsQuery) (*Stats, error) {
+	from, to := q.From, q.To
+	s := &Stats{Series: []*StatsBucket{}}
+
+	// $5 includes bots, which are otherwise left out
+	rows, err := p.db.Query(`SELECT date_trunc($4, hour, 'UTC') AS bucket, sum(clicks) FROM click_rollups
+		WHERE url_id = $1 AND hour >= $2 AND hour < $3 AND (NOT bot OR $5) GROUP BY bucket ORDER BY bucket`,
+		q.Key, from, to, q.Bucket, q.IncludeBots)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		b := &StatsBucket{}
+		if err := rows.Scan(&b.Start, &b.Clicks); err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		b.Start = b.Start.UTC()
+		s.Clicks += b.Clicks
+		s.Series = append(s.Series, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+
+	rows, err = p.db.Query(`SELECT start, sketch FROM click_sketches
+		WHERE url_id = $1 AND bucket = $2 AND start >= $3 AND start < $4 AND (NOT bot OR $5)`,
+		q.Key, sketchBucket(q.Bucket), from, to, q.IncludeBots)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+	visitors := visitorCounts{}
+	for rows.Next() {
+		var start time.Time
+		var b []byte
+		if err := rows.Scan(&start, &b); err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		sketch, err := hll.Unmarshal(b)
+		if err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres sketch error: %v", err))
+		}
+		visitors.add(TruncateBucket(start, q.Bucket), sketch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	visitors.count(s)
+
+	err = p.db.QueryRow(`SELECT COALESCE(sum(clicks), 0) FROM click_rollups
+		WHERE url_id = $1 AND hour >= $2 AND hour < $3 AND bot`,
+		q.Key, from, to).Scan(&s.BotClicks)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+
+	// days are rolled up whole so a day partly in range counts in full
+	rows, err = p.db.Query(`SELECT dimension, value, clicks FROM (
+			SELECT dimension, value, sum(clicks) AS clicks,
+				row_number() OVER (PARTITION BY dimension ORDER BY sum(clicks) DESC, value) AS rank
+			FROM click_dimension_rollups WHERE url_id = $1 AND day >= $2 AND day < $3 AND (NOT bot OR $5)
+			GROUP BY dimension, value
+		) ranked WHERE rank <= $4 ORDER BY dimension, clicks DESC, value`,
+		q.Key, TruncateBucket(from, BucketDay), to, q.Top, q.IncludeBots)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+	dims := map[string]*[]*StatsCount{
+		DimReferrer: &s.Referrers, DimCountry: &s.Countries, DimCity: &s.Cities, DimBrowser: &s.Browsers,
+		DimOS: &s.OperatingSystems, DimDevice: &s.Devices,
+	}
+	for _, d := range dims {
+		*d = []*StatsCount{}
+	}
+	for rows.Next() {
+		var dim string
+		c := &StatsCount{}
+		if err := rows.Scan(&dim, &c.Value, &c.Clicks); err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		if d, ok := dims[dim]; ok {
+			*d = append(*d, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return s, nil
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func (p *PostgresDB) CreateUserToken(t *UserToken) error {
+	_, err := p.db.Exec(`INSERT INTO user_tokens (hash, user_id, purpose, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		t.Hash, t.UserID, t.Purpose, t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) UseUserToken(hash string, purpose string) (*UserToken, error) {
+	t := &UserToken{Hash: hash, Purpose: purpose}
+	var usedAt sql.NullTime
+	// the update makes using a token atomic, a second concurrent use finds used_at set
+	err := p.db.QueryRow(`UPDATE user_tokens SET used_at = now()
+		WHERE hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id, created_at, expires_at, used_at`, hash, purpose).Scan(
+		&t.UserID, &t.CreatedAt, &t.ExpiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound("could not find token")
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	t.UsedAt = &usedAt.Time
+	return t, nil
+}
+
+func (p *PostgresDB) SetEmailVerified(userID string) error {
+	_, err := p.db.Exec(`UPDATE users SET email_verified_at = now() WHERE id = $1 AND email_verified_at IS NULL`, userID)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) SetPassword(userID string, passwordHash string) error {
+	_, err := p.db.Exec(`UPDATE users SET password_hash = $2 WHERE id = $1`, userID, passwordHash)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) DeleteUserSessions(userID string) error {
+	_, err := p.db.Exec(`DELETE FROM sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres delete error: %v", err))
+	}
+	return nil
+}
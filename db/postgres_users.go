@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// pqUniqueViolation is the postgres error code for a unique constraint violation
+const pqUniqueViolation = "23505"
+
+func (p *PostgresDB) CreateUser(email string, passwordHash string) (*User, error) {
+	u := &User{Email: email, PasswordHash: passwordHash}
+	err := p.db.QueryRow(`INSERT INTO users (email, password_hash) VALUES ($1, NULLIF($2, '')) RETURNING id, created_at`,
+		email, passwordHash).Scan(&u.ID, &u.CreatedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return nil, NewErrExists(fmt.Sprintf("user %s already exists", email))
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return u, nil
+}
+
+const userColumns = `id, email, email_verified_at IS NOT NULL, password_hash, created_at, is_admin,
+	banned_at IS NOT NULL, COALESCE(ban_reason, '')`
+
+func (u *User) scanDest(passwordHash *sql.NullString) []interface{} {
+	return []interface{}{&u.ID, &u.Email, &u.EmailVerified, passwordHash, &u.CreatedAt, &u.IsAdmin, &u.Banned,
+		&u.BanReason}
+}
+
+func (p *PostgresDB) queryUser(query string, args ...interface{}) (*User, error) {
+	u := &User{}
+	var passwordHash sql.NullString
+	err := p.db.QueryRow(query, args...).Scan(u.scanDest(&passwordHash)...)
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound(fmt.Sprintf("could not find user %v", args))
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	u.PasswordHash = passwordHash.String
+	return u, nil
+}
+
+func (p *PostgresDB) UserByID(id string) (*User, error) {
+	return p.queryUser(`SELECT `+userColumns+` FROM users WHERE id = $1`, id)
+}
+
+func (p *PostgresDB) UserByEmail(email string) (*User, error) {
+	return p.queryUser(`SELECT `+userColumns+` FROM users WHERE lower(email) = lower($1)`, email)
+}
+
+func (p *PostgresDB) CreateSession(s *Session) error {
+	_, err := p.db.Exec(`INSERT INTO sessions (id, user_id, kind, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		s.ID, s.UserID, s.Kind, s.CreatedAt, s.ExpiresAt)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) Session(id string) (*Session, error) {
+	s := &Session{ID: id}
+	err := p.db.QueryRow(`SELECT user_id, kind, created_at, expires_at FROM sessions WHERE id = $1 AND expires_at > now()`,
+		id).Scan(&s.UserID, &s.Kind, &s.CreatedAt, &s.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound("could not find session")
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return s, nil
+}
+
+func (p *PostgresDB) DeleteSession(id string) error {
+	_, err := p.db.Exec(`DELETE FROM sessions WHERE id = $1 OR expires_at <= now()`, id)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres delete error: %v", err))
+	}
+	return nil
+}
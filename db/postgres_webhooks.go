@@ -0,0 +1,208 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const webhookColumns = `id, user_id, COALESCE(workspace_id::text, ''), url, secret, events, click_thresholds, created_at`
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	h := &Webhook{}
+	err := row.Scan(&h.ID, &h.UserID, &h.WorkspaceID, &h.URL, &h.Secret, pq.Array(&h.Events),
+		pq.Array(&h.ClickThresholds), &h.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+const deliveryColumns = `id, webhook_id, event, COALESCE(dedupe_key, ''), payload::text, status, attempts, last_error,
+	response_status, next_attempt_at, created_at, delivered_at`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	var payload string
+	var deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.DedupeKey, &payload, &d.Status, &d.Attempts, &d.LastError,
+		&d.ResponseStatus, &d.NextAttemptAt, &d.CreatedAt, &deliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = []byte(payload)
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, nil
+}
+
+func (p *PostgresDB) CreateWebhook(h *Webhook) error {
+	if h.ClickThresholds == nil {
+		h.ClickThresholds = []int64{}
+	}
+	err := p.db.QueryRow(`INSERT INTO webhooks (user_id, workspace_id, url, secret, events, click_thresholds)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4, $5, $6) RETURNING id, created_at`,
+		h.UserID, h.WorkspaceID, h.URL, h.Secret, pq.Array(h.Events), pq.Array(h.ClickThresholds)).Scan(
+		&h.ID, &h.CreatedAt)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) Webhook(id string) (*Webhook, error) {
+	h, err := scanWebhook(p.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound(fmt.Sprintf("could not find webhook %s", id))
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return h, nil
+}
+
+func (p *PostgresDB) Webhooks(userID string, workspaceID string) ([]*Webhook, error) {
+	var rows *sql.Rows
+	var err error
+	if workspaceID != "" {
+		rows, err = p.db.Query(`SELECT `+webhookColumns+` FROM webhooks WHERE workspace_id = $1
+			ORDER BY created_at`, workspaceID)
+	} else {
+		rows, err = p.db.Query(`SELECT `+webhookColumns+` FROM webhooks WHERE user_id = $1 AND workspace_id IS NULL
+			ORDER BY created_at`, userID)
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		hooks = append(hooks, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return hooks, nil
+}
+
+func (p *PostgresDB) DeleteWebhook(id string) error {
+	res, err := p.db.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres delete error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("could not find webhook %s", id))
+	}
+	return nil
+}
+
+func (p *PostgresDB) EnqueueDelivery(d *WebhookDelivery) (bool, error) {
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	if d.NextAttemptAt.IsZero() {
+		d.NextAttemptAt = d.CreatedAt
+	}
+	d.Status = DeliveryPending
+	err := p.db.QueryRow(`INSERT INTO webhook_deliveries (webhook_id, event, dedupe_key, payload, next_attempt_at,
+		created_at) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6) ON CONFLICT DO NOTHING RETURNING id`,
+		d.WebhookID, d.Event, d.DedupeKey, string(d.Payload), d.NextAttemptAt, d.CreatedAt).Scan(&d.ID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return true, nil
+}
+
+// ClaimDeliveries skips rows locked by other claims so that several instances can send at once
+func (p *PostgresDB) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]*WebhookDelivery, error) {
+	rows, err := p.db.Query(`UPDATE webhook_deliveries SET next_attempt_at = $2
+		WHERE id IN (SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at LIMIT $3 FOR UPDATE SKIP LOCKED)
+		RETURNING `+deliveryColumns, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	return deliveries, nil
+}
+
+func (p *PostgresDB) UpdateDelivery(d *WebhookDelivery) error {
+	res, err := p.db.Exec(`UPDATE webhook_deliveries SET status = $2, attempts = $3, last_error = $4,
+		response_status = $5, next_attempt_at = $6, delivered_at = $7 WHERE id = $1`,
+		d.ID, d.Status, d.Attempts, d.LastError, d.ResponseStatus, d.NextAttemptAt, d.DeliveredAt)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("could not find delivery %s", d.ID))
+	}
+	return nil
+}
+
+func (p *PostgresDB) Delivery(id string) (*WebhookDelivery, error) {
+	d, err := scanDelivery(p.db.QueryRow(`SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound(fmt.Sprintf("could not find delivery %s", id))
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return d, nil
+}
+
+func (p *PostgresDB) Deliveries(webhookID string, status string, offset int, limit int) ([]*WebhookDelivery, int,
+	error) {
+	rows, err := p.db.Query(`SELECT `+deliveryColumns+`, count(*) OVER() FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2 = '' OR status = $2) ORDER BY created_at DESC, id LIMIT $3 OFFSET $4`,
+		webhookID, status, limit, offset)
+	if err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	total := 0
+	for rows.Next() {
+		d, err := scanDelivery(scanFunc(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &total)...)
+		}))
+		if err != nil {
+			return nil, 0, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return deliveries, total, nil
+}
+
+// scanFunc adapts a function to the Scan method shared by sql.Row and sql.Rows
+type scanFunc func(dest ...interface{}) error
+
+func (f scanFunc) Scan(dest ...interface{}) error {
+	return f(dest...)
+}
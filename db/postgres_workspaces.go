@@ -0,0 +1,228 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+func (p *PostgresDB) CreateWorkspace(name string, ownerID string) (*Workspace, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+
+	ws := &Workspace{Name: name, OwnerID: ownerID}
+	err = tx.QueryRow(`INSERT INTO workspaces (name, owner_id) VALUES ($1, $2) RETURNING id, created_at`,
+		name, ownerID).Scan(&ws.ID, &ws.CreatedAt)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	_, err = tx.Exec(`INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)`,
+		ws.ID, ownerID, RoleAdmin)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return ws, nil
+}
+
+func (p *PostgresDB) Workspace(id string) (*Workspace, error) {
+	ws := &Workspace{ID: id}
+	err := p.db.QueryRow(`SELECT name, owner_id, created_at FROM workspaces WHERE id = $1`, id).Scan(
+		&ws.Name, &ws.OwnerID, &ws.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound(fmt.Sprintf("could not find workspace %s", id))
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return ws, nil
+}
+
+func (p *PostgresDB) WorkspacesByUser(userID string) ([]*Workspace, error) {
+	rows, err := p.db.Query(`SELECT w.id, w.name, w.owner_id, w.created_at, m.role
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1 ORDER BY w.created_at`, userID)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	out := []*Workspace{}
+	for rows.Next() {
+		ws := &Workspace{}
+		if err := rows.Scan(&ws.ID, &ws.Name, &ws.OwnerID, &ws.CreatedAt, &ws.Role); err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		out = append(out, ws)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return out, nil
+}
+
+func (p *PostgresDB) Members(workspaceID string) ([]*Member, error) {
+	if _, err := p.Workspace(workspaceID); err != nil {
+		return nil, err
+	}
+	rows, err := p.db.Query(`SELECT m.user_id, u.email, m.role, m.created_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1 ORDER BY m.created_at`, workspaceID)
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	defer rows.Close()
+
+	out := []*Member{}
+	for rows.Next() {
+		m := &Member{WorkspaceID: workspaceID}
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, NewErrDB(fmt.Sprintf("postgres scan error: %v", err))
+		}
+		out = append(out, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return out, nil
+}
+
+func (p *PostgresDB) Member(workspaceID string, userID string) (*Member, error) {
+	m := &Member{WorkspaceID: workspaceID, UserID: userID}
+	err := p.db.QueryRow(`SELECT u.email, m.role, m.created_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1 AND m.user_id = $2`, workspaceID, userID).Scan(&m.Email, &m.Role, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound(fmt.Sprintf("user %s is not a member of workspace %s", userID, workspaceID))
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres select error: %v", err))
+	}
+	return m, nil
+}
+
+func (p *PostgresDB) addMember(e interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, m *Member) error {
+	_, err := e.Exec(`INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)`,
+		m.WorkspaceID, m.UserID, m.Role)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return NewErrExists(fmt.Sprintf("user %s is already a member", m.UserID))
+	}
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) AddMember(m *Member) error {
+	return p.addMember(p.db, m)
+}
+
+// execMember runs a statement on a single membership, returning ErrNotFound if there is none
+func (p *PostgresDB) execMember(query string, args ...interface{}) error {
+	res, err := p.db.Exec(query, args...)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("user %v is not a member of workspace %v", args[1], args[0]))
+	}
+	return nil
+}
+
+func (p *PostgresDB) SetRole(workspaceID string, userID string, role string) error {
+	return p.execMember(`UPDATE workspace_members SET role = $3 WHERE workspace_id = $1 AND user_id = $2`,
+		workspaceID, userID, role)
+}
+
+func (p *PostgresDB) RemoveMember(workspaceID string, userID string) error {
+	return p.execMember(`DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`,
+		workspaceID, userID)
+}
+
+func (p *PostgresDB) TransferWorkspace(workspaceID string, newOwnerID string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE workspace_members SET role = $3 WHERE workspace_id = $1 AND user_id = $2`,
+		workspaceID, newOwnerID, RoleAdmin)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("user %s is not a member of workspace %s", newOwnerID, workspaceID))
+	}
+	if _, err := tx.Exec(`UPDATE workspaces SET owner_id = $2 WHERE id = $1`, workspaceID, newOwnerID); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) CreateInvitation(inv *Invitation) error {
+	err := p.db.QueryRow(`INSERT INTO workspace_invitations
+		(token_hash, workspace_id, email, role, invited_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		inv.Hash, inv.WorkspaceID, inv.Email, inv.Role, inv.InvitedBy, inv.CreatedAt, inv.ExpiresAt).Scan(&inv.ID)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres insert error: %v", err))
+	}
+	return nil
+}
+
+func (p *PostgresDB) AcceptInvitation(hash string, userID string, email string) (*Invitation, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres begin error: %v", err))
+	}
+	defer tx.Rollback()
+
+	inv := &Invitation{Hash: hash}
+	var acceptedAt sql.NullTime
+	err = tx.QueryRow(`UPDATE workspace_invitations SET accepted_at = now()
+		WHERE token_hash = $1 AND accepted_at IS NULL AND expires_at > now() AND lower(email) = lower($2)
+		RETURNING id, workspace_id, email, role, invited_by, created_at, expires_at, accepted_at`, hash, email).Scan(
+		&inv.ID, &inv.WorkspaceID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt, &acceptedAt)
+	if err == sql.ErrNoRows {
+		return nil, NewErrNotFound("could not find invitation")
+	}
+	if err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	inv.AcceptedAt = &acceptedAt.Time
+	if err := p.addMember(tx, &Member{WorkspaceID: inv.WorkspaceID, UserID: userID, Role: inv.Role}); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, NewErrDB(fmt.Sprintf("postgres commit error: %v", err))
+	}
+	return inv, nil
+}
+
+func (p *PostgresDB) ListByWorkspace(workspaceID string, q *ListQuery) ([]*ListedURL, int, error) {
+	return p.listURLs(`workspace_id = $4`, q, workspaceID)
+}
+
+func (p *PostgresDB) TransferURL(key string, userID string, workspaceID string) error {
+	res, err := p.db.Exec(`UPDATE urls SET user_id = NULLIF($2, '')::uuid, workspace_id = NULLIF($3, '')::uuid,
+		updated_at = now() WHERE id = $1`, key, userID, workspaceID)
+	if err != nil {
+		return NewErrDB(fmt.Sprintf("postgres update error: %v", err))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return NewErrNotFound(fmt.Sprintf("could not find key %s", key))
+	}
+	return nil
+}
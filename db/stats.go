@@ -0,0 +1,311 @@
+package db
+
+import (
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/aultimus/shortly/hll"
+)
+
+// stats buckets
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+	BucketWeek = "week"
+)
+
+// dimensions clicks are broken down by, rolled up per day
+const (
+	DimReferrer = "referrer"
+	DimCountry  = "country"
+	DimBrowser  = "browser"
+	DimOS       = "os"
+	DimDevice   = "device"
+	DimCity     = "city"
+)
+
+const (
+	// directReferrer stands in for clicks without a referrer
+	directReferrer = "direct"
+	// unknownValue stands in for clicks whose country, city, browser, os or device isn't known
+	unknownValue = "unknown"
+)
+
+// TruncateBucket returns the start of the bucket t is in. Buckets are in UTC and weeks start on
+// Monday.
+func TruncateBucket(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	switch bucket {
+	case BucketHour:
+		return t.Truncate(time.Hour)
+	case BucketWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// ReferrerHost is what referrers are rolled up by, the host of the referring page
+func ReferrerHost(referrer string) string {
+	if referrer == "" {
+		return directReferrer
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return unknownValue
+	}
+	return u.Hostname()
+}
+
+// cityName qualifies city with its country, there being a Paris in Texas as well as France
+func cityName(city string, country string) string {
+	if city == "" || country == "" {
+		return city
+	}
+	return city + ", " + country
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return unknownValue
+	}
+	return s
+}
+
+// StatsQuery selects the clicks of one url to summarise
+type StatsQuery struct {
+	Key string
+	// From is inclusive and To exclusive, both are the start of a bucket
+	From   time.Time
+	To     time.Time
+	Bucket string
+	// Top is how many of the most common values of each dimension to return
+	Top int
+	// IncludeBots counts bot clicks along with everyone else's
+	IncludeBots bool
+}
+
+// StatsBucket is one point of a stats time series. Unique visitors are estimated, see
+// hll.StandardError.
+type StatsBucket struct {
+	Start          time.Time `json:"start"`
+	Clicks         int64     `json:"clicks"`
+	UniqueVisitors int64     `json:"unique_visitors"`
+}
+
+// StatsCount is how many clicks had a value of a dimension
+type StatsCount struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+// Stats summarises the clicks of a url. Series only holds buckets with clicks.
+type Stats struct {
+	Clicks         int64 `json:"clicks"`
+	UniqueVisitors int64 `json:"unique_visitors"`
+	// BotClicks is how many clicks were by bots, whether or not they are included in the rest
+	BotClicks        int64          `json:"bot_clicks"`
+	Series           []*StatsBucket `json:"series"`
+	Referrers        []*StatsCount  `json:"referrers"`
+	Countries        []*StatsCount  `json:"countries"`
+	Cities           []*StatsCount  `json:"cities"`
+	Browsers         []*StatsCount  `json:"browsers"`
+	OperatingSystems []*StatsCount  `json:"operating_systems"`
+	Devices          []*StatsCount  `json:"devices"`
+}
+
+// ClickStatter is implemented by stores that pre-aggregate clicks for stats. Clicks only show up
+// in stats once they have been rolled up.
+type ClickStatter interface {
+	// RollupClicks adds up to limit clicks not yet rolled up to the rollups, returning how many
+	RollupClicks(limit int) (int, error)
+	ClickStats(q *StatsQuery) (*Stats, error)
+}
+
+// SketchBackfiller is implemented by stores still holding the exact visitors of clicks rolled up
+// before visitors were sketched
+type SketchBackfiller interface {
+	// BackfillSketches sketches up to limit of those visitors, returning how many
+	BackfillSketches(limit int) (int, error)
+}
+
+// rollupKey identifies the hourly rollup of the bot or human clicks of a url
+type rollupKey struct {
+	key  string
+	hour time.Time
+	bot  bool
+}
+
+// sketchKey identifies the sketch of the visitors to a url in an hour or a day, by bots or humans
+type sketchKey struct {
+	key    string
+	bucket string
+	start  time.Time
+	bot    bool
+}
+
+// sketchBucket is the bucket of the sketches unique visitors are counted from, days for days and
+// weeks so that long ranges merge fewer sketches
+func sketchBucket(bucket string) string {
+	if bucket == BucketHour {
+		return BucketHour
+	}
+	return BucketDay
+}
+
+// visitorSketches sketches the visitors of a batch of clicks being rolled up
+type visitorSketches map[sketchKey]*hll.Sketch
+
+func (v visitorSketches) add(key string, clickedAt time.Time, bot bool, ipHash string) {
+	if ipHash == "" {
+		return
+	}
+	for _, bucket := range []string{BucketHour, BucketDay} {
+		k := sketchKey{key, bucket, TruncateBucket(clickedAt, bucket), bot}
+		if v[k] == nil {
+			v[k] = hll.New()
+		}
+		v[k].Add(ipHash)
+	}
+}
+
+// visitorCounts merges the visitor sketches of each bucket of a stats range
+type visitorCounts map[time.Time]*hll.Sketch
+
+func (v visitorCounts) add(start time.Time, sketch *hll.Sketch) {
+	if v[start] == nil {
+		v[start] = hll.New()
+	}
+	v[start].Merge(sketch)
+}
+
+// count sets the unique visitors of s and of each bucket of its series
+func (v visitorCounts) count(s *Stats) {
+	all := hll.New()
+	for _, b := range s.Series {
+		if sketch, ok := v[b.Start]; ok {
+			b.UniqueVisitors = int64(sketch.Count())
+			all.Merge(sketch)
+		}
+	}
+	s.UniqueVisitors = int64(all.Count())
+}
+
+// dimKey identifies the daily rollup of a value of a dimension of the bot or human clicks of a url
+type dimKey struct {
+	key       string
+	day       time.Time
+	bot       bool
+	dimension string
+	value     string
+}
+
+// clickDimensions returns the value of each dimension of c
+func clickDimensions(c *Click) map[string]string {
+	return map[string]string{
+		DimReferrer: ReferrerHost(c.Referrer),
+		DimCountry:  orUnknown(c.Country),
+		DimCity:     orUnknown(cityName(c.City, c.Country)),
+		DimBrowser:  orUnknown(c.Browser),
+		DimOS:       orUnknown(c.OS),
+		DimDevice:   orUnknown(c.Device),
+	}
+}
+
+func (m *MapDB) RollupClicks(limit int) (int, error) {
+	m.clicksMu.Lock()
+	defer m.clicksMu.Unlock()
+	n := 0
+	sketches := visitorSketches{}
+	for ; m.rolledUp < len(m.Clicks) && n < limit; m.rolledUp++ {
+		c := m.Clicks[m.rolledUp]
+		m.hourly[rollupKey{c.Key, TruncateBucket(c.ClickedAt, BucketHour), c.Bot}]++
+		sketches.add(c.Key, c.ClickedAt, c.Bot, c.IPHash)
+		day := TruncateBucket(c.ClickedAt, BucketDay)
+		for dim, value := range clickDimensions(c) {
+			m.daily[dimKey{c.Key, day, c.Bot, dim, value}]++
+		}
+		n++
+	}
+	for k, sketch := range sketches {
+		if m.sketches[k] == nil {
+			m.sketches[k] = hll.New()
+		}
+		m.sketches[k].Merge(sketch)
+	}
+	return n, nil
+}
+
+// topCounts sorts counts by clicks, most first, and keeps the top n
+func topCounts(counts map[string]int64, n int) []*StatsCount {
+	out := make([]*StatsCount, 0, len(counts))
+	for v, c := range counts {
+		out = append(out, &StatsCount{Value: v, Clicks: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Clicks != out[j].Clicks {
+			return out[i].Clicks > out[j].Clicks
+		}
+		return out[i].Value < out[j].Value
+	})
+	return page(out, 0, n)
+}
+
+func (m *MapDB) ClickStats(q *StatsQuery) (*Stats, error) {
+	m.clicksMu.Lock()
+	defer m.clicksMu.Unlock()
+	from, to := q.From, q.To
+	inRange := func(t time.Time) bool { return !t.Before(from) && t.Before(to) }
+
+	s := &Stats{}
+	buckets := map[time.Time]*StatsBucket{}
+	for k, clicks := range m.hourly {
+		if k.key != q.Key || !inRange(k.hour) {
+			continue
+		}
+		if k.bot {
+			s.BotClicks += clicks
+			if !q.IncludeBots {
+				continue
+			}
+		}
+		start := TruncateBucket(k.hour, q.Bucket)
+		if buckets[start] == nil {
+			buckets[start] = &StatsBucket{Start: start}
+		}
+		buckets[start].Clicks += clicks
+		s.Clicks += clicks
+	}
+	visitors := visitorCounts{}
+	for k, sketch := range m.sketches {
+		if k.key == q.Key && k.bucket == sketchBucket(q.Bucket) && inRange(k.start) && (!k.bot || q.IncludeBots) {
+			visitors.add(TruncateBucket(k.start, q.Bucket), sketch)
+		}
+	}
+	s.Series = make([]*StatsBucket, 0, len(buckets))
+	for _, b := range buckets {
+		s.Series = append(s.Series, b)
+	}
+	visitors.count(s)
+	sort.Slice(s.Series, func(i, j int) bool { return s.Series[i].Start.Before(s.Series[j].Start) })
+
+	dims := map[string]map[string]int64{
+		DimReferrer: {}, DimCountry: {}, DimCity: {}, DimBrowser: {}, DimOS: {}, DimDevice: {},
+	}
+	for k, clicks := range m.daily {
+		// days are rolled up whole so a day partly in range counts in full, as with postgres
+		if k.key == q.Key && (!k.bot || q.IncludeBots) && !k.day.Before(TruncateBucket(from, BucketDay)) &&
+			k.day.Before(to) {
+			dims[k.dimension][k.value] += clicks
+		}
+	}
+	s.Referrers = topCounts(dims[DimReferrer], q.Top)
+	s.Countries = topCounts(dims[DimCountry], q.Top)
+	s.Cities = topCounts(dims[DimCity], q.Top)
+	s.Browsers = topCounts(dims[DimBrowser], q.Top)
+	s.OperatingSystems = topCounts(dims[DimOS], q.Top)
+	s.Devices = topCounts(dims[DimDevice], q.Top)
+	return s, nil
+}
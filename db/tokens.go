@@ -0,0 +1,74 @@
+package db
+
+import (
+	"time"
+)
+
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+)
+
+// UserToken is a single use, time limited token emailed to a user. Only its hash is stored.
+type UserToken struct {
+	Hash      string
+	UserID    string
+	Purpose   string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// AccountRecovery is implemented by stores supporting email verification and password resets
+type AccountRecovery interface {
+	CreateUserToken(t *UserToken) error
+	// UseUserToken marks the token used and returns it. Unknown, expired and used tokens, and tokens
+	// for another purpose, are ErrNotFound.
+	UseUserToken(hash string, purpose string) (*UserToken, error)
+	SetEmailVerified(userID string) error
+	SetPassword(userID string, passwordHash string) error
+	// DeleteUserSessions logs the user out everywhere
+	DeleteUserSessions(userID string) error
+}
+
+func (m *MapDB) CreateUserToken(t *UserToken) error {
+	m.Tokens[t.Hash] = t
+	return nil
+}
+
+func (m *MapDB) UseUserToken(hash string, purpose string) (*UserToken, error) {
+	t, exists := m.Tokens[hash]
+	if !exists || t.Purpose != purpose || t.UsedAt != nil || !t.ExpiresAt.After(time.Now()) {
+		return nil, NewErrNotFound("token does not exist in db")
+	}
+	now := time.Now().UTC()
+	t.UsedAt = &now
+	return t, nil
+}
+
+func (m *MapDB) SetEmailVerified(userID string) error {
+	u, err := m.UserByID(userID)
+	if err != nil {
+		return err
+	}
+	u.EmailVerified = true
+	return nil
+}
+
+func (m *MapDB) SetPassword(userID string, passwordHash string) error {
+	u, err := m.UserByID(userID)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = passwordHash
+	return nil
+}
+
+func (m *MapDB) DeleteUserSessions(userID string) error {
+	for id, s := range m.Sessions {
+		if s.UserID == userID {
+			delete(m.Sessions, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type User struct {
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	PasswordHash  string    `json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+	IsAdmin       bool      `json:"is_admin,omitempty"`
+	// Banned users can't log in and their sessions, tokens and api keys stop working
+	Banned    bool   `json:"banned,omitempty"`
+	BanReason string `json:"ban_reason,omitempty"`
+}
+
+const (
+	// SessionBrowser is a logged in browser, its token is held in the session cookie
+	SessionBrowser = "browser"
+	// SessionRefresh is an api refresh token
+	SessionRefresh = "refresh"
+)
+
+// Session is a logged in browser or an api refresh token. ID is a hash of the token held by the
+// client so that the contents of the sessions table can't be used to log in. Kind is checked
+// wherever a token is presented so that one kind can't be used as the other.
+type Session struct {
+	ID        string
+	UserID    string
+	Kind      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// UserStore is implemented by stores that hold user accounts. Emails are unique, case insensitively.
+type UserStore interface {
+	CreateUser(email string, passwordHash string) (*User, error)
+	UserByID(id string) (*User, error)
+	UserByEmail(email string) (*User, error)
+}
+
+// SessionStore is implemented by stores that hold login sessions. Session returns ErrNotFound for
+// expired sessions.
+type SessionStore interface {
+	CreateSession(s *Session) error
+	Session(id string) (*Session, error)
+	DeleteSession(id string) error
+}
+
+type ErrExists struct {
+	ErrBase
+}
+
+func NewErrExists(message string) *ErrExists {
+	return &ErrExists{
+		ErrBase: ErrBase{message},
+	}
+}
+
+// NewID returns a random version 4 uuid
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err.Error())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (m *MapDB) CreateUser(email string, passwordHash string) (*User, error) {
+	if _, err := m.UserByEmail(email); err == nil {
+		return nil, NewErrExists(fmt.Sprintf("user %s already exists", email))
+	}
+	u := &User{
+		ID:           NewID(),
+		Email:        email,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now().UTC(),
+	}
+	m.Users[u.ID] = u
+	return u, nil
+}
+
+func (m *MapDB) UserByID(id string) (*User, error) {
+	u, exists := m.Users[id]
+	if !exists {
+		return nil, NewErrNotFound(fmt.Sprintf("user %s does not exist in db", id))
+	}
+	return u, nil
+}
+
+func (m *MapDB) UserByEmail(email string) (*User, error) {
+	for _, u := range m.Users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, NewErrNotFound(fmt.Sprintf("user %s does not exist in db", email))
+}
+
+func (m *MapDB) CreateSession(s *Session) error {
+	m.Sessions[s.ID] = s
+	return nil
+}
+
+func (m *MapDB) Session(id string) (*Session, error) {
+	s, exists := m.Sessions[id]
+	if !exists || !s.ExpiresAt.After(time.Now()) {
+		return nil, NewErrNotFound("session does not exist in db")
+	}
+	return s, nil
+}
+
+func (m *MapDB) DeleteSession(id string) error {
+	delete(m.Sessions, id)
+	return nil
+}
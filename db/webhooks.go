@@ -0,0 +1,223 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// webhook events
+const (
+	EventURLCreated = "url.created"
+	EventURLDeleted = "url.deleted"
+	// EventURLClicks fires once for each of a webhook's click thresholds a url reaches
+	EventURLClicks = "url.clicks"
+)
+
+// delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead deliveries ran out of attempts, they stay dead until retried
+	DeliveryDead = "dead"
+)
+
+// Webhook subscribes a url to events on the links of a user, or of a workspace when WorkspaceID is
+// set. Payloads are signed with Secret, which unlike api keys has to be stored as is.
+type Webhook struct {
+	ID string `json:"id"`
+	// UserID created the webhook, it receives the events of their own links unless WorkspaceID is set
+	UserID      string   `json:"user_id"`
+	WorkspaceID string   `json:"workspace_id,omitempty"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"-"`
+	Events      []string `json:"events"`
+	// ClickThresholds are the click counts at which url.clicks fires for each link
+	ClickThresholds []int64   `json:"click_thresholds,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Subscribes reports whether h wants event
+func (h *Webhook) Subscribes(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event queued for a webhook, along with how sending it has gone so far
+type WebhookDelivery struct {
+	ID        string `json:"id"`
+	WebhookID string `json:"webhook_id"`
+	Event     string `json:"event"`
+	// DedupeKey, when set, stops the same event being queued for a webhook twice
+	DedupeKey string          `json:"-"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	// ResponseStatus is the http status of the last attempt, 0 if it got no response
+	ResponseStatus int        `json:"response_status,omitempty"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Webhooker is implemented by stores that hold webhooks and queue their deliveries
+type Webhooker interface {
+	CreateWebhook(h *Webhook) error
+	Webhook(id string) (*Webhook, error)
+	// Webhooks returns the webhooks of a workspace when workspaceID is set, otherwise the user's own
+	Webhooks(userID string, workspaceID string) ([]*Webhook, error)
+	// DeleteWebhook deletes a webhook along with its deliveries
+	DeleteWebhook(id string) error
+	// EnqueueDelivery queues d, returning false if a delivery with the same dedupe key was queued
+	// for the webhook before
+	EnqueueDelivery(d *WebhookDelivery) (bool, error)
+	// ClaimDeliveries returns up to limit pending deliveries due by now, pushing back their next
+	// attempt by lease so that they aren't claimed again while being sent
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]*WebhookDelivery, error)
+	// UpdateDelivery saves the status, attempts, errors and times of d
+	UpdateDelivery(d *WebhookDelivery) error
+	Delivery(id string) (*WebhookDelivery, error)
+	// Deliveries returns a page of a webhook's deliveries, newest first, and how many there are.
+	// An empty status matches every delivery.
+	Deliveries(webhookID string, status string, offset int, limit int) ([]*WebhookDelivery, int, error)
+}
+
+func (m *MapDB) CreateWebhook(h *Webhook) error {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	h.ID = NewID()
+	if h.CreatedAt.IsZero() {
+		h.CreatedAt = time.Now().UTC()
+	}
+	m.webhooks[h.ID] = h
+	return nil
+}
+
+func (m *MapDB) Webhook(id string) (*Webhook, error) {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	h, exists := m.webhooks[id]
+	if !exists {
+		return nil, NewErrNotFound(fmt.Sprintf("webhook %s does not exist in db", id))
+	}
+	return h, nil
+}
+
+func (m *MapDB) Webhooks(userID string, workspaceID string) ([]*Webhook, error) {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	hooks := []*Webhook{}
+	for _, h := range m.webhooks {
+		if h.WorkspaceID == workspaceID && (workspaceID != "" || h.UserID == userID) {
+			hooks = append(hooks, h)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, nil
+}
+
+func (m *MapDB) DeleteWebhook(id string) error {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	if _, exists := m.webhooks[id]; !exists {
+		return NewErrNotFound(fmt.Sprintf("webhook %s does not exist in db", id))
+	}
+	delete(m.webhooks, id)
+	kept := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.WebhookID != id {
+			kept = append(kept, d)
+		}
+	}
+	m.deliveries = kept
+	return nil
+}
+
+func (m *MapDB) EnqueueDelivery(d *WebhookDelivery) (bool, error) {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	if d.DedupeKey != "" {
+		for _, queued := range m.deliveries {
+			if queued.WebhookID == d.WebhookID && queued.DedupeKey == d.DedupeKey {
+				return false, nil
+			}
+		}
+	}
+	d.ID = NewID()
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	if d.NextAttemptAt.IsZero() {
+		d.NextAttemptAt = d.CreatedAt
+	}
+	d.Status = DeliveryPending
+	stored := *d
+	m.deliveries = append(m.deliveries, &stored)
+	return true, nil
+}
+
+// deliveries are copied in and out of MapDB as the dispatcher changes them while handlers read them
+
+func (m *MapDB) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]*WebhookDelivery, error) {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	claimed := []*WebhookDelivery{}
+	for _, d := range m.deliveries {
+		if len(claimed) == limit {
+			break
+		}
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			d.NextAttemptAt = now.Add(lease)
+			c := *d
+			claimed = append(claimed, &c)
+		}
+	}
+	return claimed, nil
+}
+
+func (m *MapDB) UpdateDelivery(d *WebhookDelivery) error {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	for i, stored := range m.deliveries {
+		if stored.ID == d.ID {
+			updated := *d
+			updated.Payload, updated.DedupeKey = stored.Payload, stored.DedupeKey
+			m.deliveries[i] = &updated
+			return nil
+		}
+	}
+	return NewErrNotFound(fmt.Sprintf("delivery %s does not exist in db", d.ID))
+}
+
+func (m *MapDB) Delivery(id string) (*WebhookDelivery, error) {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	for _, d := range m.deliveries {
+		if d.ID == id {
+			c := *d
+			return &c, nil
+		}
+	}
+	return nil, NewErrNotFound(fmt.Sprintf("delivery %s does not exist in db", id))
+}
+
+func (m *MapDB) Deliveries(webhookID string, status string, offset int, limit int) ([]*WebhookDelivery, int,
+	error) {
+	m.webhooksMu.Lock()
+	defer m.webhooksMu.Unlock()
+	deliveries := []*WebhookDelivery{}
+	for i := len(m.deliveries) - 1; i >= 0; i-- {
+		d := m.deliveries[i]
+		if d.WebhookID == webhookID && (status == "" || d.Status == status) {
+			c := *d
+			deliveries = append(deliveries, &c)
+		}
+	}
+	return page(deliveries, offset, limit), len(deliveries), nil
+}
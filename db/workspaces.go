@@ -0,0 +1,233 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// RoleViewer may see a workspace's urls
+	RoleViewer = "viewer"
+	// RoleEditor may also create, edit and delete them
+	RoleEditor = "editor"
+	// RoleAdmin may also invite and remove members and change their roles
+	RoleAdmin = "admin"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// ValidRole reports whether role is one of the workspace roles
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAtLeast reports whether role grants everything min does
+func RoleAtLeast(role string, min string) bool {
+	return roleRanks[role] >= roleRanks[min] && ValidRole(role)
+}
+
+// Workspace is a team sharing a set of urls. Its owner is always an admin and can't leave or be
+// removed until ownership has been transferred.
+type Workspace struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   string    `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role is the requesting user's role when listing their workspaces
+	Role string `json:"role,omitempty"`
+}
+
+type Member struct {
+	WorkspaceID string    `json:"-"`
+	UserID      string    `json:"user_id"`
+	Email       string    `json:"email"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"joined_at"`
+}
+
+// Invitation asks the holder of an email address to join a workspace. Only a hash of the emailed
+// token is stored.
+type Invitation struct {
+	ID          string     `json:"id"`
+	Hash        string     `json:"-"`
+	WorkspaceID string     `json:"workspace_id"`
+	Email       string     `json:"email"`
+	Role        string     `json:"role"`
+	InvitedBy   string     `json:"invited_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty"`
+}
+
+// WorkspaceStore is implemented by stores supporting shared workspaces
+type WorkspaceStore interface {
+	// CreateWorkspace creates a workspace with ownerID as its owner and first admin
+	CreateWorkspace(name string, ownerID string) (*Workspace, error)
+	Workspace(id string) (*Workspace, error)
+	// WorkspacesByUser returns the workspaces the user is a member of, with their role
+	WorkspacesByUser(userID string) ([]*Workspace, error)
+	Members(workspaceID string) ([]*Member, error)
+	// Member returns ErrNotFound if the user is not a member of the workspace
+	Member(workspaceID string, userID string) (*Member, error)
+	// AddMember returns ErrExists if the user is already a member
+	AddMember(m *Member) error
+	SetRole(workspaceID string, userID string, role string) error
+	RemoveMember(workspaceID string, userID string) error
+	// TransferWorkspace makes newOwnerID, who must be a member, the owner and an admin
+	TransferWorkspace(workspaceID string, newOwnerID string) error
+
+	CreateInvitation(inv *Invitation) error
+	// AcceptInvitation adds the user as a member with the invitation's role. Unknown, expired and
+	// accepted invitations, and invitations for another email, are ErrNotFound.
+	AcceptInvitation(hash string, userID string, email string) (*Invitation, error)
+
+	// ListByWorkspace returns a page of the workspace's urls and the total number matching the filter
+	ListByWorkspace(workspaceID string, q *ListQuery) ([]*ListedURL, int, error)
+	// TransferURL moves a url to a workspace, or to userID personally if workspaceID is empty
+	TransferURL(key string, userID string, workspaceID string) error
+}
+
+func (m *MapDB) CreateWorkspace(name string, ownerID string) (*Workspace, error) {
+	ws := &Workspace{ID: NewID(), Name: name, OwnerID: ownerID, CreatedAt: time.Now().UTC()}
+	m.Workspaces[ws.ID] = ws
+	m.Memberships[ws.ID] = []*Member{{WorkspaceID: ws.ID, UserID: ownerID, Role: RoleAdmin, CreatedAt: ws.CreatedAt}}
+	return ws, nil
+}
+
+func (m *MapDB) Workspace(id string) (*Workspace, error) {
+	ws, exists := m.Workspaces[id]
+	if !exists {
+		return nil, NewErrNotFound(fmt.Sprintf("workspace %s does not exist in db", id))
+	}
+	c := *ws
+	return &c, nil
+}
+
+func (m *MapDB) WorkspacesByUser(userID string) ([]*Workspace, error) {
+	out := []*Workspace{}
+	for id, members := range m.Memberships {
+		for _, mem := range members {
+			if mem.UserID == userID {
+				ws := *m.Workspaces[id]
+				ws.Role = mem.Role
+				out = append(out, &ws)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *MapDB) Members(workspaceID string) ([]*Member, error) {
+	if _, err := m.Workspace(workspaceID); err != nil {
+		return nil, err
+	}
+	out := []*Member{}
+	for _, mem := range m.Memberships[workspaceID] {
+		c := *mem
+		if u, exists := m.Users[mem.UserID]; exists {
+			c.Email = u.Email
+		}
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+func (m *MapDB) Member(workspaceID string, userID string) (*Member, error) {
+	for _, mem := range m.Memberships[workspaceID] {
+		if mem.UserID == userID {
+			c := *mem
+			if u, exists := m.Users[mem.UserID]; exists {
+				c.Email = u.Email
+			}
+			return &c, nil
+		}
+	}
+	return nil, NewErrNotFound(fmt.Sprintf("user %s is not a member of workspace %s", userID, workspaceID))
+}
+
+func (m *MapDB) AddMember(mem *Member) error {
+	if _, err := m.Workspace(mem.WorkspaceID); err != nil {
+		return err
+	}
+	if _, err := m.Member(mem.WorkspaceID, mem.UserID); err == nil {
+		return NewErrExists(fmt.Sprintf("user %s is already a member", mem.UserID))
+	}
+	if mem.CreatedAt.IsZero() {
+		mem.CreatedAt = time.Now().UTC()
+	}
+	m.Memberships[mem.WorkspaceID] = append(m.Memberships[mem.WorkspaceID], mem)
+	return nil
+}
+
+func (m *MapDB) SetRole(workspaceID string, userID string, role string) error {
+	for _, mem := range m.Memberships[workspaceID] {
+		if mem.UserID == userID {
+			mem.Role = role
+			return nil
+		}
+	}
+	return NewErrNotFound(fmt.Sprintf("user %s is not a member of workspace %s", userID, workspaceID))
+}
+
+func (m *MapDB) RemoveMember(workspaceID string, userID string) error {
+	members := m.Memberships[workspaceID]
+	for i, mem := range members {
+		if mem.UserID == userID {
+			m.Memberships[workspaceID] = append(members[:i:i], members[i+1:]...)
+			return nil
+		}
+	}
+	return NewErrNotFound(fmt.Sprintf("user %s is not a member of workspace %s", userID, workspaceID))
+}
+
+func (m *MapDB) TransferWorkspace(workspaceID string, newOwnerID string) error {
+	ws, exists := m.Workspaces[workspaceID]
+	if !exists {
+		return NewErrNotFound(fmt.Sprintf("workspace %s does not exist in db", workspaceID))
+	}
+	if err := m.SetRole(workspaceID, newOwnerID, RoleAdmin); err != nil {
+		return err
+	}
+	ws.OwnerID = newOwnerID
+	return nil
+}
+
+func (m *MapDB) CreateInvitation(inv *Invitation) error {
+	inv.ID = NewID()
+	m.Invitations[inv.Hash] = inv
+	return nil
+}
+
+func (m *MapDB) AcceptInvitation(hash string, userID string, email string) (*Invitation, error) {
+	inv, exists := m.Invitations[hash]
+	if !exists || inv.AcceptedAt != nil || !inv.ExpiresAt.After(time.Now()) ||
+		!strings.EqualFold(inv.Email, email) {
+		return nil, NewErrNotFound("invitation does not exist in db")
+	}
+	err := m.AddMember(&Member{WorkspaceID: inv.WorkspaceID, UserID: userID, Role: inv.Role})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	inv.AcceptedAt = &now
+	return inv, nil
+}
+
+func (m *MapDB) ListByWorkspace(workspaceID string, q *ListQuery) ([]*ListedURL, int, error) {
+	return m.list(func(s *StoredURL) bool { return s.WorkspaceID == workspaceID }, q)
+}
+
+func (m *MapDB) TransferURL(key string, userID string, workspaceID string) error {
+	stored, exists := m.M[key]
+	if !exists {
+		return NewErrNotFound(fmt.Sprintf("key %s does not exist in db", key))
+	}
+	stored.UserID = userID
+	stored.WorkspaceID = workspaceID
+	m.touch(key)
+	return nil
+}
@@ -0,0 +1,277 @@
+package shortly
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+// what can be exported
+const (
+	ExportClicks = "clicks"
+	ExportURLs   = "urls"
+)
+
+// export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+const (
+	// exportSettle holds url exports back from the last few minutes, so that a change being
+	// committed as an export is read isn't left behind the cursor that export returns
+	exportSettle = 5 * time.Minute
+
+	ExportCursorHeader = "X-Export-Cursor"
+)
+
+var exportContentTypes = map[string]string{
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportNDJSON: "application/x-ndjson",
+}
+
+// csv columns are named as in ndjson so that both formats load into the same table
+var clickExportColumns = []string{"id", "key", "clicked_at", "referrer", "user_agent", "ip_hash", "browser", "os",
+	"device", "bot", "country", "city"}
+
+func clickRecord(c *db.Click) []string {
+	return []string{strconv.FormatInt(c.ID, 10), c.Key, c.ClickedAt.UTC().Format(time.RFC3339Nano), c.Referrer,
+		c.UserAgent, c.IPHash, c.Browser, c.OS, c.Device, strconv.FormatBool(c.Bot), c.Country, c.City}
+}
+
+var urlExportColumns = []string{"id", "original_string", "redirect_status", "passthrough", "campaign", "created_at",
+	"user_id", "workspace_id", "disabled_status", "disabled_reason", "updated_at", "deleted"}
+
+func urlRecord(u *db.ExportedURL) []string {
+	return []string{u.ID, u.OriginalURL, strconv.Itoa(u.RedirectStatus), strconv.FormatBool(u.Passthrough),
+		u.Campaign, u.CreatedAt.UTC().Format(time.RFC3339Nano), u.UserID, u.WorkspaceID,
+		strconv.Itoa(u.DisabledStatus), u.DisabledReason, u.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		strconv.FormatBool(u.Deleted)}
+}
+
+// Export is a prepared export of clicks or urls
+type Export struct {
+	What   string
+	Format string
+	Query  *db.ExportQuery
+	// Cursor is given to the next export to carry on where this one stops. It is set by Start,
+	// until then it is the cursor this export was given.
+	Cursor string
+}
+
+// NewExport prepares an export of what, clicks or urls, as csv or ndjson. from and to are RFC 3339
+// times, from defaults to the beginning and to to now. Clicks are exported by when they happened
+// and urls by when they last changed. A cursor from an earlier export of the same thing replaces
+// from. Clicks are written a little after they happen, so a clicks cursor carries on from the last
+// click written rather than from a time and can't be given with to.
+func NewExport(what string, format string, from string, to string, cursor string) (*Export, error) {
+	if what != ExportClicks && what != ExportURLs {
+		return nil, errors.New("can only export clicks or urls")
+	}
+	if format == "" {
+		format = ExportCSV
+	}
+	if _, ok := exportContentTypes[format]; !ok {
+		return nil, errors.New("format must be csv or ndjson")
+	}
+	e := &Export{What: what, Format: format, Query: &db.ExportQuery{}, Cursor: cursor}
+	q := e.Query
+	var err error
+	if cursor != "" && from != "" {
+		return nil, errors.New("give either from or a cursor")
+	}
+	if from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return nil, errors.New("to must be an RFC 3339 time")
+		}
+		q.To = q.To.UTC()
+		if from != "" && !q.From.Before(q.To) {
+			return nil, errors.New("from must be before to")
+		}
+	}
+
+	if what == ExportClicks {
+		if cursor != "" {
+			if to != "" {
+				return nil, errors.New("give either to or a cursor")
+			}
+			v, err := parseExportCursor(what, cursor)
+			if err != nil {
+				return nil, err
+			}
+			if q.AfterID, err = strconv.ParseInt(v, 10, 64); err != nil || q.AfterID < 0 {
+				return nil, errors.New("cursor is not from an export of " + what)
+			}
+		}
+		return e, nil
+	}
+
+	if cursor != "" {
+		v, err := parseExportCursor(what, cursor)
+		if err != nil {
+			return nil, err
+		}
+		if q.From, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return nil, errors.New("cursor is not from an export of " + what)
+		}
+	}
+	settled := time.Now().Add(-exportSettle).UTC().Truncate(time.Second)
+	if q.To.IsZero() || settled.Before(q.To) {
+		q.To = settled
+	}
+	return e, nil
+}
+
+// Start fixes where the export stops and sets the Cursor carrying on from there. Clicks stop at the
+// newest click, an export of clicks up to a time has no cursor as later clicks may be written
+// already. With nothing left to export the next export carries on from the same place.
+func (e *Export) Start(store db.Exporter) error {
+	q := e.Query
+	if e.What == ExportURLs {
+		if q.To.After(q.From) {
+			e.Cursor = exportCursor(e.What, q.To.UTC().Format(time.RFC3339Nano))
+		}
+		return nil
+	}
+	var err error
+	if q.UpToID, err = store.LastClickID(); err != nil {
+		return err
+	}
+	if q.To.IsZero() && q.UpToID > q.AfterID {
+		e.Cursor = exportCursor(e.What, strconv.FormatInt(q.UpToID, 10))
+	}
+	return nil
+}
+
+// exportCursor is an opaque token for where an export stopped, the next carries on from v, a click
+// id or a time
+func exportCursor(what string, v string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(what + "|" + v))
+}
+
+func parseExportCursor(what string, cursor string) (string, error) {
+	bad := errors.New("cursor is not from an export of " + what)
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", bad
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 || parts[0] != what {
+		return "", bad
+	}
+	return parts[1], nil
+}
+
+// exportWriter writes rows as csv, after a header, or as a json object per line
+type exportWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func newExportWriter(w io.Writer, format string) *exportWriter {
+	if format == ExportNDJSON {
+		return &exportWriter{json: json.NewEncoder(w)}
+	}
+	return &exportWriter{csv: csv.NewWriter(w)}
+}
+
+func (ew *exportWriter) header(columns []string) error {
+	if ew.csv == nil {
+		return nil
+	}
+	return ew.csv.Write(columns)
+}
+
+func (ew *exportWriter) row(v interface{}, record []string) error {
+	if ew.csv == nil {
+		return ew.json.Encode(v)
+	}
+	return ew.csv.Write(record)
+}
+
+func (ew *exportWriter) flush() error {
+	if ew.csv == nil {
+		return nil
+	}
+	ew.csv.Flush()
+	return ew.csv.Error()
+}
+
+// Write streams the export from store to w a row at a time, returning how many rows were written.
+// Start has to have been called first.
+func (e *Export) Write(store db.Exporter, w io.Writer) (int, error) {
+	ew := newExportWriter(w, e.Format)
+	n := 0
+	var err error
+	if e.What == ExportURLs {
+		if err = ew.header(urlExportColumns); err == nil {
+			err = store.ExportURLs(e.Query, func(u *db.ExportedURL) error {
+				n++
+				return ew.row(u, urlRecord(u))
+			})
+		}
+	} else {
+		if err = ew.header(clickExportColumns); err == nil {
+			err = store.ExportClicks(e.Query, func(c *db.Click) error {
+				n++
+				return ew.row(c, clickRecord(c))
+			})
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, ew.flush()
+}
+
+type ExportResponse struct {
+	Err string `json:"error"`
+}
+
+// ExportHandler streams every click or url of a time range as csv or ndjson, for loading into a
+// data warehouse. The X-Export-Cursor response header is given as ?cursor= to the next export to
+// get only what is new since. Exports have to finish within the server's write timeout, the CLI's
+// export command has no such limit.
+// curl -H "Authorization: Bearer $TOKEN" "localhost:8080/api/v1/admin/export/clicks?format=csv&from=2024-06-01T00:00:00Z"
+func (a *App) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.store.(db.Exporter)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &ExportResponse{Err: "store does not support exports"})
+		return
+	}
+	params := r.URL.Query()
+	e, err := NewExport(mux.Vars(r)["what"], params.Get("format"), params.Get("from"), params.Get("to"),
+		params.Get("cursor"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ExportResponse{Err: err.Error()})
+		return
+	}
+	if err := e.Start(s); err != nil {
+		writeJSON(w, statusForErr(err), &ExportResponse{Err: err.Error()})
+		return
+	}
+	w.Header().Set(ContentType, exportContentTypes[e.Format])
+	w.Header().Set(ExportCursorHeader, e.Cursor)
+	w.WriteHeader(http.StatusOK)
+	if _, err := e.Write(s, w); err != nil {
+		slog.ErrorContext(r.Context(), "export failed", "what", e.What, "error", err)
+		// the status has been sent, cutting the response short tells the client the export is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
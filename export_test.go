@@ -0,0 +1,171 @@
+package shortly
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	dog := apiLogin(t, app, "dog@foobarcat.com")
+	catUser, _ := store.UserByEmail("cat@foobarcat.com")
+	a.NoError(store.SetAdmin(catUser.ID, true))
+	rr := apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, dog)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	key := resp.ShortenedURL
+
+	now := time.Now().UTC()
+	store.M[key].CreatedAt = now.Add(-3 * time.Hour)
+	a.NoError(store.RecordClicks([]*db.Click{
+		{Key: key, ClickedAt: now.Add(-2 * time.Hour), Referrer: "https://news.example.com/a, b", IPHash: "a",
+			Browser: "Firefox", Country: "GB", City: "London"},
+		{Key: key, ClickedAt: now.Add(-30 * time.Minute), IPHash: "b", Browser: "Slack", Device: DeviceBot, Bot: true},
+	}))
+
+	// everything up to an hour ago, which has no cursor as later clicks have been written already
+	rr = apiRequest(app, "GET", "/api/v1/admin/export/clicks?to="+now.Add(-time.Hour).Format(time.RFC3339), "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Equal("text/csv; charset=utf-8", rr.Header().Get(ContentType))
+	a.Empty(rr.Header().Get(ExportCursorHeader))
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	a.NoError(err)
+	a.Len(records, 2)
+	a.Equal(clickExportColumns, records[0])
+	a.Equal([]string{"1", key, now.Add(-2 * time.Hour).Format(time.RFC3339Nano), "https://news.example.com/a, b", "",
+		"a", "Firefox", "", "", "false", "GB", "London"}, records[1])
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/export/clicks", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	records, err = csv.NewReader(rr.Body).ReadAll()
+	a.NoError(err)
+	a.Len(records, 3)
+
+	// then only what has been written since as ndjson, including clicks written long after they happened
+	cursor := rr.Header().Get(ExportCursorHeader)
+	a.NotEmpty(cursor)
+	a.NoError(store.RecordClicks([]*db.Click{
+		{Key: key, ClickedAt: now.Add(-time.Hour), IPHash: "c"},
+		{Key: key, ClickedAt: now, IPHash: "d"},
+	}))
+	rr = apiRequest(app, "GET", "/api/v1/admin/export/clicks?format=ndjson&cursor="+cursor, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Equal("application/x-ndjson", rr.Header().Get(ContentType))
+	lines := bufio.NewScanner(rr.Body)
+	clicks := []*db.Click{}
+	for lines.Scan() {
+		c := &db.Click{}
+		a.NoError(json.Unmarshal(lines.Bytes(), c))
+		clicks = append(clicks, c)
+	}
+	a.Len(clicks, 2)
+	a.Equal(int64(3), clicks[0].ID)
+	a.Equal("c", clicks[0].IPHash)
+	a.Equal(int64(4), clicks[1].ID)
+
+	// nothing new, the cursor stays put
+	cursor = rr.Header().Get(ExportCursorHeader)
+	rr = apiRequest(app, "GET", "/api/v1/admin/export/clicks?format=ndjson&cursor="+cursor, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Empty(rr.Body.String())
+	a.Equal(cursor, rr.Header().Get(ExportCursorHeader))
+
+	rr = apiRequest(app, "GET", "/api/v1/admin/export/urls?from="+now.Add(-4*time.Hour).Format(time.RFC3339), "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	records, err = csv.NewReader(rr.Body).ReadAll()
+	a.NoError(err)
+	a.Len(records, 2)
+	a.Equal(urlExportColumns, records[0])
+	a.Equal(key, records[1][0])
+	a.Equal("http://foobarcat.blogspot.com", records[1][1])
+	a.Equal(store.M[key].UserID, records[1][6])
+	a.Equal(now.Add(-3*time.Hour).Format(time.RFC3339Nano), records[1][10])
+	a.Equal("false", records[1][11])
+
+	// changed urls are exported again and deleted ones as tombstones
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://example.com"}`, dog)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	changed := time.Now().UTC()
+	_, err = store.Update(key, "http://foobarcat.blogspot.com/about", "")
+	a.NoError(err)
+	a.NoError(store.Delete(resp.ShortenedURL))
+	urls := []*db.ExportedURL{}
+	a.NoError(store.ExportURLs(&db.ExportQuery{From: changed}, func(u *db.ExportedURL) error {
+		urls = append(urls, u)
+		return nil
+	}))
+	a.Len(urls, 2)
+	a.Equal(key, urls[0].ID)
+	a.Equal("http://foobarcat.blogspot.com/about", urls[0].OriginalURL)
+	a.False(urls[0].Deleted)
+	a.Equal(resp.ShortenedURL, urls[1].ID)
+	a.True(urls[1].Deleted)
+	a.False(urls[1].CreatedAt.IsZero())
+
+	for _, path := range []string{
+		"/api/v1/admin/export/users",
+		"/api/v1/admin/export/clicks?format=xml",
+		"/api/v1/admin/export/clicks?from=yesterday",
+		"/api/v1/admin/export/clicks?from=2024-06-02T00:00:00Z&to=2024-06-01T00:00:00Z",
+		"/api/v1/admin/export/urls?cursor=" + cursor,
+		"/api/v1/admin/export/clicks?to=2024-06-01T00:00:00Z&cursor=" + cursor,
+		"/api/v1/admin/export/clicks?cursor=junk",
+	} {
+		rr = apiRequest(app, "GET", path, "", cat)
+		a.Equal(http.StatusBadRequest, rr.Code, path)
+	}
+	rr = apiRequest(app, "GET", "/api/v1/admin/export/clicks", "", dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+}
+
+// failingWriter fails once it has been written n bytes
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.n -= len(b); w.n < 0 {
+		return 0, errors.New("disk full")
+	}
+	return len(b), nil
+}
+
+func TestExportWrite(t *testing.T) {
+	a := assert.New(t)
+
+	store := db.NewMapDB()
+	start := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	clicks := []*db.Click{}
+	for i := 0; i < 10000; i++ {
+		clicks = append(clicks, &db.Click{Key: "7RxfRd", ClickedAt: start.Add(time.Duration(i) * time.Second),
+			UserAgent: strings.Repeat("x", 100)})
+	}
+	a.NoError(store.RecordClicks(clicks))
+
+	e, err := NewExport(ExportClicks, ExportCSV, "2024-06-03T00:00:00Z", "2024-06-03T01:00:00Z", "")
+	a.NoError(err)
+	a.NoError(e.Start(store))
+	out := &strings.Builder{}
+	n, err := e.Write(store, out)
+	a.NoError(err)
+	a.Equal(3600, n)
+	a.Equal(3601, strings.Count(out.String(), "\n"))
+
+	// the error of a writer is returned rather than the export carrying on
+	_, err = e.Write(store, &failingWriter{n: 64 * 1024})
+	a.EqualError(err, "disk full")
+}
@@ -0,0 +1,79 @@
+package shortly
+
+import (
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoLocation is where an ip is, unknown fields are empty
+type GeoLocation struct {
+	// Country is an ISO 3166 code
+	Country string
+	City    string
+}
+
+// geoRecord is the part of a GeoLite2 or GeoIP2 City or Country record that we use
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// GeoIP locates ips with a local MaxMind database, e.g. GeoLite2-City.mmdb, so that no ip ever
+// leaves the server
+type GeoIP struct {
+	path string
+	// mu guards db, which is memory mapped and so must not be closed during a lookup
+	mu sync.RWMutex
+	db *maxminddb.Reader
+}
+
+// OpenGeoIP opens the MaxMind database at path
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{path: path, db: db}, nil
+}
+
+// Reload reopens the database, for when it has been updated. The old database stays in use if the
+// new one can't be opened.
+func (g *GeoIP) Reload() error {
+	db, err := maxminddb.Open(g.path)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	old := g.db
+	g.db = db
+	g.mu.Unlock()
+	return old.Close()
+}
+
+// Lookup locates ip, returning an empty location for addresses the database doesn't cover
+func (g *GeoIP) Lookup(ip string) *GeoLocation {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return &GeoLocation{}
+	}
+	rec := &geoRecord{}
+	g.mu.RLock()
+	err := g.db.Lookup(parsed, rec)
+	g.mu.RUnlock()
+	if err != nil {
+		return &GeoLocation{}
+	}
+	return &GeoLocation{Country: rec.Country.ISOCode, City: rec.City.Names["en"]}
+}
+
+func (g *GeoIP) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.db.Close()
+}
@@ -0,0 +1,223 @@
+package shortly
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// mmdbString encodes s in the MaxMind DB data format
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint encodes n as a uint16 or uint32 of the MaxMind DB data format
+func mmdbUint(typ byte, n uint32) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{typ<<5 | byte(len(b))}, b...)
+}
+
+// mmdbMap encodes m, whose values are already encoded, in the MaxMind DB data format
+func mmdbMap(m map[string][]byte) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := []byte{7<<5 | byte(len(keys))}
+	for _, k := range keys {
+		b = append(b, mmdbString(k)...)
+		b = append(b, m[k]...)
+	}
+	return b
+}
+
+type mmdbNode struct {
+	children [2]*mmdbNode
+	// data is set on leaves
+	data []byte
+}
+
+// writeTestMMDB writes an ipv4 only MaxMind database locating each cidr in a city of a country
+func writeTestMMDB(t *testing.T, path string, cities map[string][2]string) {
+	root := &mmdbNode{}
+	for cidr, loc := range cities {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := n.Mask.Size()
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := n.IP.To4()[i/8] >> (7 - i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = mmdbMap(map[string][]byte{
+			"country": mmdbMap(map[string][]byte{"iso_code": mmdbString(loc[0])}),
+			"city":    mmdbMap(map[string][]byte{"names": mmdbMap(map[string][]byte{"en": mmdbString(loc[1])})}),
+		})
+	}
+
+	// number the internal nodes breadth first, leaves become pointers into the data section
+	var nodes []*mmdbNode
+	ids := map[*mmdbNode]int{}
+	for queue := []*mmdbNode{root}; len(queue) > 0; queue = queue[1:] {
+		ids[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, c := range queue[0].children {
+			if c != nil && c.data == nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	var data []byte
+	record := func(c *mmdbNode) int {
+		switch {
+		case c == nil:
+			return len(nodes)
+		case c.data == nil:
+			return ids[c]
+		default:
+			offset := len(data)
+			data = append(data, c.data...)
+			return len(nodes) + 16 + offset
+		}
+	}
+	var tree []byte
+	for _, n := range nodes {
+		for _, c := range n.children {
+			r := record(c)
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+
+	b := append(tree, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, "\xAB\xCD\xEFMaxMind.com"...)
+	b = append(b, mmdbMap(map[string][]byte{
+		"binary_format_major_version": mmdbUint(5, 2),
+		"binary_format_minor_version": mmdbUint(5, 0),
+		"database_type":               mmdbString("Test-City"),
+		"ip_version":                  mmdbUint(5, 4),
+		"node_count":                  mmdbUint(6, uint32(len(nodes))),
+		"record_size":                 mmdbUint(5, 24),
+	})...)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	writeTestMMDB(t, path, map[string][2]string{
+		"81.2.69.0/24":     {"GB", "London"},
+		"203.0.113.0/25":   {"FR", "Paris"},
+		"203.0.113.128/25": {"US", "Paris"},
+	})
+	geo, err := OpenGeoIP(path)
+	a.NoError(err)
+	defer geo.Close()
+	a.Equal(&GeoLocation{Country: "GB", City: "London"}, geo.Lookup("81.2.69.160"))
+	a.Equal(&GeoLocation{Country: "US", City: "Paris"}, geo.Lookup("203.0.113.200"))
+	a.Equal(&GeoLocation{}, geo.Lookup("192.0.2.1"))
+	a.Equal(&GeoLocation{}, geo.Lookup("2001:db8::1"))
+	a.Equal(&GeoLocation{}, geo.Lookup("not an ip"))
+
+	// a broken update keeps the old database, a good one replaces it
+	a.NoError(ioutil.WriteFile(path+".new", []byte("garbage"), 0600))
+	a.NoError(os.Rename(path+".new", path))
+	a.Error(geo.Reload())
+	a.Equal("London", geo.Lookup("81.2.69.160").City)
+	writeTestMMDB(t, path+".new", map[string][2]string{"81.2.69.0/24": {"GB", "Manchester"}})
+	a.NoError(os.Rename(path+".new", path))
+	a.NoError(geo.Reload())
+	a.Equal("Manchester", geo.Lookup("81.2.69.160").City)
+}
+
+func TestClientIP(t *testing.T) {
+	a := assert.New(t)
+
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	a.NoError(err)
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	a.Error(err)
+
+	resolve := func(remote string, xff ...string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote + ":1234"
+		for _, v := range xff {
+			r.Header.Add(forwardedForHeader, v)
+		}
+		return resolveClientIP(r, proxies)
+	}
+	a.Equal("81.2.69.160", resolve("81.2.69.160"))
+	// only trusted proxies may say who the client is
+	a.Equal("81.2.69.160", resolve("81.2.69.160", "203.0.113.9"))
+	a.Equal("203.0.113.9", resolve("10.1.2.3", "203.0.113.9"))
+	// spoofed addresses to the left of the client are ignored
+	a.Equal("203.0.113.9", resolve("10.1.2.3", "1.1.1.1, 203.0.113.9, 192.0.2.1"))
+	a.Equal("203.0.113.9", resolve("10.1.2.3", "1.1.1.1", "203.0.113.9, 10.9.9.9"))
+	a.Equal("10.1.2.3", resolve("10.1.2.3"))
+}
+
+func TestClickGeoIP(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	writeTestMMDB(t, path, map[string][2]string{"81.2.69.0/24": {"GB", "London"}})
+	geo, err := OpenGeoIP(path)
+	a.NoError(err)
+	defer geo.Close()
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.ClickConfig.GeoIP = geo
+	app.TrustedProxies, _ = ParseTrustedProxies("10.0.0.0/8")
+	app.DropIPs = true
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	rr := apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, cat)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+
+	req, _ := http.NewRequest("GET", "/"+resp.ShortenedURL, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(forwardedForHeader, "81.2.69.160")
+	app.server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	app.Clicks.Close()
+	a.NoError(app.Rollups.Rollup())
+
+	a.Len(store.Clicks, 1)
+	a.Equal("GB", store.Clicks[0].Country)
+	a.Equal("London", store.Clicks[0].City)
+	// no trace of the ip is kept
+	a.Empty(store.Clicks[0].IP)
+	a.Empty(store.Clicks[0].IPHash)
+	for _, e := range store.Audit {
+		a.Empty(e.IP)
+	}
+
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+resp.ShortenedURL+"/stats", "", cat)
+	stats := &URLStatsResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), stats))
+	a.Equal([]*db.StatsCount{{Value: "GB", Clicks: 1}}, stats.Stats.Countries)
+	a.Equal([]*db.StatsCount{{Value: "London, GB", Clicks: 1}}, stats.Stats.Cities)
+	a.Equal(int64(0), stats.Stats.UniqueVisitors)
+}
@@ -0,0 +1,233 @@
+// Package hll counts distinct values approximately, in a small bounded amount of space, with
+// HyperLogLog sketches. Sketches of the same precision can be merged, so the distinct values of
+// several hours, or of clicks counted by several instances, are counted by merging their sketches.
+package hll
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// Precision is how many bits of a value's hash pick its register
+	Precision = 14
+	registers = 1 << Precision
+	// q is how many bits of the hash are left to count leading zeros in, registers hold up to q+1
+	q = 64 - Precision
+
+	// StandardError is the relative standard error of counts, 1.04/sqrt(registers). About two
+	// counts in three are within 0.81% of the true count and 997 in 1000 are within 2.4%. Counts of
+	// up to a few hundred are all but exact.
+	StandardError = 1.04 / 128
+
+	// a sketch becomes dense once its sparse form is no smaller
+	sparseEntrySize = 3
+	maxSparse       = registers / sparseEntrySize
+)
+
+// serialised formats, the first byte of a marshalled sketch
+const (
+	formatSparse byte = 1
+	formatDense  byte = 2
+)
+
+var ErrBadSketch = errors.New("hll: not a valid sketch")
+
+// Sketch counts distinct values. Sketches of few values only hold the registers that are set, so
+// a sketch takes at most 16KB and far less for small counts. A Sketch isn't safe for concurrent use.
+type Sketch struct {
+	// sparse maps register to value while few registers are set, dense holds every register after
+	sparse map[uint16]uint8
+	dense  []uint8
+}
+
+func New() *Sketch {
+	return &Sketch{sparse: map[uint16]uint8{}}
+}
+
+// hash is 64 bit FNV-1a finished with murmur3's mixer, as FNV alone leaves the high bits of
+// similar values alike. It is stable across processes so sketches made anywhere can be merged.
+func hash(v string) uint64 {
+	x := uint64(14695981039346656037)
+	for i := 0; i < len(v); i++ {
+		x ^= uint64(v[i])
+		x *= 1099511628211
+	}
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add counts v
+func (s *Sketch) Add(v string) {
+	x := hash(v)
+	// the low bit set stops the count of leading zeros running past the q bits that are left
+	s.set(uint16(x>>q), uint8(bits.LeadingZeros64(x<<Precision|1<<(Precision-1))+1))
+}
+
+func (s *Sketch) set(register uint16, value uint8) {
+	if s.dense != nil {
+		if value > s.dense[register] {
+			s.dense[register] = value
+		}
+		return
+	}
+	if value > s.sparse[register] {
+		s.sparse[register] = value
+		if len(s.sparse) > maxSparse {
+			s.toDense()
+		}
+	}
+}
+
+func (s *Sketch) toDense() {
+	if s.dense != nil {
+		return
+	}
+	s.dense = make([]uint8, registers)
+	for r, v := range s.sparse {
+		s.dense[r] = v
+	}
+	s.sparse = nil
+}
+
+// Merge adds the values counted by o to s
+func (s *Sketch) Merge(o *Sketch) {
+	if o.dense != nil {
+		s.toDense()
+		for r, v := range o.dense {
+			s.set(uint16(r), v)
+		}
+		return
+	}
+	for r, v := range o.sparse {
+		s.set(r, v)
+	}
+}
+
+// Count estimates how many distinct values have been added, with Ertl's improved estimator
+// ("New cardinality estimation algorithms for HyperLogLog sketches", 2017), which needs neither
+// the empirical bias correction of HyperLogLog++ nor a switch to linear counting for small counts.
+func (s *Sketch) Count() uint64 {
+	// c counts the registers holding each value
+	var c [q + 2]int
+	if s.dense != nil {
+		for _, v := range s.dense {
+			c[v]++
+		}
+	} else {
+		c[0] = registers - len(s.sparse)
+		for _, v := range s.sparse {
+			c[v]++
+		}
+	}
+	m := float64(registers)
+	z := m * tau(1-float64(c[q+1])/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + float64(c[k]))
+	}
+	z += m * sigma(float64(c[0])/m)
+	// an empty sketch has z = +Inf and counts 0
+	return uint64(math.Round(m * m / (2 * math.Ln2 * z)))
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// MarshalBinary serialises s as its format and precision followed by either each set register
+// and its value, sorted, or every register
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	if s.dense != nil {
+		return append([]byte{formatDense, Precision}, s.dense...), nil
+	}
+	set := make([]int, 0, len(s.sparse))
+	for r := range s.sparse {
+		set = append(set, int(r))
+	}
+	sort.Ints(set)
+	b := make([]byte, 2, 2+sparseEntrySize*len(set))
+	b[0], b[1] = formatSparse, Precision
+	for _, r := range set {
+		b = append(b, byte(r>>8), byte(r), s.sparse[uint16(r)])
+	}
+	return b, nil
+}
+
+// UnmarshalBinary replaces s with a sketch serialised by MarshalBinary
+func (s *Sketch) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 || b[1] != Precision {
+		return ErrBadSketch
+	}
+	t := New()
+	switch b[0] {
+	case formatSparse:
+		if (len(b)-2)%sparseEntrySize != 0 {
+			return ErrBadSketch
+		}
+		for i := 2; i < len(b); i += sparseEntrySize {
+			r := uint16(b[i])<<8 | uint16(b[i+1])
+			if r >= registers || b[i+2] == 0 || b[i+2] > q+1 {
+				return ErrBadSketch
+			}
+			t.set(r, b[i+2])
+		}
+	case formatDense:
+		if len(b) != 2+registers {
+			return ErrBadSketch
+		}
+		t.toDense()
+		for r, v := range b[2:] {
+			if v > q+1 {
+				return ErrBadSketch
+			}
+			t.dense[r] = v
+		}
+	default:
+		return ErrBadSketch
+	}
+	*s = *t
+	return nil
+}
+
+// Unmarshal returns the sketch serialised in b
+func Unmarshal(b []byte) (*Sketch, error) {
+	s := New()
+	if err := s.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
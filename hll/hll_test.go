@@ -0,0 +1,90 @@
+package hll
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sketchOf(from int, to int) *Sketch {
+	s := New()
+	for i := from; i < to; i++ {
+		s.Add("visitor-" + strconv.Itoa(i))
+	}
+	return s
+}
+
+func TestCount(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(uint64(0), New().Count())
+	for _, n := range []int{1, 2, 10, 100, 300} {
+		a.Equal(uint64(n), sketchOf(0, n).Count(), "count of %d", n)
+	}
+	for _, n := range []int{1000, 5000, 20000, 100000, 1000000} {
+		s := sketchOf(0, n)
+		// four standard errors, which a correct sketch all but never exceeds
+		a.InDelta(n, s.Count(), 4*StandardError*float64(n), "count of %d", n)
+	}
+
+	// adding a value again changes nothing
+	s := sketchOf(0, 1000)
+	before := s.Count()
+	for i := 0; i < 1000; i++ {
+		s.Add("visitor-" + strconv.Itoa(i))
+	}
+	a.Equal(before, s.Count())
+}
+
+func TestMerge(t *testing.T) {
+	a := assert.New(t)
+
+	// sparse into sparse, dense into sparse and sparse into dense
+	for _, sizes := range [][2]int{{50, 100}, {10, 50000}, {50000, 10}, {40000, 60000}} {
+		x, y := sketchOf(0, sizes[0]), sketchOf(sizes[0]/2, sizes[0]/2+sizes[1])
+		end := sizes[0]/2 + sizes[1]
+		if end < sizes[0] {
+			end = sizes[0]
+		}
+		union := sketchOf(0, end)
+		x.Merge(y)
+		a.Equal(union.Count(), x.Count(), "merge of %v", sizes)
+		xb, _ := x.MarshalBinary()
+		ub, _ := union.MarshalBinary()
+		a.Equal(ub, xb, "merge of %v", sizes)
+	}
+
+	// per hour sketches add up to the day's
+	day := New()
+	total := 0
+	for hour := 0; hour < 24; hour++ {
+		day.Merge(sketchOf(hour*500, hour*500+1000))
+		total = hour*500 + 1000
+	}
+	a.InDelta(total, day.Count(), 4*StandardError*float64(total))
+}
+
+func TestMarshal(t *testing.T) {
+	a := assert.New(t)
+
+	for _, n := range []int{0, 1, 1000, 100000} {
+		s := sketchOf(0, n)
+		b, err := s.MarshalBinary()
+		a.NoError(err)
+		a.LessOrEqual(len(b), 2+registers)
+		u, err := Unmarshal(b)
+		a.NoError(err)
+		a.Equal(s.Count(), u.Count())
+		a.Equal(s, u)
+	}
+	b, _ := sketchOf(0, 10).MarshalBinary()
+	a.Len(b, 2+10*sparseEntrySize)
+
+	for _, b := range [][]byte{nil, {formatSparse}, {formatSparse, Precision + 1}, {formatSparse, Precision, 0},
+		{formatSparse, Precision, 0xff, 0xff, 1}, {formatSparse, Precision, 0, 1, q + 2},
+		{formatDense, Precision, 1, 2, 3}, {9, Precision}} {
+		_, err := Unmarshal(b)
+		a.Equal(ErrBadSketch, err, "%v", b)
+	}
+}
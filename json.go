@@ -0,0 +1,69 @@
+package shortly
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+
+	"github.com/aultimus/shortly/db"
+)
+
+// readJSON unmarshals the request body into v
+func readJSON(r *http.Request, v interface{}) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON marshals v and writes it with the given status code. Error responses also get the
+// request id set by RequestIDMiddleware so that failures reported by clients can be found in the logs.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set(ContentType, JSONMimeType)
+	id := w.Header().Get(requestIDHeader)
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("failed to marshal response", "request_id", id, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if status >= http.StatusBadRequest && id != "" {
+		b = withRequestID(b, id)
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// withRequestID adds a request_id field to the marshalled object b
+func withRequestID(b []byte, id string) []byte {
+	if len(b) < 2 || b[0] != '{' {
+		return b
+	}
+	field, _ := json.Marshal(id)
+	field = append([]byte(`"request_id":`), field...)
+	if len(b) > 2 {
+		field = append(field, ',')
+	}
+	return append(append([]byte{'{'}, field...), b[1:]...)
+}
+
+// statusForErr maps store errors onto http status codes
+func statusForErr(err error) int {
+	switch err.(type) {
+	case *db.ErrNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// requestActor identifies who made a request for the purposes of recording changes, the user id
+// if authenticated otherwise the client address
+func requestActor(r *http.Request) string {
+	if u := UserFromContext(r.Context()); u != nil {
+		return u.ID
+	}
+	return clientIP(r)
+}
@@ -0,0 +1,448 @@
+package shortly
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+	tokenIssuer       = domainName
+)
+
+// SigningKey is a key tokens are signed or verified with. RS256 keys without a private key can
+// only verify, which is how a retired key is kept around until the tokens it signed expire.
+type SigningKey struct {
+	KID    string
+	Method jwt.SigningMethod
+	// sign is nil for verify only keys
+	sign   interface{}
+	verify interface{}
+}
+
+// TokenIssuer signs access tokens with its active key and verifies them against any of its keys,
+// so keys can be rotated by adding a new key, making it active, and later removing the old one
+type TokenIssuer struct {
+	keys      map[string]*SigningKey
+	activeKID string
+	AccessTTL time.Duration
+	// RefreshTTL is how long a refresh token may be used for, refresh tokens are opaque and
+	// stored server side as sessions so they can be revoked
+	RefreshTTL time.Duration
+}
+
+func NewTokenIssuer(active string, keys ...*SigningKey) (*TokenIssuer, error) {
+	t := &TokenIssuer{
+		keys:       make(map[string]*SigningKey),
+		activeKID:  active,
+		AccessTTL:  defaultAccessTTL,
+		RefreshTTL: defaultRefreshTTL,
+	}
+	for _, k := range keys {
+		t.keys[k.KID] = k
+	}
+	k, exists := t.keys[active]
+	if !exists {
+		return nil, fmt.Errorf("active signing key %s is not configured", active)
+	}
+	if k.sign == nil {
+		return nil, fmt.Errorf("active signing key %s has no private key", active)
+	}
+	return t, nil
+}
+
+// NewHS256Key returns a key signing with a shared secret
+func NewHS256Key(kid string, secret []byte) *SigningKey {
+	return &SigningKey{KID: kid, Method: jwt.SigningMethodHS256, sign: secret, verify: secret}
+}
+
+// NewRS256Key returns a key signing with the given pem encoded RSA private key, or only verifying
+// if privatePEM is empty
+func NewRS256Key(kid string, privatePEM []byte, publicPEM []byte) (*SigningKey, error) {
+	k := &SigningKey{KID: kid, Method: jwt.SigningMethodRS256}
+	if len(privatePEM) > 0 {
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", kid, err)
+		}
+		k.sign = private
+		k.verify = &private.PublicKey
+		return k, nil
+	}
+	public, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", kid, err)
+	}
+	k.verify = public
+	return k, nil
+}
+
+// NewEphemeralTokenIssuer signs with a random secret, tokens won't survive a restart
+func NewEphemeralTokenIssuer() *TokenIssuer {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err.Error())
+	}
+	t, _ := NewTokenIssuer("ephemeral", NewHS256Key("ephemeral", secret))
+	return t
+}
+
+type signingKeyConfig struct {
+	KID string `json:"kid"`
+	Alg string `json:"alg"`
+	// Secret is base64 encoded, for HS256
+	Secret string `json:"secret"`
+	// PrivateKey and PublicKey are paths to pem files, for RS256
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+type signingKeysConfig struct {
+	Active string              `json:"active"`
+	Keys   []*signingKeyConfig `json:"keys"`
+}
+
+// LoadTokenIssuer reads signing keys from a json file of the form
+// {"active": "2024-06", "keys": [{"kid": "2024-06", "alg": "RS256", "private_key": "jwt.pem"},
+// {"kid": "2024-01", "alg": "HS256", "secret": "c2VjcmV0"}]}
+func LoadTokenIssuer(path string) (*TokenIssuer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &signingKeysConfig{}
+	if err := json.Unmarshal(b, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse signing keys %s: %w", path, err)
+	}
+
+	keys := []*SigningKey{}
+	for _, kc := range conf.Keys {
+		switch kc.Alg {
+		case "HS256":
+			secret, err := base64.StdEncoding.DecodeString(kc.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", kc.KID, err)
+			}
+			if len(secret) < 32 {
+				return nil, fmt.Errorf("key %s: HS256 secrets must be at least 32 bytes", kc.KID)
+			}
+			keys = append(keys, NewHS256Key(kc.KID, secret))
+		case "RS256":
+			var private, public []byte
+			if kc.PrivateKey != "" {
+				if private, err = ioutil.ReadFile(kc.PrivateKey); err != nil {
+					return nil, err
+				}
+			} else if public, err = ioutil.ReadFile(kc.PublicKey); err != nil {
+				return nil, err
+			}
+			k, err := NewRS256Key(kc.KID, private, public)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		default:
+			return nil, fmt.Errorf("key %s: unsupported alg %s", kc.KID, kc.Alg)
+		}
+	}
+	return NewTokenIssuer(conf.Active, keys...)
+}
+
+// Issue returns a signed access token for u
+func (t *TokenIssuer) Issue(u *db.User) (string, error) {
+	now := time.Now()
+	claims := &jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Subject:   u.ID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(t.AccessTTL)),
+		ID:        newToken(),
+	}
+	k := t.keys[t.activeKID]
+	token := jwt.NewWithClaims(k.Method, claims)
+	token.Header["kid"] = k.KID
+	return token.SignedString(k.sign)
+}
+
+// Verify checks the signature and expiry of an access token and returns the user id it was issued to
+func (t *TokenIssuer) Verify(tokenString string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		k, exists := t.keys[kid]
+		if !exists {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != k.Method.Alg() {
+			return nil, fmt.Errorf("signing key %s does not use %s", kid, token.Method.Alg())
+		}
+		return k.verify, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	Err          string `json:"error"`
+}
+
+type MeResponse struct {
+	User *db.User `json:"user,omitempty"`
+	Err  string   `json:"error"`
+}
+
+// issueTokens returns a new access token and refresh token for u
+func (a *App) issueTokens(u *db.User) (*TokenResponse, error) {
+	s, ok := a.sessions()
+	if !ok {
+		return nil, db.NewErrDB("store does not support user accounts")
+	}
+	access, err := a.Tokens.Issue(u)
+	if err != nil {
+		return nil, err
+	}
+	refresh := newToken()
+	now := time.Now().UTC()
+	err = s.CreateSession(&db.Session{
+		ID:        hashToken(refresh),
+		UserID:    u.ID,
+		Kind:      db.SessionRefresh,
+		CreatedAt: now,
+		ExpiresAt: now.Add(a.Tokens.RefreshTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(a.Tokens.AccessTTL.Seconds()),
+	}, nil
+}
+
+func tokenErr(msg string) *TokenResponse {
+	return &TokenResponse{Err: msg}
+}
+
+// APISignupHandler registers a user and returns tokens for them
+// curl localhost:8080/api/v1/signup -d '{"email": "cat@foobarcat.com", "password": "hunter22"}'
+func (a *App) APISignupHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.sessions()
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, tokenErr("store does not support user accounts"))
+		return
+	}
+	req := &LoginRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, tokenErr(err.Error()))
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if msg := validateCredentials(req.Email, req.Password); msg != "" {
+		writeJSON(w, http.StatusBadRequest, tokenErr(msg))
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, http.StatusInternalServerError, tokenErr(err.Error()))
+		return
+	}
+	u, err := s.CreateUser(req.Email, hash)
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrExists:
+			writeJSON(w, http.StatusConflict, tokenErr(err.Error()))
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			writeJSON(w, http.StatusInternalServerError, tokenErr(err.Error()))
+		}
+		return
+	}
+	slog.InfoContext(r.Context(), "registered user", "user_id", u.ID)
+	a.audit(r, AuditUserCreate, u.ID, nil, u)
+	a.sendVerification(r.Context(), u)
+
+	resp, err := a.issueTokens(u)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, http.StatusInternalServerError, tokenErr(err.Error()))
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// APILoginHandler exchanges an email and password for an access token and refresh token
+// curl localhost:8080/api/v1/login -d '{"email": "cat@foobarcat.com", "password": "hunter22"}'
+func (a *App) APILoginHandler(w http.ResponseWriter, r *http.Request) {
+	req := &LoginRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, tokenErr(err.Error()))
+		return
+	}
+	u, err := a.authenticate(req.Email, req.Password)
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrNotFound:
+			writeJSON(w, http.StatusUnauthorized, tokenErr("incorrect email or password"))
+		case *ErrBanned:
+			writeJSON(w, http.StatusForbidden, tokenErr(err.Error()))
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			writeJSON(w, http.StatusInternalServerError, tokenErr(err.Error()))
+		}
+		return
+	}
+	resp, err := a.issueTokens(u)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, http.StatusInternalServerError, tokenErr(err.Error()))
+		return
+	}
+	slog.InfoContext(r.Context(), "user logged in to the api", "user_id", u.ID)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// APIRefreshHandler exchanges a refresh token for a new access token and refresh token. Refresh
+// tokens are single use, the one presented is revoked.
+// curl localhost:8080/api/v1/refresh -d '{"refresh_token": "..."}'
+func (a *App) APIRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.sessions()
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, tokenErr("store does not support user accounts"))
+		return
+	}
+	req := &RefreshRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, tokenErr(err.Error()))
+		return
+	}
+	id := hashToken(req.RefreshToken)
+	session, err := s.Session(id)
+	if err != nil || session.Kind != db.SessionRefresh {
+		writeJSON(w, http.StatusUnauthorized, tokenErr("invalid refresh token"))
+		return
+	}
+	if err := s.DeleteSession(id); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, http.StatusInternalServerError, tokenErr(err.Error()))
+		return
+	}
+	u, err := s.UserByID(session.UserID)
+	if err != nil {
+		writeJSON(w, statusForErr(err), tokenErr(err.Error()))
+		return
+	}
+	if u.Banned {
+		writeJSON(w, http.StatusForbidden, tokenErr("your account has been suspended"))
+		return
+	}
+	resp, err := a.issueTokens(u)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, http.StatusInternalServerError, tokenErr(err.Error()))
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+var errNoCredentials = errors.New("missing bearer token")
+
+// bearerToken returns the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, error) {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", errNoCredentials
+	}
+	return strings.TrimSpace(h[len(prefix):]), nil
+}
+
+// TokenMiddleware rejects requests without a valid access token or api key and attaches the
+// token's user to the request context
+func (a *App) TokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unauthorized := func(msg string) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenIssuer+`"`)
+			writeJSON(w, http.StatusUnauthorized, &MeResponse{Err: msg})
+		}
+		s, ok := a.sessions()
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, &MeResponse{Err: "store does not support user accounts"})
+			return
+		}
+		token, err := bearerToken(r)
+		if err != nil {
+			unauthorized(err.Error())
+			return
+		}
+		ctx := r.Context()
+		var u *db.User
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			var scopes []string
+			u, scopes, err = a.authenticateAPIKey(r.Context(), token)
+			ctx = withScopes(ctx, scopes)
+		} else {
+			var userID string
+			userID, err = a.Tokens.Verify(token)
+			if err != nil {
+				unauthorized(err.Error())
+				return
+			}
+			u, err = s.UserByID(userID)
+		}
+		if err != nil {
+			switch err.(type) {
+			case *db.ErrNotFound:
+				unauthorized("invalid credentials")
+			default:
+				slog.ErrorContext(r.Context(), "request error", "error", err)
+				writeJSON(w, http.StatusInternalServerError, &MeResponse{Err: err.Error()})
+			}
+			return
+		}
+		if u.Banned {
+			writeJSON(w, http.StatusForbidden, &MeResponse{Err: "your account has been suspended"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withUser(ctx, u)))
+	})
+}
+
+// MeHandler returns the profile of the authenticated user
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/me
+func (a *App) MeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &MeResponse{User: UserFromContext(r.Context())})
+}
@@ -0,0 +1,160 @@
+package shortly
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rsaKeyPEMs(t *testing.T) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	return private, public
+}
+
+func TestTokenIssuerRotation(t *testing.T) {
+	a := assert.New(t)
+	u := &db.User{ID: "user-1"}
+
+	oldKey := NewHS256Key("old", []byte("0123456789abcdef0123456789abcdef"))
+	old, err := NewTokenIssuer("old", oldKey)
+	a.NoError(err)
+	oldToken, err := old.Issue(u)
+	a.NoError(err)
+
+	private, public := rsaKeyPEMs(t)
+	newKey, err := NewRS256Key("new", private, nil)
+	a.NoError(err)
+
+	// rotate, the old key can still verify tokens it signed
+	rotated, err := NewTokenIssuer("new", newKey, oldKey)
+	a.NoError(err)
+	newToken, err := rotated.Issue(u)
+	a.NoError(err)
+
+	for _, token := range []string{oldToken, newToken} {
+		sub, err := rotated.Verify(token)
+		a.NoError(err)
+		a.Equal("user-1", sub)
+	}
+
+	// once the old key is dropped its tokens are rejected
+	verifyOnly, err := NewRS256Key("new", nil, public)
+	a.NoError(err)
+	_, err = NewTokenIssuer("new", verifyOnly)
+	a.Error(err, "verify only keys can't be active")
+
+	retired, err := NewTokenIssuer("new", newKey)
+	a.NoError(err)
+	_, err = retired.Verify(oldToken)
+	a.Error(err)
+	_, err = retired.Verify(newToken)
+	a.NoError(err)
+
+	// expired tokens are rejected
+	rotated.AccessTTL = -time.Minute
+	expired, err := rotated.Issue(u)
+	a.NoError(err)
+	_, err = rotated.Verify(expired)
+	a.Error(err)
+
+	// tokens can't switch alg to use the key as an hmac secret
+	_, err = old.Verify(newToken)
+	a.Error(err)
+}
+
+func apiRequest(app *App, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAPIAuth(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+
+	rr := apiRequest(app, "GET", "/api/v1/me", "", "")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+	a.NotEmpty(rr.Header().Get("WWW-Authenticate"))
+
+	creds := `{"email": "cat@foobarcat.com", "password": "hunter22"}`
+	rr = apiRequest(app, "POST", "/api/v1/signup", creds, "")
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/signup", creds, "")
+	a.Equal(http.StatusConflict, rr.Code)
+
+	rr = apiRequest(app, "POST", "/api/v1/login", `{"email": "cat@foobarcat.com", "password": "nope"}`, "")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+
+	rr = apiRequest(app, "POST", "/api/v1/login", creds, "")
+	a.Equal(http.StatusOK, rr.Code)
+	tokens := &TokenResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), tokens))
+	a.NotEmpty(tokens.AccessToken)
+	a.NotEmpty(tokens.RefreshToken)
+	a.Equal("Bearer", tokens.TokenType)
+
+	rr = apiRequest(app, "GET", "/api/v1/me", "", tokens.AccessToken)
+	a.Equal(http.StatusOK, rr.Code)
+	me := &MeResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), me))
+	a.Equal("cat@foobarcat.com", me.User.Email)
+	a.NotContains(rr.Body.String(), "password")
+
+	rr = apiRequest(app, "GET", "/api/v1/me", "", tokens.AccessToken+"x")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+
+	// refresh tokens are single use
+	rr = apiRequest(app, "POST", "/api/v1/refresh", `{"refresh_token": "`+tokens.RefreshToken+`"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+	refreshed := &TokenResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), refreshed))
+	a.NotEqual(tokens.RefreshToken, refreshed.RefreshToken)
+	rr = apiRequest(app, "POST", "/api/v1/refresh", `{"refresh_token": "`+tokens.RefreshToken+`"}`, "")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+
+	// a refresh token is not a session cookie, and a session cookie is not a refresh token
+	var seen *db.User
+	handler := app.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = UserFromContext(r.Context())
+	}))
+	loggedIn := func(c *http.Cookie) bool {
+		seen = nil
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return seen != nil
+	}
+	a.False(loggedIn(&http.Cookie{Name: sessionCookieName, Value: refreshed.RefreshToken}))
+	rr = postForm(app, "/login", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusSeeOther, rr.Code)
+	c := sessionCookie(rr)
+	a.True(loggedIn(c))
+	rr = apiRequest(app, "POST", "/api/v1/refresh", `{"refresh_token": "`+c.Value+`"}`, "")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+	a.True(loggedIn(c))
+	rr = apiRequest(app, "POST", "/api/v1/refresh", `{"refresh_token": "`+refreshed.RefreshToken+`"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+}
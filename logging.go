@@ -0,0 +1,99 @@
+package shortly
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewLogger writes json log lines at level or above. Lines logged with the context of a request
+// carry its request id, and its trace and span ids when it is traced. Level may be a
+// *slog.LevelVar to change it while running, see LogLevelHandler.
+func NewLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(&requestLogHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     level,
+	})})
+}
+
+// requestLogHandler adds the ids of the request in the context of a record to it
+type requestLogHandler struct {
+	slog.Handler
+}
+
+func (h *requestLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *requestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *requestLogHandler) WithGroup(name string) slog.Handler {
+	return &requestLogHandler{h.Handler.WithGroup(name)}
+}
+
+// LoggingMiddleware logs each request once it has been responded to
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request", "method", r.Method, "route", routeTemplate(r),
+			"status", status, "duration_ms", float64(time.Since(start).Microseconds())/1000)
+	})
+}
+
+type LogLevelResponse struct {
+	Level string `json:"level"`
+	Err   string `json:"error"`
+}
+
+// LogLevelHandler shows and changes the level of a logger while it runs. It belongs on the debug
+// listener with the metrics rather than the public router.
+// curl localhost:6060/loglevel -X PUT -d '{"level": "debug"}'
+func LogLevelHandler(level *slog.LevelVar) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			req := &LogLevelResponse{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeJSON(w, http.StatusBadRequest, &LogLevelResponse{Level: level.Level().String(), Err: err.Error()})
+				return
+			}
+			var l slog.Level
+			if err := l.UnmarshalText([]byte(req.Level)); err != nil {
+				writeJSON(w, http.StatusBadRequest, &LogLevelResponse{Level: level.Level().String(), Err: err.Error()})
+				return
+			}
+			level.Set(l)
+			slog.Info("log level changed", "level", l.String())
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, &LogLevelResponse{Level: level.Level().String(),
+				Err: "use GET to show the log level or PUT to change it"})
+			return
+		}
+		writeJSON(w, http.StatusOK, &LogLevelResponse{Level: level.Level().String()})
+	})
+}
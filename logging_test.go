@@ -0,0 +1,123 @@
+package shortly
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// logLines returns the json log lines written since the last call
+func (b *lockedBuffer) logLines(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := []map[string]interface{}{}
+	dec := json.NewDecoder(&b.buf)
+	for {
+		line := map[string]interface{}{}
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		lines = append(lines, line)
+	}
+	b.buf.Reset()
+	return lines
+}
+
+func TestLogging(t *testing.T) {
+	a := assert.New(t)
+
+	out := &lockedBuffer{}
+	level := new(slog.LevelVar)
+	slog.SetDefault(NewLogger(out, level))
+	defer slog.SetDefault(NewLogger(os.Stderr, slog.LevelInfo))
+	tracing, err := NewTracerProvider(TracingConfig{Exporter: TraceExporterStdout, Writer: io.Discard})
+	a.NoError(err)
+	app := NewApp()
+	app.Tracing = tracing
+	app.Init(db.NewMapDB(), "8080")
+
+	// the request id of the client is kept and is on every line logged for the request, and on its
+	// error body
+	app.store = &DBErrStore{}
+	req, _ := http.NewRequest("POST", "/v1/create", strings.NewReader(`{"original_url": "http://foobarcat.blogspot.com"}`))
+	req.Header.Set("X-Request-ID", "req-cat")
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusInternalServerError, rr.Code)
+	a.Equal("req-cat", rr.Header().Get("X-Request-ID"))
+	resp := map[string]string{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	a.Equal("req-cat", resp["request_id"])
+	a.NotEmpty(resp["error"])
+
+	lines := out.logLines(t)
+	a.Len(lines, 2)
+	failure, request := lines[0], lines[1]
+	a.Equal("ERROR", failure["level"])
+	a.Equal("request error", failure["msg"])
+	a.NotEmpty(failure["error"])
+	a.Contains(failure["source"].(map[string]interface{})["function"], "CreateJSONHandler")
+	a.Equal("request", request["msg"])
+	a.Equal("POST", request["method"])
+	a.Equal("/v1/create", request["route"])
+	a.Equal(float64(http.StatusInternalServerError), request["status"])
+	for _, line := range lines {
+		a.Equal("req-cat", line["request_id"])
+		a.Len(line["trace_id"], 32)
+	}
+	a.Equal(lines[0]["trace_id"], lines[1]["trace_id"])
+
+	// otherwise one is made up, successful responses are left alone
+	app.store = db.NewMapDB()
+	rr = apiRequest(app, "POST", "/v1/create", `{"original_url": "http://foobarcat.blogspot.com"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+	id := rr.Header().Get("X-Request-ID")
+	a.NotEmpty(id)
+	a.NotContains(rr.Body.String(), "request_id")
+	lines = out.logLines(t)
+	a.Len(lines, 1)
+	a.Equal("INFO", lines[0]["level"])
+	a.Equal(id, lines[0]["request_id"])
+
+	// debug lines are only logged once the level is lowered
+	handler := LogLevelHandler(level)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/loglevel", strings.NewReader(`{"level": "debug"}`)))
+	a.Equal(http.StatusOK, rr.Code)
+	a.JSONEq(`{"level": "DEBUG", "error": ""}`, rr.Body.String())
+	a.Equal(slog.LevelDebug, level.Level())
+	out.logLines(t)
+	getPage(app, "/nothere")
+	lines = out.logLines(t)
+	a.Len(lines, 3)
+	a.Equal("handling redirect", lines[0]["msg"])
+	a.Equal("nothere", lines[0]["key"])
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/loglevel", strings.NewReader(`{"level": "loud"}`)))
+	a.Equal(http.StatusBadRequest, rr.Code)
+	a.Equal(slog.LevelDebug, level.Level())
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/loglevel", strings.NewReader(`{"level": "warn"}`)))
+	a.Equal(http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/loglevel", nil))
+	a.JSONEq(`{"level": "WARN", "error": ""}`, rr.Body.String())
+	out.logLines(t)
+	getPage(app, "/nothere")
+	lines = out.logLines(t)
+	a.Len(lines, 1)
+	a.Equal("ERROR", lines[0]["level"])
+}
@@ -0,0 +1,96 @@
+package shortly
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(m *Message) error
+}
+
+// format renders m as an RFC 5322 message. Header values with line breaks are refused so that
+// user input, e.g. a workspace name in a subject, can't add headers of its own.
+func (m *Message) format(from string) ([]byte, error) {
+	b := &bytes.Buffer{}
+	for _, h := range [][2]string{{"From", from}, {"To", m.To}, {"Subject", m.Subject}} {
+		if strings.ContainsAny(h[1], "\r\n") {
+			return nil, fmt.Errorf("%s header contains a line break", h[0])
+		}
+		// non-ascii values are encoded as RFC 2047 encoded-words, ascii ones are left as they are
+		fmt.Fprintf(b, "%s: %s\r\n", h[0], mime.QEncoding.Encode("utf-8", h[1]))
+	}
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+// SMTPMailer sends mail through an SMTP server, using STARTTLS when the server offers it
+type SMTPMailer struct {
+	// Addr is the host:port of the server
+	Addr string
+	From string
+	// Auth is optional, smtp.PlainAuth refuses to send credentials over an unencrypted connection
+	// to anything but localhost
+	Auth smtp.Auth
+}
+
+func (s *SMTPMailer) Send(m *Message) error {
+	msg, err := m.format(s.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{m.To}, msg)
+}
+
+// FileMailer appends messages to a file instead of sending them, for development
+type FileMailer struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+func (f *FileMailer) Send(m *Message) error {
+	msg, err := m.format(f.From)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(msg, "\r\n\r\n"...))
+	return err
+}
+
+// LogMailer logs messages instead of sending them, the default so nothing is sent by accident.
+// Bodies hold reset and verification links that log in as the recipient, so they are only logged
+// at debug.
+type LogMailer struct {
+}
+
+func (l *LogMailer) Send(m *Message) error {
+	slog.Info("mail", "to", m.To, "subject", m.Subject)
+	slog.Debug("mail body", "to", m.To, "body", m.Body)
+	return nil
+}
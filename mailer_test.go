@@ -0,0 +1,148 @@
+package shortly
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpStandIn is a minimal smtp server that accepts every message, for testing without a real server
+type smtpStandIn struct {
+	ln   net.Listener
+	msgs chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{ln: ln, msgs: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.msgs <- data.String()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// next returns the last message received
+func (s *smtpStandIn) next(t *testing.T) string {
+	select {
+	case m := <-s.msgs:
+		return m
+	default:
+		t.Fatal("no message was sent")
+		return ""
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	a := assert.New(t)
+	server := newSMTPStandIn(t)
+
+	m := &SMTPMailer{Addr: server.ln.Addr().String(), From: "noreply@foobarcat.com"}
+	err := m.Send(&Message{To: "cat@foobarcat.com", Subject: "hello", Body: "line one\nline two"})
+	a.NoError(err)
+	msg := server.next(t)
+	a.Contains(msg, "From: noreply@foobarcat.com\r\n")
+	a.Contains(msg, "To: cat@foobarcat.com\r\n")
+	a.Contains(msg, "Subject: hello\r\n")
+	a.Contains(msg, "line one\r\nline two")
+
+	err = m.Send(&Message{To: "cat@foobarcat.com", Subject: "hello\r\nBcc: dog@foobarcat.com"})
+	a.EqualError(err, "Subject header contains a line break")
+	err = m.Send(&Message{To: "cat@foobarcat.com", Subject: "Invitation to Café"})
+	a.NoError(err)
+	a.Contains(server.next(t), "Subject: =?utf-8?q?Invitation_to_Caf=C3=A9?=\r\n")
+
+	m.Addr = "127.0.0.1:1"
+	a.Error(m.Send(&Message{To: "cat@foobarcat.com", Subject: "hello"}))
+}
+
+func TestFileMailer(t *testing.T) {
+	a := assert.New(t)
+	path := filepath.Join(t.TempDir(), "mail.txt")
+
+	m := &FileMailer{Path: path, From: "noreply@foobarcat.com"}
+	a.NoError(m.Send(&Message{To: "cat@foobarcat.com", Subject: "first", Body: "one"}))
+	a.NoError(m.Send(&Message{To: "dog@foobarcat.com", Subject: "second", Body: "two"}))
+	b, err := ioutil.ReadFile(path)
+	a.NoError(err)
+	a.Contains(string(b), "Subject: first")
+	a.Contains(string(b), "To: dog@foobarcat.com")
+
+}
+
+func TestLogMailer(t *testing.T) {
+	a := assert.New(t)
+	out := &lockedBuffer{}
+	level := new(slog.LevelVar)
+	slog.SetDefault(NewLogger(out, level))
+	defer slog.SetDefault(NewLogger(os.Stderr, slog.LevelInfo))
+
+	// bodies carry links that log in as the recipient, they are only logged at debug
+	m := &Message{To: "cat@foobarcat.com", Subject: "Reset your password", Body: "https://sho.rt/reset?token=secret"}
+	a.NoError((&LogMailer{}).Send(m))
+	lines := out.logLines(t)
+	a.Len(lines, 1)
+	a.Equal("cat@foobarcat.com", lines[0]["to"])
+	a.Equal("Reset your password", lines[0]["subject"])
+	a.NotContains(lines[0], "body")
+
+	level.Set(slog.LevelDebug)
+	a.NoError((&LogMailer{}).Send(m))
+	lines = out.logLines(t)
+	a.Len(lines, 2)
+	a.Equal(m.Body, lines[1]["body"])
+}
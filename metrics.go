@@ -0,0 +1,197 @@
+package shortly
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const metricsNamespace = "shortly"
+
+// Metrics are the prometheus collectors of an App. Each App has its own registry, which Handler
+// serves in the prometheus text format.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	storeDuration   *prometheus.HistogramVec
+	storeErrors     *prometheus.CounterVec
+	collisions      prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to respond to requests by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_operation_duration_seconds",
+			Help:      "Time taken by store operations by backend and method.",
+			// lookups are on every redirect so the buckets start well below a millisecond
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"backend", "method"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_errors_total",
+			Help:      "Store operations that failed by backend and method, not found is not a failure.",
+		}, []string{"backend", "method"}),
+		collisions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "create_collisions_total",
+			Help:      "Keys that were taken by another link, each costs creating a link another attempt.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration, m.storeDuration, m.storeErrors, m.collisions,
+	)
+	return m
+}
+
+// Handler serves the metrics to prometheus
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder remembers the status written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Middleware counts and times requests, labelled by their route template
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(status)}
+			m.requests.With(labels).Inc()
+			m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// watchClicks exports the counters of a click tracker, which keeps them itself
+func (m *Metrics) watchClicks(t *ClickTracker) {
+	counter := func(name string, help string, value func(s *ClickStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: metricsNamespace, Name: name, Help: help},
+			func() float64 { return float64(value(t.Stats())) })
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "click_queue_depth",
+			Help:      "Clicks waiting to be written.",
+		}, func() float64 { return float64(t.Stats().Queued) }),
+		counter("clicks_written_total", "Clicks written to the store.",
+			func(s *ClickStats) uint64 { return s.Written }),
+		counter("clicks_overflowed_total", "Clicks dropped because the queue was full.",
+			func(s *ClickStats) uint64 { return s.Overflowed }),
+		counter("clicks_dropped_total", "Clicks lost because the store failed to write their batch.",
+			func(s *ClickStats) uint64 { return s.Dropped }),
+	)
+}
+
+// backendName labels the metrics of store
+func backendName(store db.DBer) string {
+	switch s := store.(type) {
+	case *observedBackend:
+		return s.backend
+	case *db.PostgresDB:
+		return "postgres"
+	case *db.DynamoService:
+		return "dynamodb"
+	case *db.MapDB:
+		return "memory"
+	default:
+		return fmt.Sprintf("%T", store)
+	}
+}
+
+// observedStore times and traces the url lookups and writes of a store as part of a request. The
+// rest of the backend's methods are timed by observedBackend.
+type observedStore struct {
+	db.DBer
+	backend string
+	metrics *Metrics
+	ctx     context.Context
+	tracer  trace.Tracer
+}
+
+func (s *observedStore) start(method string, key string) (time.Time, trace.Span) {
+	_, span := s.tracer.Start(s.ctx, "store."+method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBOperation(method), attribute.String("shortly.store", s.backend),
+			attribute.String("shortly.key", key)))
+	return time.Now(), span
+}
+
+func (s *observedStore) observe(method string, start time.Time, span trace.Span, err error) {
+	s.metrics.storeDuration.WithLabelValues(s.backend, method).Observe(time.Since(start).Seconds())
+	if _, notFound := err.(*db.ErrNotFound); err != nil && !notFound {
+		s.metrics.storeErrors.WithLabelValues(s.backend, method).Inc()
+	}
+	endSpan(span, err)
+}
+
+func (s *observedStore) Create(key string, value *db.StoredURL) error {
+	start, span := s.start("Create", key)
+	err := s.DBer.Create(key, value)
+	s.observe("Create", start, span, err)
+	return err
+}
+
+func (s *observedStore) Get(key string) (*db.StoredURL, error) {
+	start, span := s.start("Get", key)
+	storedURL, err := s.DBer.Get(key)
+	s.observe("Get", start, span, err)
+	return storedURL, err
+}
+
+// urls is the store for looking up and creating urls, with the calls observed as children of
+// the span in ctx
+func (a *App) urls(ctx context.Context) db.DBer {
+	return &observedStore{DBer: a.store, backend: backendName(a.store), metrics: a.Metrics, ctx: ctx,
+		tracer: a.tracer()}
+}
@@ -0,0 +1,73 @@
+package shortly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(app *App) string {
+	rr := httptest.NewRecorder()
+	app.Metrics.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	return rr.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+
+	for _, body := range []string{
+		`{"original_url": "http://foobarcat.blogspot.com"}`,
+		// hashes to the same key as the first, taking another attempt
+		`{"original_url": "http://foobarcat.blogspot.com", "redirect_status": 308}`,
+	} {
+		rr := apiRequest(app, "POST", "/v1/create", body, "")
+		a.Equal(http.StatusOK, rr.Code)
+	}
+	getPage(app, "/nothere")
+	getPage(app, "/nothere")
+
+	out := scrape(app)
+	a.Contains(out, `shortly_http_requests_total{method="POST",route="/v1/create",status="200"} 2`)
+	// links are counted by route rather than each getting their own series
+	a.Contains(out, `shortly_http_requests_total{method="GET",route="/{url}",status="404"} 2`)
+	a.NotContains(out, "nothere")
+	a.Contains(out, `shortly_http_request_duration_seconds_count{method="GET",route="/{url}",status="404"} 2`)
+	a.Contains(out, "shortly_create_collisions_total 1")
+	a.Contains(out, `shortly_store_operation_duration_seconds_count{backend="memory",method="Create"} 2`)
+	a.Contains(out, "shortly_click_queue_depth 0")
+	a.Contains(out, "shortly_clicks_written_total 0")
+	a.NotContains(out, "shortly_store_errors_total{")
+
+	app.store = &DBErrStore{}
+	getPage(app, "/cat")
+	out = scrape(app)
+	a.Contains(out, `shortly_store_errors_total{backend="*shortly.DBErrStore",method="Get"} 1`)
+	a.Contains(out, `shortly_http_requests_total{method="GET",route="/{url}",status="500"} 1`)
+}
+
+func TestStoreMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.Init(db.NewMapDB(), "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	rr := apiRequest(app, "GET", "/api/v1/urls", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.NoError(app.Rollups.Rollup())
+
+	// every method of the backend is timed, whether called by a request or by a background job
+	out := scrape(app)
+	for _, method := range []string{"CreateUser", "CreateSession", "ListByUser", "RollupClicks"} {
+		a.Contains(out, `shortly_store_operation_duration_seconds_count{backend="memory",method="`+method+`"} 1`,
+			method)
+	}
+	// the in memory backend has no visitors to backfill
+	a.NotContains(out, `method="BackfillSketches"`)
+	a.NotContains(out, "shortly_store_errors_total{")
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS url_revisions (
+  url_id TEXT NOT NULL REFERENCES urls(id) ON DELETE CASCADE,
+  revision INTEGER NOT NULL,      -- 1-based, per short code
+  old_url TEXT NOT NULL,
+  new_url TEXT NOT NULL,
+  changed_by TEXT,
+  changed_at TIMESTAMP DEFAULT now(),
+  PRIMARY KEY (url_id, revision)
+);
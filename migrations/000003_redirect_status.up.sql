@@ -0,0 +1,2 @@
+-- 0 means the application default is used
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_status INTEGER NOT NULL DEFAULT 0;
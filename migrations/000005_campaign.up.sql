@@ -0,0 +1,2 @@
+-- url encoded parameters merged into original_url at redirect time, empty for untagged links
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS campaign TEXT NOT NULL DEFAULT '';
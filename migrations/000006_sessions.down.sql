@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS sessions;
+DROP INDEX IF EXISTS users_email_lower_idx;
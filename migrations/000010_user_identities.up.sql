@@ -0,0 +1,8 @@
+-- users signing in through an OpenID Connect provider, identified by the provider's subject
+CREATE TABLE IF NOT EXISTS user_identities (
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ DEFAULT now(),
+  PRIMARY KEY (issuer, subject)
+);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS admin_actions;
+ALTER TABLE urls DROP COLUMN IF EXISTS disabled_reason;
+ALTER TABLE urls DROP COLUMN IF EXISTS disabled_status;
+ALTER TABLE users DROP COLUMN IF EXISTS ban_reason;
+ALTER TABLE users DROP COLUMN IF EXISTS banned_at;
+ALTER TABLE users DROP COLUMN IF EXISTS is_admin;
@@ -0,0 +1,12 @@
+-- clicks are written in batches after the redirect has been served, url_id has no foreign key so
+-- that a url deleted in the meantime can't fail the rest of its batch
+CREATE TABLE IF NOT EXISTS clicks (
+  id BIGSERIAL PRIMARY KEY,
+  url_id TEXT NOT NULL,
+  clicked_at TIMESTAMPTZ NOT NULL,
+  referrer TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  ip_hash TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS clicks_url_id_idx ON clicks (url_id, clicked_at);
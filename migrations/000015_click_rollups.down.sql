@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS click_dimension_rollups;
+DROP TABLE IF EXISTS click_visitors;
+DROP TABLE IF EXISTS click_rollups;
+DROP INDEX IF EXISTS clicks_pending_rollup_idx;
+ALTER TABLE clicks DROP COLUMN IF EXISTS rolled_up;
+ALTER TABLE clicks DROP COLUMN IF EXISTS country;
+ALTER TABLE clicks DROP COLUMN IF EXISTS os;
+ALTER TABLE clicks DROP COLUMN IF EXISTS browser;
+ALTER TABLE clicks DROP COLUMN IF EXISTS referrer_host;
@@ -0,0 +1,34 @@
+-- referrer_host is what referrers are rolled up by, worked out by the app alongside referrer
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS referrer_host TEXT NOT NULL DEFAULT '';
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS browser TEXT NOT NULL DEFAULT '';
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS os TEXT NOT NULL DEFAULT '';
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '';
+-- clicks are marked once they have been added to the rollups below, rather than tracking the
+-- highest id rolled up, because ids from concurrent batches can commit out of order
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS rolled_up BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE INDEX IF NOT EXISTS clicks_pending_rollup_idx ON clicks (id) WHERE NOT rolled_up;
+
+-- buckets are the start of the hour or day in UTC
+CREATE TABLE IF NOT EXISTS click_rollups (
+  url_id TEXT NOT NULL,
+  hour TIMESTAMPTZ NOT NULL,
+  clicks BIGINT NOT NULL,
+  PRIMARY KEY (url_id, hour)
+);
+
+-- the distinct visitors of each hour, counted at query time for exact uniques over any range
+CREATE TABLE IF NOT EXISTS click_visitors (
+  url_id TEXT NOT NULL,
+  hour TIMESTAMPTZ NOT NULL,
+  ip_hash TEXT NOT NULL,
+  PRIMARY KEY (url_id, hour, ip_hash)
+);
+
+CREATE TABLE IF NOT EXISTS click_dimension_rollups (
+  url_id TEXT NOT NULL,
+  day TIMESTAMPTZ NOT NULL,
+  dimension TEXT NOT NULL,    -- referrer, country, browser or os
+  value TEXT NOT NULL,
+  clicks BIGINT NOT NULL,
+  PRIMARY KEY (url_id, day, dimension, value)
+);
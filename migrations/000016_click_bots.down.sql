@@ -0,0 +1,27 @@
+-- bot and human rollups are merged back together
+CREATE TEMPORARY TABLE merged_rollups AS
+  SELECT url_id, hour, sum(clicks) AS clicks FROM click_rollups GROUP BY url_id, hour;
+DELETE FROM click_rollups;
+ALTER TABLE click_rollups DROP CONSTRAINT IF EXISTS click_rollups_pkey;
+ALTER TABLE click_rollups DROP COLUMN IF EXISTS bot;
+INSERT INTO click_rollups SELECT url_id, hour, clicks FROM merged_rollups;
+ALTER TABLE click_rollups ADD PRIMARY KEY (url_id, hour);
+
+CREATE TEMPORARY TABLE merged_visitors AS SELECT DISTINCT url_id, hour, ip_hash FROM click_visitors;
+DELETE FROM click_visitors;
+ALTER TABLE click_visitors DROP CONSTRAINT IF EXISTS click_visitors_pkey;
+ALTER TABLE click_visitors DROP COLUMN IF EXISTS bot;
+INSERT INTO click_visitors SELECT url_id, hour, ip_hash FROM merged_visitors;
+ALTER TABLE click_visitors ADD PRIMARY KEY (url_id, hour, ip_hash);
+
+CREATE TEMPORARY TABLE merged_dimensions AS
+  SELECT url_id, day, dimension, value, sum(clicks) AS clicks FROM click_dimension_rollups
+  WHERE dimension <> 'device' GROUP BY url_id, day, dimension, value;
+DELETE FROM click_dimension_rollups;
+ALTER TABLE click_dimension_rollups DROP CONSTRAINT IF EXISTS click_dimension_rollups_pkey;
+ALTER TABLE click_dimension_rollups DROP COLUMN IF EXISTS bot;
+INSERT INTO click_dimension_rollups SELECT url_id, day, dimension, value, clicks FROM merged_dimensions;
+ALTER TABLE click_dimension_rollups ADD PRIMARY KEY (url_id, day, dimension, value);
+
+ALTER TABLE clicks DROP COLUMN IF EXISTS bot;
+ALTER TABLE clicks DROP COLUMN IF EXISTS device;
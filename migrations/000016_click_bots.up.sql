@@ -0,0 +1,15 @@
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS device TEXT NOT NULL DEFAULT '';
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- bots are rolled up separately so that stats can leave them out
+ALTER TABLE click_rollups ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE click_rollups DROP CONSTRAINT IF EXISTS click_rollups_pkey;
+ALTER TABLE click_rollups ADD PRIMARY KEY (url_id, hour, bot);
+
+ALTER TABLE click_visitors ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE click_visitors DROP CONSTRAINT IF EXISTS click_visitors_pkey;
+ALTER TABLE click_visitors ADD PRIMARY KEY (url_id, hour, bot, ip_hash);
+
+ALTER TABLE click_dimension_rollups ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE click_dimension_rollups DROP CONSTRAINT IF EXISTS click_dimension_rollups_pkey;
+ALTER TABLE click_dimension_rollups ADD PRIMARY KEY (url_id, day, bot, dimension, value);
@@ -0,0 +1,2 @@
+DELETE FROM click_dimension_rollups WHERE dimension = 'city';
+ALTER TABLE clicks DROP COLUMN IF EXISTS city;
@@ -0,0 +1 @@
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS city TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS click_visitors (
+  url_id TEXT NOT NULL,
+  hour TIMESTAMPTZ NOT NULL,
+  bot BOOLEAN NOT NULL DEFAULT FALSE,
+  ip_hash TEXT NOT NULL,
+  PRIMARY KEY (url_id, hour, bot, ip_hash)
+);
+INSERT INTO click_visitors (url_id, hour, bot, ip_hash)
+  SELECT DISTINCT url_id, date_trunc('hour', clicked_at, 'UTC'), bot, ip_hash FROM clicks
+  WHERE rolled_up AND ip_hash <> ''
+  ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS click_sketches;
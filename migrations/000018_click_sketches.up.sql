@@ -0,0 +1,13 @@
+-- HyperLogLog sketches of the visitors of each hour and day, merged at query time to estimate
+-- uniques over any range, replacing the exact visitors of each hour
+CREATE TABLE IF NOT EXISTS click_sketches (
+  url_id TEXT NOT NULL,
+  bucket TEXT NOT NULL,    -- hour or day
+  start TIMESTAMPTZ NOT NULL,
+  bot BOOLEAN NOT NULL,
+  sketch BYTEA NOT NULL,
+  PRIMARY KEY (url_id, bucket, start, bot)
+);
+
+-- click_visitors is kept until the rollup job has sketched it in batches, so the clicks rolled up
+-- before now keep their counts and only their uniques catch up
@@ -0,0 +1,3 @@
+-- exports read clicks and urls in order of time and then id
+CREATE INDEX IF NOT EXISTS clicks_clicked_at_idx ON clicks (clicked_at, id);
+CREATE INDEX IF NOT EXISTS urls_created_at_idx ON urls (created_at, id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS url_deletions;
+DROP INDEX IF EXISTS urls_changed_at_idx;
+ALTER TABLE urls DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,12 @@
+-- urls are exported by when they last changed so that edits, moderation and transfers are exported
+-- again. updated_at is NULL until a url first changes, which saves rewriting every url.
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS urls_changed_at_idx ON urls ((COALESCE(updated_at, created_at)), id);
+
+-- deleted urls are exported as tombstones
+CREATE TABLE IF NOT EXISTS url_deletions (
+  url_id TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL,
+  deleted_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS url_deletions_deleted_at_idx ON url_deletions (deleted_at, url_id);
@@ -0,0 +1,417 @@
+package shortly
+
+import (
+	"time"
+
+	"github.com/aultimus/shortly/db"
+)
+
+// fullStore is every capability of the postgres and in memory backends
+type fullStore interface {
+	db.DBer
+	db.UserStore
+	db.SessionStore
+	db.APIKeyStore
+	db.IdentityStore
+	db.AccountRecovery
+	db.Reviser
+	db.Owner
+	db.Moderator
+	db.WorkspaceStore
+	db.Auditor
+	db.ClickRecorder
+	db.ClickCounter
+	db.ClickStatter
+	db.Exporter
+	db.Webhooker
+}
+
+var (
+	_ fullStore = (*db.PostgresDB)(nil)
+	_ fullStore = (*db.MapDB)(nil)
+	_ fullStore = (*observedBackend)(nil)
+)
+
+// observedBackend times every call to a backend and counts the calls that fail, by method. It is
+// what a.store is for backends with every capability, so requests and background jobs alike are
+// observed. Create and Get are passed straight through as they are observed by observedStore,
+// which also traces them as part of a request.
+type observedBackend struct {
+	store   fullStore
+	backend string
+	metrics *Metrics
+}
+
+// observeBackend wraps store in an observedBackend if it has every capability, other backends
+// only support url lookups and writes and are observed by observedStore alone
+func (a *App) observeBackend(store db.DBer) db.DBer {
+	s, ok := store.(fullStore)
+	if !ok {
+		return store
+	}
+	return &observedBackend{store: s, backend: backendName(store), metrics: a.Metrics}
+}
+
+func (b *observedBackend) observe(method string, start time.Time, err *error) {
+	b.metrics.storeDuration.WithLabelValues(b.backend, method).Observe(time.Since(start).Seconds())
+	if _, notFound := (*err).(*db.ErrNotFound); *err != nil && !notFound {
+		b.metrics.storeErrors.WithLabelValues(b.backend, method).Inc()
+	}
+}
+
+func (b *observedBackend) Create(key string, value *db.StoredURL) error {
+	return b.store.Create(key, value)
+}
+
+func (b *observedBackend) Get(key string) (*db.StoredURL, error) {
+	return b.store.Get(key)
+}
+
+// BackfillSketches has nothing to do for backends without visitors left to sketch
+func (b *observedBackend) BackfillSketches(limit int) (n int, err error) {
+	s, ok := b.store.(db.SketchBackfiller)
+	if !ok {
+		return 0, nil
+	}
+	defer b.observe("BackfillSketches", time.Now(), &err)
+	return s.BackfillSketches(limit)
+}
+
+// db.UserStore
+
+func (b *observedBackend) CreateUser(email string, passwordHash string) (user *db.User, err error) {
+	defer b.observe("CreateUser", time.Now(), &err)
+	return b.store.CreateUser(email, passwordHash)
+}
+
+func (b *observedBackend) UserByID(id string) (user *db.User, err error) {
+	defer b.observe("UserByID", time.Now(), &err)
+	return b.store.UserByID(id)
+}
+
+func (b *observedBackend) UserByEmail(email string) (user *db.User, err error) {
+	defer b.observe("UserByEmail", time.Now(), &err)
+	return b.store.UserByEmail(email)
+}
+
+// db.SessionStore
+
+func (b *observedBackend) CreateSession(s *db.Session) (err error) {
+	defer b.observe("CreateSession", time.Now(), &err)
+	return b.store.CreateSession(s)
+}
+
+func (b *observedBackend) Session(id string) (session *db.Session, err error) {
+	defer b.observe("Session", time.Now(), &err)
+	return b.store.Session(id)
+}
+
+func (b *observedBackend) DeleteSession(id string) (err error) {
+	defer b.observe("DeleteSession", time.Now(), &err)
+	return b.store.DeleteSession(id)
+}
+
+// db.APIKeyStore
+
+func (b *observedBackend) CreateAPIKey(k *db.APIKey) (err error) {
+	defer b.observe("CreateAPIKey", time.Now(), &err)
+	return b.store.CreateAPIKey(k)
+}
+
+func (b *observedBackend) APIKeysByUser(userID string) (keys []*db.APIKey, err error) {
+	defer b.observe("APIKeysByUser", time.Now(), &err)
+	return b.store.APIKeysByUser(userID)
+}
+
+func (b *observedBackend) APIKeyByHash(hash string) (key *db.APIKey, err error) {
+	defer b.observe("APIKeyByHash", time.Now(), &err)
+	return b.store.APIKeyByHash(hash)
+}
+
+func (b *observedBackend) RevokeAPIKey(userID string, id string) (err error) {
+	defer b.observe("RevokeAPIKey", time.Now(), &err)
+	return b.store.RevokeAPIKey(userID, id)
+}
+
+func (b *observedBackend) TouchAPIKey(id string, usedAt time.Time) (err error) {
+	defer b.observe("TouchAPIKey", time.Now(), &err)
+	return b.store.TouchAPIKey(id, usedAt)
+}
+
+// db.IdentityStore
+
+func (b *observedBackend) UserByIdentity(issuer string, subject string) (user *db.User, err error) {
+	defer b.observe("UserByIdentity", time.Now(), &err)
+	return b.store.UserByIdentity(issuer, subject)
+}
+
+func (b *observedBackend) LinkIdentity(userID string, issuer string, subject string) (err error) {
+	defer b.observe("LinkIdentity", time.Now(), &err)
+	return b.store.LinkIdentity(userID, issuer, subject)
+}
+
+// db.AccountRecovery
+
+func (b *observedBackend) CreateUserToken(t *db.UserToken) (err error) {
+	defer b.observe("CreateUserToken", time.Now(), &err)
+	return b.store.CreateUserToken(t)
+}
+
+func (b *observedBackend) UseUserToken(hash string, purpose string) (token *db.UserToken, err error) {
+	defer b.observe("UseUserToken", time.Now(), &err)
+	return b.store.UseUserToken(hash, purpose)
+}
+
+func (b *observedBackend) SetEmailVerified(userID string) (err error) {
+	defer b.observe("SetEmailVerified", time.Now(), &err)
+	return b.store.SetEmailVerified(userID)
+}
+
+func (b *observedBackend) SetPassword(userID string, passwordHash string) (err error) {
+	defer b.observe("SetPassword", time.Now(), &err)
+	return b.store.SetPassword(userID, passwordHash)
+}
+
+func (b *observedBackend) DeleteUserSessions(userID string) (err error) {
+	defer b.observe("DeleteUserSessions", time.Now(), &err)
+	return b.store.DeleteUserSessions(userID)
+}
+
+// db.Reviser
+
+func (b *observedBackend) Update(key string, newURL string, changedBy string) (rev *db.Revision, err error) {
+	defer b.observe("Update", time.Now(), &err)
+	return b.store.Update(key, newURL, changedBy)
+}
+
+func (b *observedBackend) Revisions(key string) (revs []*db.Revision, err error) {
+	defer b.observe("Revisions", time.Now(), &err)
+	return b.store.Revisions(key)
+}
+
+// db.Owner
+
+func (b *observedBackend) ListByUser(userID string, q *db.ListQuery) (urls []*db.ListedURL, total int, err error) {
+	defer b.observe("ListByUser", time.Now(), &err)
+	return b.store.ListByUser(userID, q)
+}
+
+func (b *observedBackend) Delete(key string) (err error) {
+	defer b.observe("Delete", time.Now(), &err)
+	return b.store.Delete(key)
+}
+
+// db.Moderator
+
+func (b *observedBackend) SearchURLs(q *db.ListQuery) (urls []*db.ListedURL, total int, err error) {
+	defer b.observe("SearchURLs", time.Now(), &err)
+	return b.store.SearchURLs(q)
+}
+
+func (b *observedBackend) SetDisabled(key string, status int, reason string) (err error) {
+	defer b.observe("SetDisabled", time.Now(), &err)
+	return b.store.SetDisabled(key, status, reason)
+}
+
+func (b *observedBackend) DisableUserURLs(userID string, status int, reason string) (n int, err error) {
+	defer b.observe("DisableUserURLs", time.Now(), &err)
+	return b.store.DisableUserURLs(userID, status, reason)
+}
+
+func (b *observedBackend) SearchUsers(q *db.ListQuery) (users []*db.User, total int, err error) {
+	defer b.observe("SearchUsers", time.Now(), &err)
+	return b.store.SearchUsers(q)
+}
+
+func (b *observedBackend) SetAdmin(userID string, admin bool) (err error) {
+	defer b.observe("SetAdmin", time.Now(), &err)
+	return b.store.SetAdmin(userID, admin)
+}
+
+func (b *observedBackend) SetBanned(userID string, banned bool, reason string) (err error) {
+	defer b.observe("SetBanned", time.Now(), &err)
+	return b.store.SetBanned(userID, banned, reason)
+}
+
+func (b *observedBackend) RecordAdminAction(act *db.AdminAction) (err error) {
+	defer b.observe("RecordAdminAction", time.Now(), &err)
+	return b.store.RecordAdminAction(act)
+}
+
+func (b *observedBackend) AdminActions(offset int, limit int) (actions []*db.AdminAction, total int, err error) {
+	defer b.observe("AdminActions", time.Now(), &err)
+	return b.store.AdminActions(offset, limit)
+}
+
+// db.WorkspaceStore
+
+func (b *observedBackend) CreateWorkspace(name string, ownerID string) (workspace *db.Workspace, err error) {
+	defer b.observe("CreateWorkspace", time.Now(), &err)
+	return b.store.CreateWorkspace(name, ownerID)
+}
+
+func (b *observedBackend) Workspace(id string) (workspace *db.Workspace, err error) {
+	defer b.observe("Workspace", time.Now(), &err)
+	return b.store.Workspace(id)
+}
+
+func (b *observedBackend) WorkspacesByUser(userID string) (workspaces []*db.Workspace, err error) {
+	defer b.observe("WorkspacesByUser", time.Now(), &err)
+	return b.store.WorkspacesByUser(userID)
+}
+
+func (b *observedBackend) Members(workspaceID string) (members []*db.Member, err error) {
+	defer b.observe("Members", time.Now(), &err)
+	return b.store.Members(workspaceID)
+}
+
+func (b *observedBackend) Member(workspaceID string, userID string) (member *db.Member, err error) {
+	defer b.observe("Member", time.Now(), &err)
+	return b.store.Member(workspaceID, userID)
+}
+
+func (b *observedBackend) AddMember(m *db.Member) (err error) {
+	defer b.observe("AddMember", time.Now(), &err)
+	return b.store.AddMember(m)
+}
+
+func (b *observedBackend) SetRole(workspaceID string, userID string, role string) (err error) {
+	defer b.observe("SetRole", time.Now(), &err)
+	return b.store.SetRole(workspaceID, userID, role)
+}
+
+func (b *observedBackend) RemoveMember(workspaceID string, userID string) (err error) {
+	defer b.observe("RemoveMember", time.Now(), &err)
+	return b.store.RemoveMember(workspaceID, userID)
+}
+
+func (b *observedBackend) TransferWorkspace(workspaceID string, newOwnerID string) (err error) {
+	defer b.observe("TransferWorkspace", time.Now(), &err)
+	return b.store.TransferWorkspace(workspaceID, newOwnerID)
+}
+
+func (b *observedBackend) CreateInvitation(inv *db.Invitation) (err error) {
+	defer b.observe("CreateInvitation", time.Now(), &err)
+	return b.store.CreateInvitation(inv)
+}
+
+func (b *observedBackend) AcceptInvitation(hash string, userID string, email string) (inv *db.Invitation,
+	err error) {
+	defer b.observe("AcceptInvitation", time.Now(), &err)
+	return b.store.AcceptInvitation(hash, userID, email)
+}
+
+func (b *observedBackend) ListByWorkspace(workspaceID string, q *db.ListQuery) (urls []*db.ListedURL,
+	total int, err error) {
+	defer b.observe("ListByWorkspace", time.Now(), &err)
+	return b.store.ListByWorkspace(workspaceID, q)
+}
+
+func (b *observedBackend) TransferURL(key string, userID string, workspaceID string) (err error) {
+	defer b.observe("TransferURL", time.Now(), &err)
+	return b.store.TransferURL(key, userID, workspaceID)
+}
+
+// db.Auditor
+
+func (b *observedBackend) RecordAuditEvent(e *db.AuditEvent) (err error) {
+	defer b.observe("RecordAuditEvent", time.Now(), &err)
+	return b.store.RecordAuditEvent(e)
+}
+
+func (b *observedBackend) AuditEvents(f *db.AuditFilter) (events []*db.AuditEvent, total int, err error) {
+	defer b.observe("AuditEvents", time.Now(), &err)
+	return b.store.AuditEvents(f)
+}
+
+// db.ClickRecorder
+
+func (b *observedBackend) RecordClicks(clicks []*db.Click) (err error) {
+	defer b.observe("RecordClicks", time.Now(), &err)
+	return b.store.RecordClicks(clicks)
+}
+
+// db.ClickCounter
+
+func (b *observedBackend) ClickCounts(keys []string) (counts map[string]int64, err error) {
+	defer b.observe("ClickCounts", time.Now(), &err)
+	return b.store.ClickCounts(keys)
+}
+
+// db.ClickStatter
+
+func (b *observedBackend) RollupClicks(limit int) (n int, err error) {
+	defer b.observe("RollupClicks", time.Now(), &err)
+	return b.store.RollupClicks(limit)
+}
+
+func (b *observedBackend) ClickStats(q *db.StatsQuery) (stats *db.Stats, err error) {
+	defer b.observe("ClickStats", time.Now(), &err)
+	return b.store.ClickStats(q)
+}
+
+// db.Exporter
+
+func (b *observedBackend) LastClickID() (id int64, err error) {
+	defer b.observe("LastClickID", time.Now(), &err)
+	return b.store.LastClickID()
+}
+
+func (b *observedBackend) ExportClicks(q *db.ExportQuery, fn func(*db.Click) error) (err error) {
+	defer b.observe("ExportClicks", time.Now(), &err)
+	return b.store.ExportClicks(q, fn)
+}
+
+func (b *observedBackend) ExportURLs(q *db.ExportQuery, fn func(*db.ExportedURL) error) (err error) {
+	defer b.observe("ExportURLs", time.Now(), &err)
+	return b.store.ExportURLs(q, fn)
+}
+
+// db.Webhooker
+
+func (b *observedBackend) CreateWebhook(h *db.Webhook) (err error) {
+	defer b.observe("CreateWebhook", time.Now(), &err)
+	return b.store.CreateWebhook(h)
+}
+
+func (b *observedBackend) Webhook(id string) (hook *db.Webhook, err error) {
+	defer b.observe("Webhook", time.Now(), &err)
+	return b.store.Webhook(id)
+}
+
+func (b *observedBackend) Webhooks(userID string, workspaceID string) (hooks []*db.Webhook, err error) {
+	defer b.observe("Webhooks", time.Now(), &err)
+	return b.store.Webhooks(userID, workspaceID)
+}
+
+func (b *observedBackend) DeleteWebhook(id string) (err error) {
+	defer b.observe("DeleteWebhook", time.Now(), &err)
+	return b.store.DeleteWebhook(id)
+}
+
+func (b *observedBackend) EnqueueDelivery(d *db.WebhookDelivery) (queued bool, err error) {
+	defer b.observe("EnqueueDelivery", time.Now(), &err)
+	return b.store.EnqueueDelivery(d)
+}
+
+func (b *observedBackend) ClaimDeliveries(now time.Time, lease time.Duration,
+	limit int) (deliveries []*db.WebhookDelivery, err error) {
+	defer b.observe("ClaimDeliveries", time.Now(), &err)
+	return b.store.ClaimDeliveries(now, lease, limit)
+}
+
+func (b *observedBackend) UpdateDelivery(d *db.WebhookDelivery) (err error) {
+	defer b.observe("UpdateDelivery", time.Now(), &err)
+	return b.store.UpdateDelivery(d)
+}
+
+func (b *observedBackend) Delivery(id string) (delivery *db.WebhookDelivery, err error) {
+	defer b.observe("Delivery", time.Now(), &err)
+	return b.store.Delivery(id)
+}
+
+func (b *observedBackend) Deliveries(webhookID string, status string, offset int,
+	limit int) (deliveries []*db.WebhookDelivery, total int, err error) {
+	defer b.observe("Deliveries", time.Now(), &err)
+	return b.store.Deliveries(webhookID, status, offset, limit)
+}
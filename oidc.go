@@ -0,0 +1,454 @@
+package shortly
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcStateCookieName = "oidc_state"
+	oidcStateTTL        = 10 * time.Minute
+	// jwksRefreshFreq limits how often an unknown kid causes the provider's keys to be refetched
+	jwksRefreshFreq = time.Minute
+)
+
+// OIDCConfig describes the OpenID Connect provider users may log in with
+type OIDCConfig struct {
+	// Issuer is the provider's issuer url, its configuration is discovered from
+	// Issuer/.well-known/openid-configuration
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL is where the provider sends users back to, https://sh.foobarcat.com/login/oidc/callback
+	RedirectURL string `json:"redirect_url"`
+	// AllowedDomains restricts logins to email addresses at these domains, any domain if empty
+	AllowedDomains []string `json:"allowed_domains"`
+}
+
+// LoadOIDCConfig reads an OIDCConfig from a json file
+func LoadOIDCConfig(path string) (*OIDCConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &OIDCConfig{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse oidc config %s: %w", path, err)
+	}
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc config %s needs an issuer, client_id and redirect_url", path)
+	}
+	return c, nil
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	KID string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// OIDCProvider logs users in with the authorization code flow and PKCE, verifying ID tokens
+// against the provider's published keys
+type OIDCProvider struct {
+	Config    *OIDCConfig
+	discovery *oidcDiscovery
+	client    *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// NewOIDCProvider discovers the provider's endpoints and fetches its signing keys
+func NewOIDCProvider(c *OIDCConfig) (*OIDCProvider, error) {
+	p := &OIDCProvider{Config: c, client: &http.Client{Timeout: 10 * time.Second}}
+	d := &oidcDiscovery{}
+	if err := p.getJSON(strings.TrimSuffix(c.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	if d.Issuer != c.Issuer {
+		return nil, fmt.Errorf("oidc discovery returned issuer %s, expected %s", d.Issuer, c.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery document for %s is incomplete", c.Issuer)
+	}
+	p.discovery = d
+	if err := p.refreshKeys(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// refreshKeys fetches the provider's RSA signing keys, callers must not hold p.mu
+func (p *OIDCProvider) refreshKeys() error {
+	set := &struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}{}
+	if err := p.getJSON(p.discovery.JWKSURI, set); err != nil {
+		return fmt.Errorf("failed to fetch oidc keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("oidc key %s: %w", k.KID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("oidc key %s: %w", k.KID, err)
+		}
+		keys[k.KID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// key returns the public key with the given kid, refetching the key set if the provider may have
+// rotated its keys
+func (p *OIDCProvider) key(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	k, exists := p.keys[kid]
+	stale := time.Since(p.keysFetched) > jwksRefreshFreq
+	p.mu.Unlock()
+	if exists {
+		return k, nil
+	}
+	if stale {
+		if err := p.refreshKeys(); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		k, exists = p.keys[kid]
+		p.mu.Unlock()
+		if exists {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown oidc signing key %q", kid)
+}
+
+// pkceChallenge is the S256 code challenge for verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where users are sent to log in at the provider
+func (p *OIDCProvider) AuthCodeURL(state string, nonce string, verifier string) string {
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.Config.ClientID},
+		"redirect_uri":          {p.Config.RedirectURL},
+		"scope":                 {"openid email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// Exchange trades an authorization code for the user's ID token
+func (p *OIDCProvider) Exchange(code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.Config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.Config.ClientSecret == "" {
+		form.Set("client_id", p.Config.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(ContentType, "application/x-www-form-urlencoded")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	tr := &struct {
+		IDToken string `json:"id_token"`
+		Err     string `json:"error"`
+		Desc    string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(tr); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Err != "" {
+		return "", fmt.Errorf("token exchange failed with %d: %s %s", resp.StatusCode, tr.Err, tr.Desc)
+	}
+	if tr.IDToken == "" {
+		return "", fmt.Errorf("token response has no id_token")
+	}
+	return tr.IDToken, nil
+}
+
+// IDTokenClaims are the claims of a verified ID token that shortly uses
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce"`
+	AZP           string `json:"azp"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *OIDCProvider) VerifyIDToken(raw string, nonce string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(p.Config.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("id token nonce does not match")
+	}
+	if len(claims.Audience) > 1 && claims.AZP != p.Config.ClientID {
+		return nil, fmt.Errorf("id token was not issued to this client")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("id token has no subject")
+	}
+	return claims, nil
+}
+
+// AllowedEmail reports whether email may log in, it must be verified by the provider and at one of
+// the allowed domains if any are configured
+func (p *OIDCProvider) AllowedEmail(claims *IDTokenClaims) bool {
+	if claims.Email == "" || claims.EmailVerified == nil || !*claims.EmailVerified {
+		return false
+	}
+	if len(p.Config.AllowedDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(claims.Email, "@")
+	domain := strings.ToLower(claims.Email[at+1:])
+	for _, d := range p.Config.AllowedDomains {
+		if strings.ToLower(d) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcState is what the login request remembers in a cookie to check the callback against
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// provisionOIDCUser returns the user linked to the token's subject, linking an existing account
+// with the same email or creating a new account on their first login. Existing accounts that
+// never verified their email are reclaimed before they are linked, see reclaimUnverifiedUser.
+func (a *App) provisionOIDCUser(r *http.Request, claims *IDTokenClaims) (*db.User, error) {
+	s, ok := a.sessions()
+	ids, idsOK := a.store.(db.IdentityStore)
+	if !ok || !idsOK {
+		return nil, db.NewErrDB("store does not support single sign-on")
+	}
+	issuer := a.OIDC.Config.Issuer
+	u, err := ids.UserByIdentity(issuer, claims.Subject)
+	if err == nil {
+		return u, nil
+	}
+	if _, notFound := err.(*db.ErrNotFound); !notFound {
+		return nil, err
+	}
+
+	u, err = s.UserByEmail(claims.Email)
+	if _, notFound := err.(*db.ErrNotFound); notFound {
+		// sso users have no password, they can set one with a password reset
+		u, err = s.CreateUser(claims.Email, "")
+		if err == nil {
+			slog.InfoContext(r.Context(), "registered user", "user_id", u.ID, "issuer", issuer)
+			a.audit(r, AuditUserCreate, u.ID, nil, u)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !u.EmailVerified {
+		if err := a.reclaimUnverifiedUser(u); err != nil {
+			return nil, err
+		}
+	}
+	if err := ids.LinkIdentity(u.ID, issuer, claims.Subject); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// reclaimUnverifiedUser hands an account whose email was never verified to the owner of the
+// address, whom the identity provider has vouched for. Whoever signed up never proved they own
+// the address, so the password, sessions and api keys they may have set up are dropped.
+func (a *App) reclaimUnverifiedUser(u *db.User) error {
+	rec, ok := a.recovery()
+	if !ok {
+		return db.NewErrDB("store does not support account recovery")
+	}
+	if err := rec.SetPassword(u.ID, ""); err != nil {
+		return err
+	}
+	u.PasswordHash = ""
+	if err := rec.DeleteUserSessions(u.ID); err != nil {
+		return err
+	}
+	if err := a.revokeAPIKeys(u.ID); err != nil {
+		return err
+	}
+	if err := rec.SetEmailVerified(u.ID); err != nil {
+		return err
+	}
+	u.EmailVerified = true
+	return nil
+}
+
+// OIDCLoginHandler sends the user to the identity provider to log in
+func (a *App) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	st := &oidcState{State: newToken(), Nonce: newToken(), Verifier: newToken()}
+	b, _ := json.Marshal(st)
+	// lax so the cookie is sent when the provider redirects back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, a.OIDC.AuthCodeURL(st.State, st.Nonce, st.Verifier), http.StatusFound)
+}
+
+// OIDCCallbackHandler completes a login at the identity provider and starts a session
+func (a *App) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if a.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	data := &AuthTemplateData{PageTitle: "Log in", Action: "/login", SSO: true}
+	fail := func(status int, msg string) {
+		data.Err = msg
+		renderAuthPage(w, r, status, data)
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/login/oidc", MaxAge: -1,
+		HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		fail(http.StatusUnauthorized, "single sign-on failed: "+e)
+		return
+	}
+	st := &oidcState{}
+	c, err := r.Cookie(oidcStateCookieName)
+	if err == nil {
+		var b []byte
+		if b, err = base64.RawURLEncoding.DecodeString(c.Value); err == nil {
+			err = json.Unmarshal(b, st)
+		}
+	}
+	if err != nil || st.State == "" || q.Get("state") != st.State {
+		fail(http.StatusBadRequest, "single sign-on session expired, please try again")
+		return
+	}
+
+	raw, err := a.OIDC.Exchange(q.Get("code"), st.Verifier)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		fail(http.StatusBadGateway, "single sign-on failed")
+		return
+	}
+	claims, err := a.OIDC.VerifyIDToken(raw, st.Nonce)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "invalid id token", "error", err)
+		fail(http.StatusUnauthorized, "single sign-on failed")
+		return
+	}
+	if !a.OIDC.AllowedEmail(claims) {
+		slog.InfoContext(r.Context(), "refused single sign-on", "email", claims.Email)
+		fail(http.StatusForbidden, "your account is not allowed to log in")
+		return
+	}
+
+	u, err := a.provisionOIDCUser(r, claims)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		fail(statusForErr(err), "something went wrong")
+		return
+	}
+	if u.Banned {
+		fail(http.StatusForbidden, "your account has been suspended")
+		return
+	}
+	if err := a.startSession(w, u); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		fail(http.StatusInternalServerError, "something went wrong")
+		return
+	}
+	slog.InfoContext(r.Context(), "user logged in with single sign-on", "user_id", u.ID)
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
@@ -0,0 +1,310 @@
+package shortly
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testClientID     = "shortly"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "https://sh.foobarcat.com/login/oidc/callback"
+)
+
+type mockLogin struct {
+	nonce     string
+	challenge string
+}
+
+// mockIdP is a local OpenID Connect provider that logs in whoever is set as its user
+type mockIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+	kid string
+
+	mu    sync.Mutex
+	user  jwt.MapClaims
+	codes map[string]*mockLogin
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, kid: "idp-1", codes: make(map[string]*mockLogin)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kid": idp.kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("redirect_uri") != testRedirectURL ||
+		q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code := newToken()
+	idp.mu.Lock()
+	idp.codes[code] = &mockLogin{nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	idp.mu.Unlock()
+	v := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+v.Encode(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != testClientID || secret != testClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	idp.mu.Lock()
+	login, exists := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+	if !exists || r.PostFormValue("grant_type") != "authorization_code" ||
+		pkceChallenge(r.PostFormValue("code_verifier")) != login.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	claims := jwt.MapClaims{"nonce": login.nonce}
+	for k, v := range idp.user {
+		claims[k] = v
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id_token": idp.sign(claims), "token_type": "Bearer"})
+}
+
+// sign returns an id token for claims, filling in the standard claims that aren't set
+func (idp *mockIdP) sign(claims jwt.MapClaims) string {
+	now := time.Now()
+	defaults := jwt.MapClaims{"iss": idp.URL, "aud": testClientID, "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+	for k, v := range defaults {
+		if _, set := claims[k]; !set {
+			claims[k] = v
+		}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idp.mu.Lock()
+	token.Header["kid"] = idp.kid
+	s, err := token.SignedString(idp.key)
+	idp.mu.Unlock()
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return s
+}
+
+// ssoLogin logs in through the mock idp as its current user, returning the callback's response
+func ssoLogin(t *testing.T, app *App, idp *mockIdP) *httptest.ResponseRecorder {
+	rr := getPage(app, "/login/oidc")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the idp, got %d", rr.Code)
+	}
+	var state *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == oidcStateCookieName {
+			state = c
+		}
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noFollow.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	return getPage(app, "/login/oidc/callback?"+callback.RawQuery, state)
+}
+
+func newSSOApp(t *testing.T, idp *mockIdP, domains ...string) (*App, *db.MapDB) {
+	p, err := NewOIDCProvider(&OIDCConfig{Issuer: idp.URL, ClientID: testClientID, ClientSecret: testClientSecret,
+		RedirectURL: testRedirectURL, AllowedDomains: domains})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp()
+	app.OIDC = p
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	return app, store
+}
+
+func TestOIDCLogin(t *testing.T) {
+	a := assert.New(t)
+	idp := newMockIdP(t)
+	app, store := newSSOApp(t, idp, "FooBarCat.com")
+
+	rr := getPage(app, "/login")
+	a.Contains(rr.Body.String(), "/login/oidc")
+
+	// the first login provisions an account without a password
+	idp.user = jwt.MapClaims{"sub": "cat-1", "email": "cat@foobarcat.com", "email_verified": true}
+	rr = ssoLogin(t, app, idp)
+	a.Equal(http.StatusSeeOther, rr.Code)
+	session := sessionCookie(rr)
+	a.NotNil(session)
+	rr = getPage(app, "/dashboard", session)
+	a.Equal(http.StatusOK, rr.Code)
+	u, err := store.UserByEmail("cat@foobarcat.com")
+	a.NoError(err)
+	a.Empty(u.PasswordHash)
+	a.True(u.EmailVerified)
+	_, err = app.authenticate("cat@foobarcat.com", "")
+	a.IsType(&db.ErrNotFound{}, err)
+
+	// later logins find the same account even if the email changes
+	idp.user["email"] = "cat@FOOBARCAT.com"
+	rr = ssoLogin(t, app, idp)
+	a.Equal(http.StatusSeeOther, rr.Code)
+	a.Len(store.Users, 1)
+
+	// existing password accounts are linked by email, ones that never verified their email lose
+	// whatever whoever signed up with it set up
+	rr = postForm(app, "/signup", url.Values{"email": {"dog@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusSeeOther, rr.Code)
+	squatter := sessionCookie(rr)
+	idp.user = jwt.MapClaims{"sub": "dog-1", "email": "dog@foobarcat.com", "email_verified": true}
+	rr = ssoLogin(t, app, idp)
+	a.Equal(http.StatusSeeOther, rr.Code)
+	a.Len(store.Users, 2)
+	dog, _ := store.UserByIdentity(idp.URL, "dog-1")
+	a.Equal("dog@foobarcat.com", dog.Email)
+	a.True(dog.EmailVerified)
+	_, err = app.authenticate("dog@foobarcat.com", "hunter22")
+	a.Error(err)
+	rr = getPage(app, "/dashboard", squatter)
+	a.NotEqual(http.StatusOK, rr.Code)
+
+	rr = postForm(app, "/signup", url.Values{"email": {"bat@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusSeeOther, rr.Code)
+	bat, _ := store.UserByEmail("bat@foobarcat.com")
+	a.NoError(store.SetEmailVerified(bat.ID))
+	idp.user = jwt.MapClaims{"sub": "bat-1", "email": "bat@foobarcat.com", "email_verified": true}
+	rr = ssoLogin(t, app, idp)
+	a.Equal(http.StatusSeeOther, rr.Code)
+	_, err = app.authenticate("bat@foobarcat.com", "hunter22")
+	a.NoError(err)
+
+	// other domains and unverified emails are refused
+	idp.user = jwt.MapClaims{"sub": "rat-1", "email": "rat@evil.com", "email_verified": true}
+	rr = ssoLogin(t, app, idp)
+	a.Equal(http.StatusForbidden, rr.Code)
+	idp.user = jwt.MapClaims{"sub": "cow-1", "email": "cow@foobarcat.com", "email_verified": false}
+	rr = ssoLogin(t, app, idp)
+	a.Equal(http.StatusForbidden, rr.Code)
+	a.Len(store.Users, 3)
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	a := assert.New(t)
+	idp := newMockIdP(t)
+	app, _ := newSSOApp(t, idp)
+	idp.user = jwt.MapClaims{"sub": "cat-1", "email": "cat@foobarcat.com", "email_verified": true}
+
+	// without the state cookie set by /login/oidc
+	rr := getPage(app, "/login/oidc/callback?code=abc&state=abc")
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	rr = getPage(app, "/login/oidc/callback?error=access_denied")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+
+	// a forged state
+	rr = getPage(app, "/login/oidc")
+	state := rr.Result().Cookies()[0]
+	rr = getPage(app, "/login/oidc/callback?code=abc&state=forged", state)
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	// sso is off unless configured
+	app = NewApp()
+	app.Init(db.NewMapDB(), "8080")
+	rr = getPage(app, "/login/oidc")
+	a.Equal(http.StatusNotFound, rr.Code)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	a := assert.New(t)
+	idp := newMockIdP(t)
+	app, _ := newSSOApp(t, idp)
+	p := app.OIDC
+
+	valid := func() jwt.MapClaims { return jwt.MapClaims{"sub": "cat-1", "nonce": "n"} }
+	claims, err := p.VerifyIDToken(idp.sign(valid()), "n")
+	a.NoError(err)
+	a.Equal("cat-1", claims.Subject)
+
+	_, err = p.VerifyIDToken(idp.sign(valid()), "other")
+	a.Error(err)
+	c := valid()
+	c["aud"] = "someone-else"
+	_, err = p.VerifyIDToken(idp.sign(c), "n")
+	a.Error(err)
+	c = valid()
+	c["iss"] = "https://evil.com"
+	_, err = p.VerifyIDToken(idp.sign(c), "n")
+	a.Error(err)
+	c = valid()
+	c["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = p.VerifyIDToken(idp.sign(c), "n")
+	a.Error(err)
+	c = valid()
+	c["aud"] = []string{testClientID, "someone-else"}
+	_, err = p.VerifyIDToken(idp.sign(c), "n")
+	a.Error(err)
+	c["azp"] = testClientID
+	_, err = p.VerifyIDToken(idp.sign(c), "n")
+	a.NoError(err)
+
+	// a token signed by another key
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "cat-1", "nonce": "n",
+		"iss": idp.URL, "aud": testClientID, "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = idp.kid
+	forged, _ := token.SignedString(other)
+	_, err = p.VerifyIDToken(forged, "n")
+	a.Error(err)
+
+	// rotated keys are fetched when an unknown kid is seen
+	idp.mu.Lock()
+	idp.key, idp.kid = other, "idp-2"
+	idp.mu.Unlock()
+	p.keysFetched = time.Time{}
+	_, err = p.VerifyIDToken(idp.sign(valid()), "n")
+	a.NoError(err)
+}
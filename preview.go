@@ -0,0 +1,144 @@
+package shortly
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Safety is the result of checking a destination before following it
+type Safety struct {
+	Safe     bool     `json:"safe"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// SafetyChecker inspects the destination of a link for anything a visitor should be warned about
+type SafetyChecker interface {
+	Check(destination string) *Safety
+}
+
+// HeuristicSafety flags destinations using tricks commonly seen in phishing links. It does not
+// consult any external reputation service.
+type HeuristicSafety struct {
+}
+
+func (h *HeuristicSafety) Check(destination string) *Safety {
+	s := &Safety{}
+	u, err := url.Parse(destination)
+	if err != nil {
+		s.Warnings = append(s.Warnings, "destination is not a valid url")
+		return s
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		s.Warnings = append(s.Warnings, "destination uses the non web scheme "+u.Scheme)
+	}
+	if u.User != nil {
+		s.Warnings = append(s.Warnings, "destination contains credentials, the real host is "+u.Hostname())
+	}
+	if net.ParseIP(u.Hostname()) != nil {
+		s.Warnings = append(s.Warnings, "destination is a raw ip address")
+	}
+	for _, label := range strings.Split(u.Hostname(), ".") {
+		if strings.HasPrefix(label, "xn--") {
+			s.Warnings = append(s.Warnings, "destination host contains internationalised characters")
+			break
+		}
+	}
+	s.Safe = len(s.Warnings) == 0
+	return s
+}
+
+type PreviewResponse struct {
+	ShortURL       string    `json:"short_url"`
+	Destination    string    `json:"destination"`
+	CreatedAt      time.Time `json:"created_at"`
+	RedirectStatus int       `json:"redirect_status"`
+	Passthrough    bool      `json:"passthrough,omitempty"`
+	Safety         *Safety   `json:"safety,omitempty"`
+	Err            string    `json:"error"`
+}
+
+type PreviewTemplateData struct {
+	PageTitle string
+	Found     bool
+	Disabled  bool
+	*PreviewResponse
+}
+
+// preview gathers what we know about a shortened url without following it
+func (a *App) preview(ctx context.Context, shortenedURL string) (*PreviewResponse, int) {
+	resp := &PreviewResponse{ShortURL: domainName + "/" + shortenedURL}
+	storedURL, err := a.urls(ctx).Get(shortenedURL)
+	if err != nil {
+		slog.ErrorContext(ctx, "request error", "error", err)
+		resp.Err = err.Error()
+		return resp, statusForErr(err)
+	}
+	if storedURL.DisabledStatus != 0 {
+		resp.Err = disabledMessage(storedURL)
+		return resp, storedURL.DisabledStatus
+	}
+	resp.Destination, err = destination(storedURL, "", nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "request error", "error", err)
+		resp.Err = err.Error()
+		return resp, http.StatusInternalServerError
+	}
+	resp.CreatedAt = storedURL.CreatedAt
+	resp.RedirectStatus = a.redirectStatus(storedURL)
+	resp.Passthrough = storedURL.Passthrough
+	resp.Safety = a.safety().Check(resp.Destination)
+	return resp, http.StatusOK
+}
+
+func (a *App) safety() SafetyChecker {
+	if a.Safety == nil {
+		return &HeuristicSafety{}
+	}
+	return a.Safety
+}
+
+// PreviewHandler shows where a shortened url leads without redirecting. It serves /{url}+ and
+// /{url} on the preview host, responding with json if the client accepts it and html otherwise.
+func (a *App) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	shortenedURL := mux.Vars(r)["url"]
+	slog.DebugContext(r.Context(), "handling preview", "key", shortenedURL)
+	resp, status := a.preview(r.Context(), shortenedURL)
+
+	if strings.Contains(r.Header.Get("Accept"), JSONMimeType) {
+		writeJSON(w, status, resp)
+		return
+	}
+
+	w.Header().Set(ContentType, "text/html")
+	t, err := template.New("preview.html").ParseFiles("templates/preview.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	err = t.Execute(w, &PreviewTemplateData{
+		PageTitle:       "Preview of " + resp.ShortURL,
+		Found:           status == http.StatusOK,
+		Disabled:        ValidDisabledStatus(status),
+		PreviewResponse: resp,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+	}
+}
+
+// PreviewJSONHandler provides the data of the preview page as json
+// curl localhost:8080/v1/preview/7RxfRd
+func (a *App) PreviewJSONHandler(w http.ResponseWriter, r *http.Request) {
+	resp, status := a.preview(r.Context(), mux.Vars(r)["url"])
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,339 @@
+package shortly
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+)
+
+const (
+	verifyTokenTTL = 48 * time.Hour
+	resetTokenTTL  = time.Hour
+)
+
+type VerifyRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type AccountResponse struct {
+	Msg string `json:"message,omitempty"`
+	Err string `json:"error"`
+}
+
+// recovery returns the store as a db.AccountRecovery if the backend supports emailed tokens
+func (a *App) recovery() (db.AccountRecovery, bool) {
+	s, ok := a.store.(db.AccountRecovery)
+	return s, ok
+}
+
+// emailToken stores a new single use token for u and mails a link containing it
+func (a *App) emailToken(u *db.User, purpose string, ttl time.Duration, path string, subject string, body string) error {
+	s, ok := a.recovery()
+	if !ok {
+		return db.NewErrDB("store does not support account recovery")
+	}
+	token := newToken()
+	now := time.Now().UTC()
+	err := s.CreateUserToken(&db.UserToken{
+		Hash:      hashToken(token),
+		UserID:    u.ID,
+		Purpose:   purpose,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	link := a.BaseURL + path + "?token=" + token
+	return a.Mailer.Send(&Message{To: u.Email, Subject: subject, Body: fmt.Sprintf(body, link)})
+}
+
+// sendVerification emails u a link confirming they own their address. Failures are logged rather
+// than returned, a user who never gets the email can ask for another.
+func (a *App) sendVerification(ctx context.Context, u *db.User) {
+	if _, ok := a.recovery(); !ok || u.EmailVerified {
+		return
+	}
+	err := a.emailToken(u, db.TokenVerifyEmail, verifyTokenTTL, "/verify", "Verify your email address",
+		"Welcome to Shortly! Confirm your email address by visiting\n\n%s\n\nThe link expires in 48 hours.\n")
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to send verification email", "user_id", u.ID, "error", err)
+	}
+}
+
+// sendPasswordReset emails the user with the given address a reset link if they exist. It never
+// reports whether the address belongs to an account.
+func (a *App) sendPasswordReset(email string) error {
+	s, ok := a.sessions()
+	if !ok {
+		return db.NewErrDB("store does not support user accounts")
+	}
+	u, err := s.UserByEmail(strings.TrimSpace(email))
+	if err != nil {
+		if _, ok := err.(*db.ErrNotFound); ok {
+			return nil
+		}
+		return err
+	}
+	return a.emailToken(u, db.TokenResetPassword, resetTokenTTL, "/reset/confirm", "Reset your password",
+		"Someone asked to reset your Shortly password. If it was you, choose a new one at\n\n%s\n\n"+
+			"The link expires in an hour. If it wasn't you, you can ignore this email.\n")
+}
+
+// verifyEmail marks the owner of token as having verified their address
+func (a *App) verifyEmail(token string) (string, error) {
+	s, ok := a.recovery()
+	if !ok {
+		return "", db.NewErrDB("store does not support account recovery")
+	}
+	t, err := s.UseUserToken(hashToken(token), db.TokenVerifyEmail)
+	if err != nil {
+		return "", err
+	}
+	return t.UserID, s.SetEmailVerified(t.UserID)
+}
+
+// resetPassword sets a new password for the owner of token, logging them out everywhere. Their
+// api keys are revoked too, as whoever knew the old password could have made some.
+func (a *App) resetPassword(token string, password string) (string, error) {
+	s, ok := a.recovery()
+	if !ok {
+		return "", db.NewErrDB("store does not support account recovery")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	t, err := s.UseUserToken(hashToken(token), db.TokenResetPassword)
+	if err != nil {
+		return "", err
+	}
+	if err := s.SetPassword(t.UserID, hash); err != nil {
+		return "", err
+	}
+	if err := s.DeleteUserSessions(t.UserID); err != nil {
+		return "", err
+	}
+	return t.UserID, a.revokeAPIKeys(t.UserID)
+}
+
+// revokeAPIKeys revokes all of a user's api keys
+func (a *App) revokeAPIKeys(userID string) error {
+	keys, ok := a.store.(db.APIKeyStore)
+	if !ok {
+		return nil
+	}
+	existing, err := keys.APIKeysByUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, k := range existing {
+		if err := keys.RevokeAPIKey(userID, k.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type AccountTemplateData struct {
+	PageTitle string
+	// Action is where the form posts, no form is shown when it is empty
+	Action string
+	Token  string
+	// Confirm replaces the form's fields with a question, for forms that just submit the token
+	Confirm   string
+	CSRFToken string
+	Msg       string
+	Err       string
+}
+
+func renderAccountPage(w http.ResponseWriter, r *http.Request, status int, data *AccountTemplateData) {
+	data.CSRFToken = csrfToken(w, r)
+	w.Header().Set(ContentType, "text/html")
+	t, err := template.New("account.html").ParseFiles("templates/account.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	if err := t.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+	}
+}
+
+// VerifyEmailHandler handles the link in verification emails
+func (a *App) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	data := &AccountTemplateData{PageTitle: "Verify email"}
+	userID, err := a.verifyEmail(r.URL.Query().Get("token"))
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrNotFound:
+			data.Err = "this link is invalid or has expired"
+			renderAccountPage(w, r, http.StatusBadRequest, data)
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			data.Err = "something went wrong"
+			renderAccountPage(w, r, http.StatusInternalServerError, data)
+		}
+		return
+	}
+	slog.InfoContext(r.Context(), "user verified their email", "user_id", userID)
+	a.audit(r, AuditUserVerifyEmail, userID, nil, nil)
+	data.Msg = "Thanks, your email address is verified."
+	renderAccountPage(w, r, http.StatusOK, data)
+}
+
+// ForgotPasswordPageHandler serves the form asking for the email to send a reset link to
+func (a *App) ForgotPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderAccountPage(w, r, http.StatusOK, &AccountTemplateData{PageTitle: "Reset password", Action: "/reset"})
+}
+
+// ForgotPasswordHandler emails a reset link, the response is the same whether or not the account exists
+func (a *App) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := &AccountTemplateData{PageTitle: "Reset password"}
+	if err := a.sendPasswordReset(r.PostFormValue("email")); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		data.Err = "something went wrong"
+		renderAccountPage(w, r, http.StatusInternalServerError, data)
+		return
+	}
+	data.Msg = "If an account exists for that address we've emailed it a link to reset the password."
+	renderAccountPage(w, r, http.StatusOK, data)
+}
+
+// ResetPasswordPageHandler serves the form for choosing a new password. The token is only used when
+// the form is submitted so that mail scanners following the link don't spend it.
+func (a *App) ResetPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderAccountPage(w, r, http.StatusOK, &AccountTemplateData{
+		PageTitle: "Choose a new password", Action: "/reset/confirm", Token: r.URL.Query().Get("token")})
+}
+
+// ResetPasswordHandler sets the new password from the reset form
+func (a *App) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := &AccountTemplateData{
+		PageTitle: "Choose a new password", Action: "/reset/confirm", Token: r.PostFormValue("token")}
+	password := r.PostFormValue("password")
+	if len(password) < minPasswordLength {
+		data.Err = "passwords must be at least 8 characters"
+		renderAccountPage(w, r, http.StatusBadRequest, data)
+		return
+	}
+	userID, err := a.resetPassword(data.Token, password)
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrNotFound:
+			data.Action = ""
+			data.Err = "this link is invalid or has expired"
+			renderAccountPage(w, r, http.StatusBadRequest, data)
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			data.Err = "something went wrong"
+			renderAccountPage(w, r, http.StatusInternalServerError, data)
+		}
+		return
+	}
+	slog.InfoContext(r.Context(), "user reset their password", "user_id", userID)
+	a.audit(r, AuditUserResetPassword, userID, nil, nil)
+	renderAccountPage(w, r, http.StatusOK, &AccountTemplateData{
+		PageTitle: "Password changed", Msg: "Your password has been changed, you can now log in."})
+}
+
+// APIVerifyEmailHandler verifies an email address with the token from a verification email
+// curl localhost:8080/api/v1/verify -d '{"token": "..."}'
+func (a *App) APIVerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	req := &VerifyRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &AccountResponse{Err: err.Error()})
+		return
+	}
+	userID, err := a.verifyEmail(req.Token)
+	if err != nil {
+		if _, ok := err.(*db.ErrNotFound); ok {
+			writeJSON(w, http.StatusBadRequest, &AccountResponse{Err: "invalid or expired token"})
+			return
+		}
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &AccountResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "user verified their email", "user_id", userID)
+	a.audit(r, AuditUserVerifyEmail, userID, nil, nil)
+	writeJSON(w, http.StatusOK, &AccountResponse{Msg: "email verified"})
+}
+
+// ResendVerificationHandler sends the authenticated user another verification email
+// curl -X POST -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/verify/resend
+func (a *App) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	if u.EmailVerified {
+		writeJSON(w, http.StatusBadRequest, &AccountResponse{Err: "email is already verified"})
+		return
+	}
+	if _, ok := a.recovery(); !ok {
+		writeJSON(w, http.StatusNotImplemented, &AccountResponse{Err: "store does not support account recovery"})
+		return
+	}
+	a.sendVerification(r.Context(), u)
+	writeJSON(w, http.StatusAccepted, &AccountResponse{Msg: "verification email sent"})
+}
+
+// APIForgotPasswordHandler emails a password reset link. It always succeeds so as not to reveal
+// which addresses have accounts.
+// curl localhost:8080/api/v1/password/forgot -d '{"email": "cat@foobarcat.com"}'
+func (a *App) APIForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	req := &ForgotPasswordRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &AccountResponse{Err: err.Error()})
+		return
+	}
+	if err := a.sendPasswordReset(req.Email); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, http.StatusInternalServerError, &AccountResponse{Err: "failed to send reset email"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, &AccountResponse{Msg: "if the account exists a reset email has been sent"})
+}
+
+// APIResetPasswordHandler sets a new password with the token from a reset email. Every session and
+// refresh token of the user is revoked.
+// curl localhost:8080/api/v1/password/reset -d '{"token": "...", "password": "hunter23"}'
+func (a *App) APIResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	req := &ResetPasswordRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &AccountResponse{Err: err.Error()})
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		writeJSON(w, http.StatusBadRequest, &AccountResponse{Err: "passwords must be at least 8 characters"})
+		return
+	}
+	userID, err := a.resetPassword(req.Token, req.Password)
+	if err != nil {
+		if _, ok := err.(*db.ErrNotFound); ok {
+			writeJSON(w, http.StatusBadRequest, &AccountResponse{Err: "invalid or expired token"})
+			return
+		}
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &AccountResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "user reset their password", "user_id", userID)
+	a.audit(r, AuditUserResetPassword, userID, nil, nil)
+	writeJSON(w, http.StatusOK, &AccountResponse{Msg: "password changed"})
+}
@@ -0,0 +1,133 @@
+package shortly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+var emailedToken = regexp.MustCompile(`\?token=([A-Za-z0-9_-]+)`)
+
+// mailedToken extracts the token from the link in the next email the stand-in received
+func mailedToken(t *testing.T, server *smtpStandIn) string {
+	m := emailedToken.FindStringSubmatch(server.next(t))
+	if m == nil {
+		t.Fatal("email does not contain a token")
+	}
+	return m[1]
+}
+
+func TestEmailVerification(t *testing.T) {
+	a := assert.New(t)
+	server := newSMTPStandIn(t)
+	app := NewApp()
+	app.Mailer = &SMTPMailer{Addr: server.ln.Addr().String(), From: "noreply@foobarcat.com"}
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+
+	rr := postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusSeeOther, rr.Code)
+	token := mailedToken(t, server)
+	u, _ := store.UserByEmail("cat@foobarcat.com")
+	a.False(u.EmailVerified)
+
+	rr = getPage(app, "/verify?token=nonsense")
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = getPage(app, "/verify?token="+token)
+	a.Equal(http.StatusOK, rr.Code)
+	a.True(u.EmailVerified)
+	// tokens are single use
+	rr = getPage(app, "/verify?token="+token)
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	// api signups are verified with the api
+	rr = apiRequest(app, "POST", "/api/v1/signup", `{"email": "dog@foobarcat.com", "password": "hunter22"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+	tokens := &TokenResponse{}
+	json.Unmarshal(rr.Body.Bytes(), tokens)
+	mailedToken(t, server)
+	rr = apiRequest(app, "POST", "/api/v1/verify/resend", "", tokens.AccessToken)
+	a.Equal(http.StatusAccepted, rr.Code)
+	token = mailedToken(t, server)
+	rr = apiRequest(app, "POST", "/api/v1/verify", `{"token": "`+token+`"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/me", "", tokens.AccessToken)
+	a.Contains(rr.Body.String(), `"email_verified":true`)
+	rr = apiRequest(app, "POST", "/api/v1/verify/resend", "", tokens.AccessToken)
+	a.Equal(http.StatusBadRequest, rr.Code)
+}
+
+func TestPasswordReset(t *testing.T) {
+	a := assert.New(t)
+	server := newSMTPStandIn(t)
+	app := NewApp()
+	app.Mailer = &SMTPMailer{Addr: server.ln.Addr().String(), From: "noreply@foobarcat.com"}
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+
+	rr := postForm(app, "/signup", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	session := sessionCookie(rr)
+	server.next(t)
+	rr = apiRequest(app, "POST", "/api/v1/login", `{"email": "cat@foobarcat.com", "password": "hunter22"}`, "")
+	tokens := &TokenResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), tokens))
+	rr = apiRequest(app, "POST", "/api/v1/keys", `{"name": "ci", "scopes": ["read"]}`, tokens.AccessToken)
+	a.Equal(http.StatusOK, rr.Code)
+	created := &APIKeyResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), created))
+	rr = apiRequest(app, "GET", "/api/v1/urls", "", created.Key)
+	a.Equal(http.StatusOK, rr.Code)
+
+	// unknown addresses get the same response and no email
+	rr = postForm(app, "/reset", url.Values{"email": {"nobody@foobarcat.com"}})
+	a.Equal(http.StatusOK, rr.Code)
+	a.Empty(server.msgs)
+
+	rr = postForm(app, "/reset", url.Values{"email": {"cat@foobarcat.com"}})
+	a.Equal(http.StatusOK, rr.Code)
+	token := mailedToken(t, server)
+
+	// viewing the form doesn't use the token
+	rr = getPage(app, "/reset/confirm?token="+token)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), token)
+
+	rr = postForm(app, "/reset/confirm", url.Values{"token": {token}, "password": {"short"}})
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = postForm(app, "/reset/confirm", url.Values{"token": {token}, "password": {"hunter23"}})
+	a.Equal(http.StatusOK, rr.Code)
+	rr = postForm(app, "/reset/confirm", url.Values{"token": {token}, "password": {"hunter24"}})
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	// the old session and api keys are revoked and only the new password works
+	rr = getPage(app, "/dashboard", session)
+	a.Equal(http.StatusSeeOther, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls", "", created.Key)
+	a.Equal(http.StatusUnauthorized, rr.Code)
+	rr = postForm(app, "/login", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter22"}})
+	a.Equal(http.StatusUnauthorized, rr.Code)
+	rr = postForm(app, "/login", url.Values{"email": {"cat@foobarcat.com"}, "password": {"hunter23"}})
+	a.Equal(http.StatusSeeOther, rr.Code)
+
+	// and through the api
+	rr = apiRequest(app, "POST", "/api/v1/password/forgot", `{"email": "cat@foobarcat.com"}`, "")
+	a.Equal(http.StatusAccepted, rr.Code)
+	token = mailedToken(t, server)
+	rr = apiRequest(app, "POST", "/api/v1/password/reset", `{"token": "`+token+`", "password": "hunter25"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/login", `{"email": "cat@foobarcat.com", "password": "hunter25"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+
+	// expired tokens are rejected
+	rr = apiRequest(app, "POST", "/api/v1/password/forgot", `{"email": "cat@foobarcat.com"}`, "")
+	token = mailedToken(t, server)
+	store.Tokens[hashToken(token)].ExpiresAt = time.Now().Add(-time.Minute)
+	rr = apiRequest(app, "POST", "/api/v1/password/reset", `{"token": "`+token+`", "password": "hunter26"}`, "")
+	a.Equal(http.StatusBadRequest, rr.Code)
+}
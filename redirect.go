@@ -0,0 +1,49 @@
+package shortly
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aultimus/shortly/db"
+)
+
+// destination returns where a request for storedURL should be sent. Campaign parameters are applied
+// first so that, for passthrough links, they take precedence over the request's own query.
+func destination(storedURL *db.StoredURL, extraPath string, query url.Values) (string, error) {
+	target, err := ApplyCampaign(storedURL.OriginalURL, storedURL.Campaign)
+	if err != nil {
+		return "", err
+	}
+	if storedURL.Passthrough {
+		return PassthroughURL(target, extraPath, query)
+	}
+	return target, nil
+}
+
+// PassthroughURL builds the destination of a passthrough link. extraPath is appended to the path of
+// originalURL and query is merged into its query string. When a parameter is present in both, the
+// values from originalURL win so a visitor cannot override parameters the link was created with,
+// request values for other parameters are added. The fragment of originalURL is kept.
+func PassthroughURL(originalURL string, extraPath string, query url.Values) (string, error) {
+	u, err := url.Parse(originalURL)
+	if err != nil {
+		return "", err
+	}
+
+	extraPath = strings.TrimPrefix(extraPath, "/")
+	if extraPath != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + extraPath
+		u.RawPath = ""
+	}
+
+	if len(query) > 0 {
+		merged := u.Query()
+		for k, v := range query {
+			if _, exists := merged[k]; !exists {
+				merged[k] = v
+			}
+		}
+		u.RawQuery = merged.Encode()
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,160 @@
+package shortly
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+type UpdateRequest struct {
+	OriginalURL string `json:"original_url"`
+}
+
+type RollbackRequest struct {
+	Revision int `json:"revision"`
+}
+
+type RevisionResponse struct {
+	Revision *db.Revision `json:"revision,omitempty"`
+	Err      string       `json:"error"`
+}
+
+type RevisionsResponse struct {
+	Revisions []*db.Revision `json:"revisions"`
+	Err       string         `json:"error"`
+}
+
+// reviser returns the store as a db.Reviser, writing a 501 if the backend does not support edits
+func (a *App) reviser(w http.ResponseWriter) (db.Reviser, bool) {
+	rv, ok := a.store.(db.Reviser)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &RevisionResponse{Err: "store does not support editing urls"})
+	}
+	return rv, ok
+}
+
+// UpdateJSONHandler changes the destination of an existing shortened url, only its owner or a
+// workspace editor may do so
+// curl -X PUT localhost:8080/v1/urls/7RxfRd -d '{"original_url": "http://example.com"}'
+func (a *App) UpdateJSONHandler(w http.ResponseWriter, r *http.Request) {
+	rv, ok := a.reviser(w)
+	if !ok {
+		return
+	}
+	shortenedURL := mux.Vars(r)["url"]
+	storedURL, ok := a.managedURL(w, r, shortenedURL, db.RoleEditor)
+	if !ok {
+		return
+	}
+	before := urlSnapshot(storedURL)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &RevisionResponse{Err: err.Error()})
+		return
+	}
+	req := &UpdateRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		slog.ErrorContext(r.Context(), "failed to unmarshal update request", "body", string(b), "error", err)
+		writeJSON(w, http.StatusBadRequest, &RevisionResponse{Err: err.Error()})
+		return
+	}
+	if req.OriginalURL == "" {
+		writeJSON(w, http.StatusBadRequest, &RevisionResponse{Err: "original_url is required"})
+		return
+	}
+	req.OriginalURL, err = EnsurePrefix(req.OriginalURL)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &RevisionResponse{Err: err.Error()})
+		return
+	}
+
+	rev, err := rv.Update(shortenedURL, req.OriginalURL, requestActor(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &RevisionResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "updated url", "key", shortenedURL, "old_url", rev.OldURL, "new_url", rev.NewURL)
+	a.auditURLChange(r, AuditURLUpdate, shortenedURL, before)
+	writeJSON(w, http.StatusOK, &RevisionResponse{Revision: rev})
+}
+
+// RevisionsJSONHandler lists the edit history of a shortened url, oldest first
+// curl localhost:8080/v1/urls/7RxfRd/revisions
+func (a *App) RevisionsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	rv, ok := a.reviser(w)
+	if !ok {
+		return
+	}
+	shortenedURL := mux.Vars(r)["url"]
+	if _, ok := a.managedURL(w, r, shortenedURL, db.RoleViewer); !ok {
+		return
+	}
+	revs, err := rv.Revisions(shortenedURL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &RevisionsResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &RevisionsResponse{Revisions: revs})
+}
+
+// RollbackJSONHandler restores the destination a shortened url had as of the given revision.
+// Revision 0 is the url as originally created. The rollback is itself recorded as a new revision.
+// curl localhost:8080/v1/urls/7RxfRd/rollback -d '{"revision": 1}'
+func (a *App) RollbackJSONHandler(w http.ResponseWriter, r *http.Request) {
+	rv, ok := a.reviser(w)
+	if !ok {
+		return
+	}
+	shortenedURL := mux.Vars(r)["url"]
+	storedURL, ok := a.managedURL(w, r, shortenedURL, db.RoleEditor)
+	if !ok {
+		return
+	}
+	before := urlSnapshot(storedURL)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &RevisionResponse{Err: err.Error()})
+		return
+	}
+	req := &RollbackRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &RevisionResponse{Err: err.Error()})
+		return
+	}
+
+	revs, err := rv.Revisions(shortenedURL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &RevisionResponse{Err: err.Error()})
+		return
+	}
+	if req.Revision < 0 || req.Revision > len(revs) || len(revs) == 0 {
+		writeJSON(w, http.StatusBadRequest, &RevisionResponse{
+			Err: fmt.Sprintf("revision %d does not exist for %s", req.Revision, shortenedURL)})
+		return
+	}
+	target := revs[0].OldURL
+	if req.Revision > 0 {
+		target = revs[req.Revision-1].NewURL
+	}
+
+	rev, err := rv.Update(shortenedURL, target, requestActor(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &RevisionResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "rolled back url", "key", shortenedURL, "revision", req.Revision,
+		"url", target)
+	a.auditURLChange(r, AuditURLRollback, shortenedURL, before)
+	writeJSON(w, http.StatusOK, &RevisionResponse{Revision: rev})
+}
@@ -1,6 +1,7 @@
 #!/bin/bash
 
-sudo docker run -p 8080:8080/tcp -p 6060:6060/tcp --env-file .env.local 361313012007.dkr.ecr.us-west-2.amazonaws.com/shortly:latest
+# the debug port is only published on the host's loopback, it has no auth
+sudo docker run -p 8080:8080/tcp -p 127.0.0.1:6060:6060/tcp --env-file .env.local 361313012007.dkr.ecr.us-west-2.amazonaws.com/shortly:latest /go/bin/shortly -debug-addr :6060
 
 #sudo docker compose up
 # for debugging
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aultimus/shortly"
+	"github.com/aultimus/shortly/db"
+)
+
+const exportUsage = "usage: shortly export [flags] clicks|urls"
+
+// exportCommand writes an export of clicks or urls straight from the database, for loading into a
+// data warehouse. With -cursor-file each run exports only what is new since the last.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), exportUsage)
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", shortly.ExportCSV, "csv or ndjson")
+	from := flags.String("from", "", "RFC 3339 time to export from, defaults to the beginning. Ignored once -cursor-file holds a cursor.")
+	to := flags.String("to", "", "RFC 3339 time to export up to, defaults to now. Clicks exported up to a time have no cursor.")
+	cursorFile := flags.String("cursor-file", "", "file holding where the last export stopped, updated after each export")
+	out := flags.String("o", "", "file to write the export to instead of stdout")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New(exportUsage)
+	}
+
+	cursor := ""
+	if *cursorFile != "" {
+		b, err := ioutil.ReadFile(*cursorFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if cursor = strings.TrimSpace(string(b)); cursor != "" {
+			*from = ""
+		}
+	}
+	e, err := shortly.NewExport(flags.Arg(0), *format, *from, *to, cursor)
+	if err != nil {
+		return err
+	}
+
+	pgdb, err := db.NewPostgresDB(connStr)
+	if err != nil {
+		return err
+	}
+	defer pgdb.Close()
+	if err := e.Start(pgdb); err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "" {
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	n, err := e.Write(pgdb, bw)
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	// the cursor is only moved on once the export has been written in full, an export of clicks up
+	// to a time has none
+	if *cursorFile != "" && e.Cursor != "" {
+		tmp := *cursorFile + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(e.Cursor+"\n"), 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, *cursorFile); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "exported %d %s\n", n, e.What)
+	return nil
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/aultimus/shortly/db"
-	"github.com/cocoonlife/timber"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -16,35 +23,191 @@ import (
 // gitSHA represents the SHA that this application is built from, injected at compile time
 var gitSHA string
 
+const connStr = "host=localhost port=5432 user=shortly password=shortly dbname=shortly sslmode=disable"
+
 func main() {
-	timber.AddLogger(timber.ConfigLogger{
-		LogWriter: new(timber.ConsoleWriter),
-		Level:     timber.DEBUG,
-		Formatter: timber.NewPatFormatter("[%D %T] [%L] %s %M"),
-	})
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := exportCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	timber.Infof("shortly started. Git SHA [%s]", gitSHA)
+	logLevel := new(slog.LevelVar)
+	slog.SetDefault(shortly.NewLogger(os.Stdout, logLevel))
+	slog.Info("shortly started", "git_sha", gitSHA)
 
-	go func() {
-		timber.Errorf(http.ListenAndServe(":6060", nil))
-	}()
+	debugAddr := flag.String("debug-addr", "localhost:6060",
+		"address serving pprof, metrics and the log level, which have no auth so keep it off public interfaces")
+	level := flag.String("log-level", "info", "debug, info, warn or error, can be changed at -debug-addr /loglevel while running")
 	portNum := flag.String("port", "8080", "specify port number")
+	redirectStatus := flag.Int("redirect-status", 0,
+		"status used to redirect links that don't set their own (301, 302, 307 or 308), 0 picks automatically")
+	campaignsPath := flag.String("campaigns", "", "json file of named campaign templates")
+	jwtKeysPath := flag.String("jwt-keys", "", "json file of api token signing keys")
+	baseURL := flag.String("base-url", "", "scheme and host used in emailed links, defaults to the production domain")
+	smtpAddr := flag.String("smtp-addr", "", "host:port of the smtp server used to send email")
+	smtpUser := flag.String("smtp-user", "", "smtp username, the password is read from SMTP_PASSWORD")
+	mailFrom := flag.String("mail-from", "noreply@sh.foobarcat.com", "address emails are sent from")
+	oidcPath := flag.String("oidc", "", "json file configuring single sign-on with an OpenID Connect provider")
+	mailFile := flag.String("mail-file", "", "append emails to this file instead of sending them")
+	grantAdmin := flag.String("grant-admin", "", "email of an existing user to make an admin on startup")
+	clickQueue := flag.Int("click-queue", 0, "clicks that may wait to be written before new ones are dropped")
+	clickWorkers := flag.Int("click-workers", 0, "goroutines writing clicks to the database")
+	uaRulesPath := flag.String("user-agents", "", "json file of rules classifying the user agents of clicks, reloaded when it changes")
+	geoIPPath := flag.String("geoip", "", "MaxMind database used to locate clicks e.g. GeoLite2-City.mmdb, reloaded when it changes")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated ips and cidr ranges of proxies trusted to set X-Forwarded-For")
+	dropIPs := flag.Bool("drop-ips", false, "keep no client ips or ip hashes, unique visitors won't be counted")
+	traceExporter := flag.String("trace-exporter", "", "send spans of requests and store calls to otlp or stdout, none by default")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "host:port of the OTLP/HTTP trace collector, defaults to localhost:4318")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "send spans to the collector over http rather than https")
+	traceSample := flag.Float64("trace-sample", 0, "fraction of new traces to keep, 0 keeps them all")
 	flag.Parse()
+	if err := logLevel.UnmarshalText([]byte(*level)); err != nil {
+		log.Fatal(err)
+	}
+
+	// pprof, prometheus metrics and the log level are served on their own address, which is
+	// loopback by default as anyone who can reach it can read memory profiles and change the log level
+	http.Handle("/loglevel", shortly.LogLevelHandler(logLevel))
+	go func() {
+		slog.Error("debug listener stopped", "error", http.ListenAndServe(*debugAddr, nil))
+	}()
+	if *redirectStatus != 0 && !shortly.ValidRedirectStatus(*redirectStatus) {
+		log.Fatalf("unsupported redirect status %d", *redirectStatus)
+	}
+	var err error
 	app := shortly.NewApp()
-	connStr := "host=localhost port=5432 user=shortly password=shortly dbname=shortly sslmode=disable"
+	http.Handle("/metrics", app.Metrics.Handler())
+	app.RedirectStatus = *redirectStatus
+	if *jwtKeysPath != "" {
+		app.Tokens, err = shortly.LoadTokenIssuer(*jwtKeysPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		slog.Warn("no -jwt-keys given, api tokens will not survive a restart")
+	}
+	if *baseURL != "" {
+		app.BaseURL = *baseURL
+	}
+	switch {
+	case *smtpAddr != "":
+		m := &shortly.SMTPMailer{Addr: *smtpAddr, From: *mailFrom}
+		if *smtpUser != "" {
+			host, _, err := net.SplitHostPort(*smtpAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			m.Auth = smtp.PlainAuth("", *smtpUser, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		app.Mailer = m
+	case *mailFile != "":
+		app.Mailer = &shortly.FileMailer{Path: *mailFile, From: *mailFrom}
+	default:
+		slog.Warn("no -smtp-addr or -mail-file given, emails will only be logged")
+	}
+	if *oidcPath != "" {
+		conf, err := shortly.LoadOIDCConfig(*oidcPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if app.OIDC, err = shortly.NewOIDCProvider(conf); err != nil {
+			log.Fatal(err)
+		}
+	}
+	app.ClickConfig = shortly.ClickTrackerConfig{QueueSize: *clickQueue, Workers: *clickWorkers}
+	if app.TrustedProxies, err = shortly.ParseTrustedProxies(*trustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	app.DropIPs = *dropIPs
+	if *traceExporter != "" {
+		tracing, err := shortly.NewTracerProvider(shortly.TracingConfig{Exporter: *traceExporter,
+			Endpoint: *otlpEndpoint, Insecure: *otlpInsecure, SampleRatio: *traceSample})
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Tracing = tracing
+		// flush the spans of the last requests on exit
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tracing.Shutdown(ctx); err != nil {
+				slog.Error("trace shutdown failed", "error", err)
+			}
+		}()
+	}
+	if *geoIPPath != "" {
+		geo, err := shortly.OpenGeoIP(*geoIPPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer geo.Close()
+		app.ClickConfig.GeoIP = geo
+		watcher := shortly.WatchFile(*geoIPPath, 0, geo.Reload)
+		defer watcher.Close()
+	}
+	if *uaRulesPath != "" {
+		rules, err := shortly.LoadUARules(*uaRulesPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		agents := shortly.NewUAClassifier(rules)
+		app.ClickConfig.UserAgents = agents
+		watcher := shortly.WatchFile(*uaRulesPath, 0, func() error { return agents.Reload(*uaRulesPath) })
+		defer watcher.Close()
+	}
+	if salt := os.Getenv("CLICK_IP_SALT"); salt != "" {
+		app.ClickConfig.Salt = []byte(salt)
+	} else {
+		slog.Warn("no CLICK_IP_SALT set, hashed ips of clicks will not match across restarts")
+	}
+	if *campaignsPath != "" {
+		app.Campaigns, err = shortly.LoadCampaignTemplates(*campaignsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	pgdb, err := db.NewPostgresDB(connStr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer pgdb.Close()
 
+	if *grantAdmin != "" {
+		u, err := pgdb.UserByEmail(*grantAdmin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pgdb.SetAdmin(u.ID, true); err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("granted admin", "email", u.Email)
+	}
+
 	err = app.Init(pgdb, *portNum)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// finish in flight requests and write queued clicks before exiting
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := app.Shutdown(ctx); err != nil {
+			slog.Error("shutdown failed", "error", err)
+		}
+		close(stopped)
+	}()
+
 	err = app.Run()
-	if err != nil {
+	if err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
+	slog.Info("shortly stopped")
 }
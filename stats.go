@@ -0,0 +1,217 @@
+package shortly
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultRollupInterval = time.Minute
+	rollupBatchSize       = 5000
+	defaultStatsTop       = 10
+	maxStatsTop           = 100
+	// maxStatsBuckets stops a long range of small buckets producing an enormous series
+	maxStatsBuckets = 1000
+)
+
+// defaultStatsSpan is how far back stats go when no from is given, per bucket
+var defaultStatsSpan = map[string]time.Duration{
+	db.BucketHour: 48 * time.Hour,
+	db.BucketDay:  30 * 24 * time.Hour,
+	db.BucketWeek: 26 * 7 * 24 * time.Hour,
+}
+
+// RollupJob periodically rolls up newly recorded clicks so that they show up in stats
+type RollupJob struct {
+	store db.ClickStatter
+	done  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+// NewRollupJob starts rolling up the clicks of store every interval, Close stops it
+func NewRollupJob(store db.ClickStatter, interval time.Duration) *RollupJob {
+	if interval <= 0 {
+		interval = defaultRollupInterval
+	}
+	j := &RollupJob{store: store, done: make(chan struct{})}
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := j.Rollup(); err != nil {
+					slog.Error("click rollup failed", "error", err)
+				}
+			case <-j.done:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+// Rollup rolls up every click waiting to be, then sketches a batch of any visitors left from
+// before visitors were sketched
+func (j *RollupJob) Rollup() error {
+	for {
+		n, err := j.store.RollupClicks(rollupBatchSize)
+		if err != nil {
+			return err
+		}
+		if n < rollupBatchSize {
+			break
+		}
+	}
+	if b, ok := j.store.(db.SketchBackfiller); ok {
+		if _, err := b.BackfillSketches(rollupBatchSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the job after rolling up whatever is left
+func (j *RollupJob) Close() {
+	j.once.Do(func() {
+		close(j.done)
+		j.wg.Wait()
+		if err := j.Rollup(); err != nil {
+			slog.Error("click rollup failed", "error", err)
+		}
+	})
+}
+
+// nextBucket returns the start of the bucket after the one starting at t
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case db.BucketHour:
+		return t.Add(time.Hour)
+	case db.BucketWeek:
+		return t.AddDate(0, 0, 7)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// URLStats are the stats of a url over a range
+type URLStats struct {
+	URL    string    `json:"url"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Bucket string    `json:"bucket"`
+	*db.Stats
+}
+
+type URLStatsResponse struct {
+	Stats *URLStats `json:"stats,omitempty"`
+	Err   string    `json:"error"`
+}
+
+// parseStatsQuery reads ?bucket=&from=&to=&top=&include_bots= where bucket is hour, day or week and
+// from and to are RFC 3339 times. The range is widened to whole buckets.
+func parseStatsQuery(r *http.Request, key string) (*db.StatsQuery, string) {
+	params := r.URL.Query()
+	q := &db.StatsQuery{Key: key, Bucket: db.BucketDay, To: time.Now().UTC(), Top: defaultStatsTop}
+	if s := params.Get("bucket"); s != "" {
+		if _, ok := defaultStatsSpan[s]; !ok {
+			return nil, "bucket must be one of hour, day or week"
+		}
+		q.Bucket = s
+	}
+	var err error
+	if s := params.Get("to"); s != "" {
+		if q.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, "to must be an RFC 3339 time"
+		}
+	}
+	q.From = q.To.Add(-defaultStatsSpan[q.Bucket])
+	if s := params.Get("from"); s != "" {
+		if q.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, "from must be an RFC 3339 time"
+		}
+	}
+	if !q.From.Before(q.To) {
+		return nil, "from must be before to"
+	}
+	if s := params.Get("include_bots"); s != "" {
+		if q.IncludeBots, err = strconv.ParseBool(s); err != nil {
+			return nil, "include_bots must be true or false"
+		}
+	}
+	if s := params.Get("top"); s != "" {
+		if q.Top, err = strconv.Atoi(s); err != nil || q.Top < 1 || q.Top > maxStatsTop {
+			return nil, "top must be between 1 and " + strconv.Itoa(maxStatsTop)
+		}
+	}
+
+	to := db.TruncateBucket(q.To, q.Bucket)
+	if to.Before(q.To) {
+		to = nextBucket(to, q.Bucket)
+	}
+	q.From, q.To = db.TruncateBucket(q.From, q.Bucket), to
+	n := 0
+	for t := q.From; t.Before(q.To); t = nextBucket(t, q.Bucket) {
+		if n++; n > maxStatsBuckets {
+			return nil, "the range is too long, use fewer than " + strconv.Itoa(maxStatsBuckets) + " buckets"
+		}
+	}
+	return q, ""
+}
+
+// fillSeries adds empty buckets to series so that it covers the whole of q's range
+func fillSeries(q *db.StatsQuery, series []*db.StatsBucket) []*db.StatsBucket {
+	byStart := make(map[time.Time]*db.StatsBucket, len(series))
+	for _, b := range series {
+		byStart[b.Start] = b
+	}
+	out := []*db.StatsBucket{}
+	for t := q.From; t.Before(q.To); t = nextBucket(t, q.Bucket) {
+		if b, ok := byStart[t]; ok {
+			out = append(out, b)
+		} else {
+			out = append(out, &db.StatsBucket{Start: t})
+		}
+	}
+	return out
+}
+
+// URLStatsHandler returns the clicks of one of the user's urls over time along with its top
+// referrers, countries, browsers, operating systems and devices. Bots are left out unless asked for.
+// Stats lag clicks by up to a minute.
+// curl -H "Authorization: Bearer $TOKEN" "localhost:8080/api/v1/urls/7RxfRd/stats?bucket=hour&from=2024-06-01T00:00:00Z"
+func (a *App) URLStatsHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.store.(db.ClickStatter)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &URLStatsResponse{Err: "store does not support click stats"})
+		return
+	}
+	key := mux.Vars(r)["url"]
+	if _, ok := a.managedURL(w, r, key, db.RoleViewer); !ok {
+		return
+	}
+	q, msg := parseStatsQuery(r, key)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &URLStatsResponse{Err: msg})
+		return
+	}
+	stats, err := s.ClickStats(q)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &URLStatsResponse{Err: err.Error()})
+		return
+	}
+	stats.Series = fillSeries(q, stats.Series)
+	writeJSON(w, http.StatusOK, &URLStatsResponse{Stats: &URLStats{
+		URL: key, From: q.From, To: q.To, Bucket: q.Bucket, Stats: stats,
+	}})
+}
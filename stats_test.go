@@ -0,0 +1,167 @@
+package shortly
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/aultimus/shortly/hll"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURLStats(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	dog := apiLogin(t, app, "dog@foobarcat.com")
+	rr := apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, cat)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	key := resp.ShortenedURL
+
+	// Monday the 3rd of June 2024
+	day := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0 Safari/537.36"
+	a.NoError(store.RecordClicks([]*db.Click{
+		{Key: key, ClickedAt: day.Add(9 * time.Hour), Referrer: "https://news.example.com/a", IPHash: "a", Browser: "Chrome", OS: "Windows"},
+		{Key: key, ClickedAt: day.Add(9*time.Hour + time.Minute), Referrer: "https://news.example.com/b", IPHash: "a", Browser: "Chrome", OS: "Windows"},
+		{Key: key, ClickedAt: day.Add(11 * time.Hour), IPHash: "b", Browser: "Firefox", OS: "Linux", Country: "GB"},
+		{Key: key, ClickedAt: day.AddDate(0, 0, 2), IPHash: "a"},
+		{Key: key, ClickedAt: day.Add(9 * time.Hour), IPHash: "d", Browser: "Slack", Device: DeviceBot, Bot: true},
+		{Key: "other", ClickedAt: day.Add(9 * time.Hour), IPHash: "c"},
+	}))
+	ua := DefaultUARules().Classify(chrome)
+	a.Equal("Chrome", ua.Browser)
+	a.Equal("Windows", ua.OS)
+
+	// clicks only count once rolled up
+	path := "/api/v1/urls/" + key + "/stats?from=2024-06-03T00:00:00Z&to=2024-06-06T00:00:00Z"
+	rr = apiRequest(app, "GET", path, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	stats := &URLStatsResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), stats))
+	a.Equal(int64(0), stats.Stats.Clicks)
+	a.NoError(app.Rollups.Rollup())
+
+	rr = apiRequest(app, "GET", path, "", cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), stats))
+	a.Equal(int64(4), stats.Stats.Clicks)
+	a.Equal(int64(2), stats.Stats.UniqueVisitors)
+	a.Equal(int64(1), stats.Stats.BotClicks)
+	a.Len(stats.Stats.Series, 3)
+	a.Equal(int64(3), stats.Stats.Series[0].Clicks)
+	a.Equal(int64(2), stats.Stats.Series[0].UniqueVisitors)
+	a.Equal(int64(0), stats.Stats.Series[1].Clicks)
+	// ties are alphabetical
+	a.Equal(&db.StatsCount{Value: "direct", Clicks: 2}, stats.Stats.Referrers[0])
+	a.Equal(&db.StatsCount{Value: "news.example.com", Clicks: 2}, stats.Stats.Referrers[1])
+	a.Equal("unknown", stats.Stats.Countries[0].Value)
+	a.Equal(&db.StatsCount{Value: "Chrome", Clicks: 2}, stats.Stats.Browsers[0])
+	a.Len(stats.Stats.OperatingSystems, 3)
+
+	rr = apiRequest(app, "GET", path+"&include_bots=true", "", cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), stats))
+	a.Equal(int64(5), stats.Stats.Clicks)
+	a.Equal(int64(3), stats.Stats.UniqueVisitors)
+	a.Equal(int64(1), stats.Stats.BotClicks)
+	a.Contains(stats.Stats.Devices, &db.StatsCount{Value: DeviceBot, Clicks: 1})
+
+	// hours of a single day, the end is widened to a whole bucket
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key+"/stats?bucket=hour&from=2024-06-03T08:30:00Z&to=2024-06-03T11:10:00Z&top=1", "", cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), stats))
+	a.Equal(day.Add(8*time.Hour), stats.Stats.From)
+	a.Equal(day.Add(12*time.Hour), stats.Stats.To)
+	a.Len(stats.Stats.Series, 4)
+	a.Equal(int64(2), stats.Stats.Series[1].Clicks)
+	a.Equal(int64(1), stats.Stats.Series[1].UniqueVisitors)
+	a.Equal(int64(3), stats.Stats.Clicks)
+	a.Len(stats.Stats.Browsers, 1)
+
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key+"/stats?bucket=week&from=2024-06-05T00:00:00Z&to=2024-06-06T00:00:00Z", "", cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), stats))
+	a.Equal(day, stats.Stats.From)
+	a.Len(stats.Stats.Series, 1)
+	a.Equal(int64(4), stats.Stats.Series[0].Clicks)
+
+	rr = apiRequest(app, "GET", path, "", dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key+"/stats?bucket=month", "", cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key+"/stats?from=2024-06-06T00:00:00Z&to=2024-06-03T00:00:00Z", "", cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key+"/stats?bucket=hour&from=2020-01-01T00:00:00Z", "", cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+}
+
+func TestURLStatsUniqueVisitors(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	rr := apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, cat)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+
+	// 4000 visitors over three days, each day's 2000 overlapping the day before's by half
+	day := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	clicks := []*db.Click{}
+	for d := 0; d < 3; d++ {
+		for i := d * 1000; i < d*1000+2000; i++ {
+			clicks = append(clicks, &db.Click{Key: resp.ShortenedURL, ClickedAt: day.AddDate(0, 0, d).Add(time.Duration(i%24) * time.Hour),
+				IPHash: strconv.Itoa(i)})
+		}
+	}
+	a.NoError(store.RecordClicks(clicks))
+	a.NoError(app.Rollups.Rollup())
+
+	within := func(expected int, actual int64) {
+		a.InDelta(expected, actual, 4*hll.StandardError*float64(expected))
+	}
+	for _, bucket := range []string{"hour", "day", "week"} {
+		rr = apiRequest(app, "GET", "/api/v1/urls/"+resp.ShortenedURL+"/stats?bucket="+bucket+
+			"&from=2024-06-03T00:00:00Z&to=2024-06-06T00:00:00Z", "", cat)
+		stats := &URLStatsResponse{}
+		a.NoError(json.Unmarshal(rr.Body.Bytes(), stats))
+		a.Equal(int64(6000), stats.Stats.Clicks)
+		within(4000, stats.Stats.UniqueVisitors)
+		if bucket == "day" {
+			for _, b := range stats.Stats.Series {
+				within(2000, b.UniqueVisitors)
+			}
+		}
+	}
+}
+
+// backfillStore holds visitors left to sketch from before visitors were sketched
+type backfillStore struct {
+	*db.MapDB
+	left int
+}
+
+func (s *backfillStore) BackfillSketches(limit int) (int, error) {
+	n := min(limit, s.left)
+	s.left -= n
+	return n, nil
+}
+
+func TestRollupBackfillsSketchesInBatches(t *testing.T) {
+	a := assert.New(t)
+	store := &backfillStore{MapDB: db.NewMapDB(), left: 2*rollupBatchSize + 1}
+	j := NewRollupJob(store, time.Hour)
+	defer j.Close()
+
+	// each rollup sketches one batch so a large backlog doesn't hold up new clicks
+	a.NoError(j.Rollup())
+	a.Equal(rollupBatchSize+1, store.left)
+	a.NoError(j.Rollup())
+	a.NoError(j.Rollup())
+	a.Equal(0, store.left)
+}
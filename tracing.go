@@ -0,0 +1,137 @@
+package shortly
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/aultimus/shortly"
+
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+)
+
+// traceContext reads and writes the W3C traceparent and tracestate headers
+var traceContext = propagation.TraceContext{}
+
+// TracingConfig picks where the spans of requests and store calls are sent
+type TracingConfig struct {
+	// Exporter is TraceExporterOTLP or TraceExporterStdout
+	Exporter string
+	// Endpoint is the host:port of an OTLP/HTTP collector, defaults to localhost:4318
+	Endpoint string
+	// Insecure sends spans to the collector over http rather than https
+	Insecure bool
+	// SampleRatio is the fraction of traces started by us that are kept, 0 keeps them all.
+	// Traces started by a caller's traceparent are kept when the caller kept them.
+	SampleRatio float64
+	// Writer receives the spans of the stdout exporter, defaults to os.Stdout
+	Writer io.Writer
+}
+
+// NewTracerProvider exports spans as configured, it should be shut down to flush them on exit.
+// The stdout exporter writes each span as it ends, which is what tests want.
+func NewTracerProvider(conf TracingConfig) (*sdktrace.TracerProvider, error) {
+	sampler := sdktrace.AlwaysSample()
+	if conf.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(conf.SampleRatio)
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("shortly"))),
+	}
+
+	switch conf.Exporter {
+	case TraceExporterOTLP:
+		clientOpts := []otlptracehttp.Option{}
+		if conf.Endpoint != "" {
+			clientOpts = append(clientOpts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), clientOpts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	case TraceExporterStdout:
+		w := conf.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithSyncer(exporter))
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q, expected %s or %s", conf.Exporter,
+			TraceExporterOTLP, TraceExporterStdout)
+	}
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+func (a *App) tracer() trace.Tracer {
+	return a.Tracing.Tracer(tracerName)
+}
+
+// routeTemplate names the route of a request by its template, e.g. /{url}, so that every link
+// doesn't get a series or span name of its own
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// TracingMiddleware starts a span for each request, continuing the trace of an incoming
+// traceparent header. Handlers pass r.Context() on so that store calls become its children.
+func (a *App) TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := a.tracer().Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethod(r.Method), semconv.HTTPRoute(route),
+				attribute.String("http.request_id", RequestIDFromContext(r.Context()))))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// endSpan records a failed call on its span, not found is not a failure
+func endSpan(span trace.Span, err error) {
+	if _, notFound := err.(*db.ErrNotFound); err != nil && !notFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,149 @@
+package shortly
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer collects output that may be written from the click workers as well as the test
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// exportedSpan is the part of a span written by the stdout exporter that tests look at
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	Parent struct {
+		TraceID string
+		SpanID  string
+	}
+	Attributes []struct {
+		Key   string
+		Value struct {
+			Value interface{}
+		}
+	}
+	Status struct {
+		Code string
+	}
+}
+
+func (s *exportedSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return fmt.Sprint(a.Value.Value)
+		}
+	}
+	return ""
+}
+
+// take returns the spans written since the last take, in the order they ended
+func (b *lockedBuffer) take(t *testing.T) []*exportedSpan {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	spans := []*exportedSpan{}
+	dec := json.NewDecoder(&b.buf)
+	for {
+		s := &exportedSpan{}
+		err := dec.Decode(s)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		spans = append(spans, s)
+	}
+	b.buf.Reset()
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	a := assert.New(t)
+
+	out := &lockedBuffer{}
+	tracing, err := NewTracerProvider(TracingConfig{Exporter: TraceExporterStdout, Writer: out})
+	a.NoError(err)
+	app := NewApp()
+	app.Tracing = tracing
+	app.Init(db.NewMapDB(), "8080")
+
+	// an incoming trace is continued, with each attempt at a key and its store calls below it
+	apiRequest(app, "POST", "/v1/create", `{"original_url": "http://foobarcat.blogspot.com"}`, "")
+	out.take(t)
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("POST", "/v1/create",
+		strings.NewReader(`{"original_url": "http://foobarcat.blogspot.com", "redirect_status": 308}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(rr, req)
+	a.Equal(http.StatusOK, rr.Code)
+
+	spans := out.take(t)
+	names := []string{}
+	for _, s := range spans {
+		names = append(names, s.Name)
+		a.Equal(traceID, s.SpanContext.TraceID)
+	}
+	// after the attempts the audit trail and webhooks look up the new link
+	a.Equal([]string{"store.Get", "create.attempt", "store.Get", "store.Create", "create.attempt",
+		"store.Get", "store.Get", "POST /v1/create"}, names)
+	server := spans[7]
+	a.Equal("00f067aa0ba902b7", server.Parent.SpanID)
+	a.Equal("200", server.attr("http.status_code"))
+	a.Equal("/v1/create", server.attr("http.route"))
+	a.Equal(rr.Header().Get("X-Request-ID"), server.attr("http.request_id"))
+
+	first, second := spans[1], spans[4]
+	a.Equal(server.SpanContext.SpanID, first.Parent.SpanID)
+	a.Equal(server.SpanContext.SpanID, second.Parent.SpanID)
+	a.Equal("0", first.attr("shortly.attempt"))
+	a.Equal("true", first.attr("shortly.collision"))
+	a.Equal("1", second.attr("shortly.attempt"))
+	a.Equal("false", second.attr("shortly.collision"))
+	a.Equal(first.SpanContext.SpanID, spans[0].Parent.SpanID)
+	for _, s := range spans[2:4] {
+		a.Equal(second.SpanContext.SpanID, s.Parent.SpanID)
+		a.Equal("memory", s.attr("shortly.store"))
+		a.Equal(second.attr("shortly.key"), s.attr("shortly.key"))
+	}
+	a.Equal(server.SpanContext.SpanID, spans[5].Parent.SpanID)
+
+	// without a traceparent a trace is started, store failures are marked on their spans
+	app.store = &DBErrStore{}
+	rr = getPage(app, "/cat")
+	a.Equal(http.StatusInternalServerError, rr.Code)
+	spans = out.take(t)
+	a.Len(spans, 2)
+	a.Equal("store.Get", spans[0].Name)
+	a.Equal("Error", spans[0].Status.Code)
+	a.Equal("GET /{url}", spans[1].Name)
+	a.Equal("Error", spans[1].Status.Code)
+	a.Equal("0000000000000000", spans[1].Parent.SpanID)
+	a.Equal(spans[1].SpanContext.TraceID, spans[0].SpanContext.TraceID)
+	a.Equal(spans[1].SpanContext.SpanID, spans[0].Parent.SpanID)
+
+	_, err = NewTracerProvider(TracingConfig{Exporter: "zipkin"})
+	a.EqualError(err, `unsupported trace exporter "zipkin", expected otlp or stdout`)
+}
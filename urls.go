@@ -0,0 +1,165 @@
+package shortly
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type URLResponse struct {
+	URL *db.ListedURL `json:"url,omitempty"`
+	Err string        `json:"error"`
+}
+
+type ListURLsResponse struct {
+	URLs  []*db.ListedURL `json:"urls"`
+	Total int             `json:"total"`
+	// NextOffset is the offset of the next page, absent on the last page
+	NextOffset int    `json:"next_offset,omitempty"`
+	Err        string `json:"error"`
+}
+
+// canAccess reports whether u may act on storedURL with the privileges of role. Personal urls are
+// managed by their creator alone, workspace urls by members with at least role. Anonymous links
+// can't be managed by anyone.
+func (a *App) canAccess(ctx context.Context, u *db.User, storedURL *db.StoredURL, role string) bool {
+	if u == nil {
+		return false
+	}
+	if storedURL.WorkspaceID != "" {
+		return db.RoleAtLeast(a.workspaceRole(ctx, storedURL.WorkspaceID, u.ID), role)
+	}
+	return storedURL.UserID != "" && storedURL.UserID == u.ID
+}
+
+// managedURL fetches the url with the given key if the requesting user has at least role for it,
+// otherwise writing an error response. Role only matters for workspace urls.
+func (a *App) managedURL(w http.ResponseWriter, r *http.Request, key string, role string) (*db.StoredURL, bool) {
+	storedURL, err := a.urls(r.Context()).Get(key)
+	if err != nil {
+		writeJSON(w, statusForErr(err), &URLResponse{Err: err.Error()})
+		return nil, false
+	}
+	u := UserFromContext(r.Context())
+	if u == nil {
+		writeJSON(w, http.StatusUnauthorized, &URLResponse{Err: "log in to manage urls"})
+		return nil, false
+	}
+	if !a.canAccess(r.Context(), u, storedURL, role) {
+		writeJSON(w, http.StatusForbidden, &URLResponse{Err: "you don't have permission to do that to " + key})
+		return nil, false
+	}
+	return storedURL, true
+}
+
+// owner returns the store as a db.Owner, writing a 501 if the backend does not support ownership
+func (a *App) owner(w http.ResponseWriter) (db.Owner, bool) {
+	o, ok := a.store.(db.Owner)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &URLResponse{Err: "store does not support listing or deleting urls"})
+	}
+	return o, ok
+}
+
+func defaultListQuery() *db.ListQuery {
+	return &db.ListQuery{Limit: defaultPageSize, Sort: db.SortCreatedAt, Desc: true}
+}
+
+// parseListQuery reads ?offset=&limit=&sort=&q= where sort is one of created_at, original_url or id,
+// prefixed with - for descending order
+func parseListQuery(r *http.Request) (*db.ListQuery, string) {
+	params := r.URL.Query()
+	q := defaultListQuery()
+	q.Filter = params.Get("q")
+
+	var err error
+	if s := params.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return nil, "offset must be a non negative integer"
+		}
+	}
+	if s := params.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return nil, "limit must be between 1 and " + strconv.Itoa(maxPageSize)
+		}
+	}
+	if s := params.Get("sort"); s != "" {
+		q.Desc = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		switch q.Sort {
+		case db.SortCreatedAt, db.SortOriginalURL, db.SortID:
+		default:
+			return nil, "unsupported sort " + s
+		}
+	}
+	return q, ""
+}
+
+// ListURLsHandler lists the urls created by the authenticated user, newest first by default
+// curl -H "Authorization: Bearer $TOKEN" "localhost:8080/api/v1/urls?limit=10&offset=10&sort=original_url&q=blog"
+func (a *App) ListURLsHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := a.owner(w)
+	if !ok {
+		return
+	}
+	q, msg := parseListQuery(r)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &ListURLsResponse{Err: msg})
+		return
+	}
+	urls, total, err := o.ListByUser(UserFromContext(r.Context()).ID, q)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &ListURLsResponse{Err: err.Error()})
+		return
+	}
+	resp := &ListURLsResponse{URLs: urls, Total: total}
+	if q.Offset+len(urls) < total {
+		resp.NextOffset = q.Offset + len(urls)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GetURLHandler returns one of the authenticated user's urls or one of their workspaces' urls
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/urls/7RxfRd
+func (a *App) GetURLHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["url"]
+	storedURL, ok := a.managedURL(w, r, key, db.RoleViewer)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, &URLResponse{URL: &db.ListedURL{ID: key, StoredURL: *storedURL}})
+}
+
+// DeleteURLHandler deletes one of the authenticated user's urls
+// curl -X DELETE -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/urls/7RxfRd
+func (a *App) DeleteURLHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := a.owner(w)
+	if !ok {
+		return
+	}
+	key := mux.Vars(r)["url"]
+	storedURL, ok := a.managedURL(w, r, key, db.RoleEditor)
+	if !ok {
+		return
+	}
+	if err := o.Delete(key); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &URLResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "deleted url", "key", key)
+	a.audit(r, AuditURLDelete, key, urlSnapshot(storedURL), nil)
+	a.emitURLEvent(r.Context(), db.EventURLDeleted, key, storedURL)
+	writeJSON(w, http.StatusOK, &URLResponse{})
+}
@@ -0,0 +1,99 @@
+package shortly
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// apiLogin signs up a user and returns their access token
+func apiLogin(t *testing.T, app *App, email string) string {
+	rr := apiRequest(app, "POST", "/api/v1/signup", `{"email": "`+email+`", "password": "hunter22"}`, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	tokens := &TokenResponse{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), tokens))
+	return tokens.AccessToken
+}
+
+func TestOwnedURLs(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	dog := apiLogin(t, app, "dog@foobarcat.com")
+
+	// anonymous creation still works and isn't owned
+	rr := apiRequest(app, "POST", "/v1/create", `{"original_url": "http://foobarcat.blogspot.com"}`, "")
+	a.Equal(http.StatusOK, rr.Code)
+	anon := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), anon))
+	stored, err := store.Get(anon.ShortenedURL)
+	a.NoError(err)
+	a.Empty(stored.UserID)
+
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, "")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+
+	codes := []string{}
+	for _, u := range []string{"http://foobarcat.blogspot.com", "http://b.com", "http://c.com/blog"} {
+		rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "`+u+`"}`, cat)
+		a.Equal(http.StatusOK, rr.Code)
+		resp := &CreateResponse{}
+		a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+		codes = append(codes, resp.ShortenedURL)
+	}
+	a.NotEqual(anon.ShortenedURL, codes[0], "owned links don't share the anonymous key")
+
+	list := func(query string, token string) *ListURLsResponse {
+		rr := apiRequest(app, "GET", "/api/v1/urls"+query, "", token)
+		a.Equal(http.StatusOK, rr.Code)
+		resp := &ListURLsResponse{}
+		a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+		return resp
+	}
+
+	resp := list("?sort=original_url&limit=2", cat)
+	a.Equal(3, resp.Total)
+	a.Len(resp.URLs, 2)
+	a.Equal(2, resp.NextOffset)
+	a.Equal("http://b.com", resp.URLs[0].OriginalURL)
+	resp = list("?sort=original_url&limit=2&offset=2", cat)
+	a.Len(resp.URLs, 1)
+	a.Equal(0, resp.NextOffset)
+	a.Equal("http://foobarcat.blogspot.com", resp.URLs[0].OriginalURL)
+
+	resp = list("?q=BLOG&sort=-original_url", cat)
+	a.Equal(2, resp.Total)
+	a.Equal("http://foobarcat.blogspot.com", resp.URLs[0].OriginalURL)
+
+	a.Equal(0, list("", dog).Total)
+
+	rr = apiRequest(app, "GET", "/api/v1/urls?sort=password", "", cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	// only the owner may view, update or delete
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+codes[1], "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+codes[1], "", dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "PUT", "/api/v1/urls/"+codes[1], `{"original_url": "http://evil.com"}`, dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "DELETE", "/api/v1/urls/"+codes[1], "", dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "DELETE", "/api/v1/urls/"+anon.ShortenedURL, "", cat)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	rr = apiRequest(app, "PUT", "/api/v1/urls/"+codes[1], `{"original_url": "http://bb.com"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "DELETE", "/api/v1/urls/"+codes[1], "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	_, err = store.Get(codes[1])
+	a.Error(err)
+	a.Equal(2, list("", cat).Total)
+}
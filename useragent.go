@@ -0,0 +1,178 @@
+package shortly
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+)
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceBot     = "bot"
+)
+
+// UARule names the user agents matching Pattern, a Go regular expression
+type UARule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	re      *regexp.Regexp
+}
+
+// UARules classify user agents. The first matching rule of each list wins so more specific rules
+// come first, e.g. Edge and Chrome both claim to be Safari.
+type UARules struct {
+	// Bots are crawlers, link unfurlers and scripts. A bot's name is reported as its browser.
+	Bots     []*UARule `json:"bots"`
+	Browsers []*UARule `json:"browsers"`
+	OS       []*UARule `json:"operating_systems"`
+	// Devices are e.g. mobile or tablet, user agents matching none are desktops
+	Devices []*UARule `json:"devices"`
+}
+
+// DefaultUARules are used until rules are loaded from a file
+func DefaultUARules() *UARules {
+	rules := &UARules{
+		Bots: []*UARule{
+			{Name: "Slack", Pattern: `Slackbot`},
+			{Name: "Twitter", Pattern: `Twitterbot`},
+			{Name: "Facebook", Pattern: `facebookexternalhit|Facebot`},
+			{Name: "LinkedIn", Pattern: `LinkedInBot`},
+			{Name: "Discord", Pattern: `Discordbot`},
+			{Name: "Telegram", Pattern: `TelegramBot`},
+			{Name: "WhatsApp", Pattern: `WhatsApp`},
+			{Name: "Googlebot", Pattern: `Googlebot`},
+			{Name: "Bingbot", Pattern: `bingbot`},
+			{Name: "script", Pattern: `(?i)^(curl|wget|python-requests|python-urllib|go-http-client|okhttp|java)/`},
+			{Name: "other", Pattern: `(?i)bot\b|crawl|spider|HeadlessChrome`},
+		},
+		Browsers: []*UARule{
+			{Name: "Edge", Pattern: `Edg(e|A|iOS)?/`},
+			{Name: "Opera", Pattern: `OPR/`},
+			{Name: "Samsung Internet", Pattern: `SamsungBrowser/`},
+			{Name: "Firefox", Pattern: `Firefox/|FxiOS/`},
+			{Name: "Chrome", Pattern: `Chrome/|CriOS/`},
+			{Name: "Safari", Pattern: `Safari/`},
+		},
+		OS: []*UARule{
+			{Name: "Windows", Pattern: `Windows`},
+			{Name: "Android", Pattern: `Android`},
+			{Name: "iOS", Pattern: `iPhone|iPad|iPod`},
+			{Name: "macOS", Pattern: `Mac OS X|Macintosh`},
+			{Name: "ChromeOS", Pattern: `CrOS`},
+			{Name: "Linux", Pattern: `Linux`},
+		},
+		// iPads claim to be Mobile and Android tablets are the Androids that don't
+		Devices: []*UARule{
+			{Name: "tablet", Pattern: `iPad|Tablet`},
+			{Name: "mobile", Pattern: `Mobi|iPhone|iPod`},
+			{Name: "tablet", Pattern: `Android`},
+		},
+	}
+	if err := rules.compile(); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func (rs *UARules) compile() error {
+	for _, list := range [][]*UARule{rs.Bots, rs.Browsers, rs.OS, rs.Devices} {
+		for _, rule := range list {
+			if rule.Name == "" {
+				return fmt.Errorf("user agent rule %q has no name", rule.Pattern)
+			}
+			var err error
+			if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+				return fmt.Errorf("bad pattern for user agent rule %s: %w", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadUARules reads UARules from a json file
+func LoadUARules(path string) (*UARules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := &UARules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse user agent rules %s: %w", path, err)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func matchUA(ua string, rules []*UARule) string {
+	for _, rule := range rules {
+		if rule.re.MatchString(ua) {
+			return rule.Name
+		}
+	}
+	return ""
+}
+
+// UserAgent is what a user agent was classified as, unknown fields are empty
+type UserAgent struct {
+	Browser string
+	OS      string
+	Device  string
+	Bot     bool
+}
+
+// Classify classifies ua. Clicks without a user agent are unknown rather than bots.
+func (rs *UARules) Classify(ua string) *UserAgent {
+	if ua == "" {
+		return &UserAgent{}
+	}
+	if bot := matchUA(ua, rs.Bots); bot != "" {
+		return &UserAgent{Browser: bot, OS: matchUA(ua, rs.OS), Device: DeviceBot, Bot: true}
+	}
+	c := &UserAgent{Browser: matchUA(ua, rs.Browsers), OS: matchUA(ua, rs.OS), Device: matchUA(ua, rs.Devices)}
+	if c.Device == "" {
+		c.Device = DeviceDesktop
+	}
+	return c
+}
+
+// UAClassifier classifies user agents with rules that can be replaced while it is in use
+type UAClassifier struct {
+	mu    sync.RWMutex
+	rules *UARules
+}
+
+// NewUAClassifier classifies with rules, or the default rules if nil
+func NewUAClassifier(rules *UARules) *UAClassifier {
+	if rules == nil {
+		rules = DefaultUARules()
+	}
+	return &UAClassifier{rules: rules}
+}
+
+func (c *UAClassifier) SetRules(rules *UARules) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = rules
+}
+
+func (c *UAClassifier) Classify(ua string) *UserAgent {
+	c.mu.RLock()
+	rules := c.rules
+	c.mu.RUnlock()
+	return rules.Classify(ua)
+}
+
+// Reload replaces the rules with those in the json file at path, keeping the current rules if the
+// file is invalid
+func (c *UAClassifier) Reload(path string) error {
+	rules, err := LoadUARules(path)
+	if err != nil {
+		return err
+	}
+	c.SetRules(rules)
+	return nil
+}
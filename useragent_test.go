@@ -0,0 +1,62 @@
+package shortly
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyUserAgent(t *testing.T) {
+	a := assert.New(t)
+
+	rules := DefaultUARules()
+	for ua, want := range map[string]*UserAgent{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0.0.0 Safari/537.36 Edg/125.0.0.0": {
+			Browser: "Edge", OS: "Windows", Device: DeviceDesktop},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1": {
+			Browser: "Safari", OS: "iOS", Device: "mobile"},
+		"Mozilla/5.0 (iPad; CPU OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1": {
+			Browser: "Safari", OS: "iOS", Device: "tablet"},
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0.0.0 Mobile Safari/537.36": {
+			Browser: "Chrome", OS: "Android", Device: "mobile"},
+		"Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0.0.0 Safari/537.36": {
+			Browser: "Chrome", OS: "Android", Device: "tablet"},
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)": {Browser: "Slack", Device: DeviceBot, Bot: true},
+		"Twitterbot/1.0": {Browser: "Twitter", Device: DeviceBot, Bot: true},
+		"curl/8.4.0":     {Browser: "script", Device: DeviceBot, Bot: true},
+		"Mozilla/5.0 (compatible; YandexBot/3.0)": {Browser: "other", Device: DeviceBot, Bot: true},
+		"": {},
+	} {
+		a.Equal(want, rules.Classify(ua), ua)
+	}
+}
+
+func TestReloadUserAgentRules(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "user-agents.json")
+	a.NoError(ioutil.WriteFile(path, []byte(`{"bots": [{"name": "monitor", "pattern": "^UptimeRobot/"}]}`), 0600))
+	rules, err := LoadUARules(path)
+	a.NoError(err)
+	agents := NewUAClassifier(rules)
+	a.True(agents.Classify("UptimeRobot/2.0").Bot)
+	a.False(agents.Classify("Slackbot 1.0").Bot)
+
+	w := WatchFile(path, time.Hour, func() error { return agents.Reload(path) })
+	defer w.Close()
+	// the size changes along with the contents so the reload doesn't depend on mtime resolution
+	a.NoError(ioutil.WriteFile(path, []byte(`{"bots": [{"name": "Slack", "pattern": "Slackbot"}, {"name": "x", "pattern": "x"}]}`), 0600))
+	w.Check()
+	a.True(agents.Classify("Slackbot 1.0").Bot)
+	a.False(agents.Classify("UptimeRobot/2.0").Bot)
+
+	// broken rules are rejected and the old ones kept
+	a.NoError(ioutil.WriteFile(path, []byte(`{"bots": [{"name": "broken", "pattern": "("}]}`), 0600))
+	w.Check()
+	a.True(agents.Classify("Slackbot 1.0").Bot)
+	_, err = LoadUARules(path)
+	a.Error(err)
+}
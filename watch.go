@@ -0,0 +1,85 @@
+package shortly
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultWatchInterval = 10 * time.Second
+
+// FileWatcher calls a reload function whenever a file changes. It polls the file's modification
+// time and size rather than relying on filesystem notifications, which miss files replaced by
+// renames, as config management tools tend to do.
+type FileWatcher struct {
+	path   string
+	reload func() error
+	done   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	// mu guards the last seen state of the file
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// WatchFile polls path every interval, calling reload after it changes. Failed reloads are logged
+// and retried on the next change.
+func WatchFile(path string, interval time.Duration, reload func() error) *FileWatcher {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	w := &FileWatcher{path: path, reload: reload, done: make(chan struct{})}
+	w.changed()
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Check()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// changed records the file's current state, reporting whether it differs from the last
+func (w *FileWatcher) changed() bool {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return true
+}
+
+// Check reloads the file now if it has changed
+func (w *FileWatcher) Check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.changed() {
+		return
+	}
+	if err := w.reload(); err != nil {
+		slog.Error("failed to reload", "path", w.path, "error", err)
+		return
+	}
+	slog.Info("reloaded", "path", w.path)
+}
+
+func (w *FileWatcher) Close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.wg.Wait()
+	})
+}
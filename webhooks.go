@@ -0,0 +1,752 @@
+package shortly
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+const (
+	WebhookEventHeader    = "X-Shortly-Event"
+	WebhookDeliveryHeader = "X-Shortly-Delivery"
+	// WebhookSignatureHeader is t=<unix time>,v1=<hex hmac-sha256 of "<unix time>.<body>">
+	WebhookSignatureHeader = "X-Shortly-Signature"
+
+	webhookSecretPrefix     = "whsec_"
+	defaultWebhookInterval  = 10 * time.Second
+	defaultWebhookTimeout   = 10 * time.Second
+	defaultWebhookAttempts  = 10
+	defaultWebhookBackoff   = 30 * time.Second
+	defaultWebhookMaxWait   = 6 * time.Hour
+	defaultWebhookWorkers   = 4
+	maxWebhookThresholds    = 20
+	maxWebhookResponseError = 256
+)
+
+var webhookEvents = []string{db.EventURLCreated, db.EventURLDeleted, db.EventURLClicks}
+
+// WebhookConfig tunes the delivery of webhooks, zero fields take the defaults
+type WebhookConfig struct {
+	// Interval is how often deliveries due a retry are looked for, new events are sent straight away
+	Interval time.Duration
+	// Timeout bounds each attempt, receivers should respond before doing any slow work
+	Timeout time.Duration
+	// MaxAttempts are made before a delivery is dead
+	MaxAttempts int
+	// Backoff is the wait after the first failed attempt, which doubles with each failure up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Workers is how many deliveries are sent at once
+	Workers int
+	// Client sends deliveries, redirects are treated as failures. Unless AllowPrivateAddresses is
+	// set its transport, the default one when nil, is made to refuse internal addresses.
+	Client *http.Client
+	// AllowPrivateAddresses lets deliveries reach loopback, private and link-local addresses, for
+	// tests that receive webhooks on localhost
+	AllowPrivateAddresses bool
+}
+
+// sharedAddressSpace is carrier-grade NAT space, which is as internal as the private ranges
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether webhooks may be sent to ip. Anyone can add a webhook, so internal
+// addresses are refused to keep them from reaching our own services or the cloud metadata endpoint.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// publicOnly is a net.Dialer Control that refuses connections to internal addresses. It runs on
+// the address being connected to, after DNS resolution, so names pointing inside are caught too.
+func publicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// publicTransport returns a copy of rt that only connects to public addresses, without a proxy
+// which would connect on its behalf. Transports other than *http.Transport are left as they are.
+func publicTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return rt
+	}
+	t = t.Clone()
+	t.Proxy = nil
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicOnly}
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// WebhookPayload is the json body POSTed to webhooks
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	URL       *WebhookURL `json:"url"`
+	// Clicks is the threshold reached, for url.clicks
+	Clicks int64 `json:"clicks,omitempty"`
+}
+
+type WebhookURL struct {
+	Key         string `json:"key"`
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+	UserID      string `json:"user_id,omitempty"`
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+// SignWebhook returns the X-Shortly-Signature of body sent at t
+func SignWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks that signature is of body and was made within tolerance of now, so
+// that receivers can reject forged and replayed deliveries
+func VerifyWebhookSignature(secret string, signature string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(signature, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sigs = append(sigs, kv[1])
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return errors.New("malformed webhook signature")
+	}
+	t := time.Unix(unix, 0)
+	if d := time.Since(t); d > tolerance || d < -tolerance {
+		return errors.New("webhook signature is too old")
+	}
+	want := SignWebhook(secret, t, body)
+	for _, sig := range sigs {
+		if hmac.Equal([]byte("t="+ts+",v1="+sig), []byte(want)) {
+			return nil
+		}
+	}
+	return errors.New("webhook signature does not match")
+}
+
+// webhookBackoff is how long to wait after the given number of failed attempts
+func webhookBackoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+// WebhookDispatcher sends queued deliveries in the background, retrying failures with exponential
+// backoff until they are delivered or run out of attempts. Deliveries are claimed from the store so
+// that any number of instances can share the work.
+type WebhookDispatcher struct {
+	store       db.Webhooker
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	workers     int
+	// lease keeps a claimed delivery from being claimed again while a round of attempts is sent
+	lease  time.Duration
+	notify chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// NewWebhookDispatcher starts sending the deliveries queued in store, Close stops it
+func NewWebhookDispatcher(store db.Webhooker, conf WebhookConfig) *WebhookDispatcher {
+	if conf.Interval <= 0 {
+		conf.Interval = defaultWebhookInterval
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultWebhookTimeout
+	}
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = defaultWebhookAttempts
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = defaultWebhookBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = defaultWebhookMaxWait
+	}
+	if conf.Workers <= 0 {
+		conf.Workers = defaultWebhookWorkers
+	}
+	if conf.Client == nil {
+		conf.Client = &http.Client{}
+	}
+	client := *conf.Client
+	client.Timeout = conf.Timeout
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	if !conf.AllowPrivateAddresses {
+		client.Transport = publicTransport(client.Transport)
+	}
+	d := &WebhookDispatcher{
+		store:       store,
+		client:      &client,
+		maxAttempts: conf.MaxAttempts,
+		backoff:     conf.Backoff,
+		maxBackoff:  conf.MaxBackoff,
+		workers:     conf.Workers,
+		lease:       2 * conf.Timeout,
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(conf.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-d.notify:
+			case <-d.done:
+				return
+			}
+			if err := d.Deliver(); err != nil {
+				slog.Error("webhook delivery failed", "error", err)
+			}
+		}
+	}()
+	return d
+}
+
+// Notify wakes the dispatcher to send newly queued deliveries, it never blocks
+func (d *WebhookDispatcher) Notify() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Deliver attempts every delivery that is due, a few at a time
+func (d *WebhookDispatcher) Deliver() error {
+	for {
+		claimed, err := d.store.ClaimDeliveries(time.Now().UTC(), d.lease, d.workers)
+		if err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		wg.Add(len(claimed))
+		for _, dl := range claimed {
+			go func(dl *db.WebhookDelivery) {
+				defer wg.Done()
+				d.attempt(dl)
+			}(dl)
+		}
+		wg.Wait()
+		if len(claimed) < d.workers {
+			return nil
+		}
+	}
+}
+
+// attempt sends dl once, recording the outcome and when to try again
+func (d *WebhookDispatcher) attempt(dl *db.WebhookDelivery) {
+	h, err := d.store.Webhook(dl.WebhookID)
+	if err != nil {
+		// the webhook has been deleted along with its deliveries since dl was claimed
+		if _, notFound := err.(*db.ErrNotFound); !notFound {
+			slog.Error("failed to load webhook", "webhook_id", dl.WebhookID, "delivery_id", dl.ID, "error", err)
+		}
+		return
+	}
+	dl.Attempts++
+	status, err := d.send(h, dl)
+	dl.ResponseStatus = status
+	now := time.Now().UTC()
+	switch {
+	case err == nil:
+		dl.Status = db.DeliveryDelivered
+		dl.DeliveredAt = &now
+		dl.LastError = ""
+	case dl.Attempts >= d.maxAttempts:
+		dl.Status = db.DeliveryDead
+		dl.LastError = truncate(err.Error(), maxWebhookResponseError)
+		slog.Warn("webhook delivery is dead", "webhook_id", h.ID, "delivery_id", dl.ID,
+			"attempts", dl.Attempts, "error", err)
+	default:
+		dl.NextAttemptAt = now.Add(webhookBackoff(dl.Attempts, d.backoff, d.maxBackoff))
+		dl.LastError = truncate(err.Error(), maxWebhookResponseError)
+	}
+	if err := d.store.UpdateDelivery(dl); err != nil {
+		slog.Error("failed to update webhook delivery", "delivery_id", dl.ID, "error", err)
+	}
+}
+
+// send POSTs dl to h, anything but a 2xx response is a failure
+func (d *WebhookDispatcher) send(h *db.Webhook, dl *db.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(ContentType, JSONMimeType)
+	req.Header.Set(WebhookEventHeader, dl.Event)
+	req.Header.Set(WebhookDeliveryHeader, dl.ID)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(h.Secret, time.Now(), dl.Payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Close stops the dispatcher once the attempts in flight are done, queued deliveries are left
+// for the next start
+func (d *WebhookDispatcher) Close() {
+	d.once.Do(func() {
+		close(d.done)
+		d.wg.Wait()
+	})
+}
+
+// urlWebhooks returns the webhooks of the owner of storedURL subscribed to event, anonymous links
+// have none
+func urlWebhooks(s db.Webhooker, storedURL *db.StoredURL, event string) ([]*db.Webhook, error) {
+	if storedURL.UserID == "" && storedURL.WorkspaceID == "" {
+		return nil, nil
+	}
+	hooks, err := s.Webhooks(storedURL.UserID, storedURL.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	subscribed := []*db.Webhook{}
+	for _, h := range hooks {
+		if h.Subscribes(event) {
+			subscribed = append(subscribed, h)
+		}
+	}
+	return subscribed, nil
+}
+
+// enqueueWebhook queues payload for h, dedupeKey makes sure it is only ever queued once
+func (a *App) enqueueWebhook(ctx context.Context, s db.Webhooker, h *db.Webhook, payload *WebhookPayload,
+	dedupeKey string) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to marshal webhook payload", "error", err)
+		return
+	}
+	d := &db.WebhookDelivery{WebhookID: h.ID, Event: payload.Event, DedupeKey: dedupeKey, Payload: b}
+	if _, err := s.EnqueueDelivery(d); err != nil {
+		slog.ErrorContext(ctx, "failed to queue webhook delivery", "event", payload.Event, "webhook_id", h.ID,
+			"error", err)
+	}
+}
+
+func (a *App) webhookURL(key string, storedURL *db.StoredURL) *WebhookURL {
+	return &WebhookURL{
+		Key:         key,
+		ShortURL:    a.BaseURL + "/" + key,
+		OriginalURL: storedURL.OriginalURL,
+		UserID:      storedURL.UserID,
+		WorkspaceID: storedURL.WorkspaceID,
+	}
+}
+
+// emitURLEvent queues event on key for the webhooks of its owner. storedURL is fetched when nil,
+// deleted links have to be passed in. Like audit the change has been made, failures are only logged.
+func (a *App) emitURLEvent(ctx context.Context, event string, key string, storedURL *db.StoredURL) {
+	s, ok := a.store.(db.Webhooker)
+	if !ok {
+		return
+	}
+	if storedURL == nil {
+		var err error
+		if storedURL, err = a.urls(ctx).Get(key); err != nil {
+			slog.ErrorContext(ctx, "failed to look up url for webhooks", "key", key, "error", err)
+			return
+		}
+	}
+	hooks, err := urlWebhooks(s, storedURL, event)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to find webhooks", "key", key, "error", err)
+		return
+	}
+	payload := &WebhookPayload{Event: event, CreatedAt: time.Now().UTC(), URL: a.webhookURL(key, storedURL)}
+	for _, h := range hooks {
+		a.enqueueWebhook(ctx, s, h, payload, "")
+	}
+	if len(hooks) > 0 && a.Webhooks != nil {
+		a.Webhooks.Notify()
+	}
+}
+
+// clickThresholds queues url.clicks for every threshold reached by the links clicked in a batch
+// that was just written. Workers write batches of the same link concurrently, so rather than
+// working out which thresholds a batch crossed every threshold reached is queued again, and dedupe
+// keys see to it that each is only delivered once.
+func (a *App) clickThresholds(clicks []*db.Click) {
+	s, ok := a.store.(db.Webhooker)
+	if !ok {
+		return
+	}
+	counter, ok := a.store.(db.ClickCounter)
+	if !ok {
+		return
+	}
+	// links are looked up once each and the webhooks of their owners once each
+	urls := map[string]*db.StoredURL{}
+	owners := map[[2]string][]*db.Webhook{}
+	hooks := map[string][]*db.Webhook{}
+	for _, c := range clicks {
+		if _, seen := urls[c.Key]; seen || c.Bot {
+			continue
+		}
+		storedURL, err := a.urls(context.Background()).Get(c.Key)
+		urls[c.Key] = storedURL
+		if err != nil {
+			// deleted since being clicked
+			continue
+		}
+		owner := [2]string{storedURL.UserID, storedURL.WorkspaceID}
+		subscribed, seen := owners[owner]
+		if !seen {
+			if subscribed, err = urlWebhooks(s, storedURL, db.EventURLClicks); err != nil {
+				slog.Error("failed to find webhooks", "key", c.Key, "error", err)
+			}
+			owners[owner] = subscribed
+		}
+		if len(subscribed) > 0 {
+			hooks[c.Key] = subscribed
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(hooks))
+	for k := range hooks {
+		keys = append(keys, k)
+	}
+	counts, err := counter.ClickCounts(keys)
+	if err != nil {
+		slog.Error("failed to count clicks for webhooks", "error", err)
+		return
+	}
+	for _, key := range keys {
+		for _, h := range hooks[key] {
+			for _, n := range h.ClickThresholds {
+				if counts[key] < n {
+					break
+				}
+				payload := &WebhookPayload{Event: db.EventURLClicks, CreatedAt: time.Now().UTC(),
+					URL: a.webhookURL(key, urls[key]), Clicks: n}
+				a.enqueueWebhook(context.Background(), s, h, payload, fmt.Sprintf("%s:%s:%d", db.EventURLClicks, key, n))
+			}
+		}
+	}
+	if a.Webhooks != nil {
+		a.Webhooks.Notify()
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// ClickThresholds are required for url.clicks, e.g. [100, 1000]
+	ClickThresholds []int64 `json:"click_thresholds,omitempty"`
+	// WorkspaceID subscribes to the links of a workspace, which needs its admin role, rather than
+	// the user's own
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+type WebhookResponse struct {
+	Webhook *db.Webhook `json:"webhook,omitempty"`
+	// Secret signs every delivery, it is only ever returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+	Err    string `json:"error"`
+}
+
+type WebhooksResponse struct {
+	Webhooks []*db.Webhook `json:"webhooks"`
+	Err      string        `json:"error"`
+}
+
+type WebhookDeliveriesResponse struct {
+	Deliveries []*db.WebhookDelivery `json:"deliveries"`
+	Total      int                   `json:"total"`
+	NextOffset int                   `json:"next_offset,omitempty"`
+	Err        string                `json:"error"`
+}
+
+type WebhookDeliveryResponse struct {
+	Delivery *db.WebhookDelivery `json:"delivery,omitempty"`
+	Err      string              `json:"error"`
+}
+
+// validateWebhookRequest returns a message describing what is wrong with req, if anything
+func validateWebhookRequest(req *CreateWebhookRequest, allowPrivate bool) string {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "url must be an absolute http or https url"
+	}
+	// names are checked when deliveries connect, once they have been resolved
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !allowPrivate && !publicIP(ip) {
+		return "url must not be an internal address"
+	}
+	if len(req.Events) == 0 {
+		return "at least one event is required"
+	}
+	clicks := false
+	for _, event := range req.Events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return "unknown event " + event
+		}
+		clicks = clicks || event == db.EventURLClicks
+	}
+	if clicks != (len(req.ClickThresholds) > 0) {
+		return "click_thresholds are given with, and only with, the url.clicks event"
+	}
+	if len(req.ClickThresholds) > maxWebhookThresholds {
+		return "at most " + strconv.Itoa(maxWebhookThresholds) + " click_thresholds are allowed"
+	}
+	for _, n := range req.ClickThresholds {
+		if n < 1 {
+			return "click_thresholds must be positive"
+		}
+	}
+	sort.Slice(req.ClickThresholds, func(i, j int) bool { return req.ClickThresholds[i] < req.ClickThresholds[j] })
+	return ""
+}
+
+// webhookStore returns the store as a db.Webhooker, writing a 501 if the backend doesn't support
+// webhooks
+func (a *App) webhookStore(w http.ResponseWriter) (db.Webhooker, bool) {
+	s, ok := a.store.(db.Webhooker)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &WebhookResponse{Err: "store does not support webhooks"})
+	}
+	return s, ok
+}
+
+// canManageWebhook reports whether u may manage h. Webhooks of a workspace need its admin role,
+// a user's own webhooks are theirs alone.
+func (a *App) canManageWebhook(ctx context.Context, u *db.User, h *db.Webhook) bool {
+	if h.WorkspaceID == "" {
+		return h.UserID == u.ID
+	}
+	return db.RoleAtLeast(a.workspaceRole(ctx, h.WorkspaceID, u.ID), db.RoleAdmin)
+}
+
+// managedWebhook fetches the webhook named in the path, writing an error unless the user may
+// manage it. Webhooks the user can't manage are reported as not existing.
+func (a *App) managedWebhook(w http.ResponseWriter, r *http.Request) (db.Webhooker, *db.Webhook, bool) {
+	s, ok := a.webhookStore(w)
+	if !ok {
+		return nil, nil, false
+	}
+	id := mux.Vars(r)["id"]
+	h, err := s.Webhook(id)
+	if err == nil && !a.canManageWebhook(r.Context(), UserFromContext(r.Context()), h) {
+		err = db.NewErrNotFound(fmt.Sprintf("webhook %s does not exist", id))
+	}
+	if err != nil {
+		writeJSON(w, statusForErr(err), &WebhookResponse{Err: err.Error()})
+		return nil, nil, false
+	}
+	return s, h, true
+}
+
+// CreateWebhookHandler subscribes a url to events on the user's links, or a workspace's. The
+// secret deliveries are signed with is only shown once.
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/webhooks -d '{"url": "https://example.com/hook", "events": ["url.created", "url.clicks"], "click_thresholds": [100, 1000]}'
+func (a *App) CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.webhookStore(w)
+	if !ok {
+		return
+	}
+	req := &CreateWebhookRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &WebhookResponse{Err: err.Error()})
+		return
+	}
+	if msg := validateWebhookRequest(req, a.WebhookConfig.AllowPrivateAddresses); msg != "" {
+		writeJSON(w, http.StatusBadRequest, &WebhookResponse{Err: msg})
+		return
+	}
+	u := UserFromContext(r.Context())
+	secret := webhookSecretPrefix + newToken()
+	h := &db.Webhook{
+		UserID:          u.ID,
+		WorkspaceID:     req.WorkspaceID,
+		URL:             req.URL,
+		Secret:          secret,
+		Events:          req.Events,
+		ClickThresholds: req.ClickThresholds,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if !a.canManageWebhook(r.Context(), u, h) {
+		writeJSON(w, http.StatusForbidden, &WebhookResponse{Err: "you must be a workspace admin to do that"})
+		return
+	}
+	if err := s.CreateWebhook(h); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WebhookResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "created webhook", "user_id", u.ID, "webhook_id", h.ID)
+	a.audit(r, AuditWebhookCreate, h.ID, nil, h)
+	writeJSON(w, http.StatusOK, &WebhookResponse{Webhook: h, Secret: secret})
+}
+
+// ListWebhooksHandler lists the user's webhooks, or a workspace's with ?workspace_id=
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/webhooks
+func (a *App) ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.webhookStore(w)
+	if !ok {
+		return
+	}
+	u := UserFromContext(r.Context())
+	workspaceID := r.URL.Query().Get("workspace_id")
+	if !a.canManageWebhook(r.Context(), u, &db.Webhook{UserID: u.ID, WorkspaceID: workspaceID}) {
+		writeJSON(w, http.StatusForbidden, &WebhooksResponse{Err: "you must be a workspace admin to do that"})
+		return
+	}
+	hooks, err := s.Webhooks(u.ID, workspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WebhooksResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &WebhooksResponse{Webhooks: hooks})
+}
+
+// DeleteWebhookHandler deletes a webhook, its queued deliveries are dropped
+// curl -X DELETE -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/webhooks/$ID
+func (a *App) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	s, h, ok := a.managedWebhook(w, r)
+	if !ok {
+		return
+	}
+	if err := s.DeleteWebhook(h.ID); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WebhookResponse{Err: err.Error()})
+		return
+	}
+	a.audit(r, AuditWebhookDelete, h.ID, h, nil)
+	writeJSON(w, http.StatusOK, &WebhookResponse{})
+}
+
+// WebhookDeliveriesHandler is the delivery log of a webhook, newest first. ?status=dead lists the
+// deliveries that ran out of attempts.
+// curl -H "Authorization: Bearer $TOKEN" "localhost:8080/api/v1/webhooks/$ID/deliveries?status=dead"
+func (a *App) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	s, h, ok := a.managedWebhook(w, r)
+	if !ok {
+		return
+	}
+	q, msg := parseListQuery(r)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &WebhookDeliveriesResponse{Err: msg})
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", db.DeliveryPending, db.DeliveryDelivered, db.DeliveryDead:
+	default:
+		writeJSON(w, http.StatusBadRequest, &WebhookDeliveriesResponse{
+			Err: "status must be pending, delivered or dead"})
+		return
+	}
+	deliveries, total, err := s.Deliveries(h.ID, status, q.Offset, q.Limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WebhookDeliveriesResponse{Err: err.Error()})
+		return
+	}
+	resp := &WebhookDeliveriesResponse{Deliveries: deliveries, Total: total}
+	if q.Offset+len(deliveries) < total {
+		resp.NextOffset = q.Offset + len(deliveries)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// RetryWebhookDeliveryHandler queues a dead delivery to be sent again, with a fresh set of attempts
+// curl -X POST -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/webhooks/$ID/deliveries/$DELIVERY/retry
+func (a *App) RetryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	s, h, ok := a.managedWebhook(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["delivery"]
+	d, err := s.Delivery(id)
+	if err == nil && d.WebhookID != h.ID {
+		err = db.NewErrNotFound(fmt.Sprintf("delivery %s does not exist", id))
+	}
+	if err != nil {
+		writeJSON(w, statusForErr(err), &WebhookDeliveryResponse{Err: err.Error()})
+		return
+	}
+	if d.Status != db.DeliveryDead {
+		writeJSON(w, http.StatusConflict, &WebhookDeliveryResponse{Err: "only dead deliveries can be retried"})
+		return
+	}
+	before := *d
+	d.Status = db.DeliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now().UTC()
+	if err := s.UpdateDelivery(d); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WebhookDeliveryResponse{Err: err.Error()})
+		return
+	}
+	a.audit(r, AuditWebhookRetry, d.ID, &before, d)
+	if a.Webhooks != nil {
+		a.Webhooks.Notify()
+	}
+	writeJSON(w, http.StatusOK, &WebhookDeliveryResponse{Delivery: d})
+}
@@ -0,0 +1,281 @@
+package shortly
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	a := assert.New(t)
+
+	body := []byte(`{"event": "url.created"}`)
+	sig := SignWebhook("whsec_cat", time.Now(), body)
+	a.NoError(VerifyWebhookSignature("whsec_cat", sig, body, time.Minute))
+	a.EqualError(VerifyWebhookSignature("whsec_dog", sig, body, time.Minute), "webhook signature does not match")
+	a.EqualError(VerifyWebhookSignature("whsec_cat", sig, []byte(`{"event": "url.deleted"}`), time.Minute),
+		"webhook signature does not match")
+	a.EqualError(VerifyWebhookSignature("whsec_cat", SignWebhook("whsec_cat", time.Now().Add(-time.Hour), body),
+		body, time.Minute), "webhook signature is too old")
+	a.EqualError(VerifyWebhookSignature("whsec_cat", "v1=abc", body, time.Minute), "malformed webhook signature")
+
+	a.Equal(30*time.Second, webhookBackoff(1, 30*time.Second, time.Hour))
+	a.Equal(2*time.Minute, webhookBackoff(3, 30*time.Second, time.Hour))
+	a.Equal(time.Hour, webhookBackoff(100, 30*time.Second, time.Hour))
+}
+
+// webhookReceiver records the deliveries it is sent, failing the first few
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+	mu     sync.Mutex
+	fail   int
+	got    []*WebhookPayload
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	assert.NoError(rc.t, VerifyWebhookSignature(rc.secret, r.Header.Get(WebhookSignatureHeader), body, time.Minute))
+	assert.NotEmpty(rc.t, r.Header.Get(WebhookDeliveryHeader))
+	if rc.fail > 0 {
+		rc.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	p := &WebhookPayload{}
+	assert.NoError(rc.t, json.Unmarshal(body, p))
+	assert.Equal(rc.t, p.Event, r.Header.Get(WebhookEventHeader))
+	rc.got = append(rc.got, p)
+}
+
+func (rc *webhookReceiver) received() []*WebhookPayload {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]*WebhookPayload{}, rc.got...)
+}
+
+func (rc *webhookReceiver) failNext(n int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.fail = n
+}
+
+func TestWebhooks(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	app.WebhookConfig = WebhookConfig{Interval: 5 * time.Millisecond, Backoff: time.Millisecond,
+		MaxBackoff: time.Millisecond, MaxAttempts: 3, AllowPrivateAddresses: true}
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	defer app.Webhooks.Close()
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	dog := apiLogin(t, app, "dog@foobarcat.com")
+
+	receiver := &webhookReceiver{t: t}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	rr := apiRequest(app, "POST", "/api/v1/webhooks", `{"url": "`+server.URL+`", "events": ["url.created",
+		"url.deleted", "url.clicks"], "click_thresholds": [5, 2]}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	created := &WebhookResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), created))
+	a.Contains(created.Secret, webhookSecretPrefix)
+	a.Equal([]int64{2, 5}, created.Webhook.ClickThresholds)
+	hookID := created.Webhook.ID
+	receiver.mu.Lock()
+	receiver.secret = created.Secret
+	receiver.mu.Unlock()
+
+	// the secret is never shown again
+	rr = apiRequest(app, "GET", "/api/v1/webhooks", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.NotContains(rr.Body.String(), created.Secret)
+	hooks := &WebhooksResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), hooks))
+	a.Len(hooks.Webhooks, 1)
+
+	// creating a link is delivered, after being retried
+	receiver.failNext(1)
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	key := resp.ShortenedURL
+	a.Eventually(func() bool { return len(receiver.received()) == 1 }, 5*time.Second, 5*time.Millisecond)
+	got := receiver.received()[0]
+	a.Equal(db.EventURLCreated, got.Event)
+	a.Equal(key, got.URL.Key)
+	a.Equal(app.BaseURL+"/"+key, got.URL.ShortURL)
+	a.Equal("http://foobarcat.blogspot.com", got.URL.OriginalURL)
+
+	rr = apiRequest(app, "GET", "/api/v1/webhooks/"+hookID+"/deliveries", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	log := &WebhookDeliveriesResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), log))
+	a.Len(log.Deliveries, 1)
+	a.Equal(db.DeliveryDelivered, log.Deliveries[0].Status)
+	a.Equal(2, log.Deliveries[0].Attempts)
+	a.Equal(http.StatusOK, log.Deliveries[0].ResponseStatus)
+
+	// shortening the same link again returns it without announcing it again
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	a.Equal(key, resp.ShortenedURL)
+	deliveries, _, err := store.Deliveries(hookID, "", 0, 10)
+	a.NoError(err)
+	a.Len(deliveries, 1)
+
+	// each threshold fires once, however many batches pass it, and bots don't count
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/"+key, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:126.0) Gecko/20100101 Firefox/126.0")
+		app.server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req, _ := http.NewRequest("GET", "/"+key, nil)
+	req.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+	app.server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	app.Clicks.Close()
+	// as though another batch had been written
+	app.clickThresholds([]*db.Click{{Key: key}})
+	a.Eventually(func() bool { return len(receiver.received()) == 2 }, 5*time.Second, 5*time.Millisecond)
+	got = receiver.received()[1]
+	a.Equal(db.EventURLClicks, got.Event)
+	a.Equal(int64(2), got.Clicks)
+
+	// a receiver that stays down leaves a dead delivery, which can be retried
+	receiver.failNext(3)
+	rr = apiRequest(app, "DELETE", "/api/v1/urls/"+key, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	var dead *db.WebhookDelivery
+	a.Eventually(func() bool {
+		deliveries, _, _ := store.Deliveries(hookID, db.DeliveryDead, 0, 10)
+		if len(deliveries) == 1 {
+			dead = deliveries[0]
+		}
+		return dead != nil
+	}, 5*time.Second, 5*time.Millisecond)
+	a.Equal(db.EventURLDeleted, dead.Event)
+	a.Equal(3, dead.Attempts)
+	a.Equal(http.StatusServiceUnavailable, dead.ResponseStatus)
+	a.Contains(dead.LastError, "503")
+	a.Len(receiver.received(), 2)
+
+	rr = apiRequest(app, "GET", "/api/v1/webhooks/"+hookID+"/deliveries?status=dead", "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	log = &WebhookDeliveriesResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), log))
+	a.Equal(1, log.Total)
+	a.Equal(dead.ID, log.Deliveries[0].ID)
+
+	retry := "/api/v1/webhooks/" + hookID + "/deliveries/" + dead.ID + "/retry"
+	rr = apiRequest(app, "POST", retry, "", dog)
+	a.Equal(http.StatusNotFound, rr.Code)
+	rr = apiRequest(app, "POST", retry, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	events, _, err := store.AuditEvents(&db.AuditFilter{Action: AuditWebhookRetry, Target: dead.ID, Limit: 10})
+	a.NoError(err)
+	a.Len(events, 1)
+	a.Contains(string(events[0].Before), `"status":"dead"`)
+	a.Contains(string(events[0].After), `"status":"pending"`)
+	a.Eventually(func() bool { return len(receiver.received()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	a.Equal(db.EventURLDeleted, receiver.received()[2].Event)
+	rr = apiRequest(app, "POST", retry, "", cat)
+	a.Equal(http.StatusConflict, rr.Code)
+
+	// other users can't see or delete the webhook, and only workspace admins manage a workspace's
+	rr = apiRequest(app, "GET", "/api/v1/webhooks/"+hookID+"/deliveries", "", dog)
+	a.Equal(http.StatusNotFound, rr.Code)
+	rr = apiRequest(app, "DELETE", "/api/v1/webhooks/"+hookID, "", dog)
+	a.Equal(http.StatusNotFound, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/workspaces", `{"name": "marketing"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	ws := &WorkspaceResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), ws))
+	body := `{"url": "` + server.URL + `", "events": ["url.created"], "workspace_id": "` + ws.Workspace.ID + `"}`
+	rr = apiRequest(app, "POST", "/api/v1/webhooks", body, dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/webhooks", body, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/webhooks?workspace_id="+ws.Workspace.ID, "", cat)
+	hooks = &WebhooksResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), hooks))
+	a.Len(hooks.Webhooks, 1)
+
+	for _, body := range []string{
+		`{"url": "ftp://example.com", "events": ["url.created"]}`,
+		`{"url": "https://example.com", "events": []}`,
+		`{"url": "https://example.com", "events": ["url.updated"]}`,
+		`{"url": "https://example.com", "events": ["url.clicks"]}`,
+		`{"url": "https://example.com", "events": ["url.created"], "click_thresholds": [10]}`,
+		`{"url": "https://example.com", "events": ["url.clicks"], "click_thresholds": [0]}`,
+	} {
+		rr = apiRequest(app, "POST", "/api/v1/webhooks", body, cat)
+		a.Equal(http.StatusBadRequest, rr.Code, body)
+	}
+
+	rr = apiRequest(app, "DELETE", "/api/v1/webhooks/"+hookID, "", cat)
+	a.Equal(http.StatusOK, rr.Code)
+	deliveries, _, err = store.Deliveries(hookID, "", 0, 10)
+	a.NoError(err)
+	a.Empty(deliveries)
+}
+
+func TestWebhookInternalAddresses(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(publicIP(net.ParseIP("93.184.216.34")))
+	for _, ip := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"fe80::1", "fd00::1", "0.0.0.0", "100.64.0.1", "::ffff:127.0.0.1"} {
+		a.False(publicIP(net.ParseIP(ip)), ip)
+	}
+
+	app := NewApp()
+	app.WebhookConfig = WebhookConfig{Interval: 5 * time.Millisecond, MaxAttempts: 1}
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	defer app.Webhooks.Close()
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+
+	for _, u := range []string{"http://127.0.0.1:6060/loglevel", "http://169.254.169.254/latest/meta-data",
+		"http://[::1]/", "http://10.0.0.1/"} {
+		rr := apiRequest(app, "POST", "/api/v1/webhooks", `{"url": "`+u+`", "events": ["url.created"]}`, cat)
+		a.Equal(http.StatusBadRequest, rr.Code, u)
+	}
+
+	// names are resolved before they are refused, so they can't be pointed inside either
+	receiver := &webhookReceiver{t: t}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	rr := apiRequest(app, "POST", "/api/v1/webhooks", `{"url": "http://localhost:`+port+`",
+		"events": ["url.created"]}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	created := &WebhookResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), created))
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://foobarcat.blogspot.com"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	var dead *db.WebhookDelivery
+	a.Eventually(func() bool {
+		deliveries, _, _ := store.Deliveries(created.Webhook.ID, db.DeliveryDead, 0, 10)
+		if len(deliveries) == 1 {
+			dead = deliveries[0]
+		}
+		return dead != nil
+	}, 5*time.Second, 5*time.Millisecond)
+	a.Contains(dead.LastError, "is not public")
+	a.Zero(dead.ResponseStatus)
+	a.Empty(receiver.received())
+}
@@ -0,0 +1,554 @@
+package shortly
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/gorilla/mux"
+)
+
+const (
+	invitationTTL    = 7 * 24 * time.Hour
+	maxWorkspaceName = 100
+)
+
+type WorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+type WorkspaceResponse struct {
+	Workspace *db.Workspace `json:"workspace,omitempty"`
+	Members   []*db.Member  `json:"members,omitempty"`
+	Err       string        `json:"error"`
+}
+
+type WorkspacesResponse struct {
+	Workspaces []*db.Workspace `json:"workspaces"`
+	Err        string          `json:"error"`
+}
+
+type InviteRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type InvitationResponse struct {
+	Invitation *db.Invitation `json:"invitation,omitempty"`
+	Err        string         `json:"error"`
+}
+
+type MemberRequest struct {
+	Role string `json:"role"`
+}
+
+// TransferRequest names who to give something to, a url may go to a workspace or a user, a
+// workspace only to a user
+type TransferRequest struct {
+	UserID      string `json:"user_id,omitempty"`
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+// workspaceRole returns the user's role in the workspace, empty if they are not a member
+func (a *App) workspaceRole(ctx context.Context, workspaceID string, userID string) string {
+	s, ok := a.store.(db.WorkspaceStore)
+	if !ok {
+		return ""
+	}
+	m, err := s.Member(workspaceID, userID)
+	if err != nil {
+		if _, notFound := err.(*db.ErrNotFound); !notFound {
+			slog.ErrorContext(ctx, "failed to look up workspace member", "workspace_id", workspaceID,
+				"user_id", userID, "error", err)
+		}
+		return ""
+	}
+	return m.Role
+}
+
+// canCreateIn checks u may create urls in the workspace, returning the status and message to
+// respond with if not
+func (a *App) canCreateIn(ctx context.Context, u *db.User, workspaceID string) (int, string) {
+	if _, ok := a.store.(db.WorkspaceStore); !ok {
+		return http.StatusNotImplemented, "store does not support workspaces"
+	}
+	if u == nil {
+		return http.StatusUnauthorized, "log in to create urls in a workspace"
+	}
+	if !db.RoleAtLeast(a.workspaceRole(ctx, workspaceID, u.ID), db.RoleEditor) {
+		return http.StatusForbidden, "you must be an editor of the workspace to create urls in it"
+	}
+	return http.StatusOK, ""
+}
+
+// workspaceMember loads the workspace named in the path and the requesting user's membership,
+// writing an error if they don't have at least role. Workspaces the user isn't a member of are
+// reported as not existing.
+func (a *App) workspaceMember(w http.ResponseWriter, r *http.Request, role string) (db.WorkspaceStore,
+	*db.Workspace, *db.Member, bool) {
+	s, ok := a.store.(db.WorkspaceStore)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &WorkspaceResponse{Err: "store does not support workspaces"})
+		return nil, nil, nil, false
+	}
+	id := mux.Vars(r)["id"]
+	m, err := s.Member(id, UserFromContext(r.Context()).ID)
+	if err != nil {
+		if _, notFound := err.(*db.ErrNotFound); notFound {
+			err = db.NewErrNotFound(fmt.Sprintf("workspace %s does not exist", id))
+		}
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return nil, nil, nil, false
+	}
+	if !db.RoleAtLeast(m.Role, role) {
+		writeJSON(w, http.StatusForbidden, &WorkspaceResponse{Err: "you must be a workspace " + role + " to do that"})
+		return nil, nil, nil, false
+	}
+	ws, err := s.Workspace(id)
+	if err != nil {
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return nil, nil, nil, false
+	}
+	return s, ws, m, true
+}
+
+// validateWorkspaceName returns why name can't be used, or "" if it can. Names are put in the
+// subjects of invitation emails so control characters, line breaks among them, are refused.
+func validateWorkspaceName(name string) string {
+	if name == "" || len(name) > maxWorkspaceName {
+		return "name must be between 1 and 100 characters"
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "name must not contain control characters"
+	}
+	return ""
+}
+
+// CreateWorkspaceHandler creates a workspace with the authenticated user as its owner
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces -d '{"name": "marketing"}'
+func (a *App) CreateWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.store.(db.WorkspaceStore)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &WorkspaceResponse{Err: "store does not support workspaces"})
+		return
+	}
+	req := &WorkspaceRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if msg := validateWorkspaceName(req.Name); msg != "" {
+		writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{Err: msg})
+		return
+	}
+	u := UserFromContext(r.Context())
+	ws, err := s.CreateWorkspace(req.Name, u.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	ws.Role = db.RoleAdmin
+	slog.InfoContext(r.Context(), "created workspace", "user_id", u.ID, "workspace_id", ws.ID)
+	a.audit(r, AuditWorkspaceCreate, ws.ID, nil, ws)
+	writeJSON(w, http.StatusOK, &WorkspaceResponse{Workspace: ws})
+}
+
+// ListWorkspacesHandler lists the workspaces the authenticated user belongs to
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces
+func (a *App) ListWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.store.(db.WorkspaceStore)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &WorkspacesResponse{Err: "store does not support workspaces"})
+		return
+	}
+	wss, err := s.WorkspacesByUser(UserFromContext(r.Context()).ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WorkspacesResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &WorkspacesResponse{Workspaces: wss})
+}
+
+// GetWorkspaceHandler returns a workspace and its members
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces/$ID
+func (a *App) GetWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	s, ws, m, ok := a.workspaceMember(w, r, db.RoleViewer)
+	if !ok {
+		return
+	}
+	members, err := s.Members(ws.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	ws.Role = m.Role
+	writeJSON(w, http.StatusOK, &WorkspaceResponse{Workspace: ws, Members: members})
+}
+
+// ListWorkspaceURLsHandler lists a workspace's urls, taking the same parameters as ListURLsHandler
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces/$ID/urls
+func (a *App) ListWorkspaceURLsHandler(w http.ResponseWriter, r *http.Request) {
+	s, ws, _, ok := a.workspaceMember(w, r, db.RoleViewer)
+	if !ok {
+		return
+	}
+	q, msg := parseListQuery(r)
+	if msg != "" {
+		writeJSON(w, http.StatusBadRequest, &ListURLsResponse{Err: msg})
+		return
+	}
+	urls, total, err := s.ListByWorkspace(ws.ID, q)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &ListURLsResponse{Err: err.Error()})
+		return
+	}
+	resp := &ListURLsResponse{URLs: urls, Total: total}
+	if q.Offset+len(urls) < total {
+		resp.NextOffset = q.Offset + len(urls)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// InviteHandler emails an invitation to join the workspace with the given role
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces/$ID/invitations -d '{"email": "dog@foobarcat.com", "role": "editor"}'
+func (a *App) InviteHandler(w http.ResponseWriter, r *http.Request) {
+	s, ws, m, ok := a.workspaceMember(w, r, db.RoleAdmin)
+	if !ok {
+		return
+	}
+	req := &InviteRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &InvitationResponse{Err: err.Error()})
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+		writeJSON(w, http.StatusBadRequest, &InvitationResponse{Err: "please enter a valid email address"})
+		return
+	}
+	if !db.ValidRole(req.Role) {
+		writeJSON(w, http.StatusBadRequest, &InvitationResponse{Err: "role must be admin, editor or viewer"})
+		return
+	}
+
+	token := newToken()
+	now := time.Now().UTC()
+	inv := &db.Invitation{
+		Hash:        hashToken(token),
+		WorkspaceID: ws.ID,
+		Email:       req.Email,
+		Role:        req.Role,
+		InvitedBy:   m.UserID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(invitationTTL),
+	}
+	if err := s.CreateInvitation(inv); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &InvitationResponse{Err: err.Error()})
+		return
+	}
+	err := a.Mailer.Send(&Message{
+		To:      req.Email,
+		Subject: "You've been invited to " + ws.Name + " on Shortly",
+		Body: fmt.Sprintf("%s invited you to join the %s workspace as %s %s. Accept at\n\n%s\n\n"+
+			"The invitation expires in 7 days. You'll need to sign up or log in as %s first.\n",
+			m.Email, ws.Name, article(req.Role), req.Role, a.BaseURL+"/invitations/accept?token="+token, req.Email),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to send invitation", "invitation_id", inv.ID, "error", err)
+		writeJSON(w, http.StatusBadGateway, &InvitationResponse{Err: "failed to send the invitation email"})
+		return
+	}
+	slog.InfoContext(r.Context(), "invited to workspace", "user_id", m.UserID, "email", req.Email,
+		"workspace_id", ws.ID)
+	a.audit(r, AuditWorkspaceInvite, ws.ID, nil, inv)
+	writeJSON(w, http.StatusOK, &InvitationResponse{Invitation: inv})
+}
+
+func article(word string) string {
+	if strings.ContainsAny(word[:1], "aeiou") {
+		return "an"
+	}
+	return "a"
+}
+
+// acceptInvitation adds the user making r to the workspace of the invitation token, which must have
+// been sent to their email
+func (a *App) acceptInvitation(r *http.Request, token string) (*db.Invitation, error) {
+	u := UserFromContext(r.Context())
+	s, ok := a.store.(db.WorkspaceStore)
+	if !ok {
+		return nil, db.NewErrDB("store does not support workspaces")
+	}
+	inv, err := s.AcceptInvitation(hashToken(token), u.ID, u.Email)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(r.Context(), "joined workspace", "user_id", u.ID, "workspace_id", inv.WorkspaceID,
+		"role", inv.Role)
+	a.audit(r, AuditWorkspaceJoin, inv.WorkspaceID, nil, &db.Member{UserID: u.ID, Email: u.Email, Role: inv.Role})
+	return inv, nil
+}
+
+// AcceptInvitationHandler joins the workspace of an emailed invitation
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/invitations/accept -d '{"token": "..."}'
+func (a *App) AcceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	req := &VerifyRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &InvitationResponse{Err: err.Error()})
+		return
+	}
+	inv, err := a.acceptInvitation(r, req.Token)
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrNotFound:
+			writeJSON(w, http.StatusBadRequest, &InvitationResponse{Err: "invalid or expired invitation"})
+		case *db.ErrExists:
+			writeJSON(w, http.StatusConflict, &InvitationResponse{Err: "you are already a member"})
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			writeJSON(w, statusForErr(err), &InvitationResponse{Err: err.Error()})
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, &InvitationResponse{Invitation: inv})
+}
+
+// AcceptInvitationPageHandler asks the logged in user to confirm joining the workspace. Like
+// password resets the token is only used when the form is submitted.
+func (a *App) AcceptInvitationPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderAccountPage(w, r, http.StatusOK, &AccountTemplateData{PageTitle: "Join workspace",
+		Action: "/invitations/accept", Token: r.URL.Query().Get("token"),
+		Confirm: "You've been invited to join a workspace."})
+}
+
+// AcceptInvitationFormHandler joins the workspace from the invitation form
+func (a *App) AcceptInvitationFormHandler(w http.ResponseWriter, r *http.Request) {
+	data := &AccountTemplateData{PageTitle: "Join workspace"}
+	_, err := a.acceptInvitation(r, r.PostFormValue("token"))
+	if err != nil {
+		switch err.(type) {
+		case *db.ErrNotFound:
+			data.Err = "this invitation is invalid, has expired, or was sent to another email address"
+			renderAccountPage(w, r, http.StatusBadRequest, data)
+		case *db.ErrExists:
+			data.Err = "you are already a member of this workspace"
+			renderAccountPage(w, r, http.StatusConflict, data)
+		default:
+			slog.ErrorContext(r.Context(), "request error", "error", err)
+			data.Err = "something went wrong"
+			renderAccountPage(w, r, http.StatusInternalServerError, data)
+		}
+		return
+	}
+	data.Msg = "You've joined the workspace."
+	renderAccountPage(w, r, http.StatusOK, data)
+}
+
+// SetMemberRoleHandler changes a member's role, the owner always stays an admin
+// curl -X PUT -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces/$ID/members/$USER_ID -d '{"role": "viewer"}'
+func (a *App) SetMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	s, ws, m, ok := a.workspaceMember(w, r, db.RoleAdmin)
+	if !ok {
+		return
+	}
+	req := &MemberRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	if !db.ValidRole(req.Role) {
+		writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{Err: "role must be admin, editor or viewer"})
+		return
+	}
+	userID := mux.Vars(r)["user_id"]
+	if userID == ws.OwnerID && req.Role != db.RoleAdmin {
+		writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{Err: "the workspace owner must be an admin"})
+		return
+	}
+	before, err := s.Member(ws.ID, userID)
+	if err != nil {
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	if err := s.SetRole(ws.ID, userID, req.Role); err != nil {
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "changed workspace role", "user_id", m.UserID, "member_id", userID,
+		"role", req.Role, "workspace_id", ws.ID)
+	after := *before
+	after.Role = req.Role
+	a.audit(r, AuditWorkspaceSetRole, ws.ID, before, &after)
+	writeJSON(w, http.StatusOK, &WorkspaceResponse{})
+}
+
+// RemoveMemberHandler removes a member, admins may remove anyone but the owner and anyone may leave.
+// Workspace urls stay with the workspace.
+// curl -X DELETE -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces/$ID/members/$USER_ID
+func (a *App) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user_id"]
+	role := db.RoleAdmin
+	if userID == UserFromContext(r.Context()).ID {
+		role = db.RoleViewer
+	}
+	s, ws, m, ok := a.workspaceMember(w, r, role)
+	if !ok {
+		return
+	}
+	if userID == ws.OwnerID {
+		writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{
+			Err: "the workspace owner can't be removed, transfer ownership first"})
+		return
+	}
+	before, err := s.Member(ws.ID, userID)
+	if err != nil {
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	if err := s.RemoveMember(ws.ID, userID); err != nil {
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "removed from workspace", "user_id", m.UserID, "member_id", userID,
+		"workspace_id", ws.ID)
+	a.audit(r, AuditWorkspaceRemove, ws.ID, before, nil)
+	writeJSON(w, http.StatusOK, &WorkspaceResponse{})
+}
+
+// TransferWorkspaceHandler makes another member the owner, only the owner may do so
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/workspaces/$ID/transfer -d '{"user_id": "..."}'
+func (a *App) TransferWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	s, ws, m, ok := a.workspaceMember(w, r, db.RoleAdmin)
+	if !ok {
+		return
+	}
+	if m.UserID != ws.OwnerID {
+		writeJSON(w, http.StatusForbidden, &WorkspaceResponse{Err: "only the owner can transfer the workspace"})
+		return
+	}
+	req := &TransferRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	before := *ws
+	if err := s.TransferWorkspace(ws.ID, req.UserID); err != nil {
+		if _, notFound := err.(*db.ErrNotFound); notFound {
+			writeJSON(w, http.StatusBadRequest, &WorkspaceResponse{Err: "the new owner must be a member"})
+			return
+		}
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &WorkspaceResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "transferred workspace", "user_id", m.UserID, "workspace_id", ws.ID,
+		"owner_id", req.UserID)
+	ws.OwnerID = req.UserID
+	a.audit(r, AuditWorkspaceTransfer, ws.ID, &before, ws)
+	writeJSON(w, http.StatusOK, &WorkspaceResponse{Workspace: ws})
+}
+
+// sharesWorkspace reports whether two users are members of a workspace together
+func sharesWorkspace(s db.WorkspaceStore, userID string, otherID string) (bool, error) {
+	workspaces, err := s.WorkspacesByUser(userID)
+	if err != nil {
+		return false, err
+	}
+	for _, ws := range workspaces {
+		_, err := s.Member(ws.ID, otherID)
+		if err == nil {
+			return true, nil
+		}
+		if _, notFound := err.(*db.ErrNotFound); !notFound {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// TransferURLHandler moves a url into a workspace the user is an editor of, or to another user who
+// shares a workspace with them, so links can't be pushed onto strangers. Moving a url out of a
+// workspace needs the workspace admin role.
+// curl -H "Authorization: Bearer $TOKEN" localhost:8080/api/v1/urls/7RxfRd/transfer -d '{"workspace_id": "..."}'
+func (a *App) TransferURLHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.store.(db.WorkspaceStore)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, &URLResponse{Err: "store does not support workspaces"})
+		return
+	}
+	key := mux.Vars(r)["url"]
+	storedURL, ok := a.managedURL(w, r, key, db.RoleEditor)
+	if !ok {
+		return
+	}
+	u := UserFromContext(r.Context())
+	if storedURL.WorkspaceID != "" && !a.canAccess(r.Context(), u, storedURL, db.RoleAdmin) {
+		writeJSON(w, http.StatusForbidden, &URLResponse{Err: "only workspace admins can move urls out of it"})
+		return
+	}
+	req := &TransferRequest{}
+	if err := readJSON(r, req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &URLResponse{Err: err.Error()})
+		return
+	}
+
+	before := urlSnapshot(storedURL)
+	userID := storedURL.UserID
+	switch {
+	case req.WorkspaceID != "" && req.UserID == "":
+		if status, msg := a.canCreateIn(r.Context(), u, req.WorkspaceID); status != http.StatusOK {
+			writeJSON(w, status, &URLResponse{Err: msg})
+			return
+		}
+	case req.UserID != "" && req.WorkspaceID == "":
+		users, ok := a.store.(db.UserStore)
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, &URLResponse{Err: "store does not support user accounts"})
+			return
+		}
+		if _, err := users.UserByID(req.UserID); err != nil {
+			writeJSON(w, http.StatusBadRequest, &URLResponse{Err: "user " + req.UserID + " does not exist"})
+			return
+		}
+		if req.UserID != u.ID {
+			shared, err := sharesWorkspace(s, u.ID, req.UserID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "request error", "error", err)
+				writeJSON(w, statusForErr(err), &URLResponse{Err: err.Error()})
+				return
+			}
+			if !shared {
+				writeJSON(w, http.StatusForbidden,
+					&URLResponse{Err: "urls can only be given to members of a workspace you are in"})
+				return
+			}
+		}
+		userID = req.UserID
+	default:
+		writeJSON(w, http.StatusBadRequest, &URLResponse{Err: "give one of workspace_id or user_id"})
+		return
+	}
+
+	if err := s.TransferURL(key, userID, req.WorkspaceID); err != nil {
+		slog.ErrorContext(r.Context(), "request error", "error", err)
+		writeJSON(w, statusForErr(err), &URLResponse{Err: err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "transferred url", "user_id", u.ID, "key", key, "owner_id", userID,
+		"workspace_id", req.WorkspaceID)
+	a.auditURLChange(r, AuditURLTransfer, key, before)
+	storedURL.UserID, storedURL.WorkspaceID = userID, req.WorkspaceID
+	writeJSON(w, http.StatusOK, &URLResponse{URL: &db.ListedURL{ID: key, StoredURL: *storedURL}})
+}
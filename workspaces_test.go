@@ -0,0 +1,200 @@
+package shortly
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aultimus/shortly/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// mailRecorder keeps sent messages in memory
+type mailRecorder struct {
+	sent []*Message
+}
+
+func (m *mailRecorder) Send(msg *Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// token returns the token in the last message sent to addr
+func (m *mailRecorder) token(t *testing.T, addr string) string {
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == addr {
+			if match := emailedToken.FindStringSubmatch(m.sent[i].Body); match != nil {
+				return match[1]
+			}
+		}
+	}
+	t.Fatalf("no token was sent to %s", addr)
+	return ""
+}
+
+func TestWorkspaces(t *testing.T) {
+	a := assert.New(t)
+
+	app := NewApp()
+	mailer := &mailRecorder{}
+	app.Mailer = mailer
+	store := db.NewMapDB()
+	app.Init(store, "8080")
+	cat := apiLogin(t, app, "cat@foobarcat.com")
+	dog := apiLogin(t, app, "dog@foobarcat.com")
+	rat := apiLogin(t, app, "rat@foobarcat.com")
+	rr := postForm(app, "/signup", url.Values{"email": {"cow@foobarcat.com"}, "password": {"hunter22"}})
+	cowSession := sessionCookie(rr)
+	cowUser, _ := store.UserByEmail("cow@foobarcat.com")
+	catUser, _ := store.UserByEmail("cat@foobarcat.com")
+	dogUser, _ := store.UserByEmail("dog@foobarcat.com")
+
+	rr = apiRequest(app, "POST", "/api/v1/workspaces", `{"name": ""}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	// names go into email subjects, so can't smuggle in headers
+	rr = apiRequest(app, "POST", "/api/v1/workspaces", `{"name": "x\r\nBcc: dog@foobarcat.com"}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/workspaces", `{"name": "marketing"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	created := &WorkspaceResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), created))
+	ws := created.Workspace.ID
+	a.Equal(catUser.ID, created.Workspace.OwnerID)
+
+	// only admins invite, and non members can't see the workspace at all
+	rr = apiRequest(app, "POST", "/api/v1/workspaces/"+ws+"/invitations", `{"email": "dog@foobarcat.com", "role": "editor"}`, rat)
+	a.Equal(http.StatusNotFound, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/workspaces/"+ws+"/invitations", `{"email": "dog@foobarcat.com", "role": "owner"}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/workspaces/"+ws+"/invitations", `{"email": "dog@foobarcat.com", "role": "editor"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	dogInvite := mailer.token(t, "dog@foobarcat.com")
+	rr = apiRequest(app, "POST", "/api/v1/workspaces/"+ws+"/invitations", `{"email": "cow@foobarcat.com", "role": "viewer"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	cowInvite := mailer.token(t, "cow@foobarcat.com")
+
+	// invitations only work for the address they were sent to, and only once
+	rr = apiRequest(app, "POST", "/api/v1/invitations/accept", `{"token": "`+dogInvite+`"}`, rat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/invitations/accept", `{"token": "`+dogInvite+`"}`, dog)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/invitations/accept", `{"token": "`+dogInvite+`"}`, dog)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = getPage(app, "/invitations/accept?token="+cowInvite, cowSession)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = postForm(app, "/invitations/accept", url.Values{"token": {cowInvite}}, cowSession)
+	a.Equal(http.StatusOK, rr.Code)
+	cow := apiToken(t, app, "cow@foobarcat.com")
+
+	rr = apiRequest(app, "GET", "/api/v1/workspaces/"+ws, "", cow)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), `"role":"viewer"`)
+	a.Contains(rr.Body.String(), "dog@foobarcat.com")
+	rr = apiRequest(app, "GET", "/api/v1/workspaces", "", dog)
+	a.Contains(rr.Body.String(), `"role":"editor"`)
+
+	// editors create workspace urls, viewers and outsiders can't
+	body := `{"original_url": "http://foobarcat.blogspot.com", "workspace_id": "` + ws + `"}`
+	rr = apiRequest(app, "POST", "/api/v1/urls", body, cow)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/urls", body, rat)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "POST", "/v1/create", body, "")
+	a.Equal(http.StatusUnauthorized, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/urls", body, dog)
+	a.Equal(http.StatusOK, rr.Code)
+	resp := &CreateResponse{}
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	key := resp.ShortenedURL
+
+	// workspace urls aren't in their creator's personal list
+	rr = apiRequest(app, "GET", "/api/v1/urls", "", dog)
+	a.Contains(rr.Body.String(), `"total":0`)
+	rr = apiRequest(app, "GET", "/api/v1/workspaces/"+ws+"/urls", "", cow)
+	a.Equal(http.StatusOK, rr.Code)
+	a.Contains(rr.Body.String(), key)
+	rr = apiRequest(app, "GET", "/api/v1/workspaces/"+ws+"/urls", "", rat)
+	a.Equal(http.StatusNotFound, rr.Code)
+
+	update := `{"original_url": "http://example.com"}`
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key, "", cow)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "PUT", "/api/v1/urls/"+key, update, cow)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key, "", rat)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "PUT", "/api/v1/urls/"+key, update, cat)
+	a.Equal(http.StatusOK, rr.Code)
+
+	// admins change roles but the owner stays an admin
+	rr = apiRequest(app, "PUT", "/api/v1/workspaces/"+ws+"/members/"+cowUser.ID, `{"role": "editor"}`, dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "PUT", "/api/v1/workspaces/"+ws+"/members/"+cowUser.ID, `{"role": "editor"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "PUT", "/api/v1/urls/"+key, update, cow)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "PUT", "/api/v1/workspaces/"+ws+"/members/"+catUser.ID, `{"role": "viewer"}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+
+	// personal urls move into workspaces, only admins move them out
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://dog.com"}`, dog)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	personal := resp.ShortenedURL
+	rr = apiRequest(app, "POST", "/api/v1/urls/"+personal+"/transfer", `{"workspace_id": "`+ws+`"}`, cat)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/urls/"+personal+"/transfer", `{"workspace_id": "`+ws+`"}`, dog)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+personal, "", cow)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/urls/"+personal+"/transfer", `{"user_id": "`+dogUser.ID+`"}`, dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/urls/"+personal+"/transfer", `{"user_id": "`+dogUser.ID+`"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+personal, "", cow)
+	a.Equal(http.StatusForbidden, rr.Code)
+
+	// urls are only given to people the user shares a workspace with
+	ratUser, _ := store.UserByEmail("rat@foobarcat.com")
+	rr = apiRequest(app, "POST", "/api/v1/urls", `{"original_url": "http://cat.com"}`, cat)
+	a.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+	rr = apiRequest(app, "POST", "/api/v1/urls/"+resp.ShortenedURL+"/transfer", `{"user_id": "`+ratUser.ID+`"}`, cat)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls", "", rat)
+	a.Contains(rr.Body.String(), `"total":0`)
+	rr = apiRequest(app, "POST", "/api/v1/urls/"+resp.ShortenedURL+"/transfer", `{"user_id": "`+cowUser.ID+`"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+
+	// members can leave, their urls stay with the workspace
+	rr = apiRequest(app, "DELETE", "/api/v1/workspaces/"+ws+"/members/"+dogUser.ID, "", dog)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key, "", dog)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/urls/"+key, "", cow)
+	a.Equal(http.StatusOK, rr.Code)
+
+	// the owner can only leave once they have handed over the workspace
+	rr = apiRequest(app, "DELETE", "/api/v1/workspaces/"+ws+"/members/"+catUser.ID, "", cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/workspaces/"+ws+"/transfer", `{"user_id": "`+dogUser.ID+`"}`, cat)
+	a.Equal(http.StatusBadRequest, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/workspaces/"+ws+"/transfer", `{"user_id": "`+cowUser.ID+`"}`, cow)
+	a.Equal(http.StatusForbidden, rr.Code)
+	rr = apiRequest(app, "POST", "/api/v1/workspaces/"+ws+"/transfer", `{"user_id": "`+cowUser.ID+`"}`, cat)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/workspaces/"+ws, "", cow)
+	a.Contains(rr.Body.String(), `"role":"admin"`)
+	rr = apiRequest(app, "DELETE", "/api/v1/workspaces/"+ws+"/members/"+catUser.ID, "", cow)
+	a.Equal(http.StatusOK, rr.Code)
+	rr = apiRequest(app, "GET", "/api/v1/workspaces/"+ws, "", cat)
+	a.Equal(http.StatusNotFound, rr.Code)
+}
+
+// apiToken logs in an existing user and returns their access token
+func apiToken(t *testing.T, app *App, email string) string {
+	rr := apiRequest(app, "POST", "/api/v1/login", `{"email": "`+email+`", "password": "hunter22"}`, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	tokens := &TokenResponse{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), tokens))
+	return tokens.AccessToken
+}